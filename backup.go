@@ -0,0 +1,168 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// BackupManifestName is the file in each backup directory that lists every
+// SSTable the backup is made of, including ones copied by earlier backups
+const BackupManifestName = "BACKUP_MANIFEST"
+
+// backupEntry identifies one SSTable in a backup manifest
+// SSTable IDs can be reused once every table is gone, so the size and
+// creation time are recorded too.
+type backupEntry struct {
+	name      string
+	size      int64
+	createdAt int64 // Unix nanos (0 = unknown)
+}
+
+func (e backupEntry) String() string {
+	return fmt.Sprintf("%s %d %d", e.name, e.size, e.createdAt)
+}
+
+// IncrementalBackup flushes the memtable and copies the live SSTables into
+// destDir, skipping tables listed in the manifest at sinceManifest (a
+// previous backup's BACKUP_MANIFEST; "" = full backup). destDir also gets a
+// manifest of the complete table set, to pass to the next backup.
+//
+// To restore, copy the tables named in the last manifest, from every
+// directory in the chain, into an empty DB directory. Tables are pinned
+// while they are copied, so compaction can run meanwhile.
+func (db *DB) IncrementalBackup(destDir string, sinceManifest string) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	var previous map[backupEntry]bool
+	if sinceManifest != "" {
+		var err error
+		if previous, err = db.readBackupManifest(sinceManifest); err != nil {
+			return err
+		}
+	}
+
+	// Flush so the tables hold everything, then pin them like a Snapshot
+	db.mu.Lock()
+	db.waitForFlush()
+	if db.memtable.Count() > 0 {
+		if err := db.triggerFlush(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	tables := append([]*SSTableReader(nil), db.sstables...)
+	for _, sst := range tables {
+		db.pins[sst]++
+	}
+	db.mu.Unlock()
+
+	defer db.releaseTables(tables)
+
+	if err := db.fs.MkdirAll(destDir, 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	var manifest bytes.Buffer
+	for _, sst := range tables {
+		info, err := db.fs.Stat(sst.Path())
+		if err != nil {
+			return fmt.Errorf("failed to stat SSTable: %w", err)
+		}
+		entry := backupEntry{name: filepath.Base(sst.Path()), size: info.Size()}
+		if created := sst.CreatedAt(); !created.IsZero() {
+			entry.createdAt = created.UnixNano()
+		}
+
+		if !previous[entry] {
+			if err := db.copyFile(sst.Path(), filepath.Join(destDir, entry.name)); err != nil {
+				return fmt.Errorf("failed to back up %s: %w", entry.name, err)
+			}
+		}
+		fmt.Fprintln(&manifest, entry)
+	}
+
+	// Write the manifest last: a backup without one is incomplete
+	manifestPath := filepath.Join(destDir, BackupManifestName)
+	if err := db.writeFile(manifestPath+".tmp", manifest.Bytes()); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	if err := db.fs.Rename(manifestPath+".tmp", manifestPath); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+	return nil
+}
+
+// readBackupManifest parses a manifest written by IncrementalBackup
+func (db *DB) readBackupManifest(path string) (map[backupEntry]bool, error) {
+	file, err := db.fs.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup manifest: %w", err)
+	}
+	defer file.Close()
+
+	entries := make(map[backupEntry]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%w: bad backup manifest line %q", ErrCorruptedData, scanner.Text())
+		}
+		size, err1 := strconv.ParseInt(fields[1], 10, 64)
+		createdAt, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("%w: bad backup manifest line %q", ErrCorruptedData, scanner.Text())
+		}
+		entries[backupEntry{name: fields[0], size: size, createdAt: createdAt}] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// copyFile copies src to dst and syncs it
+func (db *DB) copyFile(src, dst string) error {
+	in, err := db.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := db.fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeFile writes data to path and syncs it
+func (db *DB) writeFile(path string, data []byte) error {
+	out, err := db.fs.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -2,10 +2,75 @@ package lsm
 
 import (
 	"encoding/binary"
+	"fmt"
 	"hash/fnv"
 	"math"
+	"sync"
 )
 
+// BloomHasher produces the two 32-bit hashes used for double hashing
+type BloomHasher interface {
+	// Hash returns two independent hashes of key
+	Hash(key []byte) (uint32, uint32)
+
+	// Name identifies the hasher (1-255 bytes); it is stored with each
+	// filter so decoding picks a compatible hasher
+	Name() string
+}
+
+// FNVBloomHasher is the default hasher: FNV-1a and FNV-1
+type FNVBloomHasher struct{}
+
+func (FNVBloomHasher) Hash(key []byte) (uint32, uint32) {
+	// Use FNV-1a for first hash
+	h1 := fnv.New32a()
+	h1.Write(key)
+
+	// Use FNV-1 for second hash
+	h2 := fnv.New32()
+	h2.Write(key)
+
+	return h1.Sum32(), h2.Sum32()
+}
+
+func (FNVBloomHasher) Name() string {
+	return "lsm.FNVBloomHasher"
+}
+
+// PrefixExtractor returns the prefix of key that bloom filters are built
+// over, or nil if key has no prefix (it is then left out of the filter)
+// If it returns p for some key, it must return p for every key starting
+// with p; a fixed-length extractor should return nil for shorter keys.
+type PrefixExtractor func(key []byte) []byte
+
+var (
+	bloomHashersMu sync.RWMutex
+	bloomHashers   = map[string]BloomHasher{
+		FNVBloomHasher{}.Name(): FNVBloomHasher{},
+	}
+)
+
+// RegisterBloomHasher makes a hasher available to DecodeBloomFilter
+// Filters written with a custom hasher can only be decoded once it is
+// registered; DB.Open registers DBOptions.BloomHasher automatically.
+func RegisterBloomHasher(h BloomHasher) {
+	if n := len(h.Name()); n == 0 || n > 255 {
+		panic(fmt.Sprintf("lsm: bloom hasher name must be 1-255 bytes, got %d", n))
+	}
+
+	bloomHashersMu.Lock()
+	defer bloomHashersMu.Unlock()
+	bloomHashers[h.Name()] = h
+}
+
+// lookupBloomHasher returns the registered hasher with the given name
+func lookupBloomHasher(name string) (BloomHasher, bool) {
+	bloomHashersMu.RLock()
+	defer bloomHashersMu.RUnlock()
+	h, ok := bloomHashers[name]
+	return h, ok
+}
+
 // BloomFilter is a space-efficient probabilistic data structure
 // that tests whether an element is a member of a set.
 // False positives are possible, but false negatives are not.
@@ -14,10 +79,33 @@ type BloomFilter struct {
 	numBits  uint64 // total number of bits
 	numHash  uint32 // number of hash functions
 	numItems uint64 // number of items added
+	hasher   BloomHasher
 }
 
 // NewBloomFilter creates a bloom filter with specific bits per key.
 func NewBloomFilter(expectedItems int, bitsPerKey int) *BloomFilter {
+	return NewBloomFilterWithHasher(expectedItems, bitsPerKey, nil)
+}
+
+// NewBloomFilterWithHasher is NewBloomFilter with a custom hasher
+// A nil hasher means FNVBloomHasher.
+func NewBloomFilterWithHasher(expectedItems int, bitsPerKey int, hasher BloomHasher) *BloomFilter {
+	if hasher == nil {
+		hasher = FNVBloomHasher{}
+	}
+
+	numBits, numHash := bloomParams(expectedItems, bitsPerKey)
+	return &BloomFilter{
+		bits:    make([]byte, numBits/8),
+		numBits: numBits,
+		numHash: numHash,
+		hasher:  hasher,
+	}
+}
+
+// bloomParams sizes a filter: its bit count (a whole number of bytes) and
+// number of hash functions
+func bloomParams(expectedItems int, bitsPerKey int) (uint64, uint32) {
 	if expectedItems <= 0 {
 		expectedItems = 1
 	}
@@ -31,8 +119,7 @@ func NewBloomFilter(expectedItems int, bitsPerKey int) *BloomFilter {
 	}
 
 	// Round up to nearest byte
-	numBytes := (numBits + 7) / 8
-	numBits = numBytes * 8
+	numBits = (numBits + 7) / 8 * 8
 
 	// Optimal hash functions for given bits per key: k = bitsPerKey * ln(2)
 	numHash := uint32(float64(bitsPerKey) * math.Ln2)
@@ -43,11 +130,19 @@ func NewBloomFilter(expectedItems int, bitsPerKey int) *BloomFilter {
 		numHash = 30
 	}
 
-	return &BloomFilter{
-		bits:    make([]byte, numBytes),
-		numBits: numBits,
-		numHash: numHash,
+	return numBits, numHash
+}
+
+// EstimateBloom returns the size in bytes of a filter built by
+// NewBloomFilter(expectedItems, bitsPerKey), and its theoretical false
+// positive rate once expectedItems keys are added, without allocating it.
+// Use it to pick BloomBitsPerKey.
+func EstimateBloom(expectedItems int, bitsPerKey int) (int, float64) {
+	numBits, numHash := bloomParams(expectedItems, bitsPerKey)
+	if expectedItems <= 0 {
+		return int(numBits / 8), 0
 	}
+	return int(numBits / 8), falsePositiveRate(numHash, uint64(expectedItems), numBits)
 }
 
 // Add inserts a key into the bloom filter
@@ -80,15 +175,7 @@ func (bf *BloomFilter) MayContain(key []byte) bool {
 
 // hash computes two 32-bit hash values for double hashing
 func (bf *BloomFilter) hash(key []byte) (uint32, uint32) {
-	// Use FNV-1a for first hash
-	h1 := fnv.New32a()
-	h1.Write(key)
-	hash1 := h1.Sum32()
-
-	// Use FNV-1 for second hash
-	h2 := fnv.New32()
-	h2.Write(key)
-	hash2 := h2.Sum32()
+	hash1, hash2 := bf.hasher.Hash(key)
 
 	// Ensure hash2 is odd (for better distribution in double hashing)
 	if hash2%2 == 0 {
@@ -128,26 +215,53 @@ func (bf *BloomFilter) FalsePositiveRate() float64 {
 	if bf.numItems == 0 {
 		return 0
 	}
+	return falsePositiveRate(bf.numHash, bf.numItems, bf.numBits)
+}
+
+// falsePositiveRate is the expected rate for numItems keys in numBits bits
+func falsePositiveRate(numHash uint32, numItems, numBits uint64) float64 {
 	// p = (1 - e^(-k*n/m))^k
-	k := float64(bf.numHash)
-	n := float64(bf.numItems)
-	m := float64(bf.numBits)
+	k := float64(numHash)
+	n := float64(numItems)
+	m := float64(numBits)
 	return math.Pow(1-math.Exp(-k*n/m), k)
 }
 
 // Encode serializes the bloom filter to bytes
 func (bf *BloomFilter) Encode() []byte {
 	// Format: [numBits:8][numHash:4][numItems:8][bits...]
-	buf := make([]byte, 8+4+8+len(bf.bits))
+	// followed by [nameLen:1][name] for non-default hashers
+	// (the default writes nothing extra, so old filters decode as FNV)
+	var name string
+	if _, isDefault := bf.hasher.(FNVBloomHasher); !isDefault {
+		name = bf.hasher.Name()
+	}
+
+	size := 8 + 4 + 8 + len(bf.bits)
+	if name != "" {
+		size += 1 + len(name)
+	}
+	buf := make([]byte, size)
 
 	binary.LittleEndian.PutUint64(buf[0:8], bf.numBits)
 	binary.LittleEndian.PutUint32(buf[8:12], bf.numHash)
 	binary.LittleEndian.PutUint64(buf[12:20], bf.numItems)
 	copy(buf[20:], bf.bits)
 
+	if name != "" {
+		trailer := buf[20+len(bf.bits):]
+		trailer[0] = byte(len(name))
+		copy(trailer[1:], name)
+	}
+
 	return buf
 }
 
+// HasherName returns the name of the filter's hasher
+func (bf *BloomFilter) HasherName() string {
+	return bf.hasher.Name()
+}
+
 // DecodeBloomFilter deserializes a bloom filter from bytes
 func DecodeBloomFilter(data []byte) (*BloomFilter, error) {
 	if len(data) < 20 {
@@ -166,11 +280,27 @@ func DecodeBloomFilter(data []byte) (*BloomFilter, error) {
 	bits := make([]byte, expectedSize)
 	copy(bits, data[20:20+expectedSize])
 
+	// Optional hasher name trailer
+	var hasher BloomHasher = FNVBloomHasher{}
+	if trailer := data[20+expectedSize:]; len(trailer) > 0 {
+		nameLen := int(trailer[0])
+		if nameLen == 0 || len(trailer) < 1+nameLen {
+			return nil, ErrCorruptedData
+		}
+		name := string(trailer[1 : 1+nameLen])
+		h, ok := lookupBloomHasher(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownBloomHasher, name)
+		}
+		hasher = h
+	}
+
 	return &BloomFilter{
 		bits:     bits,
 		numBits:  numBits,
 		numHash:  numHash,
 		numItems: numItems,
+		hasher:   hasher,
 	}, nil
 }
 
@@ -1,7 +1,11 @@
 package lsm
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sync"
 	"testing"
 )
 
@@ -247,7 +251,296 @@ func TestBloomFilterManyKeys(t *testing.T) {
 	t.Logf("Estimated FP rate: %.4f%%", bf.FalsePositiveRate()*100)
 }
 
+func TestEstimateBloom(t *testing.T) {
+	cases := []struct{ items, bitsPerKey int }{
+		{1, 10}, {100, 10}, {1000, 5}, {5000, 16}, {10000, 1}, {0, 10}, {100, 0},
+	}
+	for _, c := range cases {
+		size, fpRate := EstimateBloom(c.items, c.bitsPerKey)
+
+		bf := NewBloomFilter(c.items, c.bitsPerKey)
+		for i := 0; i < c.items; i++ {
+			bf.Add([]byte(fmt.Sprintf("key_%d", i)))
+		}
+
+		if size != bf.Size() {
+			t.Errorf("EstimateBloom(%d, %d): size %d, filter has %d", c.items, c.bitsPerKey, size, bf.Size())
+		}
+		if fpRate != bf.FalsePositiveRate() {
+			t.Errorf("EstimateBloom(%d, %d): FP rate %v, filter has %v", c.items, c.bitsPerKey, fpRate, bf.FalsePositiveRate())
+		}
+	}
+
+	// More bits per key buys a lower rate
+	_, fp5 := EstimateBloom(1000, 5)
+	_, fp10 := EstimateBloom(1000, 10)
+	if fp10 >= fp5 {
+		t.Errorf("Expected 10 bits/key (%v) to beat 5 bits/key (%v)", fp10, fp5)
+	}
+}
+
 // Benchmark tests
+// fnv64Hasher splits a 64-bit FNV-1a hash into two halves
+type fnv64Hasher struct{ name string }
+
+func (h fnv64Hasher) Hash(key []byte) (uint32, uint32) {
+	f := fnv.New64a()
+	f.Write(key)
+	sum := f.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (h fnv64Hasher) Name() string {
+	return h.name
+}
+
+func TestBloomFilterCustomHasher(t *testing.T) {
+	hasher := fnv64Hasher{name: "test.fnv64"}
+	RegisterBloomHasher(hasher)
+
+	bf := NewBloomFilterWithHasher(1000, 10, hasher)
+	for i := 0; i < 1000; i++ {
+		bf.Add([]byte(fmt.Sprintf("key_%d", i)))
+	}
+
+	decoded, err := DecodeBloomFilter(bf.Encode())
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if decoded.HasherName() != "test.fnv64" {
+		t.Errorf("Expected hasher test.fnv64, got %s", decoded.HasherName())
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key_%d", i))
+		if !decoded.MayContain(key) {
+			t.Errorf("False negative for %s after decode", key)
+		}
+	}
+
+	// The default hasher adds no trailer, keeping the old format
+	if got, want := len(NewBloomFilter(100, 10).Encode()), 20+NewBloomFilter(100, 10).Size(); got != want {
+		t.Errorf("Default filter encoded to %d bytes, want %d", got, want)
+	}
+}
+
+func TestBloomFilterUnknownHasher(t *testing.T) {
+	bf := NewBloomFilterWithHasher(100, 10, fnv64Hasher{name: "test.unregistered"})
+	bf.Add([]byte("key"))
+
+	_, err := DecodeBloomFilter(bf.Encode())
+	if !errors.Is(err, ErrUnknownBloomHasher) {
+		t.Errorf("Expected ErrUnknownBloomHasher, got %v", err)
+	}
+}
+
+func TestDBCustomBloomHasher(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.BloomHasher = fnv64Hasher{name: "test.db.fnv64"}
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value")); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := db.ForceFlushAndReload(); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	if len(db.sstables) == 0 || db.sstables[0].bloomFilter == nil {
+		t.Fatal("Expected a flushed SSTable with a bloom filter")
+	}
+	if name := db.sstables[0].bloomFilter.HasherName(); name != "test.db.fnv64" {
+		t.Errorf("Expected hasher test.db.fnv64, got %s", name)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil {
+			t.Errorf("key_%03d not found: %v", i, err)
+		}
+	}
+}
+
+// driftingHasher hashes every call differently, so lookups miss added keys
+type driftingHasher struct{ calls uint32 }
+
+func (h *driftingHasher) Hash(key []byte) (uint32, uint32) {
+	h.calls++
+	return h.calls * 2654435761, h.calls
+}
+
+func (h *driftingHasher) Name() string {
+	return "test.drifting"
+}
+
+func TestDBParanoidBloom(t *testing.T) {
+	write := func(hasher BloomHasher) error {
+		opts := DefaultOptions(t.TempDir())
+		opts.ParanoidBloom = true
+		opts.BloomHasher = hasher
+
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return db.triggerFlush()
+	}
+
+	// A correct filter passes and the table is written
+	if err := write(nil); err != nil {
+		t.Errorf("Flush with a correct filter failed: %v", err)
+	}
+
+	// A filter that forgets keys fails the flush
+	if err := write(&driftingHasher{}); !errors.Is(err, ErrBloomFalseNegative) {
+		t.Errorf("Expected ErrBloomFalseNegative, got %v", err)
+	}
+}
+
+// readCountFS counts ReadAt calls per file
+type readCountFS struct {
+	OSFileSystem
+	mu    sync.Mutex
+	reads map[string]int
+}
+
+type readCountFile struct {
+	File
+	fs   *readCountFS
+	name string
+}
+
+func (f *readCountFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.reads[f.name]++
+	f.fs.mu.Unlock()
+	return f.File.ReadAt(p, off)
+}
+
+func (f *readCountFS) Open(name string) (File, error) {
+	file, err := f.OSFileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountFile{File: file, fs: f, name: filepath.Base(name)}, nil
+}
+
+func (f *readCountFS) reset() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reads := f.reads
+	f.reads = make(map[string]int)
+	return reads
+}
+
+func TestDBPrefixBloom(t *testing.T) {
+	fs := &readCountFS{reads: make(map[string]int)}
+	opts := DefaultOptions(t.TempDir())
+	opts.FS = fs
+	opts.BlockCacheSize = 0
+	opts.PrefixExtractor = func(key []byte) []byte {
+		if len(key) < 4 {
+			return nil
+		}
+		return key[:4]
+	}
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// One table per prefix
+	for _, prefix := range []string{"aaaa", "bbbb"} {
+		for i := 0; i < 50; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("%s:%03d", prefix, i)), []byte("value")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		if err := db.ForceFlushAndReload(); err != nil {
+			t.Fatalf("Failed to flush: %v", err)
+		}
+	}
+	if len(db.sstables) != 2 {
+		t.Fatalf("Expected 2 SSTables, got %d", len(db.sstables))
+	}
+	tableA := filepath.Base(db.sstables[1].Path())
+	tableB := filepath.Base(db.sstables[0].Path())
+
+	scan := func(prefix string) int {
+		t.Helper()
+		keys, err := db.Keys([]byte(prefix), 0)
+		if err != nil {
+			t.Fatalf("Failed to scan %s: %v", prefix, err)
+		}
+		return len(keys)
+	}
+
+	// A prefix present in one table scans only that table
+	fs.reset()
+	if n := scan("aaaa"); n != 50 {
+		t.Errorf("Expected 50 keys for aaaa, got %d", n)
+	}
+	reads := fs.reset()
+	if reads[tableA] == 0 {
+		t.Errorf("Expected reads of %s", tableA)
+	}
+	if reads[tableB] != 0 {
+		t.Errorf("Expected %s to be skipped, got %d reads", tableB, reads[tableB])
+	}
+
+	// An absent prefix reads neither table
+	if n := scan("cccc"); n != 0 {
+		t.Errorf("Expected no keys for cccc, got %d", n)
+	}
+	if reads := fs.reset(); reads[tableA] != 0 || reads[tableB] != 0 {
+		t.Errorf("Expected both tables to be skipped, got %v", reads)
+	}
+
+	// Scans that span prefixes, and point lookups, still see everything
+	if n := scan("a"); n != 50 {
+		t.Errorf("Expected 50 keys for a, got %d", n)
+	}
+	if n := scan(""); n != 100 {
+		t.Errorf("Expected 100 keys in total, got %d", n)
+	}
+	for _, key := range []string{"aaaa:007", "bbbb:042"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Errorf("Failed to get %s: %v", key, err)
+		}
+	}
+	fs.reset()
+	if _, err := db.Get([]byte("cccc:000")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if reads := fs.reset(); len(reads) != 0 {
+		t.Errorf("Expected a lookup of an absent prefix to read nothing, got %v", reads)
+	}
+}
+
 func BenchmarkBloomFilterAdd(b *testing.B) {
 	bf := NewBloomFilter(b.N, 10)
 	keys := make([][]byte, b.N)
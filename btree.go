@@ -0,0 +1,332 @@
+package lsm
+
+import (
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// Items per B-tree node, at most; nodes split in half when full
+const btreeMaxItems = 31
+
+// Per-node memory beyond the entries' own bytes: every node reserves room
+// for btreeMaxItems entries up front, so nodes never reallocate, and
+// internal nodes room for their children too
+const (
+	btreeLeafOverhead     = int64(unsafe.Sizeof(btreeNode{})) + btreeMaxItems*int64(unsafe.Sizeof(Entry{}))
+	btreeInternalOverhead = btreeLeafOverhead + (btreeMaxItems+1)*pointerSize
+)
+
+type btreeNode struct {
+	items    []Entry      // Sorted; stored inline rather than one allocation each
+	children []*btreeNode // len(items)+1 children, or nil for a leaf
+}
+
+// BTree is a concurrent-safe sorted in-memory structure
+// It stores entries inline in wide nodes, so it needs fewer allocations
+// and pointers per entry than SkipList, at the cost of moving entries
+// within a node on insert.
+type BTree struct {
+	root       *btreeNode
+	comparator Comparator
+	size       int64
+	overhead   int64 // Node bytes not counted in size
+	count      int
+	mu         sync.RWMutex
+}
+
+// NewBTree creates a B-tree with default comparator
+func NewBTree() *BTree {
+	return NewBTreeWithComparator(DefaultComparator{})
+}
+
+func NewBTreeWithComparator(cmp Comparator) *BTree {
+	return &BTree{
+		root:       &btreeNode{items: make([]Entry, 0, btreeMaxItems)},
+		comparator: cmp,
+		overhead:   btreeLeafOverhead,
+	}
+}
+
+// search returns the index of the first item >= key in n, and whether
+// it equals key
+func (t *BTree) search(n *btreeNode, key []byte) (int, bool) {
+	return slices.BinarySearchFunc(n.items, key, func(e Entry, key []byte) int {
+		return t.comparator.Compare(e.Key, key)
+	})
+}
+
+// PutEntry inserts an entry, or updates the entry with the same key
+// (thread-safe)
+func (t *BTree) PutEntry(entry *Entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Split a full root first, so the tree grows at the top
+	if len(t.root.items) == btreeMaxItems {
+		old := t.root
+		t.root = &btreeNode{
+			items:    make([]Entry, 0, btreeMaxItems),
+			children: append(make([]*btreeNode, 0, btreeMaxItems+1), old),
+		}
+		t.overhead += btreeInternalOverhead
+		t.splitChild(t.root, 0)
+	}
+
+	// Split full nodes on the way down, so the leaf always has room
+	n := t.root
+	for {
+		i, found := t.search(n, entry.Key)
+		if found {
+			t.update(&n.items[i], entry)
+			return
+		}
+		if n.children == nil {
+			n.items = slices.Insert(n.items, i, *entry)
+			t.size += entry.Size()
+			t.count++
+			return
+		}
+
+		if len(n.children[i].items) == btreeMaxItems {
+			t.splitChild(n, i)
+			switch c := t.comparator.Compare(entry.Key, n.items[i].Key); {
+			case c == 0:
+				t.update(&n.items[i], entry)
+				return
+			case c > 0:
+				i++
+			}
+		}
+		n = n.children[i]
+	}
+}
+
+// update overwrites an existing item in place, like SkipList.PutEntry
+func (t *BTree) update(item *Entry, entry *Entry) {
+	oldSize := item.Size()
+	item.Value = entry.Value
+	item.Deleted = entry.Deleted
+	item.Timestamp = entry.Timestamp
+	t.size += item.Size() - oldSize
+}
+
+// splitChild splits the full child i of parent around its median item,
+// which moves up into parent
+func (t *BTree) splitChild(parent *btreeNode, i int) {
+	child := parent.children[i]
+	mid := btreeMaxItems / 2
+	median := child.items[mid]
+
+	right := &btreeNode{items: append(make([]Entry, 0, btreeMaxItems), child.items[mid+1:]...)}
+	clear(child.items[mid:]) // Drop references held past the new length
+	child.items = child.items[:mid]
+	if child.children != nil {
+		right.children = append(make([]*btreeNode, 0, btreeMaxItems+1), child.children[mid+1:]...)
+		clear(child.children[mid+1:])
+		child.children = child.children[:mid+1]
+		t.overhead += btreeInternalOverhead
+	} else {
+		t.overhead += btreeLeafOverhead
+	}
+
+	parent.items = slices.Insert(parent.items, i, median)
+	parent.children = slices.Insert(parent.children, i+1, right)
+}
+
+// Put inserts or updates an entry (thread-safe)
+func (t *BTree) Put(key, value []byte) {
+	t.PutEntry(NewEntry(key, value))
+}
+
+// Delete marks a key as deleted (thread-safe)
+func (t *BTree) Delete(key []byte) {
+	t.PutEntry(NewTombstone(key))
+}
+
+// find returns the item holding key, or nil
+// Must be called with t.mu held
+func (t *BTree) find(key []byte) *Entry {
+	for n := t.root; n != nil; {
+		i, found := t.search(n, key)
+		if found {
+			return &n.items[i]
+		}
+		if n.children == nil {
+			return nil
+		}
+		n = n.children[i]
+	}
+	return nil
+}
+
+// Get retrieves a value by key (thread-safe)
+// Returns: (value, deleted, found)
+func (t *BTree) Get(key []byte) ([]byte, bool, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if e := t.find(key); e != nil {
+		return e.Value, e.Deleted, true
+	}
+	return nil, false, false
+}
+
+// GetEntry returns a copy of the entry for key, tombstones included (thread-safe)
+func (t *BTree) GetEntry(key []byte) (Entry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if e := t.find(key); e != nil {
+		return *e, true
+	}
+	return Entry{}, false
+}
+
+// Size returns the bytes of all entries' keys, values and metadata
+// (thread-safe)
+func (t *BTree) Size() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
+
+// MemoryUsage estimates the memory held by the tree: Size plus the nodes'
+// structs and reserved entry and child slots (thread-safe)
+func (t *BTree) MemoryUsage() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size + t.overhead
+}
+
+// Count returns number of entries (thread-safe)
+func (t *BTree) Count() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.count
+}
+
+// BTreeIterator walks a BTree in key order
+// NOTE: Iterator holds a read lock - don't forget to close it!
+type BTreeIterator struct {
+	tree  *BTree
+	stack []btreeCursor // Path from the root; the top is the current item
+}
+
+// btreeCursor is a position within one node: the next item to visit
+type btreeCursor struct {
+	node *btreeNode
+	pos  int
+}
+
+// NewIterator creates an iterator (acquires read lock)
+func (t *BTree) NewIterator() *BTreeIterator {
+	t.mu.RLock()
+	return &BTreeIterator{tree: t}
+}
+
+// Close releases the read lock - MUST be called!
+func (it *BTreeIterator) Close() {
+	it.tree.mu.RUnlock()
+}
+
+// SeekToFirst moves to the first entry
+func (it *BTreeIterator) SeekToFirst() {
+	it.stack = it.stack[:0]
+	it.descend(it.tree.root)
+	it.settle()
+}
+
+// Seek moves to first entry >= target
+func (it *BTreeIterator) Seek(target []byte) {
+	it.stack = it.stack[:0]
+	for n := it.tree.root; n != nil; n = n.children[it.stack[len(it.stack)-1].pos] {
+		i, found := it.tree.search(n, target)
+		it.stack = append(it.stack, btreeCursor{node: n, pos: i})
+		if found || n.children == nil {
+			break
+		}
+	}
+	it.settle()
+}
+
+// descend pushes the path to the leftmost item under n
+func (it *BTreeIterator) descend(n *btreeNode) {
+	for ; n != nil; n = n.children[0] {
+		it.stack = append(it.stack, btreeCursor{node: n})
+		if n.children == nil {
+			break
+		}
+	}
+}
+
+// settle pops finished nodes until the top cursor is on an item
+func (it *BTreeIterator) settle() {
+	for len(it.stack) > 0 {
+		top := it.stack[len(it.stack)-1]
+		if top.pos < len(top.node.items) {
+			return
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+}
+
+// Valid returns true if at a valid entry
+func (it *BTreeIterator) Valid() bool {
+	return len(it.stack) > 0
+}
+
+// Next moves to next entry
+func (it *BTreeIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+	top := &it.stack[len(it.stack)-1]
+	top.pos++
+	if top.node.children != nil {
+		// The items between this one and the next sit in the child between them
+		it.descend(top.node.children[top.pos])
+	}
+	it.settle()
+}
+
+// Entry returns current entry
+func (it *BTreeIterator) Entry() *Entry {
+	if !it.Valid() {
+		return nil
+	}
+	top := it.stack[len(it.stack)-1]
+	return &top.node.items[top.pos]
+}
+
+// Key returns current key
+func (it *BTreeIterator) Key() []byte {
+	if e := it.Entry(); e != nil {
+		return e.Key
+	}
+	return nil
+}
+
+// Value returns current value
+func (it *BTreeIterator) Value() []byte {
+	if e := it.Entry(); e != nil {
+		return e.Value
+	}
+	return nil
+}
+
+// Timestamp returns current entry's timestamp
+func (it *BTreeIterator) Timestamp() uint64 {
+	if e := it.Entry(); e != nil {
+		return e.Timestamp
+	}
+	return 0
+}
+
+// IsDeleted returns true if current entry is a tombstone
+func (it *BTreeIterator) IsDeleted() bool {
+	if e := it.Entry(); e != nil {
+		return e.Deleted
+	}
+	return false
+}
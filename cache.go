@@ -0,0 +1,87 @@
+package lsm
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// nextTableID gives every opened SSTableReader a unique cache identity
+var nextTableID atomic.Uint64
+
+// blockKey identifies a data block: the reader it belongs to and its offset
+type blockKey struct {
+	table  uint64
+	offset uint64
+}
+
+// cachedBlock is one LRU entry
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+// blockCache is an LRU cache of verified data blocks, shared by every
+// SSTable of a DB and bounded by the total size of the cached blocks
+// Cached blocks are shared between readers and must never be modified.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	lru      *list.List // Most recently used at the front
+	blocks   map[blockKey]*list.Element
+}
+
+// newBlockCache creates a cache holding up to capacity bytes
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[blockKey]*list.Element),
+	}
+}
+
+// get returns a cached block and marks it recently used
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+// add caches a block, evicting the least recently used ones to make room
+// Blocks larger than the whole cache are not cached.
+func (c *blockCache) add(key blockKey, data []byte) {
+	if int64(len(data)) > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		return // Another reader got there first
+	}
+
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.size += int64(len(data))
+
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		block := c.lru.Remove(oldest).(*cachedBlock)
+		delete(c.blocks, block.key)
+		c.size -= int64(len(block.data))
+	}
+}
+
+// len returns the number of cached blocks
+func (c *blockCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,256 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestBlockCacheEviction(t *testing.T) {
+	cache := newBlockCache(100)
+
+	cache.add(blockKey{1, 0}, make([]byte, 40))
+	cache.add(blockKey{1, 40}, make([]byte, 40))
+	cache.get(blockKey{1, 0}) // Make the second block the oldest
+	cache.add(blockKey{2, 0}, make([]byte, 40))
+
+	if _, ok := cache.get(blockKey{1, 40}); ok {
+		t.Error("Expected least recently used block to be evicted")
+	}
+	for _, key := range []blockKey{{1, 0}, {2, 0}} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("Expected block %v to be cached", key)
+		}
+	}
+
+	cache.add(blockKey{3, 0}, make([]byte, 101))
+	if _, ok := cache.get(blockKey{3, 0}); ok {
+		t.Error("Expected block larger than the cache not to be cached")
+	}
+	if cache.len() != 2 {
+		t.Errorf("Expected 2 cached blocks, got %d", cache.len())
+	}
+}
+
+func TestDBReadOptionsFillCache(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		if err := db.Put([]byte(key), []byte("value_"+key)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	forceFlush(t, db)
+
+	// A scan that opts out leaves the cache untouched
+	iter := db.NewIteratorOpt(nil, nil, &ReadOptions{FillCache: false})
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	iter.Close()
+	if count != 1000 {
+		t.Fatalf("Expected 1000 keys, got %d", count)
+	}
+	if n := db.cache.len(); n != 0 {
+		t.Errorf("Expected empty cache after FillCache=false scan, got %d blocks", n)
+	}
+
+	if _, err := db.GetOpt([]byte("key_0500"), &ReadOptions{FillCache: false}); err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if n := db.cache.len(); n != 0 {
+		t.Errorf("Expected empty cache after FillCache=false Get, got %d blocks", n)
+	}
+
+	// A default Get caches its block and later reads are served from it
+	for i := 0; i < 2; i++ {
+		value, err := db.Get([]byte("key_0500"))
+		if err != nil || string(value) != "value_key_0500" {
+			t.Fatalf("Expected value_key_0500, got %q (err=%v)", value, err)
+		}
+	}
+	if n := db.cache.len(); n != 1 {
+		t.Errorf("Expected 1 cached block after Get, got %d", n)
+	}
+
+	// A default scan fills the cache and still returns every key intact
+	iter = db.NewIterator(nil, nil)
+	count = 0
+	for ; iter.Valid(); iter.Next() {
+		if want := "value_" + string(iter.Key()); string(iter.Value()) != want {
+			t.Fatalf("Expected %s, got %s", want, iter.Value())
+		}
+		count++
+	}
+	iter.Close()
+	if count != 1000 || db.cache.len() <= 1 {
+		t.Errorf("Expected 1000 keys and a filled cache, got %d keys and %d blocks", count, db.cache.len())
+	}
+}
+
+func TestDBTableStatsSkipsCache(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 1000; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 1000; i += 2 {
+		db.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte("newer"))
+	}
+	forceFlush(t, db)
+
+	if _, err := db.Get([]byte("key_0501")); err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	cached := db.cache.len()
+
+	// Reading every entry of every table leaves the hot block alone
+	stats := readTableStats(t, db)
+	if n := db.cache.len(); n != cached {
+		t.Errorf("Expected %d cached blocks after TableStats, got %d", cached, n)
+	}
+	older := stats[1]
+	if string(older.SmallestKey) != "key_0000" || string(older.LargestKey) != "key_0999" {
+		t.Errorf("Expected keys [key_0000, key_0999], got [%s, %s]", older.SmallestKey, older.LargestKey)
+	}
+
+	// A corrupt block fails the call instead of truncating the stats
+	data, err := os.ReadFile(older.Path)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+	data[len(data)/4] ^= 0xff
+	if err := os.WriteFile(older.Path, data, 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if _, err := db.TableStats(); err == nil {
+		t.Error("Expected TableStats to fail on a corrupt table")
+	}
+}
+
+func TestDBBlockCacheDisabled(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.BlockCacheSize = 0
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("key"), []byte("value"))
+	forceFlush(t, db)
+
+	if db.cache != nil {
+		t.Fatal("Expected no block cache")
+	}
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %q (err=%v)", value, err)
+	}
+}
+
+// Run with -race: a Get that aliased a cached block or memtable value
+// would race with the readers writing into their results
+func TestDBGetReturnsCopy(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.BlockCacheSize = 16 * 1024 // A few blocks, so reads keep evicting
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	want := []byte("the value under test")
+	db.Put([]byte("hot"), bytes.Clone(want))
+
+	// Memtable values are copied too
+	got, err := db.Get([]byte("hot"))
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	copy(got, "XXX")
+	if got, _ := db.Get([]byte("hot")); !bytes.Equal(got, want) {
+		t.Fatalf("Modifying a result changed the stored value to %q", got)
+	}
+
+	// So are a snapshot's, from its memtable copy and from the tables
+	snapshotGet := func(snap *Snapshot) {
+		t.Helper()
+		got, err := snap.Get([]byte("hot"))
+		if err != nil {
+			t.Fatalf("Failed to get from snapshot: %v", err)
+		}
+		copy(got, "XXX")
+		if got, _ := snap.Get([]byte("hot")); !bytes.Equal(got, want) {
+			t.Fatalf("Modifying a snapshot result changed its value to %q", got)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	snapshotGet(snap)
+	snap.Release()
+	forceFlush(t, db)
+	if snap, err = db.Snapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	snapshotGet(snap)
+	snap.Release()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				got, err := db.Get([]byte("hot"))
+				if err != nil || !bytes.Equal(got, want) {
+					t.Errorf("Expected %q, got %q (err=%v)", want, got, err)
+					return
+				}
+				copy(got, "XXX") // The caller owns it
+				if cold, _ := db.Get([]byte(fmt.Sprintf("cold_%04d", len(got)%7))); cold != nil {
+					copy(cold, "XXX")
+				}
+			}
+		}()
+	}
+
+	// Keep rewriting the tables under the readers
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 200; i++ {
+			db.Put([]byte(fmt.Sprintf("cold_%04d", round*200+i)), bytes.Repeat([]byte{'v'}, 100))
+		}
+		forceFlush(t, db)
+		if round%4 == 3 {
+			if err := db.Compact(); err != nil {
+				t.Errorf("Compact failed: %v", err)
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
@@ -0,0 +1,758 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Compact flushes the memtable and merges all SSTables into one
+// Shadowed versions and tombstones are dropped, since no older data remains.
+// Input files pinned by a Snapshot or an open iterator stay on disk until
+// it is released or closed, so both keep reading what they started with.
+// Tables overlapping PreserveRanges are left as they are. Concurrent calls,
+// like every flush and table drop, are serialized on the DB lock, so each
+// one picks its inputs from the previous one's output and no table is
+// compacted or deleted twice.
+func (db *DB) Compact() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.compactAll()
+}
+
+// compactAll performs a full compaction
+// Must be called with db.mu held
+func (db *DB) compactAll() error {
+	// Flush the memtable so the merged table holds every live key
+	if db.memtable.Count() > 0 {
+		db.stalls.Add(1)
+		err := db.triggerFlush()
+		db.stalls.Add(-1)
+		if err != nil {
+			return err
+		}
+	}
+	return db.compactSSTables()
+}
+
+// compactSSTables merges every SSTable into one, leaving the memtable
+// With PreserveRanges, each run of tables between preserved ones is
+// merged on its own instead (see compactionRuns).
+// Must be called with db.mu held
+func (db *DB) compactSSTables() error {
+	db.waitForFlush()
+	db.stalls.Add(1)
+	defer db.stalls.Add(-1)
+
+	runs, err := db.compactionRuns()
+	if err != nil {
+		return fmt.Errorf("compaction failed: %w", err)
+	}
+
+	// Oldest first, so only the oldest run can see itself as bottommost
+	for i := len(runs) - 1; i >= 0; i-- {
+		if err := db.mergeRun(runs[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactionRuns returns the runs of two or more adjacent SSTables
+// outside PreserveRanges, newest first; without PreserveRanges, that is
+// every table. A run overlapping a newer table outside it is left out,
+// since its output is read as the newest table.
+// Must be called with db.mu held
+func (db *DB) compactionRuns() ([][]*SSTableReader, error) {
+	var runs [][]*SSTableReader
+	start := 0
+	for i := 0; i <= len(db.sstables); i++ {
+		if i < len(db.sstables) {
+			preserved, err := db.tablePreserved(db.sstables[i])
+			if err != nil {
+				return nil, err
+			}
+			if !preserved {
+				continue
+			}
+		}
+
+		if i-start >= 2 {
+			err := db.checkNewerOverlap(start, i)
+			switch {
+			case err == nil:
+				runs = append(runs, db.sstables[start:i])
+			case !errors.Is(err, ErrInvalidCompaction):
+				return nil, err
+			}
+		}
+		start = i + 1
+	}
+	return runs, nil
+}
+
+// checkNewerOverlap returns ErrInvalidCompaction if a table newer than
+// db.sstables[start:end] overlaps the key range of one of them
+// Must be called with db.mu held
+func (db *DB) checkNewerOverlap(start, end int) error {
+	cmp := DefaultComparator{}
+	for _, newer := range db.sstables[:start] {
+		nSmallest, nLargest, err := newer.keyRange()
+		if err != nil {
+			return fmt.Errorf("failed to read key range of %s: %w", newer.Path(), err)
+		}
+		if nSmallest == nil {
+			continue // Empty tables hide nothing
+		}
+		for _, input := range db.sstables[start:end] {
+			smallest, largest, err := input.keyRange()
+			if err != nil {
+				return fmt.Errorf("failed to read key range of %s: %w", input.Path(), err)
+			}
+			if smallest != nil && cmp.Compare(smallest, nLargest) <= 0 && cmp.Compare(nSmallest, largest) <= 0 {
+				return fmt.Errorf("%w: newer table %s overlaps %s", ErrInvalidCompaction, newer.Path(), input.Path())
+			}
+		}
+	}
+	return nil
+}
+
+// mergeRun merges run, adjacent tables in db.sstables, into one table
+// It goes first in read order, as on reopen, since it has the highest ID.
+// purge is passed on to mergeSSTables.
+// Must be called with db.mu held
+func (db *DB) mergeRun(run []*SSTableReader, purge bool) error {
+	sstPath := db.nextSSTablePath(compactionLevel)
+	written, err := db.mergeSSTables(run, sstPath, purge)
+	if err != nil {
+		return fmt.Errorf("compaction failed: %w", err)
+	}
+
+	var remaining []*SSTableReader
+	if written {
+		reader, err := db.openSSTable(sstPath)
+		if err != nil {
+			return fmt.Errorf("failed to open compacted SSTable: %w", err)
+		}
+		remaining = append(remaining, reader)
+	}
+	for _, sst := range db.sstables {
+		if !slices.Contains(run, sst) {
+			remaining = append(remaining, sst)
+		}
+	}
+	db.sstables = remaining
+
+	// Remove inputs oldest first. If we crash part way, the survivors are
+	// always the newest inputs, so any tombstone dropped from the output
+	// still sits in a surviving table newer than the value it hides.
+	// Inputs pinned by a snapshot (and everything newer) wait for Release.
+	for i := len(run) - 1; i >= 0; i-- {
+		db.obsolete = append(db.obsolete, run[i])
+	}
+	db.deleteObsolete()
+
+	return nil
+}
+
+// KeyRange is the keys in [Start, End), as for NewIterator
+// A nil Start or End means unbounded on that side.
+type KeyRange struct {
+	Start, End []byte
+}
+
+// overlaps reports whether r holds any key in [smallest, largest]
+func (r KeyRange) overlaps(smallest, largest []byte) bool {
+	cmp := DefaultComparator{}
+	return (r.Start == nil || cmp.Compare(largest, r.Start) >= 0) &&
+		(r.End == nil || cmp.Compare(smallest, r.End) < 0)
+}
+
+// isPreserved reports whether a table with keys [smallest, largest]
+// overlaps one of PreserveRanges; empty tables never do
+func (db *DB) isPreserved(smallest, largest []byte) bool {
+	if smallest == nil {
+		return false
+	}
+	for _, r := range db.opts.PreserveRanges {
+		if r.overlaps(smallest, largest) {
+			return true
+		}
+	}
+	return false
+}
+
+// tablePreserved is isPreserved for sst's key range
+func (db *DB) tablePreserved(sst *SSTableReader) (bool, error) {
+	if len(db.opts.PreserveRanges) == 0 {
+		return false, nil
+	}
+	smallest, largest, err := sst.keyRange()
+	if err != nil {
+		return false, fmt.Errorf("failed to read key range of %s: %w", sst.Path(), err)
+	}
+	return db.isPreserved(smallest, largest), nil
+}
+
+// PauseCompaction stops background compaction (see CompactionTrigger)
+// A compaction already running finishes before it returns. Writes go on
+// as usual, so SSTables pile up until ResumeCompaction. Compact and
+// CompactFiles still run when called.
+func (db *DB) PauseCompaction() {
+	db.compactionPaused.Store(true)
+
+	// The worker may release the lock while it waits for a flush, so wait
+	// for it to say it is done rather than just for the lock
+	db.mu.Lock()
+	for db.compacting {
+		db.compactionDone.Wait()
+	}
+	db.mu.Unlock()
+}
+
+// ResumeCompaction restarts background compaction, catching up on any
+// tables that piled up while it was paused
+func (db *DB) ResumeCompaction() {
+	db.compactionPaused.Store(false)
+	db.wakeCompaction()
+}
+
+// wakeCompaction asks the background worker to check CompactionTrigger
+// It never blocks: a wakeup already pending covers this one.
+func (db *DB) wakeCompaction() {
+	select {
+	case db.compactionWake <- struct{}{}:
+	default:
+	}
+}
+
+// compactionWorker compacts in the background whenever the SSTable count
+// reaches CompactionTrigger, until Close (see compactPicked)
+func (db *DB) compactionWorker() {
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-db.compactionWake:
+		}
+
+		db.mu.Lock()
+		// Waiting releases the lock, so check for a pause or Close after
+		db.waitForFlush()
+		if !db.closed.Load() && !db.compactionPaused.Load() && len(db.sstables) >= db.opts.CompactionTrigger {
+			db.compacting = true
+			if err := db.compactPicked(); err != nil {
+				fmt.Printf("Warning: background compaction failed: %v\n", err)
+			}
+			db.compacting = false
+			db.compactionDone.Broadcast()
+		}
+		db.mu.Unlock()
+	}
+}
+
+// mergeSSTables writes the newest version of each key in tables (newest
+// first) to path. Tombstones are dropped if tables include the oldest
+// table, and kept otherwise since they may hide keys in older tables,
+// unless purge is set and no older table may hold the key.
+// Returns false without creating a file if no entries remain
+func (db *DB) mergeSSTables(tables []*SSTableReader, path string, purge bool) (bool, error) {
+	opts := db.sstableOptions()
+	bottommost := len(tables) > 0 && tables[len(tables)-1] == db.sstables[len(db.sstables)-1]
+	var older []*SSTableReader
+	if purge && !bottommost {
+		older = db.sstables[slices.Index(db.sstables, tables[len(tables)-1])+1:]
+	}
+	if bottommost {
+		opts.bitsPerKey = db.bottomBloomBitsPerKey()
+	}
+	if opts.valueDictSize > 0 {
+		samples, err := sampleTableValues(tables)
+		if err != nil {
+			return false, err
+		}
+		opts.valueDict = TrainValueDictionary(samples, opts.valueDictSize)
+	}
+
+	tempPath := path + ".tmp"
+	opts.fs.Remove(tempPath) // Stale from a crashed compaction
+
+	writer, err := opts.newWriter(tempPath)
+	if err != nil {
+		return false, err
+	}
+
+	// The output holds nothing newer than its newest input, so it keeps
+	// that age for DropTablesOlderThan
+	if created, ok := newestCreatedAt(tables); ok {
+		writer.SetCreatedAt(created)
+	}
+	seqs := tablesSeqRange(tables)
+	writer.setSequenceRange(seqs)
+
+	// The inputs' total size is an upper bound on the output
+	if opts.preallocate {
+		var total int64
+		for _, sst := range tables {
+			if info, err := opts.fs.Stat(sst.Path()); err == nil {
+				total += info.Size()
+			}
+		}
+		writer.Preallocate(total)
+	}
+
+	// Reuse the DB iterator's merge: newest version wins
+	// It holds keys across child.Next, so the children keep per-block buffers
+	it := &DBIterator{comparator: DefaultComparator{}, tombstones: !bottommost, indexEntries: true}
+	for _, sst := range tables {
+		sstIter := sst.NewIterator()
+		sstIter.SetFillCache(false) // Inputs are about to be deleted
+		sstIter.SeekToFirst()
+		it.children = append(it.children, sstIter)
+	}
+	defer it.Close()
+
+	count := 0
+	purged := false
+	for it.findNext(); it.Valid(); it.Next() {
+		if it.deleted && older != nil && !anyMayHold(older, it.Key()) {
+			purged = true
+			continue
+		}
+		if err := writer.AddWithTimestamp(it.Key(), it.Value(), it.deleted, it.Timestamp()); err != nil {
+			writer.Close()
+			opts.fs.Remove(tempPath)
+			return false, err
+		}
+		count++
+	}
+
+	// A corrupt input ends the merge early; don't replace it with a
+	// table missing its tail
+	if err := it.Err(); err != nil {
+		writer.Close()
+		opts.fs.Remove(tempPath)
+		return false, fmt.Errorf("failed to read compaction input: %w", err)
+	}
+
+	// Dropped tombstones take their keys' history with them, so GetAsOf
+	// can't look below the inputs' writes any more
+	if bottommost || purged {
+		if err := db.raiseHistoryFloor(seqs.max); err != nil {
+			writer.Close()
+			opts.fs.Remove(tempPath)
+			return false, err
+		}
+	}
+
+	// Everything was deleted
+	if count == 0 {
+		writer.Close()
+		opts.fs.Remove(tempPath)
+		return false, nil
+	}
+
+	if err := writer.Finish(); err != nil {
+		opts.fs.Remove(tempPath)
+		return false, err
+	}
+
+	if err := opts.fs.Rename(tempPath, path); err != nil {
+		opts.fs.Remove(tempPath)
+		return false, err
+	}
+	return true, nil
+}
+
+// CompactFiles merges the SSTables at paths into one, leaving the other
+// tables untouched, for tools and tests that need control over which files
+// are rewritten. The tables must be adjacent in read order, and no newer
+// table may overlap their key ranges, since the output is written as the
+// newest table, and none may overlap PreserveRanges. Tombstones are kept
+// unless the oldest table is included. The memtable is not flushed. Like
+// Compact, calls are serialized on the DB lock, so no table can be
+// compacted twice.
+func (db *DB) CompactFiles(paths []string) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitForFlush()
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	index := make(map[string]int, len(db.sstables))
+	for i, sst := range db.sstables {
+		index[filepath.Clean(sst.Path())] = i
+	}
+	picked := make(map[int]bool, len(paths))
+	start, end := len(db.sstables), 0
+	for _, path := range paths {
+		i, ok := index[filepath.Clean(path)]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownTable, path)
+		}
+		picked[i] = true
+		start, end = min(start, i), max(end, i+1)
+	}
+	if len(picked) != end-start {
+		return fmt.Errorf("%w: tables to compact are not adjacent", ErrInvalidCompaction)
+	}
+
+	run := db.sstables[start:end]
+	for _, sst := range run {
+		preserved, err := db.tablePreserved(sst)
+		if err != nil {
+			return err
+		}
+		if preserved {
+			return fmt.Errorf("%w: %s holds a preserved key range", ErrInvalidCompaction, sst.Path())
+		}
+	}
+	if err := db.checkNewerOverlap(start, end); err != nil {
+		return err
+	}
+
+	db.stalls.Add(1)
+	defer db.stalls.Add(-1)
+
+	return db.mergeRun(run, false)
+}
+
+// RewriteTable rewrites the SSTable at path on its own, dropping its
+// tombstones for keys no older table may hold, e.g. to reclaim a
+// tombstone-heavy table without merging others. A table holds one
+// version per key, so tombstones are all a rewrite can drop; the others
+// are kept, as are live entries. The output replaces the table as the
+// newest one, so, as for CompactFiles, no newer table may overlap it and
+// it can't hold a preserved range.
+func (db *DB) RewriteTable(path string) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitForFlush()
+
+	i := slices.IndexFunc(db.sstables, func(sst *SSTableReader) bool {
+		return filepath.Clean(sst.Path()) == filepath.Clean(path)
+	})
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrUnknownTable, path)
+	}
+	preserved, err := db.tablePreserved(db.sstables[i])
+	if err != nil {
+		return err
+	}
+	if preserved {
+		return fmt.Errorf("%w: %s holds a preserved key range", ErrInvalidCompaction, path)
+	}
+	if err := db.checkNewerOverlap(i, i+1); err != nil {
+		return err
+	}
+
+	db.stalls.Add(1)
+	defer db.stalls.Add(-1)
+
+	return db.mergeRun(db.sstables[i:i+1], true)
+}
+
+// newestCreatedAt returns the latest creation time among tables
+// ok is false if any table's creation time is unknown
+func newestCreatedAt(tables []*SSTableReader) (newest time.Time, ok bool) {
+	for _, sst := range tables {
+		created := sst.CreatedAt()
+		if created.IsZero() {
+			return time.Time{}, false
+		}
+		if created.After(newest) {
+			newest = created
+		}
+	}
+	return newest, len(tables) > 0
+}
+
+// DropTablesOlderThan deletes SSTables written before cutoff without
+// reading their keys, for append-only data that expires by age
+// A table is only dropped if no older table that is kept overlaps its key
+// range, since its values and tombstones may hide keys in such a table.
+// Tables with an unknown creation time, or overlapping PreserveRanges, are
+// kept. Like compaction, tables
+// are removed oldest first, and files pinned by a Snapshot stay on disk
+// until it is released. Returns the number of tables dropped.
+func (db *DB) DropTablesOlderThan(cutoff time.Time) (int, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitForFlush()
+
+	type keptRange struct{ smallest, largest []byte }
+	var kept []keptRange // Older tables that stay
+	drop := make(map[*SSTableReader]bool)
+	cmp := DefaultComparator{}
+
+	for i := len(db.sstables) - 1; i >= 0; i-- {
+		sst := db.sstables[i]
+		smallest, largest, err := sst.keyRange()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read key range of %s: %w", sst.Path(), err)
+		}
+		if smallest == nil {
+			continue // Empty tables hide nothing
+		}
+
+		created := sst.CreatedAt()
+		expired := !created.IsZero() && created.Before(cutoff) && !db.isPreserved(smallest, largest)
+		if expired {
+			for _, k := range kept {
+				if cmp.Compare(smallest, k.largest) <= 0 && cmp.Compare(k.smallest, largest) <= 0 {
+					expired = false
+					break
+				}
+			}
+		}
+
+		if expired {
+			drop[sst] = true
+		} else {
+			kept = append(kept, keptRange{smallest, largest})
+		}
+	}
+	if len(drop) == 0 {
+		return 0, nil
+	}
+
+	dropped := make([]*SSTableReader, 0, len(drop))
+	for sst := range drop {
+		dropped = append(dropped, sst)
+	}
+	if err := db.raiseHistoryFloor(tablesSeqRange(dropped).max); err != nil {
+		return 0, err
+	}
+
+	remaining := make([]*SSTableReader, 0, len(db.sstables)-len(drop))
+	for _, sst := range db.sstables {
+		if !drop[sst] {
+			remaining = append(remaining, sst)
+		}
+	}
+	for i := len(db.sstables) - 1; i >= 0; i-- {
+		if drop[db.sstables[i]] {
+			db.obsolete = append(db.obsolete, db.sstables[i])
+		}
+	}
+	db.sstables = remaining
+	db.deleteObsolete()
+
+	return len(drop), nil
+}
+
+// bottomBloomBitsPerKey returns the bloom bits for bottommost tables
+func (db *DB) bottomBloomBitsPerKey() int {
+	switch {
+	case db.opts.BottomBloomBitsPerKey < 0:
+		return 0
+	case db.opts.BottomBloomBitsPerKey > 0:
+		return db.opts.BottomBloomBitsPerKey
+	default:
+		return db.opts.BloomBitsPerKey
+	}
+}
+
+// compactionPick is a run of adjacent SSTables worth merging
+// Only adjacent tables can be merged without reordering versions.
+type compactionPick struct {
+	start, end int // db.sstables[start:end], newest first
+	score      float64
+}
+
+// pickTable is the per-table metadata the picker scores from, read from
+// the summary block and index without touching data blocks
+type pickTable struct {
+	smallest, largest []byte // nil for an empty table
+	keys              float64
+	size              int64
+	preserved         bool
+}
+
+// pickPair is what merging a table with the next older one gains
+type pickPair struct {
+	overlap   bool
+	deadBytes float64 // Older entries likely shadowed by the newer table
+}
+
+// runScore rates merging a run of adjacent tables from its totals
+// It adds the fraction of adjacent pairs whose key ranges intersect to
+// the run's estimated dead-byte ratio. Both lie in [0, 1], so disjoint
+// tables without garbage score 0 and fully overlapping garbage
+// approaches 2.
+func runScore(overlapping, pairs int, dead float64, total int64) float64 {
+	score := float64(overlapping) / float64(pairs)
+	if total > 0 {
+		score += min(dead/float64(total), 1)
+	}
+	return score
+}
+
+// pickTableFor reads sst's picker metadata
+func (db *DB) pickTableFor(sst *SSTableReader) (pickTable, error) {
+	t := pickTable{size: sst.size}
+	smallest, largest, err := sst.keyRange()
+	if err != nil {
+		return t, fmt.Errorf("failed to read key range of %s: %w", sst.Path(), err)
+	}
+	t.smallest, t.largest = smallest, largest
+	if sst.summary != nil {
+		t.keys = float64(sst.summary.keyCount)
+	} else if t.keys, err = sst.approximateCount(nil, nil); err != nil {
+		return t, err
+	}
+	t.preserved = db.isPreserved(smallest, largest)
+	return t, nil
+}
+
+// pickPairFor estimates what merging newer with older, the next table in
+// read order, gains. Older entries in newer's key range count as shadowed,
+// up to newer's entry count, at older's average entry size.
+func pickPairFor(older *SSTableReader, n, o pickTable) (pickPair, error) {
+	cmp := DefaultComparator{}
+	if n.smallest == nil || o.smallest == nil ||
+		cmp.Compare(n.smallest, o.largest) > 0 || cmp.Compare(o.smallest, n.largest) > 0 {
+		return pickPair{}, nil
+	}
+
+	// Just past newer's largest key, since the range end is exclusive
+	end := append(bytes.Clone(n.largest), 0)
+	inRange, err := older.approximateCount(n.smallest, end)
+	if err != nil {
+		return pickPair{}, err
+	}
+	p := pickPair{overlap: true}
+	if o.keys > 0 {
+		p.deadBytes = min(inRange, n.keys) * float64(o.size) / o.keys
+	}
+	return p, nil
+}
+
+// pickMetadata returns the picker metadata of every table, newest first,
+// and of every adjacent pair (pairs[i] joins tables i and i+1), reading
+// only tables and pairs that are not cached yet
+// Must be called with db.mu and db.pickMu held
+func (db *DB) pickMetadata() ([]pickTable, []pickPair, error) {
+	n := len(db.sstables)
+	tables := make([]pickTable, n)
+	pairs := make([]pickPair, max(n-1, 0))
+	infos := make(map[*SSTableReader]pickTable, n)
+	gains := make(map[[2]*SSTableReader]pickPair, n)
+	for i, sst := range db.sstables {
+		t, ok := db.pickInfos[sst]
+		if !ok {
+			var err error
+			if t, err = db.pickTableFor(sst); err != nil {
+				return nil, nil, err
+			}
+		}
+		tables[i], infos[sst] = t, t
+	}
+	for i := 0; i+1 < n; i++ {
+		key := [2]*SSTableReader{db.sstables[i], db.sstables[i+1]}
+		p, ok := db.pickPairs[key]
+		if !ok {
+			var err error
+			if p, err = pickPairFor(db.sstables[i+1], tables[i], tables[i+1]); err != nil {
+				return nil, nil, fmt.Errorf("failed to score %s: %w", db.sstables[i+1].Path(), err)
+			}
+		}
+		pairs[i], gains[key] = p, p
+	}
+	db.pickInfos, db.pickPairs = infos, gains
+	return tables, pairs, nil
+}
+
+// pickCompaction returns the highest-scoring run of two or more tables
+// outside PreserveRanges
+// Ties go to the newer run. Table and pair metadata is cached, so after a
+// flush or compaction only the new tables are read; runs are rescored
+// only when the set of SSTables changes. Must be called with db.mu held
+// (read or write)
+func (db *DB) pickCompaction() compactionPick {
+	db.pickMu.Lock()
+	defer db.pickMu.Unlock()
+
+	if db.pickTables != nil && slices.Equal(db.pickTables, db.sstables) {
+		return db.pick
+	}
+
+	tables, pairs, err := db.pickMetadata()
+	if err != nil {
+		fmt.Printf("Warning: failed to score tables for compaction: %v\n", err)
+		return compactionPick{} // Retried on the next call
+	}
+	n := len(tables)
+
+	// Extend each run one table at a time, keeping running totals
+	var best compactionPick
+	for start := 0; start < n; start++ {
+		overlapping, dead, total := 0, 0.0, int64(0)
+		for end := start + 1; end <= n && !tables[end-1].preserved; end++ {
+			total += tables[end-1].size
+			if end-start < 2 {
+				continue
+			}
+			p := pairs[end-2]
+			if p.overlap {
+				overlapping++
+			}
+			dead += p.deadBytes
+			if score := runScore(overlapping, end-start-1, dead, total); score > best.score {
+				best = compactionPick{start: start, end: end, score: score}
+			}
+		}
+	}
+
+	db.pick = best
+	db.pickTables = slices.Clone(db.sstables)
+	return best
+}
+
+// compactPicked merges the best-scoring run of tables (see pickCompaction)
+// until fewer than CompactionTrigger tables remain. When no run scores, or
+// the pick overlaps a newer table, it falls back to a full compaction.
+// Must be called with db.mu held
+func (db *DB) compactPicked() error {
+	db.waitForFlush()
+	db.stalls.Add(1)
+	defer db.stalls.Add(-1)
+
+	for len(db.sstables) >= db.opts.CompactionTrigger {
+		pick := db.pickCompaction()
+		if pick.score == 0 {
+			return db.compactSSTables()
+		}
+		if err := db.checkNewerOverlap(pick.start, pick.end); errors.Is(err, ErrInvalidCompaction) {
+			return db.compactSSTables()
+		} else if err != nil {
+			return fmt.Errorf("compaction failed: %w", err)
+		}
+		if err := db.mergeRun(db.sstables[pick.start:pick.end], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,928 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDBCompact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("a1"))
+	db.Put([]byte("b"), []byte("b1"))
+	forceFlush(t, db)
+
+	db.Put([]byte("a"), []byte("a2"))
+	db.Delete([]byte("b"))
+	forceFlush(t, db)
+
+	// Left in the memtable; Compact must flush it too
+	db.Put([]byte("c"), []byte("c3"))
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	if count := db.Stats().SSTableCount; count != 1 {
+		t.Errorf("Expected 1 SSTable after compaction, got %d", count)
+	}
+
+	if val, err := db.Get([]byte("a")); err != nil || string(val) != "a2" {
+		t.Errorf("Expected a=a2, got %s (err=%v)", val, err)
+	}
+	if _, err := db.Get([]byte("b")); err != ErrNotFound {
+		t.Errorf("Expected b to stay deleted, got %v", err)
+	}
+	if val, err := db.Get([]byte("c")); err != nil || string(val) != "c3" {
+		t.Errorf("Expected c=c3, got %s (err=%v)", val, err)
+	}
+
+	// The tombstone for b is dropped, not just shadowed
+	stats := readTableStats(t, db)
+	if len(stats) != 1 || stats[0].KeyCount != 2 {
+		t.Errorf("Expected one table with 2 keys, got %+v", stats)
+	}
+}
+
+func TestDBCompactOnClose(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 1024
+	opts.CompactOnClose = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// Several generations of overwrites and deletes across many tables
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key_%03d", i)
+			db.Put([]byte(key), []byte(fmt.Sprintf("value_%d_%03d", round, i)))
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		db.Delete([]byte(fmt.Sprintf("key_%03d", i)))
+	}
+
+	before := db.Stats().SSTableCount
+	if before < 2 {
+		t.Fatalf("Expected multiple SSTables before close, got %d", before)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if len(files) >= before {
+		t.Errorf("Expected fewer than %d SSTables on disk, got %d", before, len(files))
+	}
+
+	// Reopen without the option and check the live data
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		val, err := db.Get([]byte(key))
+		if i%2 == 0 {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be deleted, got %v", key, err)
+			}
+			continue
+		}
+		if expected := fmt.Sprintf("value_2_%03d", i); err != nil || string(val) != expected {
+			t.Errorf("Expected %s=%s, got %s (err=%v)", key, expected, val, err)
+		}
+	}
+}
+
+func TestDBBottomBloomBitsPerKey(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.BottomBloomBitsPerKey = -1
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 50; i++ {
+			db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%d", round)))
+		}
+		forceFlush(t, db)
+	}
+	for _, sst := range db.sstables {
+		if sst.bloomFilter == nil {
+			t.Fatalf("Expected flushed table %s to have a bloom filter", sst.Path())
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if len(db.sstables) != 1 || db.sstables[0].bloomFilter != nil {
+		t.Fatalf("Expected one bottom table without a bloom filter, got %d tables", len(db.sstables))
+	}
+
+	// New flushes above the bottom table keep the default
+	db.Put([]byte("key_new"), []byte("value"))
+	forceFlush(t, db)
+	if db.sstables[0].bloomFilter == nil {
+		t.Error("Expected newly flushed table to have a bloom filter")
+	}
+
+	for i := 0; i < 50; i++ {
+		if val, err := db.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil || string(val) != "value_1" {
+			t.Errorf("key_%03d: expected value_1, got %s (err=%v)", i, val, err)
+		}
+	}
+}
+
+func TestDBCompactManyBlocks(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Several tables spanning many blocks, with overwrites and deletes, so
+	// the merge crosses block boundaries in every input
+	expected := make(map[string]string)
+	for round := 0; round < 3; round++ {
+		for i := round; i < 2000; i += 1 + round {
+			key := fmt.Sprintf("key_%05d", i)
+			if round == 2 && i%10 == 0 {
+				db.Delete([]byte(key))
+				delete(expected, key)
+				continue
+			}
+			value := fmt.Sprintf("value_%d_%05d_%s", round, i, key)
+			db.Put([]byte(key), []byte(value))
+			expected[key] = value
+		}
+		forceFlush(t, db)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if count := db.Stats().SSTableCount; count != 1 {
+		t.Fatalf("Expected 1 SSTable after compaction, got %d", count)
+	}
+
+	iter := db.sstables[0].NewIterator()
+	count := 0
+	var prev []byte
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if prev != nil && string(prev) >= string(key) {
+			t.Fatalf("Keys out of order: %s then %s", prev, key)
+		}
+		if iter.IsDeleted() {
+			t.Errorf("Unexpected tombstone for %s", key)
+		}
+		if want, ok := expected[string(key)]; !ok || want != string(iter.Value()) {
+			t.Errorf("Key %s: expected %q, got %q", key, want, iter.Value())
+		}
+		prev = key // Held across Next on purpose
+		count++
+	}
+	if count != len(expected) {
+		t.Errorf("Expected %d keys in compacted table, got %d", len(expected), count)
+	}
+}
+
+func TestCompactionPickerPrefersOverlapAndGarbage(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Oldest: a_000..a_099
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("a_%03d", i)), []byte("old_value"))
+	}
+	forceFlush(t, db)
+
+	// Overwrites half of the oldest table, same key range
+	for i := 0; i < 100; i += 2 {
+		db.Put([]byte(fmt.Sprintf("a_%03d", i)), []byte("new_value"))
+	}
+	forceFlush(t, db)
+
+	// Two newer tables in disjoint ranges with no garbage
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("m_%03d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("z_%03d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+
+	db.mu.RLock()
+	pick := db.pickCompaction()
+	db.mu.RUnlock()
+
+	// Newest first: [z, m, a-overwrites, a-original]
+	if pick.start != 2 || pick.end != 4 {
+		t.Errorf("Expected the two overlapping a_ tables [2:4], got [%d:%d]", pick.start, pick.end)
+	}
+	if pick.score <= 1 {
+		t.Errorf("Expected full overlap plus garbage to score above 1, got %f", pick.score)
+	}
+
+	db.mu.RLock()
+	disjoint := db.pickPairs[[2]*SSTableReader{db.sstables[0], db.sstables[1]}]
+	db.mu.RUnlock()
+	if disjoint.overlap || disjoint.deadBytes != 0 {
+		t.Errorf("Expected disjoint tables without garbage to gain nothing, got %+v", disjoint)
+	}
+
+	if score := db.Stats().CompactionScore; score != pick.score {
+		t.Errorf("Expected Stats to report %f, got %f", pick.score, score)
+	}
+
+	// After a full compaction nothing is left to merge
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if score := db.Stats().CompactionScore; score != 0 {
+		t.Errorf("Expected score 0 after compaction, got %f", score)
+	}
+}
+
+func TestDBBackgroundCompactionMergesPick(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.CompactionTrigger = 4
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Same layout as TestCompactionPickerPrefersOverlapAndGarbage
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("a_%03d", i)), []byte("old_value"))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 100; i += 2 {
+		db.Put([]byte(fmt.Sprintf("a_%03d", i)), []byte("new_value"))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("m_%03d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+	mPath := db.SSTables()[0].Path
+
+	// The fourth table wakes the worker, which merges only the a_ tables
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("z_%03d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().SSTableCount != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 3 SSTables after background compaction, got %d", db.Stats().SSTableCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	kept := db.SSTables()
+	if string(kept[1].FirstKey) != "z_000" || kept[2].Path != mPath {
+		t.Errorf("Expected the z_ and m_ tables to be left alone")
+	}
+	if score := db.Stats().CompactionScore; score != 0 {
+		t.Errorf("Expected score 0 once the overlap is merged, got %f", score)
+	}
+	for i := 0; i < 100; i++ {
+		want := "old_value"
+		if i%2 == 0 {
+			want = "new_value"
+		}
+		if value, err := db.Get([]byte(fmt.Sprintf("a_%03d", i))); err != nil || string(value) != want {
+			t.Errorf("a_%03d: expected %q, got %q (%v)", i, want, value, err)
+		}
+	}
+}
+
+func TestDBDropTablesOlderThan(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Append-only time series: each flush covers a later key range
+	writeHour := func(hour int) {
+		for m := 0; m < 60; m++ {
+			key := fmt.Sprintf("ts_%02d:%02d", hour, m)
+			if err := db.Put([]byte(key), []byte("reading")); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+		forceFlush(t, db)
+	}
+
+	writeHour(0)
+	writeHour(1)
+	time.Sleep(time.Millisecond)
+	cutoff := time.Now()
+	writeHour(2)
+	db.Put([]byte("ts_03:00"), []byte("in memtable"))
+
+	dropped, err := db.DropTablesOlderThan(cutoff)
+	if err != nil {
+		t.Fatalf("Failed to drop tables: %v", err)
+	}
+	if dropped != 2 {
+		t.Fatalf("Expected 2 tables dropped, got %d", dropped)
+	}
+	if stats := db.Stats(); stats.SSTableCount != 1 {
+		t.Errorf("Expected 1 SSTable left, got %d", stats.SSTableCount)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(files) != 1 {
+		t.Errorf("Expected 1 SSTable file left, got %v", files)
+	}
+
+	if _, err := db.Get([]byte("ts_01:30")); err != ErrNotFound {
+		t.Errorf("Expected dropped key to be gone, got %v", err)
+	}
+	for _, key := range []string{"ts_02:30", "ts_03:00"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Errorf("Expected %s to survive, got %v", key, err)
+		}
+	}
+
+	// Nothing else is old enough
+	if dropped, err := db.DropTablesOlderThan(cutoff); err != nil || dropped != 0 {
+		t.Errorf("Expected nothing dropped, got %d (err=%v)", dropped, err)
+	}
+}
+
+func TestDBDropTablesOlderThanKeepsOverlapping(t *testing.T) {
+	dir := t.TempDir()
+
+	// An older table (by file order) that claims a creation time in the
+	// future, as after a clock step back
+	writer, err := NewSSTableWriter(filepath.Join(dir, "sst_000001.sst"), nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetCreatedAt(time.Now().Add(time.Hour))
+	writer.Add([]byte("key"), []byte("stale"), false)
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("key"), []byte("current"))
+	forceFlush(t, db)
+
+	// The newer table is old enough, but dropping it would bring back the
+	// stale value underneath
+	dropped, err := db.DropTablesOlderThan(time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to drop tables: %v", err)
+	}
+	if dropped != 0 {
+		t.Errorf("Expected no tables dropped, got %d", dropped)
+	}
+	if value, err := db.Get([]byte("key")); err != nil || string(value) != "current" {
+		t.Errorf("Expected current, got %q (err=%v)", value, err)
+	}
+}
+
+func TestDBCompactKeepsNewestCreatedAt(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value"))
+		forceFlush(t, db)
+	}
+	newest := readTableStats(t, db)[0].CreatedAt
+
+	time.Sleep(time.Millisecond)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	stats := readTableStats(t, db)
+	if len(stats) != 1 || !stats[0].CreatedAt.Equal(newest) {
+		t.Errorf("Expected compacted table created at %v, got %+v", newest, stats)
+	}
+}
+
+func TestDBCompactFailsOnCorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.BlockCacheSize = 0
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100))
+	}
+	forceFlush(t, db)
+	db.Put([]byte("key_00050"), []byte("newer"))
+	forceFlush(t, db)
+	older := db.sstables[1].Path()
+	db.Close()
+
+	// Corrupt a middle block of the older table
+	reader, err := OpenSSTable(older, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	middle := reader.index[len(reader.index)/2]
+	reader.Close()
+	data, _ := os.ReadFile(older)
+	data[middle.Handle.Offset+5] ^= 0xFF
+	os.WriteFile(older, data, 0644)
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	// Compaction fails instead of writing a table missing the tail
+	if err := db.Compact(); !errors.Is(err, ErrCorruptedData) {
+		t.Fatalf("Expected ErrCorruptedData from Compact, got %v", err)
+	}
+	if count := db.Stats().SSTableCount; count != 2 {
+		t.Errorf("Expected both inputs to be kept, got %d SSTables", count)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) != 0 {
+		t.Errorf("Expected no leftover temp files, got %v", files)
+	}
+
+	// So does a full scan
+	if _, err := db.Keys(nil, 0); !errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Expected ErrCorruptedData from Keys, got %v", err)
+	}
+}
+
+func TestDBConcurrentCompactions(t *testing.T) {
+	fs := &removeCountFS{removed: make(map[string]int)}
+	opts := DefaultOptions(t.TempDir())
+	opts.FS = fs
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	want := make(map[string]string)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key_%03d", (i*7+round)%300)
+			value := fmt.Sprintf("value_%d_%d", round, i)
+			db.Put([]byte(key), []byte(value))
+			want[key] = value
+		}
+		forceFlush(t, db)
+	}
+
+	// Compactions, and a drop that finds nothing old enough, all at once
+	var wg sync.WaitGroup
+	errs := make(chan error, 6)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.Compact()
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.DropTablesOlderThan(time.Now().Add(-time.Hour))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent compaction failed: %v", err)
+		}
+	}
+
+	fs.mu.Lock()
+	for name, n := range fs.removed {
+		if n != 1 {
+			t.Errorf("%s removed %d times", name, n)
+		}
+	}
+	if len(fs.removed) != 5 {
+		t.Errorf("Expected the 5 flushed tables to be removed once each, got %v", fs.removed)
+	}
+	fs.mu.Unlock()
+
+	if count := db.Stats().SSTableCount; count != 1 {
+		t.Errorf("Expected 1 SSTable, got %d", count)
+	}
+	for key, value := range want {
+		if got, err := db.Get([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("%s: expected %s, got %s (err=%v)", key, value, got, err)
+		}
+	}
+}
+
+func TestDBCompactFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("a1"))
+	db.Put([]byte("b"), []byte("b1"))
+	forceFlush(t, db)
+
+	db.Put([]byte("a"), []byte("a2"))
+	db.Delete([]byte("b"))
+	forceFlush(t, db)
+
+	db.Put([]byte("a"), []byte("a3"))
+	forceFlush(t, db)
+
+	stats := readTableStats(t, db) // Newest first
+	oldest := stats[2].Path
+
+	if err := db.CompactFiles([]string{stats[0].Path, stats[2].Path}); !errors.Is(err, ErrInvalidCompaction) {
+		t.Errorf("Expected ErrInvalidCompaction for non-adjacent tables, got %v", err)
+	}
+	if err := db.CompactFiles([]string{filepath.Join(dir, "sst_999999.sst")}); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("Expected ErrUnknownTable, got %v", err)
+	}
+
+	if err := db.CompactFiles([]string{stats[0].Path, stats[1].Path}); err != nil {
+		t.Fatalf("CompactFiles failed: %v", err)
+	}
+
+	stats = readTableStats(t, db)
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 SSTables, got %d", len(stats))
+	}
+	if stats[1].Path != oldest {
+		t.Errorf("Expected oldest table %s untouched, got %s", oldest, stats[1].Path)
+	}
+	// The tombstone for b must survive: b1 is still in the oldest table
+	if stats[0].KeyCount != 2 {
+		t.Errorf("Expected merged table to hold a and b's tombstone, got %d keys", stats[0].KeyCount)
+	}
+
+	check := func() {
+		t.Helper()
+		if val, err := db.Get([]byte("a")); err != nil || string(val) != "a3" {
+			t.Errorf("Expected a=a3, got %s (err=%v)", val, err)
+		}
+		if _, err := db.Get([]byte("b")); err != ErrNotFound {
+			t.Errorf("Expected b to stay deleted, got %v", err)
+		}
+	}
+	check()
+
+	// Read order must survive reopen
+	db.Close()
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check()
+
+	// A newer table overlapping the inputs would be reordered
+	db.Put([]byte("a"), []byte("a4"))
+	forceFlush(t, db)
+	stats = readTableStats(t, db)
+	if err := db.CompactFiles([]string{stats[1].Path, stats[2].Path}); !errors.Is(err, ErrInvalidCompaction) {
+		t.Errorf("Expected ErrInvalidCompaction under an overlapping newer table, got %v", err)
+	}
+}
+
+func TestDBPauseCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.CompactionTrigger = 3
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	waitForTables := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for db.Stats().SSTableCount != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d SSTables, got %d", want, db.Stats().SSTableCount)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Unpaused, the third table triggers a merge
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%02d", i)), []byte("v"))
+		forceFlush(t, db)
+	}
+	waitForTables(1)
+
+	db.PauseCompaction()
+	if !db.Stats().CompactionPaused {
+		t.Fatal("Expected Stats to report compaction paused")
+	}
+
+	// Writes go on and tables pile up past the trigger
+	for i := 3; i < 10; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key_%02d", i)), []byte("v")); err != nil {
+			t.Fatalf("Put failed while paused: %v", err)
+		}
+		forceFlush(t, db)
+	}
+	time.Sleep(20 * time.Millisecond) // Give a wrongly woken worker time to run
+	if got := db.Stats().SSTableCount; got != 8 {
+		t.Fatalf("Expected 8 SSTables while paused, got %d", got)
+	}
+
+	db.ResumeCompaction()
+	waitForTables(1)
+	if db.Stats().CompactionPaused {
+		t.Error("Expected Stats to report compaction resumed")
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key_%02d", i))); err != nil {
+			t.Errorf("key_%02d lost by background compaction: %v", i, err)
+		}
+	}
+}
+
+func TestDBCompactPreserveRanges(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.PreserveRanges = []KeyRange{{Start: []byte("hold_"), End: []byte("hold`")}}
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Two overlapping runs on either side of a table under legal hold
+	put := func(prefix string, from, to int) {
+		for i := from; i < to; i++ {
+			db.Put([]byte(fmt.Sprintf("%s_%03d", prefix, i)), []byte(fmt.Sprintf("%s%d", prefix, from)))
+		}
+		forceFlush(t, db)
+	}
+	put("aaa", 0, 100)
+	put("aaa", 50, 150)
+	db.Put([]byte("hold_001"), []byte("evidence"))
+	db.Delete([]byte("hold_002"))
+	forceFlush(t, db)
+	put("zzz", 0, 100)
+	put("zzz", 50, 150)
+
+	stats := readTableStats(t, db)
+	held := stats[2]
+	if !held.Preserved || stats[0].Preserved || stats[4].Preserved {
+		t.Fatalf("Expected only the middle table preserved, got %+v", stats)
+	}
+	before, err := os.ReadFile(held.Path)
+	if err != nil {
+		t.Fatalf("Failed to read preserved table: %v", err)
+	}
+
+	if err := db.CompactFiles([]string{stats[1].Path, held.Path}); !errors.Is(err, ErrInvalidCompaction) {
+		t.Errorf("Expected ErrInvalidCompaction for a preserved table, got %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	// Each run merged into one table; the preserved one is untouched
+	stats = readTableStats(t, db)
+	if len(stats) != 3 {
+		t.Fatalf("Expected 3 SSTables, got %d", len(stats))
+	}
+	preserved := 0
+	for _, ts := range stats {
+		if ts.Path == held.Path {
+			preserved++
+			if !ts.CreatedAt.Equal(held.CreatedAt) {
+				t.Errorf("Preserved table's creation time changed: %v -> %v", held.CreatedAt, ts.CreatedAt)
+			}
+		} else if ts.KeyCount != 150 {
+			t.Errorf("Expected merged table %s to hold 150 keys, got %d", ts.Path, ts.KeyCount)
+		}
+	}
+	if preserved != 1 {
+		t.Fatalf("Expected preserved table %s to remain, got %+v", held.Path, stats)
+	}
+	after, err := os.ReadFile(held.Path)
+	if err != nil {
+		t.Fatalf("Failed to read preserved table: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Error("Preserved table was rewritten")
+	}
+
+	check := func() {
+		t.Helper()
+		want := map[string]string{"aaa_000": "aaa0", "aaa_120": "aaa50", "hold_001": "evidence", "zzz_010": "zzz0", "zzz_060": "zzz50"}
+		for key, value := range want {
+			if got, err := db.Get([]byte(key)); err != nil || string(got) != value {
+				t.Errorf("Expected %s=%s, got %s (err=%v)", key, value, got, err)
+			}
+		}
+	}
+	check()
+
+	db.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check()
+
+	// Nor is it dropped by age
+	if dropped, err := db.DropTablesOlderThan(time.Now().Add(time.Hour)); err != nil || dropped != 2 {
+		t.Errorf("Expected the 2 merged tables dropped, got %d (err=%v)", dropped, err)
+	}
+	if stats = readTableStats(t, db); len(stats) != 1 || stats[0].Path != held.Path {
+		t.Errorf("Expected only the preserved table left, got %+v", stats)
+	}
+}
+
+func TestDBCompactValueDictionary(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.ValueDictionarySize = 8 * 1024
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"user":"user_%04d","plan":"standard","region":"us-east-1","active":true}`, i))
+	}
+	for i := 0; i < 2000; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%04d", i)), value(i))
+		if i == 999 {
+			forceFlush(t, db)
+		}
+	}
+	forceFlush(t, db)
+	for _, sst := range db.sstables {
+		if sst.valueDict == nil {
+			t.Errorf("Expected flushed table %s to carry a value dictionary", sst.Path())
+		}
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	if len(db.sstables) != 1 || db.sstables[0].valueDict == nil {
+		t.Fatalf("Expected one compacted table with a value dictionary")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close DB: %v", err)
+	}
+
+	db, err = Open(DefaultOptions(dir)) // Reading needs no option
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	for i := 0; i < 2000; i += 37 {
+		if got, err := db.Get([]byte(fmt.Sprintf("key_%04d", i))); err != nil || !bytes.Equal(got, value(i)) {
+			t.Errorf("Key %d: expected %s, got %s (err=%v)", i, value(i), got, err)
+		}
+	}
+}
+
+func TestDBRewriteTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("hidden_%03d", i)), []byte("old"))
+		db.Put([]byte(fmt.Sprintf("live_%03d", i)), []byte("old"))
+	}
+	forceFlush(t, db)
+
+	// Tombstone-heavy: most delete keys no older table holds
+	for i := 0; i < 2000; i++ {
+		db.Delete([]byte(fmt.Sprintf("gone_%04d", i)))
+	}
+	for i := 0; i < 100; i++ {
+		db.Delete([]byte(fmt.Sprintf("hidden_%03d", i)))
+		db.Put([]byte(fmt.Sprintf("live_%03d", i)), []byte(fmt.Sprintf("new_%03d", i)))
+	}
+	forceFlush(t, db)
+
+	scan := func() map[string]string {
+		live := make(map[string]string)
+		it := db.NewIterator(nil, nil)
+		defer it.Close()
+		for ; it.Valid(); it.Next() {
+			live[string(it.Key())] = string(it.Value())
+		}
+		return live
+	}
+	before := scan()
+	stats := readTableStats(t, db)
+
+	if err := db.RewriteTable(filepath.Join(dir, "sst_999999.sst")); !errors.Is(err, ErrUnknownTable) {
+		t.Errorf("Expected ErrUnknownTable, got %v", err)
+	}
+	if err := db.RewriteTable(stats[0].Path); err != nil {
+		t.Fatalf("RewriteTable failed: %v", err)
+	}
+
+	after := readTableStats(t, db)
+	if len(after) != 2 || after[1].Path != stats[1].Path {
+		t.Fatalf("Expected the older table untouched, got %+v", after)
+	}
+	if after[0].TotalBytes >= stats[0].TotalBytes {
+		t.Errorf("Expected the rewritten table to shrink, got %d bytes from %d", after[0].TotalBytes, stats[0].TotalBytes)
+	}
+	// The live values and the tombstones hiding older values stay
+	if after[0].KeyCount != 200 {
+		t.Errorf("Expected 200 keys in the rewritten table, got %d", after[0].KeyCount)
+	}
+
+	check := func() {
+		t.Helper()
+		if got := scan(); len(got) != len(before) {
+			t.Errorf("Expected %d live keys, got %d", len(before), len(got))
+		} else {
+			for k, v := range before {
+				if got[k] != v {
+					t.Errorf("Key %s: expected %s, got %s", k, v, got[k])
+				}
+			}
+		}
+		if _, err := db.Get([]byte("hidden_042")); err != ErrNotFound {
+			t.Errorf("Expected hidden_042 to stay deleted, got %v", err)
+		}
+	}
+	check()
+
+	db.Close()
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check()
+}
@@ -1,6 +1,9 @@
 package lsm
 
-import "bytes"
+import (
+    "bytes"
+    "fmt"
+)
 
 type Comparator interface {
     // Compare returns -1, 0, or +1
@@ -21,4 +24,56 @@ func (DefaultComparator) Name() string {
     return "lsm.DefaultComparator"
 }
 
-// add mvcc comparator later
+// InternalKeyComparator orders versioned keys: a user key followed by a
+// SuffixLen-byte version, such as a big-endian uint64. User keys sort
+// ascending and, within one user key, higher versions first, so the
+// newest version is the first one at or after SeekKey(userKey).
+// Keys shorter than SuffixLen are user keys without a version, which sort
+// before all of their versions.
+type InternalKeyComparator struct {
+    SuffixLen int        // Bytes of version at the end of every key
+    User      Comparator // Orders user keys (nil = DefaultComparator)
+}
+
+func (c InternalKeyComparator) Compare(a, b []byte) int {
+    userA, versionA := c.split(a)
+    userB, versionB := c.split(b)
+    if r := c.user().Compare(userA, userB); r != 0 {
+        return r
+    }
+    if len(versionA) != len(versionB) {
+        // Only an unversioned key is shorter, and it sorts first
+        if len(versionA) < len(versionB) {
+            return -1
+        }
+        return 1
+    }
+    return bytes.Compare(versionB, versionA) // Descending
+}
+
+func (c InternalKeyComparator) Name() string {
+    return fmt.Sprintf("lsm.InternalKeyComparator(%s,%d)", c.user().Name(), c.SuffixLen)
+}
+
+// SeekKey returns the key that sorts right before every version of
+// userKey: userKey with the highest possible version
+func (c InternalKeyComparator) SeekKey(userKey []byte) []byte {
+    key := append([]byte(nil), userKey...)
+    return append(key, bytes.Repeat([]byte{0xFF}, c.SuffixLen)...)
+}
+
+// split separates a key into its user key and version suffix
+func (c InternalKeyComparator) split(key []byte) (user, version []byte) {
+    if len(key) < c.SuffixLen {
+        return key, nil
+    }
+    n := len(key) - c.SuffixLen
+    return key[:n], key[n:]
+}
+
+func (c InternalKeyComparator) user() Comparator {
+    if c.User == nil {
+        return DefaultComparator{}
+    }
+    return c.User
+}
@@ -1,14 +1,30 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
+)
+
+const (
+	// MaxKeySize is the largest key the WAL and SSTables accept
+	MaxKeySize = 64 * 1024 // 64KB
+
+	// MaxValueSize is the largest value the WAL and SSTables accept
+	// WAL readers size their record sanity cap from it, and together with
+	// MaxKeySize it keeps records far from the 4-byte length fields' limit
+	MaxValueSize = 64 * 1024 * 1024 // 64MB
 )
 
 // DBOptions configures the database
@@ -19,14 +35,184 @@ type DBOptions struct {
 	// MemtableSize is the max size before flushing (default 4MB)
 	MemtableSize int64
 
+	// MemtableType picks the memtable's backend (default MemtableSkipList)
+	// MemtableBTree needs less memory per entry, so more entries fit
+	// before a flush, but inserts move entries within a node.
+	MemtableType MemtableType
+
+	// SkipListMaxLevel caps the height of the memtable's skip list nodes
+	// (0 = 12, at most MaxSkipListLevel). Searches degrade toward linear
+	// once a memtable holds far more than 4^SkipListMaxLevel entries; a
+	// warning is logged when flushed memtables keep reaching the cap. A
+	// tuning knob that most users leave alone.
+	SkipListMaxLevel int
+
 	// SyncWrites ensures durability on every write (slower)
 	SyncWrites bool
 
 	// BloomBitsPerKey is the number of bits per key for bloom filters
 	// Higher values = lower false positive rate but more memory
 	BloomBitsPerKey int
+
+	// BottomBloomBitsPerKey overrides BloomBitsPerKey for bottommost tables
+	// (compaction output that includes the oldest table). They hold most of
+	// the data but see few negative lookups, so smaller filters save memory.
+	// 0 = same as BloomBitsPerKey, negative = no bloom filter
+	BottomBloomBitsPerKey int
+
+	// BloomHasher hashes keys for bloom filters (default: FNVBloomHasher)
+	// It is registered on Open so tables written with it can be decoded
+	BloomHasher BloomHasher
+
+	// PrefixExtractor builds SSTable bloom filters over key prefixes
+	// instead of whole keys, so scans within one prefix skip tables that
+	// hold none of it. Point lookups still use the filter, at prefix
+	// granularity. The extractor isn't stored: pass the same one on every
+	// Open, since tables written with it can't otherwise be filtered.
+	PrefixExtractor PrefixExtractor
+
+	// CorruptionPolicy says what Open does with an SSTable that fails to
+	// load (default SkipAndWarn)
+	CorruptionPolicy CorruptionPolicy
+
+	// SSTableNaming selects the file name format for new SSTables
+	// SSTableNameLevel embeds the table's level, for debugging and for
+	// rebuilding the layout from a directory listing. Both formats are
+	// read whatever the setting, and share one ID sequence, so switching
+	// keeps the read order.
+	SSTableNaming SSTableNaming
+
+	// ParanoidChecks verifies every SSTable block CRC on Open
+	// Slower startup, but corruption is reported before it is read
+	ParanoidChecks bool
+
+	// ParanoidBloom checks, after writing each SSTable, that its bloom
+	// filter reports every key added to it, failing the flush or
+	// compaction on a false negative. It keeps a copy of every key while
+	// the table is written, so it is meant for debugging filter changes.
+	ParanoidBloom bool
+
+	// FS is the filesystem used for all files (default: OSFileSystem)
+	FS FileSystem
+
+	// DirectIO writes SSTables with O_DIRECT where the platform and
+	// filesystem support it, so flushes and compactions don't push other
+	// data out of the OS page cache (buffered writes elsewhere)
+	DirectIO bool
+
+	// PreallocateSSTables reserves disk space for flushed SSTables up
+	// front (fallocate on Linux, ignored elsewhere) to reduce fragmentation
+	PreallocateSSTables bool
+
+	// CompactOnClose flushes the memtable and runs a full compaction in
+	// Close, leaving a single SSTable on disk
+	CompactOnClose bool
+
+	// CompactionTrigger starts compacting in the background once flushes
+	// leave this many SSTables (0 = only explicit compactions). It merges
+	// the best-scoring run of tables (see Stats.CompactionScore) until
+	// fewer remain, or all of them when nothing overlaps.
+	// Open iterators and snapshots pin the tables they read, so those stay
+	// on disk until they are closed.
+	CompactionTrigger int
+
+	// FlushInterval flushes a non-empty memtable in the background once
+	// this long has passed since the last flush, bounding WAL size and
+	// recovery time when writes are slow (0 = flush only when full)
+	FlushInterval time.Duration
+
+	// IndexPartitionEntries is the number of index entries per partition
+	// SSTables with more blocks than this get a two-level index whose
+	// partitions are loaded lazily (0 = DefaultIndexPartitionEntries)
+	IndexPartitionEntries int
+
+	// WALSyncBytes syncs the WAL whenever this many bytes have been written
+	// since the last sync, bounding loss by bytes (0 = disabled)
+	WALSyncBytes int64
+
+	// KeepRecentWALSegments keeps the WALs of this many flushed memtables,
+	// newest last, as wal_<id>.log instead of deleting them, for post-mortem
+	// debugging of recent writes (read them with ReplayWAL). Open never
+	// replays them. 0 = delete each WAL once its memtable is flushed.
+	KeepRecentWALSegments int
+
+	// MaxKeySize and MaxValueSize lower the per-entry limits for Put and
+	// Delete (0 = the package MaxKeySize / MaxValueSize)
+	MaxKeySize   int
+	MaxValueSize int
+
+	// BlockCacheSize is the memory, in bytes, for caching SSTable data
+	// blocks across reads (0 = no cache)
+	BlockCacheSize int64
+
+	// TargetFileSize splits each memtable flush into SSTables of about
+	// this many bytes, so a large memtable doesn't become one huge file
+	// (0 = one SSTable per flush)
+	TargetFileSize int64
+
+	// BlockAlignment pads SSTable data blocks so each starts on a multiple
+	// of this many bytes, for direct I/O or page-aligned reads; it costs
+	// up to one alignment unit of space per block (0 = no padding)
+	BlockAlignment int
+
+	// ValueDictionarySize compresses SSTable values against a dictionary
+	// of up to this many bytes (at most MaxValueDictionarySize), trained
+	// from sampled values at each flush and compaction and stored in the
+	// table. It shrinks many small, similar values, such as JSON records,
+	// that don't compress on their own (0 = values stored raw). Older
+	// versions of this package can't read the tables it writes.
+	ValueDictionarySize int
+
+	// PackedTombstones writes SSTables in BlockFormatPackedTombstones,
+	// which stores each tombstone in 4 fewer bytes; it pays off in
+	// delete-heavy workloads. Older versions of this package can't read
+	// the tables it writes.
+	PackedTombstones bool
+
+	// NonBlockingWrites makes writes return ErrBusy instead of waiting
+	// while another goroutine holds the lock to flush or compact. Flushes
+	// started by a full memtable only hold it to publish their tables.
+	// Callers should back off and retry. A write that fills the memtable
+	// still flushes it before returning.
+	NonBlockingWrites bool
+
+	// PreserveRanges are key ranges whose SSTables are never rewritten or
+	// dropped, keeping their exact bytes and creation times (e.g. for a
+	// legal hold). Compaction leaves out every table overlapping a range,
+	// including ones flushed later, and merges the runs between them.
+	PreserveRanges []KeyRange
+
+	// PurgeTombstonesOnFlush leaves a tombstone out of the flushed SSTable
+	// when no SSTable may hold its key (e.g. a brand-new key put and then
+	// deleted before the flush), since it would hide nothing. Tables
+	// skipped as corrupt at Open aren't checked, so a key in such a table
+	// can reappear if the table is later restored.
+	PurgeTombstonesOnFlush bool
 }
 
+// CorruptionPolicy controls how Open handles SSTables that fail to load
+type CorruptionPolicy int
+
+const (
+	SkipAndWarn CorruptionPolicy = iota // Log a warning and open without the table
+	FailFast                            // Fail Open rather than serve an incomplete dataset
+)
+
+// SSTableNaming selects how SSTable file names are built
+type SSTableNaming int
+
+const (
+	SSTableNamePlain SSTableNaming = iota // sst_000042.sst
+	SSTableNameLevel                      // sst_L1_000042.sst
+)
+
+// Levels recorded in SSTableNameLevel file names. The DB has no levels
+// yet: flushes write level 0 and compactions level 1.
+const (
+	flushLevel      = 0
+	compactionLevel = 1
+)
+
 // DefaultOptions returns sensible defaults
 func DefaultOptions(dir string) *DBOptions {
 	return &DBOptions{
@@ -34,6 +220,8 @@ func DefaultOptions(dir string) *DBOptions {
 		MemtableSize:    4 * 1024 * 1024, // 4MB
 		SyncWrites:      false,
 		BloomBitsPerKey: 10, // ~1% false positive rate
+		FS:              OSFileSystem{},
+		BlockCacheSize:  8 * 1024 * 1024, // 8MB
 	}
 }
 
@@ -41,81 +229,259 @@ func DefaultOptions(dir string) *DBOptions {
 type DB struct {
 	opts *DBOptions
 
+	// Filesystem for all file operations
+	fs FileSystem
+
+	// Exclusive lock on dir/LOCK, held until Close
+	lock io.Closer
+
 	// Active memtable for writes
 	memtable *Memtable
 
-	// Immutable memtable being flushed (nil if not flushing)
+	// Immutable memtable waiting to be flushed (nil if none); its WAL is
+	// at immutableWALPath
 	immutable *Memtable
 
 	// Write-ahead log for active memtable
 	wal *WAL
 
+	// When the immutable memtable's oldest WAL record was written
+	immutableWALStart time.Time
+
 	// SSTables on disk (newest first)
 	sstables []*SSTableReader
 
+	// Snapshot references per SSTable, and compacted-away SSTables
+	// (oldest first) waiting for their pins to drop before deletion
+	pins     map[*SSTableReader]int
+	obsolete []*SSTableReader
+
 	// Next SSTable ID
 	nextSSTableID uint64
 
 	// Mutex for coordinating flushes
 	mu sync.RWMutex
 
+	// A flush is writing SSTables with mu released (see writeSSTables);
+	// anything else that changes the SSTables waits on flushDone first
+	// (guarded by mu)
+	flushing  bool
+	flushDone *sync.Cond
+
 	// Is the DB closed?
 	closed atomic.Bool
+
+	// Flushes and compactions holding mu (see NonBlockingWrites)
+	stalls atomic.Int32
+
+	// Background goroutines (see goBackground): stop is closed by Close,
+	// which then waits for every one of them to return
+	stop       chan struct{}
+	background sync.WaitGroup
+
+	// Background compaction (see CompactionTrigger); wake is nil when it
+	// is off. compacting is set while the worker compacts, which
+	// PauseCompaction waits out on compactionDone (guarded by mu)
+	compactionPaused atomic.Bool
+	compactionWake   chan struct{}
+	compacting       bool
+	compactionDone   *sync.Cond
+
+	// Time of the last flush, for FlushInterval (guarded by mu)
+	lastFlush time.Time
+
+	// Moving average of SSTables consulted per Get
+	readAmp readAmpTracker
+
+	// Tombstones left out of flushes (see PurgeTombstonesOnFlush; guarded by mu)
+	tombstonesPurged uint64
+
+	// Consecutive flushes whose skip list reached its max level (guarded by mu)
+	saturatedFlushes int
+
+	// Sequence below which GetAsOf can't answer (see HistoryFileName;
+	// guarded by mu)
+	historyFloor uint64
+
+	// Sequence number of the latest write, and the limit leased in SEQ
+	// (guarded by mu; seq is atomic for LastSequence)
+	seq      atomic.Uint64
+	seqLimit uint64
+
+	// Data blocks shared by all SSTables (nil = disabled)
+	cache *blockCache
+
+	// Secondary indexes by name, maintained by writes (guarded by mu)
+	indexes map[string]*secondaryIndex
+
+	// Best compaction pick for the current SSTable set, and the table and
+	// pair metadata it was scored from (see pickCompaction)
+	pickMu     sync.Mutex
+	pickTables []*SSTableReader
+	pick       compactionPick
+	pickInfos  map[*SSTableReader]pickTable
+	pickPairs  map[[2]*SSTableReader]pickPair
 }
 
 // Open opens or creates a database
 func Open(opts *DBOptions) (*DB, error) {
+	fs := opts.FS
+	if fs == nil {
+		fs = OSFileSystem{}
+	}
+
+	if opts.MaxKeySize < 0 || opts.MaxKeySize > MaxKeySize {
+		return nil, fmt.Errorf("MaxKeySize %d out of range (limit %d)", opts.MaxKeySize, MaxKeySize)
+	}
+	if opts.MaxValueSize < 0 || opts.MaxValueSize > MaxValueSize {
+		return nil, fmt.Errorf("MaxValueSize %d out of range (limit %d)", opts.MaxValueSize, MaxValueSize)
+	}
+	if opts.SkipListMaxLevel < 0 || opts.SkipListMaxLevel > MaxSkipListLevel {
+		return nil, fmt.Errorf("SkipListMaxLevel %d out of range (limit %d)", opts.SkipListMaxLevel, MaxSkipListLevel)
+	}
+
+	if opts.BloomHasher != nil {
+		RegisterBloomHasher(opts.BloomHasher)
+	}
+
 	// Create directory if needed
-	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+	if err := fs.MkdirAll(opts.Dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
+	// Make sure no other process is using this directory
+	lock, err := fs.Lock(filepath.Join(opts.Dir, "LOCK"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", opts.Dir, err)
+	}
+
 	db := &DB{
 		opts:     opts,
+		fs:       fs,
+		lock:     lock,
 		sstables: make([]*SSTableReader, 0),
+		pins:     make(map[*SSTableReader]int),
+		stop:     make(chan struct{}),
+	}
+	db.flushDone = sync.NewCond(&db.mu)
+	db.compactionDone = sync.NewCond(&db.mu)
+	if opts.BlockCacheSize > 0 {
+		db.cache = newBlockCache(opts.BlockCacheSize)
+	}
+
+	// Touch nothing in a directory written in a newer format
+	if err := db.checkFormatVersion(); err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	// Clean up any temp files from crashed flushes
 	db.cleanupTempFiles()
 
+	// Resume write sequence numbers above any handed out before
+	if err := db.loadSequence(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	// Load existing SSTables
 	if err := db.loadSSTables(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.loadHistoryFloor(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	// Recover memtable from WAL (if exists)
+	// Recover a memtable rotated out before a crash, then the active one
+	if err := db.recoverImmutable(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
+	}
 	walPath := filepath.Join(opts.Dir, "wal.log")
-	memtable, err := RecoverMemtable(walPath, opts.MemtableSize)
+	memtable, err := recoverMemtable(fs, walPath, db.newMemtable)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to recover from WAL: %w", err)
 	}
+	if memtable.Count() > 0 {
+		// The WAL doesn't record sequence numbers, only that they were
+		// handed out before this Open
+		memtable.noteSequences(0, db.seq.Load())
+	}
 	db.memtable = memtable
 
 	// Open WAL for new writes (truncate old one since we recovered)
-	wal, err := OpenWAL(walPath, opts.SyncWrites)
+	wal, err := db.openWAL(walPath)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
 	db.wal = wal
 
+	// Records left by the previous run aren't dated, so age them from now
+	if info, err := fs.Stat(walPath); err == nil && info.Size() > 0 {
+		wal.firstWrite = time.Now()
+	}
+
+	if opts.CompactionTrigger > 0 {
+		db.compactionWake = make(chan struct{}, 1)
+		db.goBackground(db.compactionWorker)
+		db.wakeCompaction() // Tables may have piled up before Open
+	}
+
+	db.lastFlush = time.Now()
+	if opts.FlushInterval > 0 {
+		db.goBackground(db.flushTimer)
+	}
+
 	return db, nil
 }
 
+// recoverImmutable restores the immutable memtable from its WAL, if a
+// rotated memtable wasn't flushed before the last Close or crash. It
+// stays immutable, to be flushed by the next flush.
+func (db *DB) recoverImmutable() error {
+	path := db.immutableWALPath()
+	if _, err := db.fs.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	mem, err := recoverMemtable(db.fs, path, db.newMemtable)
+	if err != nil {
+		return err
+	}
+	mem.noteSequences(0, db.seq.Load())
+	mem.SetImmutable()
+	db.immutable = mem
+	db.immutableWALStart = time.Now()
+	return nil
+}
+
+// goBackground runs fn in a goroutine that Close waits for; fn must
+// return once db.stop is closed
+func (db *DB) goBackground(fn func()) {
+	db.background.Add(1)
+	go func() {
+		defer db.background.Done()
+		fn()
+	}()
+}
+
 // cleanupTempFiles removes incomplete SSTable files
+// Runs at Open and after every flush
 func (db *DB) cleanupTempFiles() {
 	pattern := filepath.Join(db.opts.Dir, "*.tmp")
-	files, _ := filepath.Glob(pattern)
+	files, _ := db.fs.Glob(pattern)
 	for _, f := range files {
-		os.Remove(f)
+		db.fs.Remove(f)
 	}
 }
 
 // loadSSTables loads all existing SSTables
 func (db *DB) loadSSTables() error {
 	pattern := filepath.Join(db.opts.Dir, "sst_*.sst")
-	files, err := filepath.Glob(pattern)
+	files, err := db.fs.Glob(pattern)
 	if err != nil {
 		return err
 	}
@@ -128,282 +494,1460 @@ func (db *DB) loadSSTables() error {
 	})
 
 	for _, path := range files {
-		reader, err := OpenSSTable(path, nil)
+		// Track highest ID, including skipped tables so a later flush
+		// can't overwrite them
+		id := db.parseSSTableID(path)
+		if id >= db.nextSSTableID {
+			db.nextSSTableID = id + 1
+		}
+
+		reader, err := db.openSSTable(path)
 		if err != nil {
+			if db.opts.CorruptionPolicy == FailFast {
+				return fmt.Errorf("failed to load SSTable %s: %w", path, err)
+			}
 			// Log and skip corrupted SSTables
 			fmt.Printf("Warning: skipping corrupted SSTable %s: %v\n", path, err)
 			continue
 		}
-		db.sstables = append(db.sstables, reader)
 
-		// Track highest ID
-		id := db.parseSSTableID(path)
-		if id >= db.nextSSTableID {
-			db.nextSSTableID = id + 1
+		// Eagerly scan all blocks so silent corruption fails Open
+		if db.opts.ParanoidChecks {
+			if err := reader.VerifyChecksums(); err != nil {
+				reader.Close()
+				return fmt.Errorf("paranoid check failed for %s: %w", path, err)
+			}
 		}
+		db.sstables = append(db.sstables, reader)
 	}
 
 	return nil
 }
 
-// parseSSTableID extracts ID from filename like "sst_000001.sst"
+// parseSSTableID extracts ID from filename like "sst_000001.sst" or
+// "sst_L1_000001.sst"
 func (db *DB) parseSSTableID(path string) uint64 {
+	_, id, _ := parseSSTableName(path)
+	return id
+}
+
+// parseSSTableName extracts the level and ID from an SSTable file name
+// Plain names ("sst_000001.sst") are level 0.
+func parseSSTableName(path string) (level int, id uint64, ok bool) {
 	base := filepath.Base(path)
 	base = strings.TrimPrefix(base, "sst_")
 	base = strings.TrimSuffix(base, ".sst")
-	id, _ := strconv.ParseUint(base, 10, 64)
-	return id
+	if rest, found := strings.CutPrefix(base, "L"); found {
+		levelPart, idPart, found := strings.Cut(rest, "_")
+		if !found {
+			return 0, 0, false
+		}
+		l, err := strconv.Atoi(levelPart)
+		if err != nil || l < 0 {
+			return 0, 0, false
+		}
+		level, base = l, idPart
+	}
+	id, err := strconv.ParseUint(base, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return level, id, true
+}
+
+// WriteOptions controls a single write
+type WriteOptions struct {
+	// Sync fsyncs the WAL before the write returns, even when the DB was
+	// opened with SyncWrites=false
+	Sync bool
 }
 
 // Put stores a key-value pair
 func (db *DB) Put(key, value []byte) error {
+	return db.PutOpt(key, value, nil)
+}
+
+// PutOpt stores a key-value pair with per-write options (nil = defaults)
+func (db *DB) PutOpt(key, value []byte, opts *WriteOptions) error {
+	return db.write(RecordTypePut, key, value, 0, opts)
+}
+
+// PutWithTimestamp stores a key-value pair versioned by an application
+// timestamp: it is ignored if the key's current version (value or
+// tombstone) has a higher timestamp, so the highest timestamp wins no
+// matter the write order. Plain Put and Delete use timestamp 0 and always
+// apply. Timestamps of deleted keys are forgotten once compaction drops
+// the tombstone.
+func (db *DB) PutWithTimestamp(key, value []byte, ts uint64) error {
+	return db.write(RecordTypePut, key, value, ts, nil)
+}
+
+// DeleteWithTimestamp removes a key unless its current version has a
+// higher timestamp (see PutWithTimestamp)
+func (db *DB) DeleteWithTimestamp(key []byte, ts uint64) error {
+	return db.write(RecordTypeDelete, key, nil, ts, nil)
+}
+
+// Delete removes a key (writes a tombstone)
+func (db *DB) Delete(key []byte) error {
+	return db.DeleteOpt(key, nil)
+}
+
+// DeleteOpt removes a key with per-write options (nil = defaults)
+func (db *DB) DeleteOpt(key []byte, opts *WriteOptions) error {
+	return db.write(RecordTypeDelete, key, nil, 0, opts)
+}
+
+// CompareAndDelete deletes key only if its current value equals expected
+// The check and the delete happen atomically under the write lock.
+// Returns whether the key was deleted; an absent or already deleted key
+// returns false without writing a tombstone.
+func (db *DB) CompareAndDelete(key, expected []byte) (bool, error) {
 	if db.closed.Load() {
-		return ErrClosed
+		return false, ErrClosed
+	}
+
+	if err := db.checkEntrySize(key, nil); err != nil {
+		return false, err
+	}
+
+	if err := db.checkBusy(); err != nil {
+		return false, err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	// Write to WAL first (for durability)
-	if err := db.wal.WritePut(key, value); err != nil {
-		return fmt.Errorf("WAL write failed: %w", err)
+	current, found, _, err := db.getEntry(key, true)
+	if err != nil {
+		return false, err
+	}
+	if !found || current.Deleted || !bytes.Equal(current.Value, expected) {
+		return false, nil
 	}
 
-	// Write to memtable
-	if err := db.memtable.Put(key, value); err != nil {
-		return err
+	if err := db.apply(RecordTypeDelete, key, nil, 0, false); err != nil {
+		return false, err
+	}
+	if err := db.updateIndexes(key, current.Value, true, nil, false); err != nil {
+		return false, err
 	}
 
-	// Check if memtable is full
-	if db.memtable.IsFull() {
-		if err := db.triggerFlush(); err != nil {
-			return err
-		}
+	if err := db.flushIfFull(); err != nil {
+		return false, err
 	}
 
-	return nil
+	return true, nil
 }
 
-// Delete removes a key (writes a tombstone)
-func (db *DB) Delete(key []byte) error {
+// Append adds suffix to the end of key's value, creating it if absent
+// The read and the write happen atomically under the write lock, so
+// concurrent Appends to one key all land, in some order. The result is
+// stored as a plain value and must fit MaxValueSize.
+func (db *DB) Append(key, suffix []byte) error {
 	if db.closed.Load() {
 		return ErrClosed
 	}
 
+	if err := db.checkEntrySize(key, suffix); err != nil {
+		return err
+	}
+
+	if err := db.checkBusy(); err != nil {
+		return err
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	// Write to WAL first
-	if err := db.wal.WriteDelete(key); err != nil {
-		return fmt.Errorf("WAL write failed: %w", err)
+	current, found, _, err := db.getEntry(key, true)
+	if err != nil {
+		return err
 	}
+	live := found && !current.Deleted
 
-	// Write tombstone to memtable
-	if err := db.memtable.Delete(key); err != nil {
+	var value []byte
+	if live {
+		value = append(value, current.Value...)
+	}
+	value = append(value, suffix...)
+	if err := db.checkEntrySize(key, value); err != nil {
 		return err
 	}
 
-	// Check if memtable is full
-	if db.memtable.IsFull() {
-		if err := db.triggerFlush(); err != nil {
-			return err
-		}
+	if err := db.apply(RecordTypePut, key, value, 0, false); err != nil {
+		return err
+	}
+	if err := db.updateIndexes(key, current.Value, live, value, true); err != nil {
+		return err
+	}
+
+	if err := db.flushIfFull(); err != nil {
+		return err
 	}
 
 	return nil
 }
 
-// Get retrieves a value by key
-// Returns: (value, error)
-// Returns ErrNotFound if key doesn't exist
-// Returns nil value if key was deleted
-func (db *DB) Get(key []byte) ([]byte, error) {
+// write logs and applies a single Put or Delete
+// A non-zero ts makes it a versioned write (see PutWithTimestamp)
+func (db *DB) write(recordType byte, key, value []byte, ts uint64, opts *WriteOptions) error {
 	if db.closed.Load() {
-		return nil, ErrClosed
-	}
-
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	// 1. Check active memtable (newest data)
-	if value, deleted, found := db.memtable.Get(key); found {
-		if deleted {
-			return nil, ErrNotFound // Key was deleted
-		}
-		return value, nil
+		return ErrClosed
 	}
 
-	// 2. Check immutable memtable (if flushing)
-	if db.immutable != nil {
-		if value, deleted, found := db.immutable.Get(key); found {
-			if deleted {
-				return nil, ErrNotFound
-			}
-			return value, nil
-		}
+	if err := db.checkEntrySize(key, value); err != nil {
+		return err
 	}
+	forceSync := opts != nil && opts.Sync
 
-	// 3. Check SSTables (newest to oldest)
-	// Use bloom filter to skip SSTables that definitely don't have the key
-	for _, sst := range db.sstables {
-		// Bloom filter check: skip if key definitely not in this SSTable
-		if !sst.MayContain(key) {
-			continue
-		}
-
-		if value, deleted, found := sst.Get(key); found {
-			if deleted {
-				return nil, ErrNotFound
-			}
-			return value, nil
-		}
+	if err := db.checkBusy(); err != nil {
+		return err
 	}
 
-	return nil, ErrNotFound
-}
+	db.mu.Lock()
+	defer db.mu.Unlock()
 
-// triggerFlush starts flushing the memtable to an SSTable
-// Must be called with db.mu held
-func (db *DB) triggerFlush() error {
-	// If already flushing, wait (simple blocking approach)
-	// In production, you'd use a background goroutine
-	if db.immutable != nil {
-		// Previous flush still in progress - do it synchronously
-		if err := db.doFlush(); err != nil {
+	// Versioned writes and secondary indexes need the current version
+	var current Entry
+	var found bool
+	if ts != 0 || len(db.indexes) > 0 {
+		var err error
+		if current, found, _, err = db.getEntry(key, true); err != nil {
 			return err
 		}
 	}
 
-	// Make current memtable immutable
-	db.memtable.SetImmutable()
-	db.immutable = db.memtable
-
-	// Create new active memtable
-	db.memtable = NewMemtable(db.opts.MemtableSize)
-
-	// Create new WAL (old WAL will be deleted after flush)
-	oldWAL := db.wal
-	walPath := filepath.Join(db.opts.Dir, "wal.log")
-
-	// We need to close old WAL and create new one
-	// For simplicity, we'll reuse the same path after flush completes
+	// A versioned write loses to a newer version. Checking here keeps the
+	// newest version of every key the one with the highest timestamp, so
+	// reads and merges can keep resolving conflicts by recency.
+	if ts != 0 && found && current.Timestamp > ts {
+		return nil
+	}
 
-	// Perform the flush
-	if err := db.doFlush(); err != nil {
+	if err := db.apply(recordType, key, value, ts, forceSync); err != nil {
 		return err
 	}
 
-	// Now safe to remove WAL (data is in SSTable)
-	// We delete instead of truncate - if delete fails but SSTable exists,
-	// recovery will safely handle duplicates via idempotent overwrites
-	oldWAL.Close()
-	if err := os.Remove(walPath); err != nil && !os.IsNotExist(err) {
-		// Log warning but continue - worst case is duplicate replay on restart
-		// which is safe because memtable overwrites are idempotent
-		fmt.Printf("Warning: failed to remove WAL: %v\n", err)
+	deleted := recordType == RecordTypeDelete
+	if err := db.updateIndexes(key, current.Value, found && !current.Deleted, value, !deleted); err != nil {
+		return err
 	}
 
-	newWAL, err := OpenWAL(walPath, db.opts.SyncWrites)
-	if err != nil {
+	// Check if memtable is full
+	if err := db.flushIfFull(); err != nil {
 		return err
 	}
-	db.wal = newWAL
 
 	return nil
 }
 
-// doFlush writes the immutable memtable to an SSTable
-func (db *DB) doFlush() error {
-	if db.immutable == nil {
-		return nil
+// apply logs one Put or Delete to the WAL and adds it to the memtable
+// Must be called with db.mu held; the caller checks whether to flush
+func (db *DB) apply(recordType byte, key, value []byte, ts uint64, forceSync bool) error {
+	if err := db.nextSequence(1); err != nil {
+		return err
 	}
 
-	// Generate SSTable path
-	sstPath := filepath.Join(db.opts.Dir, fmt.Sprintf("sst_%06d.sst", db.nextSSTableID))
-	db.nextSSTableID++
-
-	// Flush memtable to SSTable (uses atomic rename internally)
-	if err := FlushMemtableToSSTable(db.immutable, sstPath, db.opts.BloomBitsPerKey); err != nil {
-		return fmt.Errorf("flush failed: %w", err)
+	// Write to WAL first (for durability)
+	if err := db.wal.write(recordType, key, value, ts, forceSync); err != nil {
+		return db.dirError(fmt.Errorf("WAL write failed: %w", err))
 	}
 
-	// Open the new SSTable for reading
-	reader, err := OpenSSTable(sstPath, nil)
-	if err != nil {
-		return fmt.Errorf("failed to open new SSTable: %w", err)
+	// Write to memtable (a tombstone for deletes)
+	entry := &Entry{Key: key, Value: value, Timestamp: ts}
+	if recordType == RecordTypeDelete {
+		entry = &Entry{Key: key, Deleted: true, Timestamp: ts}
 	}
+	return db.memtable.PutEntry(entry)
+}
 
-	// Add to front of sstables list (newest first)
-	db.sstables = append([]*SSTableReader{reader}, db.sstables...)
-
-	// Clear immutable memtable
-	db.immutable = nil
+// DeleteMulti deletes many keys with one WAL write and one lock acquisition
+// If any key is empty or too large, nothing is deleted.
+func (db *DB) DeleteMulti(keys [][]byte) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
 
-	return nil
-}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return ErrEmptyKey
+		}
+		if err := db.checkEntrySize(key, nil); err != nil {
+			return err
+		}
+	}
 
-// Close closes the database
-func (db *DB) Close() error {
-	if db.closed.Swap(true) {
-		return nil // Already closed
+	if err := db.checkBusy(); err != nil {
+		return err
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	var firstErr error
-
-	// Flush any remaining data
-	if db.immutable != nil {
-		if err := db.doFlush(); err != nil {
-			firstErr = err
+	// Current values, to remove their secondary index entries
+	var current []Entry
+	if len(db.indexes) > 0 {
+		current = make([]Entry, len(keys))
+		for i, key := range keys {
+			entry, found, _, err := db.getEntry(key, true)
+			if err != nil {
+				return err
+			}
+			if found && !entry.Deleted {
+				current[i] = entry
+			}
 		}
 	}
 
-	// Close WAL
-	if db.wal != nil {
-		if err := db.wal.Close(); err != nil && firstErr == nil {
-			firstErr = err
+	if err := db.nextSequence(uint64(len(keys))); err != nil {
+		return err
+	}
+
+	// Write all tombstones to the WAL in one append
+	if err := db.wal.WriteDeleteBatch(keys); err != nil {
+		return db.dirError(fmt.Errorf("WAL write failed: %w", err))
+	}
+
+	for _, key := range keys {
+		if err := db.memtable.Delete(key); err != nil {
+			return err
 		}
 	}
 
-	// Close all SSTables
-	for _, sst := range db.sstables {
-		if err := sst.Close(); err != nil && firstErr == nil {
-			firstErr = err
+	for i, entry := range current {
+		if err := db.updateIndexes(keys[i], entry.Value, entry.Key != nil, nil, false); err != nil {
+			return err
 		}
 	}
 
-	return firstErr
-}
+	// Check once whether the batch filled the memtable
+	if err := db.flushIfFull(); err != nil {
+		return err
+	}
 
-// Stats returns database statistics
-type Stats struct {
-	MemtableSize   int64
-	ImmutableSize  int64
-	SSTableCount   int
-	TotalDiskUsage int64
+	return nil
 }
 
-func (db *DB) Stats() Stats {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-
-	stats := Stats{
-		MemtableSize: db.memtable.Size(),
-		SSTableCount: len(db.sstables),
+// checkEntrySize applies the configured key and value limits to a user
+// write, and rejects keys in the secondary index keyspace
+func (db *DB) checkEntrySize(key, value []byte) error {
+	if isIndexKey(key) {
+		return fmt.Errorf("%w: %q", ErrReservedKey, key)
 	}
-
-	if db.immutable != nil {
-		stats.ImmutableSize = db.immutable.Size()
+	maxKeySize, maxValueSize := db.opts.MaxKeySize, db.opts.MaxValueSize
+	if maxKeySize == 0 {
+		maxKeySize = MaxKeySize
 	}
-
+	if maxValueSize == 0 {
+		maxValueSize = MaxValueSize
+	}
+	return checkEntrySize(key, value, maxKeySize, maxValueSize)
+}
+
+// ReadOptions controls a single read or iterator
+// A nil *ReadOptions means the defaults: FillCache true.
+type ReadOptions struct {
+	// FillCache adds blocks read from disk to the block cache; turn it
+	// off for large scans so they don't evict blocks hot lookups need
+	FillCache bool
+
+	// ReadFromDiskOnly makes GetOpt skip the memtables and read only the
+	// SSTables, e.g. to check flushed data against what is in memory.
+	// Tombstones on disk still hide older values. Iterators ignore it.
+	ReadFromDiskOnly bool
+
+	// MaxSSTables bounds how many SSTables, newest first, GetOpt consults
+	// after the memtables, for a fast miss within a latency budget: a key
+	// only in older tables reads as ErrNotFound. Values that are found are
+	// always current (0 = all tables).
+	MaxSSTables int
+}
+
+// fillCache reports the FillCache setting, treating nil as the defaults
+func (o *ReadOptions) fillCache() bool {
+	return o == nil || o.FillCache
+}
+
+// diskOnly reports the ReadFromDiskOnly setting, treating nil as the defaults
+func (o *ReadOptions) diskOnly() bool {
+	return o != nil && o.ReadFromDiskOnly
+}
+
+// sstables returns the SSTables, newest first, that a read may consult
+func (o *ReadOptions) sstables(tables []*SSTableReader) []*SSTableReader {
+	if o != nil && o.MaxSSTables > 0 && o.MaxSSTables < len(tables) {
+		return tables[:o.MaxSSTables]
+	}
+	return tables
+}
+
+// checkBusy returns ErrBusy if writes shouldn't wait for the flush or
+// compaction currently holding the lock
+// Best effort: one that starts right after the check is still waited for.
+func (db *DB) checkBusy() error {
+	if db.opts.NonBlockingWrites && db.stalls.Load() > 0 {
+		return ErrBusy
+	}
+	return nil
+}
+
+// Get retrieves a value by key
+// Returns: (value, error)
+// Returns ErrNotFound if key doesn't exist
+// Returns nil value if key was deleted
+// The value is a copy the caller owns: it may be modified or kept, and
+// never changes as the DB writes, flushes, compacts or evicts blocks.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	return db.GetOpt(key, nil)
+}
+
+// GetOpt is Get with per-read options (nil = defaults)
+func (db *DB) GetOpt(key []byte, opts *ReadOptions) ([]byte, error) {
+	value, state, err := db.getExtended(key, opts)
+	if err != nil {
+		return nil, err
+	}
+	if state != KeyPresent {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// KeyState says whether a key is live, deleted, or was never written
+type KeyState int
+
+const (
+	KeyAbsent  KeyState = iota // No version of the key exists
+	KeyPresent                 // Newest version is a value
+	KeyDeleted                 // Newest version is a tombstone
+)
+
+func (s KeyState) String() string {
+	switch s {
+	case KeyPresent:
+		return "present"
+	case KeyDeleted:
+		return "deleted"
+	default:
+		return "absent"
+	}
+}
+
+// GetExtended is like Get but tells a deleted key apart from one that was
+// never written. err is only set for failures (closed DB, corruption);
+// a missing key is reported as KeyAbsent with a nil error.
+func (db *DB) GetExtended(key []byte) ([]byte, KeyState, error) {
+	return db.getExtended(key, nil)
+}
+
+// getExtended is GetExtended with read options (nil = defaults)
+func (db *DB) getExtended(key []byte, opts *ReadOptions) ([]byte, KeyState, error) {
+	if db.closed.Load() {
+		return nil, KeyAbsent, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var entry Entry
+	var found bool
+	if !opts.diskOnly() {
+		entry, found = db.getMemtableEntry(key)
+	}
+	var depth int
+	var err error
+	if !found {
+		entry, found, depth, err = db.getSSTableEntry(opts.sstables(db.sstables), key, opts.fillCache())
+	}
+	db.readAmp.record(depth)
+	if err != nil || !found {
+		return nil, KeyAbsent, err
+	}
+	return resolveKeyState(entry.Value, entry.Deleted)
+}
+
+// Result is the outcome of one lookup in GetAll
+type Result struct {
+	Value []byte
+	Found bool // False if the key is absent or deleted
+}
+
+// GetAll looks up many keys under one read lock, so the results are a
+// consistent view. Results line up index-for-index with keys, including
+// duplicates.
+func (db *DB) GetAll(keys [][]byte) ([]Result, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		entry, found, depth, err := db.getEntry(key, true)
+		db.readAmp.record(depth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get key %d: %w", i, err)
+		}
+		if found && !entry.Deleted {
+			results[i] = Result{Value: entry.Value, Found: true}
+		}
+	}
+	return results, nil
+}
+
+// GetWithTimestamp is Get that also returns the value's timestamp
+// (0 if it was written without one)
+func (db *DB) GetWithTimestamp(key []byte) ([]byte, uint64, error) {
+	if db.closed.Load() {
+		return nil, 0, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entry, found, depth, err := db.getEntry(key, true)
+	db.readAmp.record(depth)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found || entry.Deleted {
+		return nil, 0, ErrNotFound
+	}
+	return entry.Value, entry.Timestamp, nil
+}
+
+// getEntry returns the newest version of key, tombstones included, and the
+// number of SSTables it descended through. The value is the caller's own
+// copy (see Get).
+// Must be called with db.mu held
+func (db *DB) getEntry(key []byte, fillCache bool) (Entry, bool, int, error) {
+	// 1. Check the memtables (newest data)
+	if entry, found := db.getMemtableEntry(key); found {
+		return entry, true, 0, nil
+	}
+
+	// 2. Check SSTables (newest to oldest)
+	return db.getSSTableEntry(db.sstables, key, fillCache)
+}
+
+// getMemtableEntry looks key up in the active memtable, then the
+// immutable one
+// Must be called with db.mu held
+func (db *DB) getMemtableEntry(key []byte) (Entry, bool) {
+	if entry, found := db.memtable.GetEntry(key); found {
+		return ownedEntry(entry), true
+	}
+	if db.immutable != nil {
+		if entry, found := db.immutable.GetEntry(key); found {
+			return ownedEntry(entry), true
+		}
+	}
+	return Entry{}, false
+}
+
+// getSSTableEntry looks key up in tables only, which are newest first
+// Must be called with db.mu held
+func (db *DB) getSSTableEntry(tables []*SSTableReader, key []byte, fillCache bool) (Entry, bool, int, error) {
+	// Use bloom filter to skip SSTables that definitely don't have the key
+	depth := 0
+	for _, sst := range tables {
+		depth++
+
+		// Bloom filter check: skip if key definitely not in this SSTable
+		if !sst.MayContain(key) {
+			continue
+		}
+
+		entry, found, err := sst.lookupEntry(key, fillCache)
+		if err != nil {
+			return Entry{}, false, depth, err
+		}
+		if found {
+			return entry, true, depth, nil
+		}
+	}
+
+	return Entry{}, false, depth, nil
+}
+
+// ownedEntry copies a memtable entry's value, which is shared with the
+// memtable and the writer's buffer. SSTable lookups already copy values
+// out of cached blocks (see searchBlock).
+func ownedEntry(entry Entry) Entry {
+	entry.Value = bytes.Clone(entry.Value)
+	return entry
+}
+
+// resolveKeyState maps the newest version of a key to GetExtended's result
+func resolveKeyState(value []byte, deleted bool) ([]byte, KeyState, error) {
+	if deleted {
+		return nil, KeyDeleted, nil
+	}
+	return value, KeyPresent, nil
+}
+
+// RotateMemtable seals the active memtable as immutable and starts a
+// fresh one with its own WAL, without flushing: the sealed memtable keeps
+// serving reads until the next flush (a full memtable, FlushInterval,
+// Compact, or another rotation) writes it out. Only one memtable can be
+// sealed at a time, so one sealed earlier is flushed first. An empty
+// memtable is left alone.
+func (db *DB) RotateMemtable() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.memtable.Count() == 0 {
+		return nil
+	}
+	return db.rotateMemtable()
+}
+
+// triggerFlush flushes the memtable to an SSTable
+// Must be called with db.mu held
+func (db *DB) triggerFlush() error {
+	if err := db.rotateMemtable(); err != nil {
+		return db.dirError(err)
+	}
+	return db.dirError(db.flushImmutable(false))
+}
+
+// triggerFlushUnlocked is triggerFlush with db.mu released while the
+// SSTables are written, so reads, and writes to the new memtable, go on
+// during the flush I/O. Callers must not rely on anything they read under
+// db.mu before the call.
+// Must be called with db.mu held
+func (db *DB) triggerFlushUnlocked() error {
+	if err := db.rotateMemtable(); err != nil {
+		return db.dirError(err)
+	}
+	return db.dirError(db.flushImmutable(true))
+}
+
+// flushIfFull flushes the memtable with triggerFlushUnlocked once it is
+// full. A writer that fills it while another flush is writing waits for
+// that flush, then checks again: the first writer to wake flushes the
+// memtable, and the rest would otherwise each flush the nearly empty one
+// that replaced it.
+// Must be called with db.mu held
+func (db *DB) flushIfFull() error {
+	if !db.memtable.IsFull() {
+		return nil
+	}
+	db.waitForFlush()
+	if !db.memtable.IsFull() {
+		return nil
+	}
+	return db.triggerFlushUnlocked()
+}
+
+// waitForFlush waits until no flush is writing SSTables with db.mu
+// released, so the caller can change the SSTables
+// Must be called with db.mu held (for writing)
+func (db *DB) waitForFlush() {
+	for db.flushing {
+		db.flushDone.Wait()
+	}
+}
+
+// dirError reports err as ErrDirectoryMissing if the data directory has
+// been removed. It is never re-created here: tables written to a fresh
+// directory would be orphaned from the ones that were lost.
+func (db *DB) dirError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, statErr := db.fs.Stat(db.opts.Dir); os.IsNotExist(statErr) {
+		return fmt.Errorf("%w: %s: %w", ErrDirectoryMissing, db.opts.Dir, err)
+	}
+	return err
+}
+
+// immutableWALPath is where the immutable memtable's WAL waits for its flush
+func (db *DB) immutableWALPath() string {
+	return filepath.Join(db.opts.Dir, "wal.immutable.log")
+}
+
+// rotateMemtable makes the memtable immutable and moves its WAL aside,
+// starting a new memtable and WAL. Open replays both WALs, so a crash
+// before the flush loses nothing.
+// Must be called with db.mu held
+func (db *DB) rotateMemtable() error {
+	// Only one memtable can wait for a flush
+	if db.immutable != nil {
+		if err := db.flushImmutable(false); err != nil {
+			return err
+		}
+	}
+
+	walPath := db.wal.Path()
+	firstWrite := db.wal.oldestRecordTime()
+	if err := db.wal.Close(); err != nil {
+		return fmt.Errorf("failed to close WAL: %w", err)
+	}
+	if err := db.fs.Rename(walPath, db.immutableWALPath()); err != nil {
+		// Keep writing to the old WAL; the memtable stays active
+		if wal, reopenErr := db.openWAL(walPath); reopenErr == nil {
+			wal.firstWrite = firstWrite
+			db.wal = wal
+		}
+		return fmt.Errorf("failed to rotate WAL: %w", err)
+	}
+	newWAL, err := db.openWAL(walPath)
+	if err != nil {
+		return err
+	}
+	db.wal = newWAL
+	db.immutableWALStart = firstWrite
+
+	db.memtable.SetImmutable()
+	db.immutable = db.memtable
+	db.memtable = db.newMemtable()
+	return nil
+}
+
+// flushImmutable flushes the immutable memtable, then deletes its WAL
+// unlock is passed on to writeSSTables.
+// Must be called with db.mu held
+func (db *DB) flushImmutable(unlock bool) error {
+	if err := db.doFlush(unlock); err != nil {
+		return err
+	}
+
+	// Now safe to remove the WAL (data is in SSTables). If that fails,
+	// replaying it over the tables on restart is harmless.
+	db.retireWAL(db.immutableWALPath())
+	db.immutableWALStart = time.Time{}
+	return nil
+}
+
+// retireWAL deletes a flushed memtable's WAL, or keeps it as the newest
+// WAL segment (see KeepRecentWALSegments), then deletes all but the
+// newest KeepRecentWALSegments segments
+// Must be called with db.mu held
+func (db *DB) retireWAL(path string) {
+	ids := db.walSegmentIDs()
+	if db.opts.KeepRecentWALSegments > 0 {
+		next := uint64(1)
+		if len(ids) > 0 {
+			next = ids[len(ids)-1] + 1
+		}
+		err := db.fs.Rename(path, db.walSegmentPath(next))
+		if err == nil {
+			ids = append(ids, next)
+		} else if !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to keep WAL segment: %v\n", err)
+		}
+	} else if err := db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Warning: failed to remove WAL: %v\n", err)
+	}
+
+	for len(ids) > db.opts.KeepRecentWALSegments {
+		if err := db.fs.Remove(db.walSegmentPath(ids[0])); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Warning: failed to remove WAL segment: %v\n", err)
+		}
+		ids = ids[1:]
+	}
+}
+
+// walSegmentPath returns the path of kept WAL segment id
+func (db *DB) walSegmentPath(id uint64) string {
+	return filepath.Join(db.opts.Dir, fmt.Sprintf("wal_%06d.log", id))
+}
+
+// walSegmentIDs returns the IDs of the kept WAL segments, oldest first
+func (db *DB) walSegmentIDs() []uint64 {
+	files, _ := db.fs.Glob(filepath.Join(db.opts.Dir, "wal_*.log"))
+	var ids []uint64
+	for _, f := range files {
+		base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "wal_"), ".log")
+		if id, err := strconv.ParseUint(base, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// newMemtable creates an empty memtable with the configured backend
+func (db *DB) newMemtable() *Memtable {
+	backend := newMemtableBackend(db.opts.MemtableType, db.opts.SkipListMaxLevel)
+	return NewMemtableWithBackend(db.opts.MemtableSize, backend)
+}
+
+// nextSSTablePath reserves the next SSTable ID and returns its path for a
+// table at level, named as SSTableNaming says
+func (db *DB) nextSSTablePath(level int) string {
+	name := fmt.Sprintf("sst_%06d.sst", db.nextSSTableID)
+	if db.opts.SSTableNaming == SSTableNameLevel {
+		name = fmt.Sprintf("sst_L%d_%06d.sst", level, db.nextSSTableID)
+	}
+	db.nextSSTableID++
+	return filepath.Join(db.opts.Dir, name)
+}
+
+// openSSTable opens an SSTable attached to the DB's block cache
+func (db *DB) openSSTable(path string) (*SSTableReader, error) {
+	reader, err := openSSTable(db.fs, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	reader.cache = db.cache
+	reader.SetPrefixExtractor(db.opts.PrefixExtractor)
+	return reader, nil
+}
+
+// openWAL opens the WAL with the DB's sync settings
+func (db *DB) openWAL(path string) (*WAL, error) {
+	wal, err := openWAL(db.fs, path, db.opts.SyncWrites)
+	if err != nil {
+		return nil, err
+	}
+	wal.SetSyncBytes(db.opts.WALSyncBytes)
+	return wal, nil
+}
+
+// doFlush writes the immutable memtable to SSTables and publishes them
+func (db *DB) doFlush(unlock bool) error {
+	// Another flush may have taken the immutable memtable already
+	db.waitForFlush()
+	if db.immutable == nil {
+		return nil
+	}
+
+	// Writers only wait while db.mu is held: for the whole flush, or with
+	// unlock just while the tables are published
+	if !unlock {
+		db.stalls.Add(1)
+		defer db.stalls.Add(-1)
+	}
+
+	purged := db.tombstonesPurged
+	paths, err := db.writeSSTables(unlock)
+	if err != nil {
+		return err
+	}
+	if unlock {
+		db.stalls.Add(1)
+		defer db.stalls.Add(-1)
+	}
+	if err := db.publishSSTables(paths, db.tombstonesPurged > purged); err != nil {
+		return err
+	}
+	db.lastFlush = time.Now()
+	return nil
+}
+
+// flushTimer flushes the memtable whenever FlushInterval has passed since
+// the last flush and it holds anything, until Close
+func (db *DB) flushTimer() {
+	timer := time.NewTimer(db.opts.FlushInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-db.stop:
+			return
+		case <-timer.C:
+		}
+
+		db.mu.Lock()
+		db.waitForFlush() // Counts as a flush since the timer was set
+		next := db.opts.FlushInterval
+		if !db.closed.Load() {
+			// A flush since the timer was set restarts the interval
+			if wait := time.Until(db.lastFlush.Add(db.opts.FlushInterval)); wait > 0 {
+				next = wait
+			} else if db.memtable.Count() > 0 {
+				if err := db.triggerFlushUnlocked(); err != nil {
+					fmt.Printf("Warning: timed flush failed: %v\n", err)
+				}
+			}
+		}
+		db.mu.Unlock()
+		timer.Reset(next)
+	}
+}
+
+// writeSSTables is the first phase of a flush: it writes the immutable
+// memtable to finished SSTables that are still under temp names, without
+// touching the DB's state. Open deletes temp files, so a crash before
+// publishSSTables leaves the data only in the WAL, as before the flush.
+// With unlock, db.mu is released while the tables are written: the
+// immutable memtable no longer changes, and the SSTables can't either
+// until the flush is done (see waitForFlush), which also keeps its table
+// IDs the newest.
+// Must be called with db.mu held
+func (db *DB) writeSSTables(unlock bool) ([]string, error) {
+	mem, tables := db.immutable, db.sstables
+	var purge func(key []byte) bool
+	var purged uint64
+	if db.opts.PurgeTombstonesOnFlush {
+		// A tombstone hides nothing if no SSTable may hold its key
+		purge = func(key []byte) bool {
+			if anyMayHold(tables, key) {
+				return false
+			}
+			purged++
+			return true
+		}
+	}
+	nextPath := func() string { return db.nextSSTablePath(flushLevel) }
+	if unlock {
+		db.flushing = true
+		db.mu.Unlock()
+		nextPath = func() string {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			return db.nextSSTablePath(flushLevel)
+		}
+	}
+	paths, err := flushMemtableToSSTables(mem, db.opts.TargetFileSize, nextPath, purge, db.sstableOptions())
+	if unlock {
+		db.mu.Lock()
+		db.flushing = false
+		db.flushDone.Broadcast()
+	}
+	db.tombstonesPurged += purged
+	if err != nil {
+		return nil, fmt.Errorf("flush failed: %w", err)
+	}
+	return paths, nil
+}
+
+// publishSSTables is the second phase of a flush: it renames the tables
+// from writeSSTables into place, which is what makes Open adopt them, then
+// adds them to the read path and retires the immutable memtable. A crash
+// after a rename leaves the table's data both in it and in the WAL until
+// the caller deletes the WAL; replaying the WAL over it is harmless.
+// purged says whether writeSSTables left tombstones out.
+// Must be called with db.mu held
+func (db *DB) publishSSTables(paths []string, purged bool) error {
+	// A purged tombstone takes the key's earlier versions in this memtable
+	// with it; raise the floor before the tables become durable
+	if purged && db.immutable.seqs != nil {
+		if err := db.raiseHistoryFloor(db.immutable.seqs.max); err != nil {
+			for _, p := range paths {
+				db.fs.Remove(p + ".tmp")
+			}
+			return err
+		}
+	}
+
+	if err := publishTables(db.fs, paths); err != nil {
+		return fmt.Errorf("flush failed: %w", err)
+	}
+
+	// Open the new SSTables for reading. Their key ranges don't overlap, so
+	// their relative order only has to match the ID order Open uses.
+	readers := make([]*SSTableReader, len(paths))
+	for i, path := range paths {
+		reader, err := db.openSSTable(path)
+		if err != nil {
+			for _, r := range readers[:i] {
+				r.Close()
+			}
+			return fmt.Errorf("failed to open new SSTable: %w", err)
+		}
+		readers[len(paths)-1-i] = reader
+	}
+
+	db.checkSkipListSaturation(db.immutable)
+
+	// Add to front of sstables list (newest first)
+	db.sstables = append(readers, db.sstables...)
+	if db.compactionWake != nil && len(db.sstables) >= db.opts.CompactionTrigger {
+		db.wakeCompaction()
+	}
+
+	// Clear immutable memtable
+	db.immutable = nil
+
+	// No other flush or compaction runs while we hold db.mu, so any
+	// temp file left now is an orphan from an earlier failure
+	db.cleanupTempFiles()
+
+	return nil
+}
+
+// skipListSaturationFlushes is how many flushes in a row must reach the
+// skip list's max level before checkSkipListSaturation warns
+const skipListSaturationFlushes = 3
+
+// checkSkipListSaturation warns once flushed memtables keep filling their
+// skip list to its max level, where lookups start to slow down
+// Must be called with db.mu held
+func (db *DB) checkSkipListSaturation(mem *Memtable) {
+	sl := mem.skipList()
+	if sl == nil || sl.Level() < sl.MaxLevel() {
+		db.saturatedFlushes = 0
+		return
+	}
+
+	db.saturatedFlushes++
+	if db.saturatedFlushes == skipListSaturationFlushes {
+		fmt.Printf("Warning: the last %d memtables reached the skip list max level %d; use a smaller MemtableSize or a larger SkipListMaxLevel\n",
+			skipListSaturationFlushes, sl.MaxLevel())
+	}
+}
+
+// anyMayHold reports whether any of tables may hold key, going by their
+// key ranges and bloom filters
+func anyMayHold(tables []*SSTableReader, key []byte) bool {
+	for _, sst := range tables {
+		// Count unreadable index partitions as holding the key
+		if idx, err := sst.findBlock(key); (err != nil || idx >= 0) && sst.MayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForceFlushAndReload flushes the memtable and reopens every SSTable from
+// disk, dropping any in-memory index or bloom state, so later reads go
+// through the on-disk format only. Meant for tests that want to catch
+// serialization bugs. It fails while snapshots or iterators are open,
+// since they pin the readers it would close.
+func (db *DB) ForceFlushAndReload() error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitForFlush()
+
+	if len(db.pins) > 0 {
+		return fmt.Errorf("cannot reload SSTables while snapshots or iterators are open")
+	}
+
+	if db.memtable.Count() > 0 {
+		if err := db.triggerFlush(); err != nil {
+			return err
+		}
+	}
+
+	for i, sst := range db.sstables {
+		path := sst.Path()
+		if err := sst.Close(); err != nil {
+			return fmt.Errorf("failed to close %s: %w", path, err)
+		}
+
+		reader, err := db.openSSTable(path)
+		if err != nil {
+			// Drop the closed reader so Close doesn't touch it again
+			db.sstables = append(db.sstables[:i], db.sstables[i+1:]...)
+			return fmt.Errorf("failed to reopen %s: %w", path, err)
+		}
+		db.sstables[i] = reader
+	}
+
+	return nil
+}
+
+// sstableOptions returns the settings used to write new SSTables
+func (db *DB) sstableOptions() sstableOptions {
+	return sstableOptions{
+		fs:               db.fs,
+		bitsPerKey:       db.opts.BloomBitsPerKey,
+		preallocate:      db.opts.PreallocateSSTables,
+		partitionEntries: db.opts.IndexPartitionEntries,
+		bloomHasher:      db.opts.BloomHasher,
+		blockAlignment:   db.opts.BlockAlignment,
+		paranoidBloom:    db.opts.ParanoidBloom,
+		prefixExtractor:  db.opts.PrefixExtractor,
+		directIO:         db.opts.DirectIO,
+		valueDictSize:    db.opts.ValueDictionarySize,
+		packedTombstones: db.opts.PackedTombstones,
+	}
+}
+
+// Close closes the database
+func (db *DB) Close() error {
+	if db.closed.Swap(true) {
+		return nil // Already closed
+	}
+
+	// Stop background goroutines before taking the lock they need
+	close(db.stop)
+	db.background.Wait()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var firstErr error
+
+	// Flush any remaining data, waiting out a flush in progress
+	if db.immutable != nil {
+		if err := db.flushImmutable(false); err != nil {
+			firstErr = err
+		}
+	}
+
+	// Tidy the on-disk layout; a failure here must not block shutdown
+	if db.opts.CompactOnClose && db.wal != nil && firstErr == nil {
+		if err := db.compactAll(); err != nil {
+			fmt.Printf("Warning: compaction on close failed: %v\n", err)
+		}
+	}
+
+	// Close WAL
+	if db.wal != nil {
+		if err := db.wal.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Close all SSTables, including compacted ones still pinned by
+	// snapshots (their files are left for the next compaction)
+	for _, sst := range append(db.sstables, db.obsolete...) {
+		if err := sst.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Release the directory lock last
+	if db.lock != nil {
+		if err := db.lock.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Stats returns database statistics
+type Stats struct {
+	MemtableSize   int64 `json:"memtable_size"`
+	MemtableMemory int64 `json:"memtable_memory"` // MemtableSize plus skip list overhead
+	ImmutableSize  int64 `json:"immutable_size"`
+	SSTableCount   int   `json:"sstable_count"`
+	TotalDiskUsage int64 `json:"total_disk_usage"`
+
+	// ReadAmplification is a moving average of the SSTables consulted
+	// per Get (including ones skipped by the bloom filter)
+	ReadAmplification float64 `json:"read_amplification"`
+
+	// CompactionScore is the score of the best run of SSTables to merge
+	// (0 = nothing worth compacting, up to 2 for fully overlapping garbage)
+	CompactionScore float64 `json:"compaction_score"`
+
+	// WALSizeBytes is the size of the WAL, i.e. the unflushed data replayed
+	// on recovery, and WALOldestRecordAge how long its oldest record has
+	// waited for a flush (0 = empty). Records recovered at Open are aged
+	// from Open.
+	WALSizeBytes       int64         `json:"wal_size_bytes"`
+	WALOldestRecordAge time.Duration `json:"wal_oldest_record_age"`
+
+	// TombstonesPurged counts tombstones left out of flushes since Open
+	// (see PurgeTombstonesOnFlush)
+	TombstonesPurged uint64 `json:"tombstones_purged"`
+
+	// SkipListLevel is the height of the tallest node in the active
+	// memtable's skip list, up to SkipListMaxLevel (0 for MemtableBTree)
+	SkipListLevel int `json:"skiplist_level"`
+
+	// CompactionPaused is set between PauseCompaction and ResumeCompaction
+	CompactionPaused bool `json:"compaction_paused"`
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.stats()
+}
+
+// statsJSON is what StatsJSON encodes: Stats plus derived fields
+type statsJSON struct {
+	Stats
+	EstimatedDeadBytes int64        `json:"estimated_dead_bytes"`
+	DeadBytesRatio     float64      `json:"dead_bytes_ratio"` // Of TotalDiskUsage
+	Tables             []TableStats `json:"tables"`           // Estimated (see summaryTableStats)
+}
+
+// StatsJSON returns Stats as JSON for monitoring, together with per-table
+// stats and the dead-byte totals derived from them. The per-table stats
+// are estimated from each table's summary and index, so a scrape never
+// reads data blocks; TableStats scans the tables for exact figures.
+func (db *DB) StatsJSON() ([]byte, error) {
+	db.mu.RLock()
+	out := statsJSON{Stats: db.stats()}
+	tables, err := db.summaryTableStats()
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	out.Tables = tables
+
+	for _, ts := range out.Tables {
+		out.EstimatedDeadBytes += ts.EstimatedDeadBytes
+	}
+	if out.TotalDiskUsage > 0 {
+		out.DeadBytesRatio = float64(out.EstimatedDeadBytes) / float64(out.TotalDiskUsage)
+	}
+
+	return json.Marshal(out)
+}
+
+// stats computes Stats
+// Must be called with db.mu held
+func (db *DB) stats() Stats {
+	stats := Stats{
+		MemtableSize:      db.memtable.Size(),
+		MemtableMemory:    db.memtable.MemoryUsage(),
+		SSTableCount:      len(db.sstables),
+		ReadAmplification: db.readAmp.value(),
+		CompactionScore:   db.pickCompaction().score,
+		TombstonesPurged:  db.tombstonesPurged,
+		CompactionPaused:  db.compactionPaused.Load(),
+	}
+
+	if sl := db.memtable.skipList(); sl != nil {
+		stats.SkipListLevel = sl.Level()
+	}
+
+	if db.immutable != nil {
+		stats.ImmutableSize = db.immutable.Size()
+	}
+
+	if db.wal != nil {
+		if info, err := db.fs.Stat(db.wal.Path()); err == nil {
+			stats.WALSizeBytes = info.Size()
+		}
+		if oldest := db.wal.oldestRecordTime(); !oldest.IsZero() {
+			stats.WALOldestRecordAge = time.Since(oldest)
+		}
+	}
+	if db.immutable != nil {
+		if info, err := db.fs.Stat(db.immutableWALPath()); err == nil {
+			stats.WALSizeBytes += info.Size()
+		}
+		if !db.immutableWALStart.IsZero() {
+			stats.WALOldestRecordAge = time.Since(db.immutableWALStart)
+		}
+	}
+
 	// Calculate disk usage
 	for _, sst := range db.sstables {
-		if info, err := os.Stat(sst.Path()); err == nil {
+		if info, err := db.fs.Stat(sst.Path()); err == nil {
 			stats.TotalDiskUsage += info.Size()
 		}
 	}
 
 	return stats
 }
+
+// readAmpWeight is how much each Get moves the read amplification average
+const readAmpWeight = 1.0 / 64
+
+// readAmpTracker keeps an exponential moving average of Get depth
+// It is lock-free so concurrent readers only pay for one CAS
+type readAmpTracker struct {
+	bits atomic.Uint64 // math.Float64bits of the average
+}
+
+func (t *readAmpTracker) record(depth int) {
+	for {
+		old := t.bits.Load()
+		avg := math.Float64frombits(old)
+		avg += (float64(depth) - avg) * readAmpWeight
+		if t.bits.CompareAndSwap(old, math.Float64bits(avg)) {
+			return
+		}
+	}
+}
+
+func (t *readAmpTracker) value() float64 {
+	return math.Float64frombits(t.bits.Load())
+}
+
+// TableStats describes a single SSTable for compaction planning
+type TableStats struct {
+	Path               string    `json:"path"`
+	TotalBytes         int64     `json:"total_bytes"`          // File size on disk
+	EstimatedDeadBytes int64     `json:"estimated_dead_bytes"` // Bytes in tombstones and shadowed entries
+	KeyCount           int       `json:"key_count"`            // Entries in the table (including tombstones)
+	SmallestKey        []byte    `json:"smallest_key"`         // First key in the table (nil if empty)
+	LargestKey         []byte    `json:"largest_key"`          // Last key in the table (nil if empty)
+	CreatedAt          time.Time `json:"created_at"`           // When the table was written (zero if unknown)
+	Preserved          bool      `json:"preserved"`            // Overlaps PreserveRanges, so never compacted
+	Level              int       `json:"level"`                // From the file name (0 for plain names)
+}
+
+// TableStats returns per-SSTable live/dead byte estimates (newest first)
+// An entry is dead if it is a tombstone or its key is shadowed by a newer
+// memtable or SSTable. Newer SSTables are checked via key range and bloom
+// filter only, so the estimate may overcount on bloom false positives.
+// It reads every table in full, bypassing the block cache.
+func (db *DB) TableStats() ([]TableStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.tableStats()
+}
+
+// tableStats computes TableStats for every SSTable
+// Must be called with db.mu held
+func (db *DB) tableStats() ([]TableStats, error) {
+	result := make([]TableStats, 0, len(db.sstables))
+	for i, sst := range db.sstables {
+		ts := TableStats{Path: sst.Path(), CreatedAt: sst.CreatedAt()}
+		ts.Level, _, _ = parseSSTableName(sst.Path())
+		if info, err := db.fs.Stat(sst.Path()); err == nil {
+			ts.TotalBytes = info.Size()
+		}
+
+		// A stats scan must not evict the blocks point lookups keep hot
+		iter := sst.NewIterator()
+		iter.SetFillCache(false)
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			// Copied, since the iterator reuses its block buffer
+			if ts.KeyCount == 0 {
+				ts.SmallestKey = bytes.Clone(iter.Key())
+			}
+			ts.LargestKey = append(ts.LargestKey[:0], iter.Key()...)
+			ts.KeyCount++
+			if iter.IsDeleted() || db.isShadowed(iter.Key(), db.sstables[:i]) {
+				// Same encoding as SSTableWriter.Add: [keyLen:4][valueLen:4][deleted:1][key][value]
+				ts.EstimatedDeadBytes += int64(4 + 4 + 1 + len(iter.Key()) + len(iter.Value()))
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", sst.Path(), err)
+		}
+
+		ts.Preserved = db.isPreserved(ts.SmallestKey, ts.LargestKey)
+		result = append(result, ts)
+	}
+
+	return result, nil
+}
+
+// summaryTableStats estimates TableStats from the compaction picker's
+// cached metadata (see pickMetadata). Dead bytes are the entries a table
+// likely shares with the next newer one; tombstones aren't counted.
+// Must be called with db.mu held
+func (db *DB) summaryTableStats() ([]TableStats, error) {
+	db.pickMu.Lock()
+	tables, pairs, err := db.pickMetadata()
+	db.pickMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]TableStats, len(tables))
+	for i, t := range tables {
+		sst := db.sstables[i]
+		ts := TableStats{
+			Path:        sst.Path(),
+			TotalBytes:  t.size,
+			KeyCount:    int(t.keys),
+			SmallestKey: bytes.Clone(t.smallest),
+			LargestKey:  bytes.Clone(t.largest),
+			CreatedAt:   sst.CreatedAt(),
+			Preserved:   t.preserved,
+		}
+		ts.Level, _, _ = parseSSTableName(sst.Path())
+		if i > 0 {
+			ts.EstimatedDeadBytes = int64(pairs[i-1].deadBytes)
+		}
+		result[i] = ts
+	}
+	return result, nil
+}
+
+// SSTableInfo describes a live SSTable (see DB.SSTables)
+type SSTableInfo struct {
+	Path        string  `json:"path"`
+	ID          uint64  `json:"id"`            // From the file name
+	Level       int     `json:"level"`         // From the file name (0 for plain names)
+	KeyCount    uint64  `json:"key_count"`     // Entries in the table (including tombstones)
+	SizeBytes   int64   `json:"size_bytes"`    // File size on disk
+	FirstKey    []byte  `json:"first_key"`     // Smallest key (nil if empty)
+	LastKey     []byte  `json:"last_key"`      // Largest key (nil if empty)
+	BloomFPRate float64 `json:"bloom_fp_rate"` // Estimated false positive rate (1 = no filter)
+}
+
+// SSTables lists the live SSTables, newest first, from their metadata
+// Unlike TableStats it reads no data blocks, except for tables written
+// before summary blocks existed.
+func (db *DB) SSTables() []SSTableInfo {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	result := make([]SSTableInfo, 0, len(db.sstables))
+	for _, sst := range db.sstables {
+		info := SSTableInfo{Path: sst.Path(), BloomFPRate: 1}
+		info.Level, info.ID, _ = parseSSTableName(sst.Path())
+		info.SizeBytes = sst.size
+		if sst.summary != nil {
+			info.KeyCount = sst.summary.keyCount
+		} else if count, err := sst.approximateCount(nil, nil); err == nil {
+			info.KeyCount = uint64(count) // Exact without bounds
+		}
+		info.FirstKey, info.LastKey, _ = sst.keyRange()
+		info.FirstKey = bytes.Clone(info.FirstKey)
+		info.LastKey = bytes.Clone(info.LastKey)
+		if sst.bloomFilter != nil {
+			info.BloomFPRate = sst.bloomFilter.FalsePositiveRate()
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+// isShadowed reports whether key may have a newer version in the memtables
+// or in any of the given newer SSTables
+// Must be called with db.mu held
+func (db *DB) isShadowed(key []byte, newer []*SSTableReader) bool {
+	if _, _, found := db.memtable.Get(key); found {
+		return true
+	}
+	if db.immutable != nil {
+		if _, _, found := db.immutable.Get(key); found {
+			return true
+		}
+	}
+	for _, sst := range newer {
+		// Count unreadable index partitions as shadowing (overestimate)
+		if idx, err := sst.findBlockFill(key, false); (err != nil || idx >= 0) && sst.MayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// DumpMemtable returns a copy of the live keys held in memory (active and
+// immutable memtables), excluding tombstones and anything already flushed
+// It is a test helper so higher-level tests don't reach into DB internals;
+// it copies every entry and is not meant for production reads.
+func (db *DB) DumpMemtable() map[string][]byte {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	dump := make(map[string][]byte)
+	add := func(mem *Memtable) {
+		iter := mem.NewIterator()
+		defer iter.Close()
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if iter.IsDeleted() {
+				delete(dump, string(iter.Key()))
+				continue
+			}
+			dump[string(iter.Key())] = append([]byte(nil), iter.Value()...)
+		}
+	}
+
+	// Oldest first, so newer versions and tombstones override
+	if db.immutable != nil {
+		add(db.immutable)
+	}
+	add(db.memtable)
+	return dump
+}
@@ -1,11 +1,20 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestDBBasicOperations(t *testing.T) {
@@ -418,3 +427,1706 @@ func TestDBStats(t *testing.T) {
 		t.Error("Expected non-zero disk usage")
 	}
 }
+
+func TestDBParanoidChecks(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 512
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d_with_padding", i)))
+	}
+	db.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if len(files) == 0 {
+		t.Fatal("Expected at least one SSTable")
+	}
+
+	// Flip a byte inside the first data block
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	data[10] ^= 0xFF
+	if err := os.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	// Without paranoid checks the footer is fine, so Open succeeds
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Open without ParanoidChecks should succeed: %v", err)
+	}
+	db.Close()
+
+	// With paranoid checks the corrupted block is detected on Open
+	opts.ParanoidChecks = true
+	_, err = Open(opts)
+	if err == nil {
+		t.Fatal("Expected Open to fail with ParanoidChecks")
+	}
+	if !errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Expected ErrCorruptedData, got %v", err)
+	}
+}
+
+// forceFlush flushes the active memtable to a new SSTable
+func forceFlush(t *testing.T, db *DB) {
+	t.Helper()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.triggerFlush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+}
+
+func readTableStats(t *testing.T, db *DB) []TableStats {
+	t.Helper()
+	stats, err := db.TableStats()
+	if err != nil {
+		t.Fatalf("TableStats failed: %v", err)
+	}
+	return stats
+}
+
+func TestDBTableStats(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Older table: 20 keys
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("old_value_with_padding"))
+	}
+	forceFlush(t, db)
+
+	// Newer table: overwrites half of them plus one delete
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("new_value"))
+	}
+	db.Delete([]byte("key_015"))
+	forceFlush(t, db)
+
+	stats := readTableStats(t, db)
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 tables, got %d", len(stats))
+	}
+
+	newer, older := stats[0], stats[1]
+	if older.KeyCount != 20 {
+		t.Errorf("Expected 20 keys in older table, got %d", older.KeyCount)
+	}
+	if newer.KeyCount != 11 {
+		t.Errorf("Expected 11 keys in newer table, got %d", newer.KeyCount)
+	}
+	if older.TotalBytes == 0 || newer.TotalBytes == 0 {
+		t.Error("Expected non-zero table sizes")
+	}
+
+	// Older table has 11 shadowed entries; newer table only has its tombstone
+	if older.EstimatedDeadBytes <= newer.EstimatedDeadBytes {
+		t.Errorf("Expected older table to have more dead bytes: older=%d, newer=%d",
+			older.EstimatedDeadBytes, newer.EstimatedDeadBytes)
+	}
+	if newer.EstimatedDeadBytes == 0 {
+		t.Error("Expected tombstone in newer table to count as dead bytes")
+	}
+}
+
+func TestDBStatsWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	if stats := db.Stats(); stats.WALSizeBytes != 0 || stats.WALOldestRecordAge != 0 {
+		t.Errorf("Expected an empty WAL, got %d bytes aged %v", stats.WALSizeBytes, stats.WALOldestRecordAge)
+	}
+
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value"))
+	}
+	time.Sleep(10 * time.Millisecond)
+	stats := db.Stats()
+	if stats.WALSizeBytes == 0 {
+		t.Error("Expected a non-empty WAL after writes")
+	}
+	if stats.WALOldestRecordAge < 10*time.Millisecond {
+		t.Errorf("Expected the oldest record to be at least 10ms old, got %v", stats.WALOldestRecordAge)
+	}
+
+	forceFlush(t, db)
+	if stats := db.Stats(); stats.WALSizeBytes != 0 || stats.WALOldestRecordAge != 0 {
+		t.Errorf("Expected an empty WAL after flush, got %d bytes aged %v", stats.WALSizeBytes, stats.WALOldestRecordAge)
+	}
+
+	// Unflushed records survive a reopen and are aged from it
+	db.Put([]byte("key"), []byte("value"))
+	db.Close()
+	if db, err = Open(DefaultOptions(dir)); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if stats := db.Stats(); stats.WALSizeBytes == 0 || stats.WALOldestRecordAge == 0 {
+		t.Errorf("Expected recovered WAL records, got %d bytes aged %v", stats.WALSizeBytes, stats.WALOldestRecordAge)
+	}
+}
+
+func TestDBStatsJSON(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value"))
+	}
+	forceFlush(t, db)
+	db.Delete([]byte("key_000"))
+	forceFlush(t, db)
+	db.Put([]byte("pending"), []byte("in_memtable"))
+
+	data, err := db.StatsJSON()
+	if err != nil {
+		t.Fatalf("StatsJSON failed: %v", err)
+	}
+
+	var out map[string]any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", data, err)
+	}
+
+	for _, key := range []string{"memtable_size", "immutable_size", "total_disk_usage",
+		"read_amplification", "compaction_score", "estimated_dead_bytes", "dead_bytes_ratio"} {
+		if _, ok := out[key].(float64); !ok {
+			t.Errorf("Expected numeric %q in %s", key, data)
+		}
+	}
+	if count, _ := out["sstable_count"].(float64); count != 2 {
+		t.Errorf("Expected sstable_count 2, got %v", out["sstable_count"])
+	}
+	if size, _ := out["memtable_size"].(float64); size <= 0 {
+		t.Errorf("Expected positive memtable_size, got %v", out["memtable_size"])
+	}
+	if dead, _ := out["estimated_dead_bytes"].(float64); dead <= 0 {
+		t.Errorf("Expected dead bytes from the tombstone, got %v", out["estimated_dead_bytes"])
+	}
+
+	tables, _ := out["tables"].([]any)
+	if len(tables) != 2 {
+		t.Fatalf("Expected 2 tables, got %v", out["tables"])
+	}
+	if keys, _ := tables[1].(map[string]any)["key_count"].(float64); keys != 10 {
+		t.Errorf("Expected 10 keys in the older table, got %v", tables[1])
+	}
+
+	// Per-table stats come from table metadata, so a scrape never reads
+	// data blocks: corrupting one goes unnoticed
+	path := tables[1].(map[string]any)["path"].(string)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read table: %v", err)
+	}
+	raw[10] ^= 0xff
+	if err := os.WriteFile(path, raw, 0644); err != nil {
+		t.Fatalf("Failed to write table: %v", err)
+	}
+	if _, err := db.StatsJSON(); err != nil {
+		t.Errorf("Expected StatsJSON to skip data blocks, got %v", err)
+	}
+}
+
+func TestDBDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// A second Open on the same directory must fail while the first is open
+	if _, err := Open(DefaultOptions(dir)); !errors.Is(err, ErrAlreadyLocked) {
+		t.Fatalf("Expected ErrAlreadyLocked, got %v", err)
+	}
+
+	// Close releases the lock
+	db.Close()
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen DB after close: %v", err)
+	}
+	db.Close()
+}
+
+func TestDBDirectoryMissing(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	db.Put([]byte("key"), []byte("value"))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("Failed to remove directory: %v", err)
+	}
+
+	db.mu.Lock()
+	err = db.triggerFlush()
+	db.mu.Unlock()
+	if !errors.Is(err, ErrDirectoryMissing) {
+		t.Fatalf("Expected ErrDirectoryMissing from flush, got %v", err)
+	}
+	if err := db.Put([]byte("key2"), []byte("value")); !errors.Is(err, ErrDirectoryMissing) {
+		t.Errorf("Expected ErrDirectoryMissing from Put, got %v", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory to stay missing, got %v", err)
+	}
+	db.Close()
+
+	// Open re-creates it
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Errorf("Put after reopen failed: %v", err)
+	}
+}
+
+func TestDBGetExtended(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("present"), []byte("value"))
+	db.Put([]byte("flushed_deleted"), []byte("old"))
+	forceFlush(t, db)
+	db.Delete([]byte("flushed_deleted"))
+	forceFlush(t, db)
+	db.Put([]byte("deleted"), []byte("old"))
+	db.Delete([]byte("deleted"))
+
+	tests := []struct {
+		key   string
+		state KeyState
+		value string
+	}{
+		{"present", KeyPresent, "value"},
+		{"deleted", KeyDeleted, ""},
+		{"flushed_deleted", KeyDeleted, ""},
+		{"never_written", KeyAbsent, ""},
+	}
+
+	for _, tt := range tests {
+		value, state, err := db.GetExtended([]byte(tt.key))
+		if err != nil {
+			t.Fatalf("GetExtended(%s) failed: %v", tt.key, err)
+		}
+		if state != tt.state || string(value) != tt.value {
+			t.Errorf("GetExtended(%s): expected %v %q, got %v %q", tt.key, tt.state, tt.value, state, value)
+		}
+
+		// Plain Get still reports both deleted and absent as ErrNotFound
+		if _, err := db.Get([]byte(tt.key)); tt.state != KeyPresent && err != ErrNotFound {
+			t.Errorf("Get(%s): expected ErrNotFound, got %v", tt.key, err)
+		}
+	}
+}
+
+func TestDBReadAmplification(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// The key lives in the oldest of four tables
+	db.Put([]byte("deep"), []byte("value"))
+	forceFlush(t, db)
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("other_%d", i)), []byte("value"))
+		forceFlush(t, db)
+	}
+
+	if amp := db.Stats().ReadAmplification; amp != 0 {
+		t.Errorf("Expected 0 before any reads, got %f", amp)
+	}
+
+	for i := 0; i < 500; i++ {
+		if _, err := db.Get([]byte("deep")); err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+	}
+
+	amp := db.Stats().ReadAmplification
+	if amp <= 1 || amp > 4 {
+		t.Errorf("Expected read amplification in (1, 4], got %f", amp)
+	}
+}
+
+func TestDBForceFlushAndReload(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d", i)))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 100; i += 3 {
+		db.Delete([]byte(fmt.Sprintf("key_%03d", i)))
+	}
+	db.Put([]byte("empty"), []byte{})
+
+	before := append([]*SSTableReader(nil), db.sstables...)
+	if err := db.ForceFlushAndReload(); err != nil {
+		t.Fatalf("ForceFlushAndReload failed: %v", err)
+	}
+
+	// Everything is on disk, served by freshly opened readers
+	if db.memtable.Count() != 0 || db.immutable != nil {
+		t.Fatal("Expected memtables to be empty after reload")
+	}
+	for _, sst := range db.sstables {
+		for _, old := range before {
+			if sst == old {
+				t.Fatalf("Reader for %s was not reopened", sst.Path())
+			}
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key_%03d", i)
+		val, err := db.Get([]byte(key))
+		if i%3 == 0 {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be deleted, got %v", key, err)
+			}
+			continue
+		}
+		if err != nil || string(val) != fmt.Sprintf("value_%03d", i) {
+			t.Errorf("Expected %s=value_%03d, got %s (err=%v)", key, i, val, err)
+		}
+	}
+	if val, err := db.Get([]byte("empty")); err != nil || len(val) != 0 {
+		t.Errorf("Expected empty value, got %q (err=%v)", val, err)
+	}
+
+	// Held snapshots would lose their readers, so reload refuses
+	snap, _ := db.Snapshot()
+	if err := db.ForceFlushAndReload(); err == nil {
+		t.Error("Expected reload to fail while a snapshot is held")
+	}
+	snap.Release()
+
+	// So would open iterators
+	iter := db.NewIterator(nil, nil)
+	if err := db.ForceFlushAndReload(); err == nil {
+		t.Error("Expected reload to fail while an iterator is open")
+	}
+	iter.Close()
+	if err := db.ForceFlushAndReload(); err != nil {
+		t.Errorf("Expected reload to succeed once everything is closed: %v", err)
+	}
+}
+
+func TestDBBTreeMemtable(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 16 * 1024 // Several flushes
+	opts.MemtableType = MemtableBTree
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%04d", (i*7)%1000)), []byte(fmt.Sprintf("value_%04d", (i*7)%1000)))
+	}
+	for i := 0; i < 1000; i += 4 {
+		db.Delete([]byte(fmt.Sprintf("key_%04d", i)))
+	}
+	if db.Stats().SSTableCount == 0 {
+		t.Fatal("Expected the B-tree memtable to flush")
+	}
+
+	// Crash: the unflushed tail is recovered from the WAL into a B-tree
+	db.lock.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if _, ok := db.memtable.data.(btreeBackend); !ok {
+		t.Fatalf("Expected a B-tree memtable after recovery, got %T", db.memtable.data)
+	}
+
+	it := db.NewIterator(nil, nil)
+	defer it.Close()
+	count := 0
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if count != 750 {
+		t.Errorf("Expected 750 live keys, got %d", count)
+	}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key_%04d", i)
+		val, err := db.Get([]byte(key))
+		if i%4 == 0 {
+			if err != ErrNotFound {
+				t.Errorf("Expected %s to be deleted, got %v", key, err)
+			}
+			continue
+		}
+		if err != nil || string(val) != fmt.Sprintf("value_%04d", i) {
+			t.Errorf("Expected %s=value_%04d, got %s (err=%v)", key, i, val, err)
+		}
+	}
+}
+
+func TestDBSkipListSaturation(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.SkipListMaxLevel = 3
+	opts.MemtableSize = 32 * 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 500; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte("v"))
+	}
+	if got := db.Stats().SkipListLevel; got != 3 {
+		t.Errorf("Expected skip list level 3, got %d", got)
+	}
+
+	// Every flushed memtable reaches the cap
+	for i := 0; i < skipListSaturationFlushes; i++ {
+		forceFlush(t, db)
+		for j := 0; j < 500; j++ {
+			db.Put([]byte(fmt.Sprintf("key_%d_%04d", i, j)), []byte("v"))
+		}
+	}
+	db.mu.RLock()
+	saturated := db.saturatedFlushes
+	db.mu.RUnlock()
+	if saturated < skipListSaturationFlushes {
+		t.Errorf("Expected %d saturated flushes in a row, got %d", skipListSaturationFlushes, saturated)
+	}
+
+	opts.SkipListMaxLevel = MaxSkipListLevel + 1
+	if _, err := Open(opts); err == nil || !strings.Contains(err.Error(), "SkipListMaxLevel") {
+		t.Errorf("Expected Open to reject an out-of-range SkipListMaxLevel, got %v", err)
+	}
+}
+
+func TestDBTwoPhaseFlushCrash(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+
+	// crashAfter writes keys, runs the flush phases up to the given one,
+	// then drops the DB without Close or deleting the WAL
+	crashAfter := func(prefix string, publish bool) {
+		t.Helper()
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			db.Put([]byte(fmt.Sprintf("%s_%02d", prefix, i)), []byte("v"))
+		}
+
+		db.mu.Lock()
+		db.memtable.SetImmutable()
+		db.immutable, db.memtable = db.memtable, db.newMemtable()
+		paths, err := db.writeSSTables(false)
+		if err != nil {
+			t.Fatalf("writeSSTables failed: %v", err)
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("Expected %s unpublished before publishSSTables (err=%v)", path, err)
+			}
+			if _, err := os.Stat(path + ".tmp"); err != nil {
+				t.Fatalf("Expected finished temp file for %s: %v", path, err)
+			}
+		}
+		if publish {
+			if err := db.publishSSTables(paths, false); err != nil {
+				t.Fatalf("publishSSTables failed: %v", err)
+			}
+		}
+		db.mu.Unlock()
+		db.lock.Close()
+	}
+
+	tables := func() []string {
+		t.Helper()
+		files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+		return files
+	}
+
+	// Crash between the phases: the orphan is deleted, the WAL replayed
+	crashAfter("a", false)
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(tmp) != 0 {
+		t.Errorf("Expected orphaned temp tables removed, found %v", tmp)
+	}
+	if len(tables()) != 0 {
+		t.Errorf("Expected no SSTables, found %v", tables())
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("a_%02d", i))); err != nil {
+			t.Errorf("Key a_%02d lost: %v", i, err)
+		}
+	}
+	db.Close()
+
+	// Crash after publishing, before the WAL is deleted: the table is
+	// adopted and the WAL replays over it
+	crashAfter("b", true)
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if len(tables()) == 0 {
+		t.Error("Expected the published table to be adopted")
+	}
+	it := db.NewIterator([]byte("b"), []byte("c"))
+	defer it.Close()
+	count := 0
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if count != 10 {
+		t.Errorf("Expected 10 keys once each, got %d", count)
+	}
+}
+
+func TestDBEntrySizeLimits(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MaxKeySize = 16
+	opts.MaxValueSize = 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	atKey := bytes.Repeat([]byte("k"), 16)
+	atValue := bytes.Repeat([]byte("v"), 1024)
+
+	// Exactly at the limit is fine
+	if err := db.Put(atKey, atValue); err != nil {
+		t.Fatalf("Put at limit failed: %v", err)
+	}
+	if err := db.Delete(atKey); err != nil {
+		t.Fatalf("Delete at limit failed: %v", err)
+	}
+
+	// One byte over is rejected and nothing is written
+	if err := db.Put(append(atKey, 'k'), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := db.Put([]byte("small"), append(atValue, 'v')); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if err := db.Delete(append(atKey, 'k')); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge on Delete, got %v", err)
+	}
+	if _, err := db.Get([]byte("small")); err != ErrNotFound {
+		t.Errorf("Rejected Put should not be visible, got %v", err)
+	}
+
+	// Limits can only be lowered
+	bad := DefaultOptions(t.TempDir())
+	bad.MaxValueSize = MaxValueSize + 1
+	if _, err := Open(bad); err == nil {
+		t.Error("Expected Open to reject MaxValueSize above the hard limit")
+	}
+}
+
+func TestDBDeleteMulti(t *testing.T) {
+	dir := t.TempDir()
+	fs := &faultFS{}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	keys := make([][]byte, 500)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key_%03d", i))
+		db.Put(keys[i], []byte("value"))
+	}
+	db.Put([]byte("survivor"), []byte("value"))
+
+	// An empty key rejects the whole batch
+	if err := db.DeleteMulti([][]byte{keys[0], {}}); err != ErrEmptyKey {
+		t.Fatalf("Expected ErrEmptyKey, got %v", err)
+	}
+	if _, err := db.Get(keys[0]); err != nil {
+		t.Fatalf("No key should be deleted by a rejected batch: %v", err)
+	}
+
+	before := fs.walWrites.Load()
+	if err := db.DeleteMulti(keys); err != nil {
+		t.Fatalf("DeleteMulti failed: %v", err)
+	}
+	if writes := fs.walWrites.Load() - before; writes != 1 {
+		t.Errorf("Expected a single WAL write for the batch, got %d", writes)
+	}
+
+	for _, key := range keys {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("Expected %s to be deleted, got %v", key, err)
+		}
+	}
+	if _, err := db.Get([]byte("survivor")); err != nil {
+		t.Errorf("Unrelated key should survive: %v", err)
+	}
+
+	// The tombstones are durable in the WAL
+	db.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := db.Get(key); err != ErrNotFound {
+			t.Fatalf("Expected %s to stay deleted after reopen, got %v", key, err)
+		}
+	}
+	db.Close()
+}
+
+func TestDBWriteOptionsSync(t *testing.T) {
+	dir := t.TempDir()
+	fs := &faultFS{}
+	opts := DefaultOptions(dir)
+	opts.SyncWrites = false
+	opts.FS = fs
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// Default writes follow SyncWrites=false
+	db.Put([]byte("bulk"), []byte("value"))
+	if syncs := fs.walSyncs.Load(); syncs != 0 {
+		t.Fatalf("Expected no WAL syncs for plain writes, got %d", syncs)
+	}
+
+	if err := db.PutOpt([]byte("critical"), []byte("config"), &WriteOptions{Sync: true}); err != nil {
+		t.Fatalf("PutOpt failed: %v", err)
+	}
+	if syncs := fs.walSyncs.Load(); syncs != 1 {
+		t.Fatalf("Expected one WAL sync after synced Put, got %d", syncs)
+	}
+	if err := db.DeleteOpt([]byte("bulk"), &WriteOptions{Sync: true}); err != nil {
+		t.Fatalf("DeleteOpt failed: %v", err)
+	}
+	if syncs := fs.walSyncs.Load(); syncs != 2 {
+		t.Fatalf("Expected two WAL syncs after synced Delete, got %d", syncs)
+	}
+
+	// Simulate a crash: drop the lock without Close or any flush
+	db.lock.Close()
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	if val, err := db.Get([]byte("critical")); err != nil || string(val) != "config" {
+		t.Errorf("Expected synced write to survive, got %s (err=%v)", val, err)
+	}
+	if _, err := db.Get([]byte("bulk")); err != ErrNotFound {
+		t.Errorf("Expected synced delete to survive, got %v", err)
+	}
+}
+
+func TestDBCleanupTempFilesAfterFlush(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Orphans appear while the DB is running: one unrelated, and one
+	// with the exact name the next flush will use
+	orphan := filepath.Join(dir, "sst_999999.sst.tmp")
+	os.WriteFile(orphan, []byte("incomplete"), 0644)
+	next := filepath.Join(dir, fmt.Sprintf("sst_%06d.sst.tmp", db.nextSSTableID))
+	os.WriteFile(next, bytes.Repeat([]byte("x"), 10000), 0644)
+
+	db.Put([]byte("key"), []byte("value"))
+	forceFlush(t, db)
+
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.tmp")); len(files) > 0 {
+		t.Errorf("Temp files not cleaned up after flush: %v", files)
+	}
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Errorf("Expected flushed key to be readable, got %s (err=%v)", val, err)
+	}
+}
+
+func TestDBKeepRecentWALSegments(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.KeepRecentWALSegments = 2
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// Round 4 deletes what round 3 wrote
+	for round := 0; round < 5; round++ {
+		db.Put([]byte(fmt.Sprintf("round_%d", round)), []byte("value"))
+		if round == 4 {
+			db.Delete([]byte("round_3"))
+		}
+		forceFlush(t, db)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal_*.log"))
+	want := []string{filepath.Join(dir, "wal_000004.log"), filepath.Join(dir, "wal_000005.log")}
+	if !slices.Equal(segments, want) {
+		t.Fatalf("Expected segments %v, got %v", want, segments)
+	}
+
+	// The newest segment holds the last flushed memtable's writes
+	var keys []string
+	err = ReplayWAL(want[1], func(recordType byte, key, value []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil || !slices.Equal(keys, []string{"round_4", "round_3"}) {
+		t.Errorf("Expected round 4's writes in the newest segment, got %v (err=%v)", keys, err)
+	}
+
+	// Reopening ignores the segments, so the put in wal_000004.log
+	// doesn't come back over the flushed delete
+	db.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if _, err := db.Get([]byte("round_3")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected round_3 deleted after reopen, got %v", err)
+	}
+	if db.memtable.Count() != 0 {
+		t.Errorf("Expected nothing replayed into the memtable, got %d entries", db.memtable.Count())
+	}
+
+	// Segment IDs continue after a reopen, and 0 removes them all
+	db.Put([]byte("after_reopen"), []byte("value"))
+	forceFlush(t, db)
+	if segments, _ := filepath.Glob(filepath.Join(dir, "wal_*.log")); len(segments) != 2 || filepath.Base(segments[1]) != "wal_000006.log" {
+		t.Errorf("Expected wal_000006.log to be the newest of 2 segments, got %v", segments)
+	}
+	db.Close()
+
+	opts.KeepRecentWALSegments = 0
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	db.Put([]byte("unkept"), []byte("value"))
+	forceFlush(t, db)
+	if segments, _ := filepath.Glob(filepath.Join(dir, "wal_*.log")); len(segments) != 0 {
+		t.Errorf("Expected no segments with KeepRecentWALSegments 0, got %v", segments)
+	}
+}
+
+func TestDBWALSyncBytes(t *testing.T) {
+	dir := t.TempDir()
+	fs := &faultFS{}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+	opts.WALSyncBytes = 1000
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// 10-byte key + 69-byte value + 21 bytes of framing = 100 bytes
+	value := bytes.Repeat([]byte("v"), 69)
+	if size := walRecordSize([]byte("key_000000"), value); size != 100 {
+		t.Fatalf("Expected 100-byte records, got %d", size)
+	}
+
+	for i := 0; i < 25; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), value)
+	}
+
+	// Crossed 1000 bytes after writes 10 and 20
+	if syncs := fs.walSyncs.Load(); syncs != 2 {
+		t.Errorf("Expected 2 WAL syncs for 2500 bytes, got %d", syncs)
+	}
+
+	// A synced write resets the counter
+	db.PutOpt([]byte("key_sync"), []byte("v"), &WriteOptions{Sync: true})
+	for i := 0; i < 9; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), value)
+	}
+	if syncs := fs.walSyncs.Load(); syncs != 3 {
+		t.Errorf("Expected 3 WAL syncs after the forced sync, got %d", syncs)
+	}
+}
+
+func TestDBPutWithTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// Higher timestamp first, then lower: the lower one is ignored
+	db.PutWithTimestamp([]byte("a"), []byte("a_ts10"), 10)
+	db.PutWithTimestamp([]byte("a"), []byte("a_ts5"), 5)
+
+	// Lower first, then higher
+	db.PutWithTimestamp([]byte("b"), []byte("b_ts5"), 5)
+	db.PutWithTimestamp([]byte("b"), []byte("b_ts10"), 10)
+
+	// The winning version is flushed before the stale write arrives
+	db.PutWithTimestamp([]byte("c"), []byte("c_ts10"), 10)
+	forceFlush(t, db)
+	db.PutWithTimestamp([]byte("c"), []byte("c_ts5"), 5)
+
+	// A stale delete doesn't remove a newer value; a newer one does
+	db.PutWithTimestamp([]byte("d"), []byte("d_ts10"), 10)
+	db.DeleteWithTimestamp([]byte("d"), 5)
+	db.PutWithTimestamp([]byte("e"), []byte("e_ts10"), 10)
+	db.DeleteWithTimestamp([]byte("e"), 20)
+	db.PutWithTimestamp([]byte("e"), []byte("e_ts15"), 15)
+
+	check := func(stage string) {
+		t.Helper()
+		for _, key := range []string{"a", "b", "c", "d"} {
+			val, ts, err := db.GetWithTimestamp([]byte(key))
+			if err != nil || string(val) != key+"_ts10" || ts != 10 {
+				t.Errorf("%s: %s = %q@%d (err=%v), want %s_ts10@10", stage, key, val, ts, err, key)
+			}
+		}
+		if _, _, err := db.GetWithTimestamp([]byte("e")); err != ErrNotFound {
+			t.Errorf("%s: expected e to stay deleted, got %v", stage, err)
+		}
+	}
+	check("memtable")
+
+	// Timestamps survive WAL replay and SSTables
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check("reopen")
+
+	// ...and compaction, and iterators expose them
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	check("compacted")
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Close()
+	for ; iter.Valid(); iter.Next() {
+		if iter.Timestamp() != 10 {
+			t.Errorf("Iterator: %s has timestamp %d, want 10", iter.Key(), iter.Timestamp())
+		}
+	}
+
+	// Plain writes are unversioned and always apply
+	db.Put([]byte("a"), []byte("plain"))
+	if val, ts, err := db.GetWithTimestamp([]byte("a")); err != nil || string(val) != "plain" || ts != 0 {
+		t.Errorf("Expected plain@0 after Put, got %q@%d (err=%v)", val, ts, err)
+	}
+}
+
+func TestDBDumpMemtable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("flushed"), []byte("on_disk"))
+	forceFlush(t, db)
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("2"))
+	db.Put([]byte("b"), []byte("3"))
+	db.Put([]byte("c"), []byte("4"))
+	db.Delete([]byte("c"))
+	db.Delete([]byte("flushed"))
+
+	dump := db.DumpMemtable()
+	want := map[string]string{"a": "1", "b": "3"}
+	if len(dump) != len(want) {
+		t.Fatalf("Expected %d entries, got %v", len(want), dump)
+	}
+	for key, value := range want {
+		if string(dump[key]) != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, dump[key])
+		}
+	}
+
+	// The dump is a copy
+	dump["a"][0] = 'x'
+	if val, _ := db.Get([]byte("a")); string(val) != "1" {
+		t.Errorf("Modifying the dump changed the DB: a=%s", val)
+	}
+}
+
+func TestDBCompareAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("lease"), []byte("owner-1"))
+	forceFlush(t, db)
+
+	// Mismatch leaves the key alone
+	deleted, err := db.CompareAndDelete([]byte("lease"), []byte("owner-2"))
+	if err != nil || deleted {
+		t.Fatalf("Expected no delete on mismatch, got deleted=%v err=%v", deleted, err)
+	}
+	if value, err := db.Get([]byte("lease")); err != nil || string(value) != "owner-1" {
+		t.Fatalf("Expected owner-1 to remain, got %q (err=%v)", value, err)
+	}
+
+	// Match deletes it, even when the value is only on disk
+	deleted, err = db.CompareAndDelete([]byte("lease"), []byte("owner-1"))
+	if err != nil || !deleted {
+		t.Fatalf("Expected delete on match, got deleted=%v err=%v", deleted, err)
+	}
+	if _, state, _ := db.GetExtended([]byte("lease")); state != KeyDeleted {
+		t.Errorf("Expected KeyDeleted, got %v", state)
+	}
+
+	// Already deleted and never-written keys report false
+	if deleted, err := db.CompareAndDelete([]byte("lease"), nil); err != nil || deleted {
+		t.Errorf("Expected no delete of deleted key, got deleted=%v err=%v", deleted, err)
+	}
+	count := db.memtable.Count()
+	if deleted, err := db.CompareAndDelete([]byte("absent"), []byte("x")); err != nil || deleted {
+		t.Errorf("Expected no delete of absent key, got deleted=%v err=%v", deleted, err)
+	}
+	if _, state, _ := db.GetExtended([]byte("absent")); state != KeyAbsent {
+		t.Errorf("Expected KeyAbsent (no tombstone), got %v", state)
+	}
+	if db.memtable.Count() != count {
+		t.Errorf("Expected no memtable entry for absent key")
+	}
+}
+
+func TestDBCorruptionPolicy(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("old"), []byte("value"))
+	forceFlush(t, db)
+	db.Put([]byte("new"), []byte("value"))
+	forceFlush(t, db)
+	db.Close()
+
+	// Break the footer of the newest table so it can't be opened
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	sort.Strings(files)
+	newest := files[len(files)-1]
+	data, err := os.ReadFile(newest)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	data[len(data)-10] ^= 0xFF
+	if err := os.WriteFile(newest, data, 0644); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	opts.CorruptionPolicy = FailFast
+	if _, err := Open(opts); !errors.Is(err, ErrCorruptedData) {
+		t.Fatalf("Expected FailFast Open to fail with ErrCorruptedData, got %v", err)
+	}
+
+	// The default skips the table and serves the rest
+	opts.CorruptionPolicy = SkipAndWarn
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Expected SkipAndWarn Open to succeed: %v", err)
+	}
+	defer db.Close()
+
+	if _, err := db.Get([]byte("old")); err != nil {
+		t.Errorf("Expected old key from the intact table, got %v", err)
+	}
+	if _, err := db.Get([]byte("new")); err != ErrNotFound {
+		t.Errorf("Expected new key to be missing, got %v", err)
+	}
+
+	// New flushes don't reuse the skipped table's file
+	db.Put([]byte("later"), []byte("value"))
+	forceFlush(t, db)
+	if after, _ := os.ReadFile(newest); !bytes.Equal(after, data) {
+		t.Error("Skipped SSTable was overwritten by a flush")
+	}
+}
+
+func TestDBGetAll(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("1"))
+	db.Put([]byte("b"), []byte("2"))
+	db.Put([]byte("deleted"), []byte("x"))
+	forceFlush(t, db)
+	db.Put([]byte("c"), []byte("3"))
+	db.Delete([]byte("deleted"))
+
+	keys := [][]byte{
+		[]byte("c"), []byte("missing"), []byte("a"), []byte("c"),
+		[]byte("deleted"), []byte("b"), []byte("a"),
+	}
+	expected := []Result{
+		{[]byte("3"), true}, {nil, false}, {[]byte("1"), true}, {[]byte("3"), true},
+		{nil, false}, {[]byte("2"), true}, {[]byte("1"), true},
+	}
+
+	results, err := db.GetAll(keys)
+	if err != nil {
+		t.Fatalf("GetAll failed: %v", err)
+	}
+	if len(results) != len(keys) {
+		t.Fatalf("Expected %d results, got %d", len(keys), len(results))
+	}
+	for i := range expected {
+		if results[i].Found != expected[i].Found || !bytes.Equal(results[i].Value, expected[i].Value) {
+			t.Errorf("Result %d (%s): expected %+v, got %+v", i, keys[i], expected[i], results[i])
+		}
+	}
+
+	if results, err := db.GetAll(nil); err != nil || len(results) != 0 {
+		t.Errorf("Expected empty results for no keys, got %v (err=%v)", results, err)
+	}
+}
+
+func TestDBFlushSplitsByTargetFileSize(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 4 * 1024 * 1024
+	opts.TargetFileSize = 64 * 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 2000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key_%05d", i)), value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	forceFlush(t, db)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if len(files) < 4 {
+		t.Fatalf("Expected the flush to produce several SSTables, got %d", len(files))
+	}
+	sort.Strings(files)
+	for i, file := range files[:len(files)-1] {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", file, err)
+		}
+		if info.Size() < opts.TargetFileSize || info.Size() > opts.TargetFileSize*3/2 {
+			t.Errorf("File %d is %d bytes, expected about %d", i, info.Size(), opts.TargetFileSize)
+		}
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 2000; i++ {
+			if got, err := db.Get([]byte(fmt.Sprintf("key_%05d", i))); err != nil || !bytes.Equal(got, value) {
+				t.Fatalf("key_%05d: unexpected value (err=%v)", i, err)
+			}
+		}
+		iter := db.NewIterator(nil, nil)
+		defer iter.Close()
+		count := 0
+		for ; iter.Valid(); iter.Next() {
+			count++
+		}
+		if count != 2000 {
+			t.Errorf("Expected 2000 keys, got %d", count)
+		}
+	}
+	check()
+
+	// The split tables load back in the same order
+	db.Close()
+	if db, err = Open(opts); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	check()
+}
+
+func TestDBAppend(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 16 * 1024 // Flush while appending
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Concurrent appends to one key all land
+	const workers, perWorker = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				if err := db.Append([]byte("log"), []byte{byte('a' + w)}); err != nil {
+					t.Errorf("Failed to append: %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	value, err := db.Get([]byte("log"))
+	if err != nil {
+		t.Fatalf("Failed to get: %v", err)
+	}
+	if len(value) != workers*perWorker {
+		t.Fatalf("Expected %d bytes, got %d", workers*perWorker, len(value))
+	}
+	for w := 0; w < workers; w++ {
+		if n := bytes.Count(value, []byte{byte('a' + w)}); n != perWorker {
+			t.Errorf("Worker %d: expected %d appends, got %d", w, perWorker, n)
+		}
+	}
+
+	// Appending to a deleted key starts over
+	db.Delete([]byte("log"))
+	db.Append([]byte("log"), []byte("x"))
+	if got, _ := db.Get([]byte("log")); string(got) != "x" {
+		t.Errorf("Expected x after delete and append, got %q", got)
+	}
+
+	// The result must still fit the value limit
+	db.Close()
+	opts.MaxValueSize = 4
+	if db, err = Open(opts); err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+	if err := db.Append([]byte("log"), []byte("yyyy")); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if got, _ := db.Get([]byte("log")); string(got) != "x" {
+		t.Errorf("Expected x after a rejected append, got %q", got)
+	}
+}
+
+func TestDBPurgeTombstonesOnFlush(t *testing.T) {
+	for _, purge := range []bool{false, true} {
+		opts := DefaultOptions(t.TempDir())
+		opts.PurgeTombstonesOnFlush = purge
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+
+		db.Put([]byte("old"), []byte("v1"))
+		forceFlush(t, db)
+
+		// A brand-new key put and deleted before the flush, and a delete
+		// of a key already in an SSTable
+		db.Put([]byte("new"), []byte("v1"))
+		db.Delete([]byte("new"))
+		db.Delete([]byte("old"))
+		forceFlush(t, db)
+
+		wantKeys, wantPurged := 2, uint64(0)
+		if purge {
+			wantKeys, wantPurged = 1, 1 // Only old's tombstone hides anything
+		}
+		if got := readTableStats(t, db)[0].KeyCount; got != wantKeys {
+			t.Errorf("purge=%v: expected %d entries in the flushed table, got %d", purge, wantKeys, got)
+		}
+		if got := db.Stats().TombstonesPurged; got != wantPurged {
+			t.Errorf("purge=%v: expected %d purged tombstones, got %d", purge, wantPurged, got)
+		}
+
+		for _, key := range []string{"old", "new"} {
+			if _, err := db.Get([]byte(key)); err != ErrNotFound {
+				t.Errorf("purge=%v: expected %s to stay deleted, got %v", purge, key, err)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestDBGetReadFromDiskOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	diskOnly := &ReadOptions{ReadFromDiskOnly: true}
+	key := []byte("key")
+
+	db.Put(key, []byte("v1"))
+	if _, err := db.GetOpt(key, diskOnly); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound before flush, got %v", err)
+	}
+	if val, err := db.Get(key); err != nil || string(val) != "v1" {
+		t.Errorf("Expected v1 from memtable, got %s (err=%v)", val, err)
+	}
+
+	forceFlush(t, db)
+	if val, err := db.GetOpt(key, diskOnly); err != nil || string(val) != "v1" {
+		t.Errorf("Expected v1 from disk after flush, got %s (err=%v)", val, err)
+	}
+
+	// A tombstone in the memtable is skipped, one on disk is not
+	db.Delete(key)
+	if val, err := db.GetOpt(key, diskOnly); err != nil || string(val) != "v1" {
+		t.Errorf("Expected flushed v1 under an unflushed delete, got %s (err=%v)", val, err)
+	}
+	forceFlush(t, db)
+	if _, err := db.GetOpt(key, diskOnly); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after the tombstone is flushed, got %v", err)
+	}
+}
+
+func TestDBGetMaxSSTables(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("deep"), []byte("old"))
+	db.Put([]byte("updated"), []byte("old"))
+	forceFlush(t, db)
+	for i := 0; i < 3; i++ {
+		db.Put([]byte(fmt.Sprintf("filler_%d", i)), []byte("v"))
+		forceFlush(t, db)
+	}
+	db.Put([]byte("updated"), []byte("new"))
+	forceFlush(t, db)
+	db.Put([]byte("memtable"), []byte("v"))
+
+	limited := &ReadOptions{FillCache: true, MaxSSTables: 2}
+	if _, err := db.GetOpt([]byte("deep"), limited); err != ErrNotFound {
+		t.Errorf("Expected a limited Get to miss the key in the 5th table, got %v", err)
+	}
+	if val, err := db.GetOpt([]byte("deep"), nil); err != nil || string(val) != "old" {
+		t.Errorf("Expected an unlimited Get to find deep=old, got %s (err=%v)", val, err)
+	}
+	if val, err := db.GetOpt([]byte("updated"), limited); err != nil || string(val) != "new" {
+		t.Errorf("Expected updated=new from the newest table, got %s (err=%v)", val, err)
+	}
+	if _, err := db.GetOpt([]byte("memtable"), &ReadOptions{MaxSSTables: 1}); err != nil {
+		t.Errorf("Expected the memtable to be read under the limit, got %v", err)
+	}
+}
+
+func TestDBRotateMemtable(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	db.Put([]byte("old"), []byte("sealed"))
+	db.Put([]byte("both"), []byte("old"))
+	if err := db.RotateMemtable(); err != nil {
+		t.Fatalf("RotateMemtable failed: %v", err)
+	}
+	stats := db.Stats()
+	if stats.SSTableCount != 0 || stats.MemtableSize != 0 || stats.ImmutableSize == 0 {
+		t.Fatalf("Expected the memtable sealed but not flushed, got %+v", stats)
+	}
+	if val, err := db.Get([]byte("old")); err != nil || string(val) != "sealed" {
+		t.Errorf("Expected old=sealed from the sealed memtable, got %s (err=%v)", val, err)
+	}
+
+	db.Put([]byte("new"), []byte("fresh"))
+	db.Put([]byte("both"), []byte("new"))
+	for key, want := range map[string]string{"old": "sealed", "new": "fresh", "both": "new"} {
+		if val, err := db.Get([]byte(key)); err != nil || string(val) != want {
+			t.Errorf("Expected %s=%s, got %s (err=%v)", key, want, val, err)
+		}
+	}
+
+	// Simulate a crash: both WALs are replayed, the sealed one first
+	db.lock.Close()
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	if db.immutable == nil || db.Stats().SSTableCount != 0 {
+		t.Errorf("Expected the sealed memtable to be recovered unflushed")
+	}
+	for key, want := range map[string]string{"old": "sealed", "new": "fresh", "both": "new"} {
+		if val, err := db.Get([]byte(key)); err != nil || string(val) != want {
+			t.Errorf("After reopen: expected %s=%s, got %s (err=%v)", key, want, val, err)
+		}
+	}
+
+	// Rotating again flushes the sealed memtable and its WAL goes away
+	if err := db.RotateMemtable(); err != nil {
+		t.Fatalf("RotateMemtable failed: %v", err)
+	}
+	if count := db.Stats().SSTableCount; count != 1 {
+		t.Errorf("Expected the first sealed memtable flushed, got %d SSTables", count)
+	}
+	forceFlush(t, db)
+	if _, err := os.Stat(db.immutableWALPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the sealed WAL removed after its flush, got %v", err)
+	}
+	if val, err := db.Get([]byte("both")); err != nil || string(val) != "new" {
+		t.Errorf("Expected both=new after flushing, got %s (err=%v)", val, err)
+	}
+	db.Close()
+}
+
+func TestParseSSTableName(t *testing.T) {
+	tests := []struct {
+		name  string
+		level int
+		id    uint64
+		ok    bool
+	}{
+		{"sst_000042.sst", 0, 42, true},
+		{"sst_L0_000007.sst", 0, 7, true},
+		{"sst_L3_1234567.sst", 3, 1234567, true},
+		{"sst_Lx_000001.sst", 0, 0, false},
+		{"sst_L1.sst", 0, 0, false},
+		{"sst_abc.sst", 0, 0, false},
+	}
+	for _, tt := range tests {
+		level, id, ok := parseSSTableName(filepath.Join("dir", tt.name))
+		if level != tt.level || id != tt.id || ok != tt.ok {
+			t.Errorf("parseSSTableName(%s) = (%d, %d, %v), want (%d, %d, %v)", tt.name, level, id, ok, tt.level, tt.id, tt.ok)
+		}
+	}
+}
+
+func TestDBSSTableNameLevel(t *testing.T) {
+	dir := t.TempDir()
+	open := func(naming SSTableNaming) *DB {
+		t.Helper()
+		opts := DefaultOptions(dir)
+		opts.SSTableNaming = naming
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		return db
+	}
+
+	// A table under the plain scheme, then level-named flushes and a
+	// compaction, then a plain one again
+	db := open(SSTableNamePlain)
+	db.Put([]byte("a"), []byte("1"))
+	forceFlush(t, db)
+	db.Close()
+
+	db = open(SSTableNameLevel)
+	db.Put([]byte("a"), []byte("2"))
+	db.Put([]byte("b"), []byte("1"))
+	forceFlush(t, db)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+	db.Put([]byte("c"), []byte("1"))
+	forceFlush(t, db)
+	db.Close()
+
+	db = open(SSTableNamePlain)
+	db.Put([]byte("a"), []byte("3"))
+	forceFlush(t, db)
+	db.Close()
+
+	db = open(SSTableNameLevel)
+	defer db.Close()
+
+	want := []struct {
+		name  string
+		level int
+	}{
+		{"sst_000004.sst", 0},
+		{"sst_L0_000003.sst", 0},
+		{"sst_L1_000002.sst", 1},
+	}
+	stats := readTableStats(t, db)
+	if len(stats) != len(want) {
+		t.Fatalf("Expected %d SSTables, got %d", len(want), len(stats))
+	}
+	for i, w := range want {
+		if filepath.Base(stats[i].Path) != w.name || stats[i].Level != w.level {
+			t.Errorf("Table %d: expected %s at level %d, got %s at level %d", i, w.name, w.level, filepath.Base(stats[i].Path), stats[i].Level)
+		}
+	}
+
+	for key, value := range map[string]string{"a": "3", "b": "1", "c": "1"} {
+		if got, err := db.Get([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("Expected %s=%s, got %s (err=%v)", key, value, got, err)
+		}
+	}
+
+	// IDs keep counting up across both schemes
+	db.Put([]byte("d"), []byte("1"))
+	forceFlush(t, db)
+	if name := filepath.Base(readTableStats(t, db)[0].Path); name != "sst_L0_000005.sst" {
+		t.Errorf("Expected sst_L0_000005.sst, got %s", name)
+	}
+}
+
+func TestDBFlushInterval(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.FlushInterval = 50 * time.Millisecond
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	// An empty memtable is left alone
+	time.Sleep(120 * time.Millisecond)
+	if n := db.Stats().SSTableCount; n != 0 {
+		t.Errorf("Expected no flush of an empty memtable, got %d SSTables", n)
+	}
+
+	db.Put([]byte("key"), []byte("value"))
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().SSTableCount == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a timed flush to write an SSTable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := db.Stats(); stats.MemtableSize != 0 {
+		t.Errorf("Expected an empty memtable after the timed flush, got %d bytes", stats.MemtableSize)
+	}
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Errorf("Expected value, got %s (err=%v)", val, err)
+	}
+
+	// Close stops the timer; nothing flushes afterwards
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	time.Sleep(120 * time.Millisecond)
+	if after, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst")); len(after) != len(files) {
+		t.Errorf("Expected no flushes after Close, got %d SSTables (was %d)", len(after), len(files))
+	}
+}
+
+func TestDBCloseStopsBackgroundGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 3; i++ {
+		opts := DefaultOptions(t.TempDir())
+		opts.CompactionTrigger = 2
+		opts.FlushInterval = time.Millisecond
+		db, err := Open(opts)
+		if err != nil {
+			t.Fatalf("Failed to open DB: %v", err)
+		}
+		// Give the flush timer and compaction worker something to do
+		for j := 0; j < 20; j++ {
+			db.Put([]byte(fmt.Sprintf("key_%02d", j)), []byte("v"))
+			time.Sleep(time.Millisecond / 2)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("Failed to close DB: %v", err)
+		}
+	}
+
+	// Close has waited for them, but they may still be unwinding
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("Expected no leaked goroutines: %d before Open, %d after Close\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestDBPackedTombstones(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.PackedTombstones = true
+	opts.ValueDictionarySize = 4096
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf(`{"id":%d,"status":"active"}`, i)))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 200; i += 2 {
+		db.Delete([]byte(fmt.Sprintf("key_%03d", i)))
+	}
+	forceFlush(t, db)
+
+	for i := 0; i < 200; i++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key_%03d", i)))
+		if i%2 == 0 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("Key %d: expected ErrNotFound, got %q, %v", i, value, err)
+			}
+		} else if want := fmt.Sprintf(`{"id":%d,"status":"active"}`, i); err != nil || string(value) != want {
+			t.Errorf("Key %d: expected %s, got %q, %v", i, want, value, err)
+		}
+	}
+	for _, sst := range db.sstables {
+		data, err := os.ReadFile(sst.Path())
+		if err != nil {
+			t.Fatalf("Failed to read SSTable: %v", err)
+		}
+		want := BlockFormatPackedTombstones
+		if sst.valueDict != nil {
+			want = BlockFormatPackedValueDict
+		}
+		flags := binary.LittleEndian.Uint32(data[len(data)-sstableFooterSize+32:])
+		if code := uint8(flags >> footerBlockFormatShift); code != want {
+			t.Errorf("Expected %s in block format %d, got %d", sst.Path(), want, code)
+		}
+	}
+}
+
+func TestDBSSTables(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if tables := db.SSTables(); len(tables) != 0 {
+		t.Fatalf("Expected no tables in a new DB, got %+v", tables)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100*(round+1); i++ {
+			db.Put([]byte(fmt.Sprintf("r%d_key_%04d", round, i)), []byte("value"))
+		}
+		forceFlush(t, db)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	if err != nil {
+		t.Fatalf("Failed to list SSTables: %v", err)
+	}
+	tables := db.SSTables()
+	if len(tables) != 3 || len(files) != 3 {
+		t.Fatalf("Expected 3 tables and files, got %d and %d", len(tables), len(files))
+	}
+	for i, info := range tables {
+		round := 2 - i // Newest first
+		fi, err := os.Stat(info.Path)
+		if err != nil {
+			t.Fatalf("Listed table %s is not on disk: %v", info.Path, err)
+		}
+		if info.SizeBytes != fi.Size() {
+			t.Errorf("%s: size %d, file is %d bytes", info.Path, info.SizeBytes, fi.Size())
+		}
+		if want := db.parseSSTableID(info.Path); info.ID != want || info.Level != 0 {
+			t.Errorf("%s: expected ID %d at level 0, got %d at %d", info.Path, want, info.ID, info.Level)
+		}
+		if i > 0 && info.ID >= tables[i-1].ID {
+			t.Errorf("Expected newest first, got ID %d after %d", info.ID, tables[i-1].ID)
+		}
+		if info.KeyCount != uint64(100*(round+1)) {
+			t.Errorf("%s: expected %d keys, got %d", info.Path, 100*(round+1), info.KeyCount)
+		}
+		first, last := fmt.Sprintf("r%d_key_0000", round), fmt.Sprintf("r%d_key_%04d", round, 100*(round+1)-1)
+		if string(info.FirstKey) != first || string(info.LastKey) != last {
+			t.Errorf("%s: expected range [%s, %s], got [%s, %s]", info.Path, first, last, info.FirstKey, info.LastKey)
+		}
+		if info.BloomFPRate <= 0 || info.BloomFPRate > 0.05 {
+			t.Errorf("%s: implausible bloom false positive rate %f", info.Path, info.BloomFPRate)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package lsm
+
+import (
+	"os"
+	"unsafe"
+)
+
+const (
+	// directIOAlignment is the buffer address, size and file offset
+	// alignment O_DIRECT writes need (the largest common logical block size)
+	directIOAlignment = 4096
+
+	// directIOBufferSize is how much a direct file buffers per write
+	directIOBufferSize = 64 * directIOAlignment
+)
+
+// directFS creates files for O_DIRECT writing where supported
+// Files from other filesystems, and platforms or filesystems without
+// O_DIRECT, fall back to the wrapped filesystem's buffered Create.
+type directFS struct {
+	FileSystem
+}
+
+func (f directFS) Create(name string) (File, error) {
+	if _, ok := f.FileSystem.(OSFileSystem); ok {
+		if file, err := openDirect(name); err == nil {
+			return newDirectFile(file), nil
+		}
+	}
+	return f.FileSystem.Create(name)
+}
+
+// directFile writes through O_DIRECT in aligned chunks
+// The unaligned tail is written with O_DIRECT turned off when the file is
+// synced, truncated or closed, so the file ends up exactly the bytes written.
+type directFile struct {
+	*os.File
+	buf []byte // Aligned staging buffer
+	n   int    // Bytes staged in buf
+}
+
+func newDirectFile(file *os.File) *directFile {
+	return &directFile{File: file, buf: alignedBuffer(directIOBufferSize)}
+}
+
+// alignedBuffer returns a size-byte buffer starting on an aligned address
+func alignedBuffer(size int) []byte {
+	raw := make([]byte, size+directIOAlignment)
+	off := 0
+	if rem := int(uintptr(unsafe.Pointer(&raw[0])) % directIOAlignment); rem != 0 {
+		off = directIOAlignment - rem
+	}
+	return raw[off : off+size]
+}
+
+func (f *directFile) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		c := copy(f.buf[f.n:], p)
+		f.n += c
+		written += c
+		p = p[c:]
+		if f.n == len(f.buf) {
+			if _, err := f.File.Write(f.buf); err != nil {
+				return written, err
+			}
+			f.n = 0
+		}
+	}
+	return written, nil
+}
+
+// flushTail writes the staged bytes, leaving direct mode if they aren't
+// a whole number of aligned blocks
+func (f *directFile) flushTail() error {
+	if f.n == 0 {
+		return nil
+	}
+	if f.n%directIOAlignment != 0 {
+		if err := clearDirect(f.File); err != nil {
+			return err
+		}
+	}
+	_, err := f.File.Write(f.buf[:f.n])
+	f.n = 0
+	return err
+}
+
+func (f *directFile) Sync() error {
+	if err := f.flushTail(); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *directFile) Truncate(size int64) error {
+	if err := f.flushTail(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *directFile) Close() error {
+	err := f.flushTail()
+	if cerr := f.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
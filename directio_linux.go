@@ -0,0 +1,33 @@
+//go:build linux
+
+package lsm
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect creates name for writing with O_DIRECT
+// Fails on filesystems that don't support it (e.g. tmpfs).
+func openDirect(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC|syscall.O_DIRECT, 0644)
+}
+
+// clearDirect turns O_DIRECT off so unaligned writes succeed
+func clearDirect(f *os.File) error {
+	fd := int(f.Fd())
+	flags, err := fcntl(fd, syscall.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fcntl(fd, syscall.F_SETFL, flags&^syscall.O_DIRECT)
+	return err
+}
+
+func fcntl(fd, cmd, arg int) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(cmd), uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
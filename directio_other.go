@@ -0,0 +1,18 @@
+//go:build !linux
+
+package lsm
+
+import (
+	"errors"
+	"os"
+)
+
+// openDirect is not supported on this platform
+func openDirect(name string) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
+
+// clearDirect is never needed without openDirect
+func clearDirect(f *os.File) error {
+	return nil
+}
@@ -1,6 +1,9 @@
 package lsm
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrNotFound is returned when a key doesn't exist
@@ -15,6 +18,12 @@ var (
 	// ErrEmptyKey is returned when key is empty
 	ErrEmptyKey = errors.New("key cannot be empty")
 
+	// ErrKeyTooLarge is returned when a key exceeds the size limit
+	ErrKeyTooLarge = errors.New("key too large")
+
+	// ErrValueTooLarge is returned when a value exceeds the size limit
+	ErrValueTooLarge = errors.New("value too large")
+
 	// ErrClosed is returned when db is closed
 	ErrClosed = errors.New("database is closed")
 
@@ -23,4 +32,93 @@ var (
 
 	// ErrCorruptedData is returned when data is corrupted
 	ErrCorruptedData = errors.New("corrupted data")
+
+	// ErrUnknownBloomHasher is returned when decoding a bloom filter whose
+	// hasher hasn't been registered
+	ErrUnknownBloomHasher = errors.New("unknown bloom filter hasher")
+
+	// ErrBloomFalseNegative is returned with ParanoidBloom set when a new
+	// SSTable's bloom filter rejects a key the table contains
+	ErrBloomFalseNegative = errors.New("bloom filter false negative")
+
+	// ErrUnknownBlockFormat is returned when opening an SSTable whose block
+	// format code hasn't been registered
+	ErrUnknownBlockFormat = errors.New("unknown SSTable block format")
+
+	// ErrOutOfOrder is returned by SSTableWriter.Add for a key that isn't
+	// greater than the previous one
+	ErrOutOfOrder = errors.New("key out of order")
+
+	// ErrDuplicateKey is returned by SSTableWriter.Add for a key equal to
+	// the previous one, under DuplicateKeyReject; it also matches
+	// ErrOutOfOrder
+	ErrDuplicateKey = errors.New("duplicate key")
+
+	// ErrSnapshotReleased is returned when reading from a released snapshot
+	ErrSnapshotReleased = errors.New("snapshot released")
+
+	// ErrBusy is returned by writes with NonBlockingWrites set while a
+	// flush or compaction is running; it is temporary, so retry later
+	ErrBusy = errors.New("database is busy flushing or compacting")
+
+	// ErrIndexExists is returned by CreateIndex for a name already in use
+	ErrIndexExists = errors.New("index already exists")
+
+	// ErrUnknownIndex is returned by IndexScan for an unregistered index
+	ErrUnknownIndex = errors.New("unknown index")
+
+	// ErrUnknownTable is returned by CompactFiles for a path that isn't a
+	// live SSTable
+	ErrUnknownTable = errors.New("not a live SSTable")
+
+	// ErrInvalidCompaction is returned by CompactFiles for a set of tables
+	// that can't be merged without reordering versions
+	ErrInvalidCompaction = errors.New("invalid compaction")
+
+	// ErrIncompatibleVersion is returned by Open for a directory written in
+	// a newer on-disk format than this build supports
+	ErrIncompatibleVersion = errors.New("incompatible database format version")
+
+	// ErrVersionUnavailable is returned by GetAsOf when the versions
+	// needed to answer have been merged or compacted away
+	ErrVersionUnavailable = errors.New("version no longer available")
+
+	// ErrAlreadyLocked is returned when another process has the DB open
+	ErrAlreadyLocked = errors.New("database directory is locked by another process")
+
+	// ErrReservedKey is returned when writing a key in the keyspace that
+	// holds secondary index entries (see CreateIndex)
+	ErrReservedKey = errors.New("key uses the reserved secondary index prefix")
+
+	// ErrDirectoryMissing is returned when the data directory was removed
+	// while the DB was open. Only Open re-creates it.
+	ErrDirectoryMissing = errors.New("data directory missing")
 )
+
+// checkEntrySize rejects keys and values over the given limits
+func checkEntrySize(key, value []byte, maxKeySize, maxValueSize int) error {
+	if len(key) > maxKeySize {
+		return fmt.Errorf("%w: %d bytes (limit %d)", ErrKeyTooLarge, len(key), maxKeySize)
+	}
+	if len(value) > maxValueSize {
+		return fmt.Errorf("%w: %d bytes (limit %d)", ErrValueTooLarge, len(value), maxValueSize)
+	}
+	return nil
+}
+
+// CorruptionError describes where corrupted data was found
+// It wraps ErrCorruptedData, so errors.Is(err, ErrCorruptedData) still works
+// and errors.As can be used to extract the location.
+type CorruptionError struct {
+	Path   string // File containing the corrupted data
+	Offset int64  // Byte offset of the corrupted region
+	Kind   string // What was corrupted (e.g. "block checksum mismatch")
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("corrupted data in %s at offset %d: %s", e.Path, e.Offset, e.Kind)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return ErrCorruptedData
+}
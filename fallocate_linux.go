@@ -0,0 +1,10 @@
+//go:build linux
+
+package lsm
+
+import "syscall"
+
+// fallocate reserves size bytes for the file, extending it if needed
+func fallocate(fd uintptr, size int64) error {
+	return syscall.Fallocate(int(fd), 0, 0, size)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package lsm
+
+import "errors"
+
+// fallocate is not supported on this platform
+func fallocate(fd uintptr, size int64) error {
+	return errors.ErrUnsupported
+}
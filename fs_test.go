@@ -0,0 +1,412 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errInjected = errors.New("injected fault")
+
+// faultFS wraps OSFileSystem and fails selected operations on demand
+// It also counts writes to the WAL so tests can check batching
+type faultFS struct {
+	OSFileSystem
+	mu         sync.Mutex
+	failRename bool
+	walWrites  atomic.Int64
+	walSyncs   atomic.Int64
+}
+
+// countingFile counts Write and Sync calls on the wrapped file
+type countingFile struct {
+	File
+	writes *atomic.Int64
+	syncs  *atomic.Int64
+}
+
+func (f *countingFile) Write(p []byte) (int, error) {
+	f.writes.Add(1)
+	return f.File.Write(p)
+}
+
+func (f *countingFile) Sync() error {
+	f.syncs.Add(1)
+	return f.File.Sync()
+}
+
+func (f *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := f.OSFileSystem.OpenFile(name, flag, perm)
+	if err != nil || filepath.Base(name) != "wal.log" {
+		return file, err
+	}
+	return &countingFile{File: file, writes: &f.walWrites, syncs: &f.walSyncs}, nil
+}
+
+func (f *faultFS) setFailRename(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failRename = fail
+}
+
+func (f *faultFS) Rename(oldpath, newpath string) error {
+	f.mu.Lock()
+	fail := f.failRename
+	f.mu.Unlock()
+	if fail {
+		return errInjected
+	}
+	return f.OSFileSystem.Rename(oldpath, newpath)
+}
+
+func TestDBFlushRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	fs := &faultFS{}
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 512
+	opts.FS = fs
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	fs.setFailRename(true)
+
+	// Write until the flush fails
+	written := 0
+	var putErr error
+	for i := 0; i < 100 && putErr == nil; i++ {
+		putErr = db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value_with_some_padding"))
+		written++
+	}
+	if !errors.Is(putErr, errInjected) {
+		t.Fatalf("Expected injected rename error, got %v", putErr)
+	}
+
+	// No SSTable or leftover temp file should exist
+	if files, _ := filepath.Glob(filepath.Join(dir, "sst_*")); len(files) > 0 {
+		t.Errorf("Expected no SSTable files after failed flush, got %v", files)
+	}
+
+	// Everything written is still readable from memory
+	for i := 0; i < written; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil {
+			t.Errorf("key_%03d not readable after failed flush: %v", i, err)
+		}
+	}
+
+	// Once the fault clears, close flushes and reopen sees everything
+	fs.setFailRename(false)
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < written; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key_%03d", i))); err != nil {
+			t.Errorf("key_%03d not found after reopen: %v", i, err)
+		}
+	}
+}
+
+// removeCountFS counts removals of each SSTable
+type removeCountFS struct {
+	OSFileSystem
+	mu      sync.Mutex
+	removed map[string]int
+}
+
+func (f *removeCountFS) Remove(name string) error {
+	if strings.HasSuffix(name, ".sst") {
+		f.mu.Lock()
+		f.removed[filepath.Base(name)]++
+		f.mu.Unlock()
+	}
+	return f.OSFileSystem.Remove(name)
+}
+
+// stallFS blocks the first SSTable temp file creation until released
+type stallFS struct {
+	OSFileSystem
+	once    sync.Once
+	stalled chan struct{} // Closed once a flush is stuck
+	release chan struct{}
+}
+
+func (f *stallFS) Create(name string) (File, error) {
+	if strings.HasSuffix(name, ".sst.tmp") {
+		f.once.Do(func() {
+			close(f.stalled)
+			<-f.release
+		})
+	}
+	return f.OSFileSystem.Create(name)
+}
+
+// armedStallFS is a stallFS that only stalls once armed
+type armedStallFS struct {
+	stallFS
+	armed atomic.Bool
+}
+
+func (f *armedStallFS) Create(name string) (File, error) {
+	if f.armed.Load() {
+		return f.stallFS.Create(name)
+	}
+	return f.OSFileSystem.Create(name)
+}
+
+func TestDBNonBlockingWrites(t *testing.T) {
+	dir := t.TempDir()
+	fs := &stallFS{stalled: make(chan struct{}), release: make(chan struct{})}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+	opts.NonBlockingWrites = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Compact flushes the memtable holding the lock, and gets stuck
+	db.Put([]byte("key"), []byte("value"))
+	compactErr := make(chan error, 1)
+	go func() {
+		compactErr <- db.Compact()
+	}()
+	<-fs.stalled
+
+	if err := db.Put([]byte("other"), []byte("value")); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy while flushing, got %v", err)
+	}
+	if err := db.DeleteMulti([][]byte{[]byte("other")}); !errors.Is(err, ErrBusy) {
+		t.Errorf("Expected ErrBusy from DeleteMulti while flushing, got %v", err)
+	}
+
+	close(fs.release)
+	if err := <-compactErr; err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	// Retrying after the flush succeeds
+	if err := db.Put([]byte("other"), []byte("value")); err != nil {
+		t.Fatalf("Expected retry to succeed, got %v", err)
+	}
+	if value, err := db.Get([]byte("other")); err != nil || string(value) != "value" {
+		t.Errorf("Expected value, got %q (err=%v)", value, err)
+	}
+}
+
+func TestDBNonBlockingWritesDuringUnlockedFlush(t *testing.T) {
+	dir := t.TempDir()
+	fs := &stallFS{stalled: make(chan struct{}), release: make(chan struct{})}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+	opts.MemtableSize = 1024
+	opts.NonBlockingWrites = true
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	defer close(fs.release)
+
+	// Fill the memtable in the background until its flush gets stuck
+	go func() {
+		for i := 0; ; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value_with_some_padding")); err != nil || db.Stats().SSTableCount > 0 {
+				return
+			}
+		}
+	}()
+	<-fs.stalled
+
+	// That flush writes its tables without the lock, so writes go ahead
+	if err := db.Put([]byte("other"), []byte("value")); err != nil {
+		t.Errorf("Expected Put to succeed during the flush, got %v", err)
+	}
+	if err := db.DeleteMulti([][]byte{[]byte("other")}); err != nil {
+		t.Errorf("Expected DeleteMulti to succeed during the flush, got %v", err)
+	}
+}
+
+func TestDBPauseCompactionDuringFlush(t *testing.T) {
+	dir := t.TempDir()
+	fs := &armedStallFS{stallFS: stallFS{stalled: make(chan struct{}), release: make(chan struct{})}}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+	opts.MemtableSize = 1024
+	opts.CompactionTrigger = 2
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	released := false
+	defer func() {
+		if !released {
+			close(fs.release)
+		}
+	}()
+
+	// Two tables, held back from compaction for now
+	db.PauseCompaction()
+	for _, key := range []string{"a", "b"} {
+		db.Put([]byte(key), []byte("value"))
+		forceFlush(t, db)
+	}
+
+	// Fill the memtable in the background until its flush gets stuck
+	fs.armed.Store(true)
+	fillErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value_with_some_padding")); err != nil || db.Stats().SSTableCount > 2 {
+				fillErr <- err
+				return
+			}
+		}
+	}()
+	<-fs.stalled
+
+	// The worker wakes and waits for the flush, then a pause arrives
+	db.ResumeCompaction()
+	time.Sleep(20 * time.Millisecond)
+	db.PauseCompaction()
+
+	released = true
+	close(fs.release)
+	if err := <-fillErr; err != nil {
+		t.Fatalf("Filling write failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // Give a wrongly resumed worker time to run
+	if got := db.Stats().SSTableCount; got != 3 {
+		t.Fatalf("Expected 3 SSTables after a pause during the flush, got %d", got)
+	}
+}
+
+func TestDBReadsDuringSlowFlush(t *testing.T) {
+	dir := t.TempDir()
+	fs := &stallFS{stalled: make(chan struct{}), release: make(chan struct{})}
+	opts := DefaultOptions(dir)
+	opts.FS = fs
+	opts.MemtableSize = 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+	released := false
+	defer func() {
+		if !released {
+			close(fs.release)
+		}
+	}()
+
+	// Fill the memtable in the background until its flush gets stuck
+	fillErr := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			if err := db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value_with_some_padding")); err != nil || db.Stats().SSTableCount > 0 {
+				fillErr <- err
+				return
+			}
+		}
+	}()
+	<-fs.stalled
+
+	// Reads, and writes to the new memtable, finish while the flush is stuck
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			// key_000 is in the memtable being flushed
+			if value, err := db.Get([]byte("key_000")); err != nil || string(value) != "value_with_some_padding" {
+				done <- fmt.Errorf("Get(key_000) = %q, %v", value, err)
+				return
+			}
+			if _, err := db.Get([]byte("missing")); !errors.Is(err, ErrNotFound) {
+				done <- fmt.Errorf("Get(missing) = %v", err)
+				return
+			}
+		}
+		done <- db.Put([]byte("during_flush"), []byte("value"))
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Operation during flush failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Reads blocked behind the flush")
+	}
+	if db.Stats().SSTableCount != 0 {
+		t.Fatalf("Expected the flush still in progress")
+	}
+
+	// Writers that fill the new memtable meanwhile queue behind the flush.
+	// The first to wake flushes it; the rest find a fresh memtable.
+	const writers = 16
+	var wg sync.WaitGroup
+	writeErrs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if err := db.Put([]byte(fmt.Sprintf("w%02d_%03d", w, i)), []byte("value_with_some_padding")); err != nil {
+					writeErrs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	for full := false; !full; time.Sleep(time.Millisecond) {
+		db.mu.RLock()
+		full = db.memtable.IsFull()
+		db.mu.RUnlock()
+	}
+	time.Sleep(20 * time.Millisecond) // Let the other writers queue up
+
+	released = true
+	close(fs.release)
+	if err := <-fillErr; err != nil {
+		t.Fatalf("Filling write failed: %v", err)
+	}
+	wg.Wait()
+	close(writeErrs)
+	for err := range writeErrs {
+		t.Fatalf("Write queued behind the flush failed: %v", err)
+	}
+
+	// Every table came from a full memtable, like the first one
+	tables := db.SSTables()
+	full := tables[len(tables)-1].KeyCount
+	for _, info := range tables {
+		if info.KeyCount < full/2 {
+			t.Errorf("Expected only full memtables flushed (%d keys), got %s with %d", full, info.Path, info.KeyCount)
+		}
+	}
+
+	// Everything flushed or written meanwhile is readable
+	for _, key := range []string{"key_000", "during_flush"} {
+		if _, err := db.Get([]byte(key)); err != nil {
+			t.Errorf("Get(%s) after flush failed: %v", key, err)
+		}
+	}
+}
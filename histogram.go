@@ -0,0 +1,94 @@
+package lsm
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// SizeHistogramBuckets is the number of buckets in a SizeHistogram, enough
+// for sizes up to MaxValueSize
+const SizeHistogramBuckets = 28
+
+// Bounds on the work HistogramStats does, so it stays cheap on large DBs
+const (
+	histogramMemtableSamples = 10000 // Entries read from each memtable
+	histogramBlocksPerTable  = 4     // Data blocks read from each SSTable
+)
+
+// SizeHistogram counts sizes in power-of-two buckets: Buckets[0] counts
+// size 0 and Buckets[i] sizes in [2^(i-1), 2^i)
+type SizeHistogram struct {
+	Buckets [SizeHistogramBuckets]uint64 `json:"buckets"`
+	Count   uint64                       `json:"count"`
+}
+
+// SizeHistogramBucket returns the bucket a size falls in
+func SizeHistogramBucket(size int) int {
+	return min(bits.Len(uint(size)), SizeHistogramBuckets-1)
+}
+
+func (h *SizeHistogram) add(size int) {
+	h.Buckets[SizeHistogramBucket(size)]++
+	h.Count++
+}
+
+// HistogramStats is the distribution of key and value sizes in a sample of
+// the DB's entries. Tombstones count toward key sizes only.
+type HistogramStats struct {
+	KeySizes   SizeHistogram `json:"key_sizes"`
+	ValueSizes SizeHistogram `json:"value_sizes"`
+
+	// Entries sampled from the memtables and from SSTables
+	MemtableSamples uint64 `json:"memtable_samples"`
+	SSTableSamples  uint64 `json:"sstable_samples"`
+}
+
+func (h *HistogramStats) add(e Entry) {
+	h.KeySizes.add(len(e.Key))
+	if !e.Deleted {
+		h.ValueSizes.add(len(e.Value))
+	}
+}
+
+// HistogramStats samples key and value sizes for capacity planning
+// It reads up to 10000 entries from each memtable and, with
+// includeSSTables, 4 evenly spaced data blocks from each SSTable, so the
+// cost doesn't grow with the data size. Shadowed versions in SSTables are
+// counted as well, since they take space too.
+func (db *DB) HistogramStats(includeSSTables bool) (HistogramStats, error) {
+	var h HistogramStats
+	if db.closed.Load() {
+		return h, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, mem := range []*Memtable{db.memtable, db.immutable} {
+		if mem == nil {
+			continue
+		}
+		it := mem.NewIterator()
+		n := 0
+		for it.SeekToFirst(); it.Valid() && n < histogramMemtableSamples; it.Next() {
+			h.add(*it.Entry())
+			n++
+		}
+		it.Close()
+		h.MemtableSamples += uint64(n)
+	}
+
+	if !includeSSTables {
+		return h, nil
+	}
+	for _, sst := range db.sstables {
+		err := sst.sampleBlocks(histogramBlocksPerTable, func(e Entry) {
+			h.add(e)
+			h.SSTableSamples++
+		})
+		if err != nil {
+			return h, fmt.Errorf("failed to sample %s: %w", sst.Path(), err)
+		}
+	}
+	return h, nil
+}
@@ -0,0 +1,112 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestSizeHistogramBucket(t *testing.T) {
+	tests := []struct{ size, bucket int }{
+		{0, 0}, {1, 1}, {2, 2}, {3, 2}, {4, 3}, {7, 3}, {8, 4},
+		{1023, 10}, {1024, 11}, {MaxValueSize, SizeHistogramBuckets - 1},
+	}
+	for _, tt := range tests {
+		if got := SizeHistogramBucket(tt.size); got != tt.bucket {
+			t.Errorf("SizeHistogramBucket(%d) = %d, want %d", tt.size, got, tt.bucket)
+		}
+	}
+}
+
+func TestDBHistogramStats(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// 10 entries with 3-byte keys and 100-byte values, 5 with 10-byte keys
+	// and empty values, and 2 tombstones with 20-byte keys
+	for i := 0; i < 10; i++ {
+		db.Put([]byte(fmt.Sprintf("k%02d", i)), bytes.Repeat([]byte("v"), 100))
+	}
+	for i := 0; i < 5; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), []byte{})
+	}
+	for i := 0; i < 2; i++ {
+		db.Delete([]byte(fmt.Sprintf("deleted_key_%08d", i)))
+	}
+
+	check := func(h HistogramStats, scale uint64) {
+		t.Helper()
+		wantKeys := map[int]uint64{2: 10, 4: 5, 5: 2} // 3 -> [2,4), 10 -> [8,16), 20 -> [16,32)
+		wantValues := map[int]uint64{0: 5, 7: 10}     // 0, 100 -> [64,128)
+		for i := 0; i < SizeHistogramBuckets; i++ {
+			if got := h.KeySizes.Buckets[i]; got != wantKeys[i]*scale {
+				t.Errorf("Key bucket %d: expected %d, got %d", i, wantKeys[i]*scale, got)
+			}
+			if got := h.ValueSizes.Buckets[i]; got != wantValues[i]*scale {
+				t.Errorf("Value bucket %d: expected %d, got %d", i, wantValues[i]*scale, got)
+			}
+		}
+		if h.KeySizes.Count != 17*scale || h.ValueSizes.Count != 15*scale {
+			t.Errorf("Expected %d keys and %d values, got %d and %d", 17*scale, 15*scale, h.KeySizes.Count, h.ValueSizes.Count)
+		}
+	}
+
+	h, err := db.HistogramStats(false)
+	if err != nil {
+		t.Fatalf("HistogramStats failed: %v", err)
+	}
+	check(h, 1)
+	if h.MemtableSamples != 17 || h.SSTableSamples != 0 {
+		t.Errorf("Expected 17 memtable samples, got %d (+%d from SSTables)", h.MemtableSamples, h.SSTableSamples)
+	}
+
+	// Once flushed, the same entries are only found by sampling SSTables
+	forceFlush(t, db)
+	if h, _ = db.HistogramStats(false); h.KeySizes.Count != 0 {
+		t.Errorf("Expected no samples without SSTables, got %d", h.KeySizes.Count)
+	}
+	h, err = db.HistogramStats(true)
+	if err != nil {
+		t.Fatalf("HistogramStats failed: %v", err)
+	}
+	check(h, 1)
+	if h.SSTableSamples != 17 {
+		t.Errorf("Expected 17 SSTable samples, got %d", h.SSTableSamples)
+	}
+}
+
+func TestDBHistogramStatsBounded(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 64 * 1024 * 1024 // Keep every entry in the memtable
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 2*histogramMemtableSamples; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), value)
+	}
+	h, err := db.HistogramStats(false)
+	if err != nil {
+		t.Fatalf("HistogramStats failed: %v", err)
+	}
+	if h.MemtableSamples != histogramMemtableSamples {
+		t.Errorf("Expected %d memtable samples, got %d", histogramMemtableSamples, h.MemtableSamples)
+	}
+
+	// A table of many blocks is only partly read
+	forceFlush(t, db)
+	if h, err = db.HistogramStats(true); err != nil {
+		t.Fatalf("HistogramStats failed: %v", err)
+	}
+	if h.SSTableSamples == 0 || h.SSTableSamples >= 2*histogramMemtableSamples/10 {
+		t.Errorf("Expected a few blocks' worth of SSTable samples, got %d", h.SSTableSamples)
+	}
+}
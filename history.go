@@ -0,0 +1,148 @@
+package lsm
+
+import "fmt"
+
+// HistoryFileName is the file in the DB directory holding the history
+// floor: the sequence number below which GetAsOf may no longer see every
+// version, because a compaction or purge dropped keys entirely
+const HistoryFileName = "HISTORY"
+
+// seqRange bounds the write sequence numbers of a memtable's or SSTable's
+// entries (inclusive)
+type seqRange struct {
+	min, max uint64
+}
+
+// GetAsOf returns the value key had just after the write with sequence
+// number seq (see LastSequence), or ErrNotFound if it was absent or
+// deleted then.
+//
+// Entries don't carry their own sequence numbers: each memtable and
+// SSTable records the range of numbers written to it, and overwrites
+// within one of them replace the older version. So a version is only
+// found if a source holding the key has its whole range at or below seq,
+// after skipping newer sources. ErrVersionUnavailable is returned when
+// the source with the key straddles seq, or seq is below the history
+// floor left by compactions that drop tombstones (every full compaction)
+// and by PurgeTombstonesOnFlush.
+func (db *DB) GetAsOf(key []byte, seq uint64) ([]byte, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if seq < db.historyFloor {
+		return nil, fmt.Errorf("%w: sequence %d is below the history floor %d", ErrVersionUnavailable, seq, db.historyFloor)
+	}
+
+	// resolve settles the lookup at a source holding key, or reports that
+	// every version there is newer than seq
+	resolve := func(entry Entry, seqs *seqRange) (value []byte, done bool, err error) {
+		var r seqRange // Unrecorded: every write is below the floor
+		if seqs != nil {
+			r = *seqs
+		}
+		switch {
+		case r.min > seq:
+			return nil, false, nil
+		case r.max > seq:
+			return nil, true, fmt.Errorf("%w: versions written between sequences %d and %d are merged", ErrVersionUnavailable, r.min, r.max)
+		case entry.Deleted:
+			return nil, true, ErrNotFound
+		}
+		return entry.Value, true, nil
+	}
+
+	for _, mem := range []*Memtable{db.memtable, db.immutable} {
+		if mem == nil {
+			continue
+		}
+		if entry, found := mem.GetEntry(key); found {
+			if value, done, err := resolve(ownedEntry(entry), mem.seqs); done {
+				return value, err
+			}
+		}
+	}
+
+	for _, sst := range db.sstables {
+		if !sst.MayContain(key) {
+			continue
+		}
+		entry, found, err := sst.lookupEntry(key, true)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if value, done, err := resolve(entry, sst.seqs); done {
+				return value, err
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// loadHistoryFloor reads HISTORY, raising the floor to the current
+// sequence if any SSTable predates sequence ranges, since its history may
+// already have been compacted away
+// Must be called after loadSequence and loadSSTables
+func (db *DB) loadHistoryFloor() error {
+	floor, _, err := db.readNumberFile(HistoryFileName)
+	if err != nil {
+		return fmt.Errorf("failed to read history file: %w", err)
+	}
+	db.historyFloor = floor
+
+	// Tables copied in without SEQ and HISTORY (e.g. restored from a
+	// backup) can hold higher sequences than SEQ, and unknown history
+	if last := tablesSeqRange(db.sstables).max; last > db.seq.Load() {
+		db.seq.Store(last)
+		if err := db.leaseSequence(last + 1 + sequenceLease); err != nil {
+			return err
+		}
+		if err := db.raiseHistoryFloor(last); err != nil {
+			return err
+		}
+	}
+
+	for _, sst := range db.sstables {
+		if sst.seqs == nil {
+			return db.raiseHistoryFloor(db.seq.Load())
+		}
+	}
+	return nil
+}
+
+// raiseHistoryFloor durably moves the history floor up to floor
+// Callers raise it before dropping versions, so a crash part way leaves
+// the floor too high rather than too low.
+// Must be called with db.mu held
+func (db *DB) raiseHistoryFloor(floor uint64) error {
+	if floor <= db.historyFloor {
+		return nil
+	}
+	if err := db.writeNumberFile(HistoryFileName, floor); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	db.historyFloor = floor
+	return nil
+}
+
+// tablesSeqRange returns the union of tables' sequence ranges, counting
+// tables without one as [0, 0] since they are below the history floor
+func tablesSeqRange(tables []*SSTableReader) seqRange {
+	var r seqRange
+	for i, sst := range tables {
+		var seqs seqRange
+		if sst.seqs != nil {
+			seqs = *sst.seqs
+		}
+		if i == 0 {
+			r = seqs
+			continue
+		}
+		r.min, r.max = min(r.min, seqs.min), max(r.max, seqs.max)
+	}
+	return r
+}
@@ -0,0 +1,195 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// indexKeyPrefix starts every secondary index entry's key
+// Entries live in the same keyspace as user data, so writes reject user
+// keys starting with it (ErrReservedKey) and scans skip them.
+const indexKeyPrefix = "\x00idx\x00"
+
+// isIndexKey reports whether key is in the secondary index keyspace
+func isIndexKey(key []byte) bool {
+	return bytes.HasPrefix(key, []byte(indexKeyPrefix))
+}
+
+// skipIndexEntries moves every child positioned in the secondary index
+// keyspace past it; children must be positioned at or after its start
+func skipIndexEntries(children []internalIterator, cmp Comparator) {
+	past := prefixEnd([]byte(indexKeyPrefix))
+	for _, child := range children {
+		if child.Valid() && cmp.Compare(child.Key(), past) < 0 {
+			child.Seek(past)
+		}
+	}
+}
+
+// outsideIndexes splits [start, end) (nil = unbounded) into the parts
+// below and above the secondary index keyspace, leaving out empty ones
+func outsideIndexes(start, end []byte) [][2][]byte {
+	lo := []byte(indexKeyPrefix)
+	hi := prefixEnd(lo)
+	var ranges [][2][]byte
+	if start == nil || bytes.Compare(start, lo) < 0 {
+		upper := lo
+		if end != nil && bytes.Compare(end, lo) < 0 {
+			upper = end
+		}
+		if start == nil || bytes.Compare(start, upper) < 0 {
+			ranges = append(ranges, [2][]byte{start, upper})
+		}
+	}
+	if end == nil || bytes.Compare(end, hi) > 0 {
+		lower := hi
+		if start != nil && bytes.Compare(start, hi) > 0 {
+			lower = start
+		}
+		if end == nil || bytes.Compare(lower, end) < 0 {
+			ranges = append(ranges, [2][]byte{lower, end})
+		}
+	}
+	return ranges
+}
+
+// IndexExtractFunc returns the field a record is indexed by, or nil to
+// leave the record out of the index
+type IndexExtractFunc func(key, value []byte) []byte
+
+// secondaryIndex maps an extracted field to primary keys
+// Entry keys are [prefix][name][0][field][0][primary key], so entries sort
+// by field and then primary key; the value is the primary key.
+type secondaryIndex struct {
+	name    string
+	extract IndexExtractFunc
+}
+
+// base returns the key prefix shared by all of the index's entries
+func (idx *secondaryIndex) base() []byte {
+	return []byte(indexKeyPrefix + idx.name + "\x00")
+}
+
+// entryKey returns the key of the index entry for field -> primary
+func (idx *secondaryIndex) entryKey(field, primary []byte) []byte {
+	key := idx.base()
+	key = append(key, field...)
+	key = append(key, 0)
+	return append(key, primary...)
+}
+
+// CreateIndex registers a secondary index over a field of each value
+// From then on Put and Delete keep an entry per record mapping the field
+// returned by extract to the record's key; overwriting a record moves its
+// entry. Entries are stored in the DB, but extract is not: call CreateIndex
+// with the same function after every Open, before writing. Records written
+// while the index isn't registered are not indexed. Fields should not
+// contain 0x00 bytes, or range scans may order them unexpectedly.
+func (db *DB) CreateIndex(name string, extract IndexExtractFunc) error {
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if name == "" || bytes.IndexByte([]byte(name), 0) >= 0 {
+		return fmt.Errorf("invalid index name %q", name)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.indexes[name]; ok {
+		return fmt.Errorf("%w: %s", ErrIndexExists, name)
+	}
+	if db.indexes == nil {
+		db.indexes = make(map[string]*secondaryIndex)
+	}
+	db.indexes[name] = &secondaryIndex{name: name, extract: extract}
+	return nil
+}
+
+// updateIndexes moves key's index entries from its old value to its new
+// one; the live flags say whether each version exists (false = absent or
+// deleted). Must be called with db.mu held
+func (db *DB) updateIndexes(key, oldValue []byte, oldLive bool, newValue []byte, newLive bool) error {
+	if isIndexKey(key) {
+		return nil
+	}
+
+	for _, idx := range db.indexes {
+		var oldField, newField []byte
+		if oldLive {
+			oldField = idx.extract(key, oldValue)
+		}
+		if newLive {
+			newField = idx.extract(key, newValue)
+		}
+		if oldField != nil && newField != nil && bytes.Equal(oldField, newField) {
+			continue
+		}
+
+		if oldField != nil {
+			if err := db.apply(RecordTypeDelete, idx.entryKey(oldField, key), nil, 0, false); err != nil {
+				return fmt.Errorf("failed to update index %s: %w", idx.name, err)
+			}
+		}
+		if newField != nil {
+			if err := db.apply(RecordTypePut, idx.entryKey(newField, key), key, 0, false); err != nil {
+				return fmt.Errorf("failed to update index %s: %w", idx.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// IndexScan returns the keys of records whose indexed field is in
+// [start, end), ordered by field and then key
+// A nil start or end means unbounded on that side. Entries left stale by a
+// crash between a record's write and its index update are skipped.
+func (db *DB) IndexScan(name string, start, end []byte) ([][]byte, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	db.mu.RLock()
+	idx, ok := db.indexes[name]
+	db.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIndex, name)
+	}
+
+	base := idx.base()
+	lower := append(idx.base(), start...)
+	upper := prefixEnd(base)
+	if end != nil {
+		upper = append(idx.base(), end...)
+	}
+
+	iter := db.newIterator(lower, upper, nil, true)
+	defer iter.Close()
+
+	var keys [][]byte
+	for ; iter.Valid(); iter.Next() {
+		primary := iter.Value()
+		if len(iter.Key()) < len(base)+len(primary)+1 {
+			continue // Not written by updateIndexes
+		}
+		field := iter.Key()[len(base) : len(iter.Key())-len(primary)-1]
+
+		// Check the entry against the record it points at
+		value, err := db.Get(primary)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(idx.extract(primary, value), field) {
+			continue
+		}
+		keys = append(keys, append([]byte(nil), primary...))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -0,0 +1,204 @@
+package lsm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// extractAge indexes JSON records by their zero-padded "age" field
+func extractAge(key, value []byte) []byte {
+	var record struct {
+		Age *int `json:"age"`
+	}
+	if err := json.Unmarshal(value, &record); err != nil || record.Age == nil {
+		return nil
+	}
+	return []byte(fmt.Sprintf("%03d", *record.Age))
+}
+
+func indexScanStrings(t *testing.T, db *DB, start, end string) []string {
+	t.Helper()
+	var lo, hi []byte
+	if start != "" {
+		lo = []byte(start)
+	}
+	if end != "" {
+		hi = []byte(end)
+	}
+	keys, err := db.IndexScan("age", lo, hi)
+	if err != nil {
+		t.Fatalf("Failed to scan index: %v", err)
+	}
+	out := make([]string, len(keys))
+	for i, key := range keys {
+		out[i] = string(key)
+	}
+	return out
+}
+
+func TestDBSecondaryIndex(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.CreateIndex("age", extractAge); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	if err := db.CreateIndex("age", extractAge); !errors.Is(err, ErrIndexExists) {
+		t.Errorf("Expected ErrIndexExists, got %v", err)
+	}
+
+	users := map[string]string{
+		"user:alice": `{"name":"alice","age":31}`,
+		"user:bob":   `{"name":"bob","age":25}`,
+		"user:carol": `{"name":"carol","age":42}`,
+		"user:dave":  `{"name":"dave","age":31}`,
+		"user:eve":   `{"name":"eve"}`, // No age, not indexed
+	}
+	for key, value := range users {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	check := func(start, end string, want ...string) {
+		t.Helper()
+		got := indexScanStrings(t, db, start, end)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("IndexScan [%q, %q): expected %v, got %v", start, end, want, got)
+		}
+	}
+
+	check("030", "040", "user:alice", "user:dave")
+	check("", "", "user:bob", "user:alice", "user:dave", "user:carol")
+
+	// Overwrites move the entry, deletes remove it
+	db.Put([]byte("user:alice"), []byte(`{"name":"alice","age":26}`))
+	db.Delete([]byte("user:carol"))
+	db.Put([]byte("user:bob"), []byte(`{"name":"bob"}`))
+	check("", "", "user:alice", "user:dave")
+
+	// Index entries survive flushes and DeleteMulti keeps them in step
+	forceFlush(t, db)
+	db.Put([]byte("user:eve"), []byte(`{"name":"eve","age":50}`))
+	check("030", "", "user:dave", "user:eve")
+	if err := db.DeleteMulti([][]byte{[]byte("user:dave"), []byte("user:zed")}); err != nil {
+		t.Fatalf("Failed to delete: %v", err)
+	}
+	check("", "", "user:alice", "user:eve")
+
+	if _, err := db.IndexScan("missing", nil, nil); !errors.Is(err, ErrUnknownIndex) {
+		t.Errorf("Expected ErrUnknownIndex, got %v", err)
+	}
+}
+
+func TestDBSecondaryIndexSkipsStaleEntries(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	if err := db.CreateIndex("age", extractAge); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	db.Put([]byte("user:alice"), []byte(`{"age":31}`))
+
+	// An entry whose record changed without the index, as after a crash
+	// between the two writes
+	idx := db.indexes["age"]
+	db.Put(idx.entryKey([]byte("099"), []byte("user:alice")), []byte("user:alice"))
+	db.Put(idx.entryKey([]byte("020"), []byte("user:ghost")), []byte("user:ghost"))
+
+	if got := indexScanStrings(t, db, "", ""); fmt.Sprint(got) != "[user:alice]" {
+		t.Errorf("Expected only user:alice, got %v", got)
+	}
+}
+
+func TestDBIndexEntriesHidden(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	city := func(key, value []byte) []byte { return value }
+	if err := db.CreateIndex("city", city); err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	// User keys on both sides of the index keyspace
+	for _, key := range []string{"\x00a", "alice", "zed"} {
+		if err := db.Put([]byte(key), []byte("paris")); err != nil {
+			t.Fatalf("Put(%q) failed: %v", key, err)
+		}
+	}
+
+	// Callers can't forge index entries
+	forged := []byte(indexKeyPrefix + "city\x00rome\x00\x00a")
+	if err := db.Put(forged, []byte("\x00a")); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey from Put, got %v", err)
+	}
+	if err := db.Delete(forged); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey from Delete, got %v", err)
+	}
+	if err := db.DeleteMulti([][]byte{forged}); !errors.Is(err, ErrReservedKey) {
+		t.Errorf("Expected ErrReservedKey from DeleteMulti, got %v", err)
+	}
+
+	want := []string{"\x00a", "alice", "zed"}
+	check := func(stage string) {
+		t.Helper()
+		keys, err := db.Keys(nil, 100)
+		if err != nil || len(keys) != len(want) {
+			t.Fatalf("%s: Keys returned %q (err=%v)", stage, keys, err)
+		}
+		it := db.NewIterator(nil, nil)
+		for i := 0; it.Valid(); it.Next() {
+			if i >= len(want) || string(it.Key()) != want[i] || string(keys[i]) != want[i] {
+				t.Errorf("%s: unexpected key %q at %d", stage, it.Key(), i)
+			}
+			i++
+		}
+		it.Close()
+		if n, err := db.CountInRange(nil, nil); err != nil || n != 3 {
+			t.Errorf("%s: CountInRange = %d (err=%v)", stage, n, err)
+		}
+		if page, next, err := db.ScanPage(nil, 10); err != nil || len(page) != 3 || next != nil {
+			t.Errorf("%s: ScanPage returned %d entries (next=%q, err=%v)", stage, len(page), next, err)
+		}
+		if n, err := db.ApproximateCountInRange([]byte(indexKeyPrefix), prefixEnd([]byte(indexKeyPrefix))); err != nil || n != 0 {
+			t.Errorf("%s: expected no estimated keys in the index keyspace, got %d (err=%v)", stage, n, err)
+		}
+		if got, err := db.IndexScan("city", []byte("paris"), nil); err != nil || len(got) != 3 {
+			t.Errorf("%s: IndexScan returned %q (err=%v)", stage, got, err)
+		}
+	}
+
+	check("memtable")
+	if n, err := db.ApproximateCountInRange(nil, nil); err != nil || n != 3 {
+		t.Errorf("Expected an exact estimate of 3 from the memtable, got %d (err=%v)", n, err)
+	}
+	forceFlush(t, db)
+
+	// Moving alice rewrites her index entries in a newer source
+	db.Put([]byte("alice"), []byte("rome"))
+	conflicts, err := db.VersionConflicts(nil, nil)
+	if err != nil || len(conflicts) != 1 || string(conflicts[0].Key) != "alice" {
+		t.Errorf("Expected only alice to conflict, got %+v (err=%v)", conflicts, err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("compacted")
+	if got, err := db.IndexScan("city", []byte("rome"), nil); err != nil || len(got) != 1 || string(got[0]) != "alice" {
+		t.Errorf("Expected the compacted index to find alice in rome, got %q (err=%v)", got, err)
+	}
+}
@@ -0,0 +1,549 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// internalIterator is the common interface of memtable and SSTable iterators
+// Tombstones are visible at this level (IsDeleted)
+type internalIterator interface {
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	IsDeleted() bool
+	Timestamp() uint64
+	Next()
+	Seek(target []byte)
+}
+
+// sliceIterator iterates over a sorted, private copy of memtable entries
+// Used so a DB iterator doesn't hold the skip list read lock while open
+type sliceIterator struct {
+	entries    []Entry
+	pos        int
+	comparator Comparator
+}
+
+func (it *sliceIterator) Valid() bool       { return it.pos < len(it.entries) }
+func (it *sliceIterator) Key() []byte       { return it.entries[it.pos].Key }
+func (it *sliceIterator) Value() []byte     { return it.entries[it.pos].Value }
+func (it *sliceIterator) IsDeleted() bool   { return it.entries[it.pos].Deleted }
+func (it *sliceIterator) Timestamp() uint64 { return it.entries[it.pos].Timestamp }
+func (it *sliceIterator) Next()             { it.pos++ }
+
+// Seek positions at the first entry >= target
+func (it *sliceIterator) Seek(target []byte) {
+	it.pos = sort.Search(len(it.entries), func(i int) bool {
+		return it.comparator.Compare(it.entries[i].Key, target) >= 0
+	})
+}
+
+// copyMemtableRange copies entries in [start, end) out of a memtable
+// A nil start or end means unbounded on that side
+func copyMemtableRange(mem *Memtable, comparator Comparator, start, end []byte) *sliceIterator {
+	iter := mem.NewIterator()
+	defer iter.Close()
+
+	if start != nil {
+		iter.Seek(start)
+	} else {
+		iter.SeekToFirst()
+	}
+
+	var entries []Entry
+	for ; iter.Valid(); iter.Next() {
+		if end != nil && comparator.Compare(iter.Key(), end) >= 0 {
+			break
+		}
+		entries = append(entries, *iter.Entry())
+	}
+
+	return &sliceIterator{entries: entries, comparator: comparator}
+}
+
+// DBIterator iterates over live keys in [start, end) in sorted order
+// It merges the memtables and all SSTables, returning the newest version
+// of each key and skipping tombstones.
+//
+// Memtable contents are copied when the iterator is created, so the
+// iterator never blocks writers. Close must be called when done.
+//
+// Each key is returned once, so a full scan is also the way to export the
+// live dataset; use NewIteratorOpt with FillCache false for large exports.
+type DBIterator struct {
+	children   []internalIterator // Newest source first
+	db         *DB
+	tables     []*SSTableReader // Pinned until Close (see sources)
+	start      []byte
+	end        []byte
+	comparator Comparator
+
+	key       []byte
+	value     []byte
+	timestamp uint64
+	deleted   bool
+	valid     bool
+
+	// tombstones returns the newest tombstone of a key instead of hiding
+	// it, for merges whose output must still hide older tables
+	tombstones bool
+
+	// indexEntries returns secondary index entries, which user scans skip
+	indexEntries bool
+
+	entriesSeen uint64 // Live entries returned so far
+	bytesRead   uint64 // Key+value bytes consumed from all sources
+
+	err error // First source error; iteration stops there
+}
+
+// NewIterator returns an iterator over live keys in [start, end)
+// A nil start or end means unbounded on that side
+func (db *DB) NewIterator(start, end []byte) *DBIterator {
+	return db.NewIteratorOpt(start, end, nil)
+}
+
+// NewIteratorOpt is NewIterator with read options (nil = defaults)
+func (db *DB) NewIteratorOpt(start, end []byte, opts *ReadOptions) *DBIterator {
+	return db.newIterator(start, end, opts, false)
+}
+
+// newIterator is NewIteratorOpt, also returning secondary index entries
+// if indexEntries is set
+func (db *DB) newIterator(start, end []byte, opts *ReadOptions, indexEntries bool) *DBIterator {
+	it := &DBIterator{start: start, end: end, comparator: DefaultComparator{}, indexEntries: indexEntries}
+	if db.closed.Load() {
+		return it
+	}
+
+	it.db = db
+	it.children, _, it.tables = db.sources(start, end, opts.fillCache())
+	it.findNext()
+	return it
+}
+
+// sources returns positioned iterators over every source of keys in
+// [start, end), newest first, with a name for each: "memtable",
+// "immutable" or the SSTable's path. The SSTables they read are pinned,
+// like a Snapshot's, so compaction can't close them; the caller must
+// pass the returned tables to db.releaseTables when done.
+func (db *DB) sources(start, end []byte, fillCache bool) ([]internalIterator, []string, []*SSTableReader) {
+	comparator := DefaultComparator{}
+	prefix := db.rangePrefix(start, end)
+
+	var children []internalIterator
+	var names []string
+
+	db.mu.Lock()
+	children = append(children, copyMemtableRange(db.memtable, comparator, start, end))
+	names = append(names, "memtable")
+	if db.immutable != nil {
+		children = append(children, copyMemtableRange(db.immutable, comparator, start, end))
+		names = append(names, "immutable")
+	}
+	var tables []*SSTableReader
+	for _, sst := range db.sstables {
+		if prefix != nil && !sst.MayContainPrefix(prefix) {
+			continue // No key in the range
+		}
+		tables = append(tables, sst)
+		db.pins[sst]++
+	}
+	db.mu.Unlock()
+
+	// Position outside the lock, since it reads from disk
+	for _, sst := range tables {
+		sstIter := sst.NewRangeIterator(start, end)
+		sstIter.SetFillCache(fillCache)
+		sstIter.SeekToFirst()
+		children = append(children, sstIter)
+		names = append(names, sst.Path())
+	}
+	return children, names, tables
+}
+
+// SourceVersion is one source's version of a key
+type SourceVersion struct {
+	Source    string // "memtable", "immutable" or an SSTable path
+	Value     []byte
+	Deleted   bool
+	Timestamp uint64
+}
+
+// VersionConflict is a key whose sources disagree, newest source first
+type VersionConflict struct {
+	Key      []byte
+	Versions []SourceVersion
+}
+
+// VersionConflicts is a diagnostic scan over keys in [start, end) that,
+// instead of keeping the newest version of each key, reports every key
+// held by more than one source with differing values (or a value and a
+// tombstone). Use it to see what shadowing hides, e.g. when replicas
+// diverge. Results are copies, in key order.
+func (db *DB) VersionConflicts(start, end []byte) ([]VersionConflict, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	comparator := DefaultComparator{}
+	children, names, tables := db.sources(start, end, false)
+	defer db.releaseTables(tables)
+
+	var conflicts []VersionConflict
+	for {
+		var key []byte
+		for _, child := range children {
+			if !child.Valid() {
+				if failed, ok := child.(interface{ Err() error }); ok && failed.Err() != nil {
+					return nil, failed.Err()
+				}
+				continue
+			}
+			if key == nil || comparator.Compare(child.Key(), key) < 0 {
+				key = child.Key()
+			}
+		}
+		if key == nil || (end != nil && comparator.Compare(key, end) >= 0) {
+			return conflicts, nil
+		}
+		if isIndexKey(key) {
+			skipIndexEntries(children, comparator)
+			continue
+		}
+
+		key = append([]byte(nil), key...)
+		var versions []SourceVersion
+		for i, child := range children {
+			if child.Valid() && comparator.Compare(child.Key(), key) == 0 {
+				versions = append(versions, SourceVersion{
+					Source:    names[i],
+					Value:     append([]byte(nil), child.Value()...),
+					Deleted:   child.IsDeleted(),
+					Timestamp: child.Timestamp(),
+				})
+				child.Next()
+			}
+		}
+
+		for _, v := range versions[1:] {
+			if v.Deleted != versions[0].Deleted || !bytes.Equal(v.Value, versions[0].Value) {
+				conflicts = append(conflicts, VersionConflict{Key: key, Versions: versions})
+				break
+			}
+		}
+	}
+}
+
+// rangePrefix returns the extracted prefix shared by every key in
+// [start, end), or nil if there is no extractor or no single prefix
+func (db *DB) rangePrefix(start, end []byte) []byte {
+	extract := db.opts.PrefixExtractor
+	if extract == nil || start == nil || end == nil {
+		return nil
+	}
+	prefix := extract(start)
+	if prefix == nil {
+		return nil
+	}
+	limit := prefixEnd(prefix)
+	if limit == nil || bytes.Compare(end, limit) > 0 {
+		return nil
+	}
+	return prefix
+}
+
+// ScanPrefix returns an iterator over live keys starting with prefix
+func (db *DB) ScanPrefix(prefix []byte) *DBIterator {
+	return db.NewIterator(prefix, prefixEnd(prefix))
+}
+
+// Keys returns up to limit live keys with the given prefix, in sorted order
+// A limit of 0 means no limit. The returned keys are copies.
+func (db *DB) Keys(prefix []byte, limit int) ([][]byte, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	iter := db.ScanPrefix(prefix)
+	defer iter.Close()
+
+	var keys [][]byte
+	for ; iter.Valid(); iter.Next() {
+		if limit > 0 && len(keys) >= limit {
+			break
+		}
+		keys = append(keys, append([]byte(nil), iter.Key()...))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CountInRange returns the number of live keys in [start, end) (nil =
+// unbounded) by a merging scan, reading every entry in the range
+func (db *DB) CountInRange(start, end []byte) (uint64, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	iter := db.NewIterator(start, end)
+	defer iter.Close()
+
+	var n uint64
+	for ; iter.Valid(); iter.Next() {
+		n++
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ApproximateCountInRange estimates CountInRange without reading SSTable
+// data blocks, from the per-block entry counts in their indexes; blocks
+// straddling start or end count half. Entries in each memtable and SSTable
+// are counted separately, so keys with versions in several places, and
+// tombstones, count too: it overestimates after many overwrites or deletes
+// until a compaction.
+func (db *DB) ApproximateCountInRange(start, end []byte) (uint64, error) {
+	if db.closed.Load() {
+		return 0, ErrClosed
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// Secondary index entries aren't user keys
+	var total float64
+	for _, r := range outsideIndexes(start, end) {
+		n, err := db.approximateCount(r[0], r[1])
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return uint64(math.Round(total)), nil
+}
+
+// approximateCount is ApproximateCountInRange for any range
+// Must be called with db.mu held
+func (db *DB) approximateCount(start, end []byte) (float64, error) {
+	var total float64
+	cmp := DefaultComparator{}
+	for _, mem := range []*Memtable{db.memtable, db.immutable} {
+		if mem == nil {
+			continue
+		}
+		it := mem.NewIterator()
+		if start != nil {
+			it.Seek(start)
+		} else {
+			it.SeekToFirst()
+		}
+		for ; it.Valid() && (end == nil || cmp.Compare(it.Key(), end) < 0); it.Next() {
+			total++
+		}
+		it.Close()
+	}
+
+	for _, sst := range db.sstables {
+		n, err := sst.approximateCount(start, end)
+		if err != nil {
+			return 0, fmt.Errorf("failed to estimate %s: %w", sst.Path(), err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// KeyValue is a key and its value
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+}
+
+// ScanPage returns up to limit live entries with keys >= start (nil = from
+// the beginning), plus the cursor to pass as start for the next page
+// The cursor is nil once the scan is complete. It is the smallest key after
+// the page's last key, so the next page resumes strictly after it even if
+// that key is rewritten in between. Keys and values are copies and no
+// iterator is left open, so pages can be served across requests.
+func (db *DB) ScanPage(start []byte, limit int) ([]KeyValue, []byte, error) {
+	if db.closed.Load() {
+		return nil, nil, ErrClosed
+	}
+	if limit <= 0 {
+		return nil, nil, fmt.Errorf("invalid page limit %d", limit)
+	}
+
+	iter := db.NewIterator(start, nil)
+	defer iter.Close()
+
+	var page []KeyValue
+	for ; iter.Valid() && len(page) < limit; iter.Next() {
+		page = append(page, KeyValue{
+			Key:   append([]byte(nil), iter.Key()...),
+			Value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, err
+	}
+	if !iter.Valid() {
+		return page, nil, nil
+	}
+
+	last := page[len(page)-1].Key
+	return page, append(append([]byte(nil), last...), 0), nil
+}
+
+// prefixEnd returns the smallest key greater than every key with prefix
+// Returns nil (unbounded) if the prefix is empty or all 0xFF bytes
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// findNext moves to the next live key across all children
+func (it *DBIterator) findNext() {
+	for {
+		// Smallest key wins; on ties the newest child (lowest index) wins
+		newest := -1
+		for i, child := range it.children {
+			if !child.Valid() {
+				// A source that failed would silently drop its remaining
+				// keys, so stop the whole merge
+				if failed, ok := child.(interface{ Err() error }); ok && failed.Err() != nil {
+					it.err = failed.Err()
+					it.valid = false
+					return
+				}
+				continue
+			}
+			if newest < 0 || it.comparator.Compare(child.Key(), it.children[newest].Key()) < 0 {
+				newest = i
+			}
+		}
+
+		if newest < 0 {
+			it.valid = false
+			return
+		}
+
+		key := it.children[newest].Key()
+		if it.end != nil && it.comparator.Compare(key, it.end) >= 0 {
+			it.valid = false
+			return
+		}
+		if !it.indexEntries && isIndexKey(key) {
+			skipIndexEntries(it.children, it.comparator)
+			continue
+		}
+
+		value := it.children[newest].Value()
+		deleted := it.children[newest].IsDeleted()
+		timestamp := it.children[newest].Timestamp()
+
+		// Advance every child positioned on this key (older versions are shadowed)
+		for _, child := range it.children {
+			if child.Valid() && it.comparator.Compare(child.Key(), key) == 0 {
+				it.bytesRead += uint64(len(child.Key()) + len(child.Value()))
+				child.Next()
+			}
+		}
+
+		if deleted && !it.tombstones {
+			continue // Tombstone hides the key
+		}
+
+		it.key = key
+		it.value = value
+		it.timestamp = timestamp
+		it.deleted = deleted
+		it.valid = true
+		it.entriesSeen++
+		return
+	}
+}
+
+// Seek positions the iterator at the first live key >= target
+// The existing sources are repositioned rather than rebuilt, so repeated
+// seeks (e.g. a merge-join against another sorted stream) are cheap. The
+// iterator still sees the data as of its creation, and targets before its
+// start bound seek to the start.
+func (it *DBIterator) Seek(target []byte) {
+	if it.start != nil && it.comparator.Compare(target, it.start) < 0 {
+		target = it.start
+	}
+	for _, child := range it.children {
+		child.Seek(target)
+	}
+	it.err = nil
+	it.findNext()
+}
+
+// Valid returns true if the iterator is positioned at a live key
+func (it *DBIterator) Valid() bool {
+	return it.valid
+}
+
+// Next advances to the next live key
+func (it *DBIterator) Next() {
+	if it.valid {
+		it.findNext()
+	}
+}
+
+// Key returns the current key
+func (it *DBIterator) Key() []byte {
+	return it.key
+}
+
+// Value returns the current value
+func (it *DBIterator) Value() []byte {
+	return it.value
+}
+
+// Timestamp returns the current value's timestamp (0 if unversioned)
+func (it *DBIterator) Timestamp() uint64 {
+	return it.timestamp
+}
+
+// EntriesSeen returns the number of live entries returned so far
+func (it *DBIterator) EntriesSeen() uint64 {
+	return it.entriesSeen
+}
+
+// BytesRead returns the key+value bytes consumed so far, including
+// shadowed versions and tombstones that were skipped
+func (it *DBIterator) BytesRead() uint64 {
+	return it.bytesRead
+}
+
+// Err returns the error that ended iteration early, such as an SSTable
+// block that failed its CRC; nil if the iterator ran out of keys normally.
+// Check it after a scan: on error the scan is incomplete.
+func (it *DBIterator) Err() error {
+	return it.err
+}
+
+// Close releases the iterator
+func (it *DBIterator) Close() {
+	it.children = nil
+	it.valid = false
+	if it.tables != nil {
+		it.db.releaseTables(it.tables)
+		it.tables = nil
+	}
+}
@@ -0,0 +1,545 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDBIteratorMergesSources(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Oldest table
+	db.Put([]byte("a"), []byte("a1"))
+	db.Put([]byte("b"), []byte("b1"))
+	db.Put([]byte("c"), []byte("c1"))
+	forceFlush(t, db)
+
+	// Newer table overwrites b and deletes c
+	db.Put([]byte("b"), []byte("b2"))
+	db.Delete([]byte("c"))
+	db.Put([]byte("d"), []byte("d2"))
+	forceFlush(t, db)
+
+	// Memtable overwrites d and adds e
+	db.Put([]byte("d"), []byte("d3"))
+	db.Put([]byte("e"), []byte("e3"))
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Close()
+
+	var got []string
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+
+	expected := []string{"a=a1", "b=b2", "d=d3", "e=e3"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("At index %d: expected %s, got %s", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestDBIteratorRange(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d", i)))
+	}
+
+	iter := db.NewIterator([]byte("key_020"), []byte("key_030"))
+	defer iter.Close()
+
+	i := 20
+	for ; iter.Valid(); iter.Next() {
+		expected := fmt.Sprintf("key_%03d", i)
+		if string(iter.Key()) != expected {
+			t.Fatalf("Expected %s, got %s", expected, iter.Key())
+		}
+		i++
+	}
+	if i != 30 {
+		t.Errorf("Expected to stop before key_030, stopped at key_%03d", i)
+	}
+}
+
+func TestDBIteratorProgress(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.MemtableSize = 1024
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), []byte("value"))
+	}
+	// Delete every tenth key so live count differs from entries written
+	for i := 0; i < 200; i += 10 {
+		db.Delete([]byte(fmt.Sprintf("key_%03d", i)))
+	}
+
+	iter := db.NewIterator(nil, nil)
+	defer iter.Close()
+
+	var lastBytes uint64
+	live := 0
+	for ; iter.Valid(); iter.Next() {
+		live++
+		if iter.EntriesSeen() != uint64(live) {
+			t.Fatalf("EntriesSeen=%d, expected %d", iter.EntriesSeen(), live)
+		}
+		if iter.BytesRead() <= lastBytes {
+			t.Fatalf("BytesRead did not advance: %d", iter.BytesRead())
+		}
+		lastBytes = iter.BytesRead()
+	}
+
+	if live != 180 {
+		t.Errorf("Expected 180 live keys, got %d", live)
+	}
+	if iter.EntriesSeen() != 180 {
+		t.Errorf("Expected EntriesSeen=180, got %d", iter.EntriesSeen())
+	}
+}
+
+func TestDBKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Put([]byte(fmt.Sprintf("user:%02d", i)), []byte("value"))
+	}
+	db.Put([]byte("user"), []byte("no colon"))
+	db.Put([]byte("users"), []byte("other prefix"))
+	forceFlush(t, db)
+
+	// Deleted keys (in the memtable and flushed) are excluded
+	db.Delete([]byte("user:01"))
+	db.Delete([]byte("user:03"))
+	forceFlush(t, db)
+	db.Delete([]byte("user:05"))
+
+	// More matches than the limit: the first five live keys
+	keys, err := db.Keys([]byte("user:"), 5)
+	if err != nil {
+		t.Fatalf("Keys failed: %v", err)
+	}
+	expected := []string{"user:00", "user:02", "user:04", "user:06", "user:07"}
+	if len(keys) != len(expected) {
+		t.Fatalf("Expected %v, got %q", expected, keys)
+	}
+	for i := range expected {
+		if string(keys[i]) != expected[i] {
+			t.Errorf("At index %d: expected %s, got %s", i, expected[i], keys[i])
+		}
+	}
+
+	// No limit returns every live match and nothing outside the prefix
+	keys, _ = db.Keys([]byte("user:"), 0)
+	if len(keys) != 17 {
+		t.Errorf("Expected 17 keys, got %d: %q", len(keys), keys)
+	}
+
+	// Returned keys are copies
+	keys[0][0] = 'X'
+	if again, _ := db.Keys([]byte("user:"), 1); string(again[0]) != "user:00" {
+		t.Errorf("Mutating a returned key changed the DB: %s", again[0])
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, end []byte
+	}{
+		{[]byte("abc"), []byte("abd")},
+		{[]byte{'a', 0xFF}, []byte("b")},
+		{[]byte{0xFF, 0xFF}, nil},
+		{nil, nil},
+	}
+	for _, tt := range tests {
+		if got := prefixEnd(tt.prefix); string(got) != string(tt.end) || (got == nil) != (tt.end == nil) {
+			t.Errorf("prefixEnd(%q): expected %q, got %q", tt.prefix, tt.end, got)
+		}
+	}
+}
+
+func TestDBIteratorExportDeduplicates(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// "hot" is overwritten in three tables; "gone" is deleted in the last
+	for i := 1; i <= 3; i++ {
+		db.Put([]byte("hot"), []byte(fmt.Sprintf("v%d", i)))
+		db.Put([]byte(fmt.Sprintf("cold_%d", i)), []byte("v"))
+		if i == 1 {
+			db.Put([]byte("gone"), []byte("v"))
+		}
+		if i == 3 {
+			db.Delete([]byte("gone"))
+		}
+		forceFlush(t, db)
+	}
+
+	iter := db.NewIteratorOpt(nil, nil, &ReadOptions{FillCache: false})
+	defer iter.Close()
+
+	seen := make(map[string][]string)
+	for ; iter.Valid(); iter.Next() {
+		seen[string(iter.Key())] = append(seen[string(iter.Key())], string(iter.Value()))
+	}
+
+	if got := seen["hot"]; len(got) != 1 || got[0] != "v3" {
+		t.Errorf("Expected hot exported once as v3, got %v", got)
+	}
+	if got, ok := seen["gone"]; ok {
+		t.Errorf("Expected deleted key not exported, got %v", got)
+	}
+	if len(seen) != 4 {
+		t.Errorf("Expected 4 exported keys, got %v", seen)
+	}
+}
+
+func TestDBScanPage(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Keys where one is a prefix of the next, to exercise the cursor
+	var expected []string
+	for i := 0; i < 25; i++ {
+		key := fmt.Sprintf("key_%02d", i)
+		expected = append(expected, key)
+		db.Put([]byte(key), []byte("value_"+key))
+		if i%5 == 0 {
+			expected = append(expected, key+"\x00")
+			db.Put([]byte(key+"\x00"), []byte("value_"+key))
+		}
+		if i == 12 {
+			forceFlush(t, db)
+		}
+	}
+	db.Put([]byte("deleted"), []byte("value"))
+	db.Delete([]byte("deleted"))
+
+	var got []string
+	var cursor []byte
+	for pages := 0; ; pages++ {
+		if pages > len(expected) {
+			t.Fatal("Pagination did not terminate")
+		}
+		page, next, err := db.ScanPage(cursor, 4)
+		if err != nil {
+			t.Fatalf("Failed to scan page: %v", err)
+		}
+		if len(page) > 4 {
+			t.Fatalf("Page larger than limit: %d", len(page))
+		}
+		for _, kv := range page {
+			if want := "value_" + strings.TrimSuffix(string(kv.Key), "\x00"); string(kv.Value) != want {
+				t.Errorf("Expected %s for %q, got %s", want, kv.Key, kv.Value)
+			}
+			got = append(got, string(kv.Key))
+		}
+
+		// Rewriting the page's last key must not bring it back
+		if len(page) > 0 {
+			last := page[len(page)-1]
+			db.Put(last.Key, last.Value)
+		}
+
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d: %q", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("At index %d: expected %q, got %q", i, expected[i], got[i])
+		}
+	}
+
+	if _, _, err := db.ScanPage(nil, 0); err == nil {
+		t.Error("Expected error for zero limit")
+	}
+}
+
+func TestDBIteratorSeek(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Every third key per table, spread over three tables and the memtable
+	live := make(map[int]bool)
+	for table := 0; table < 3; table++ {
+		for i := table; i < 300; i += 3 {
+			db.Put([]byte(fmt.Sprintf("key_%03d", i*2)), []byte("value"))
+			live[i*2] = true
+		}
+		forceFlush(t, db)
+	}
+	for i := 0; i < 600; i += 10 {
+		db.Delete([]byte(fmt.Sprintf("key_%03d", i)))
+		delete(live, i)
+	}
+
+	// First live key >= n, or -1
+	firstFrom := func(n int) int {
+		for ; n < 600; n++ {
+			if live[n] {
+				return n
+			}
+		}
+		return -1
+	}
+
+	iter := db.NewIterator(nil, []byte("key_590"))
+	defer iter.Close()
+
+	// Hits, gaps between keys, deleted keys, and past the end bound
+	for _, target := range []int{0, 1, 7, 10, 11, 100, 101, 250, 251, 400, 589, 590, 599} {
+		iter.Seek([]byte(fmt.Sprintf("key_%03d", target)))
+		want := firstFrom(target)
+		if want >= 590 {
+			want = -1
+		}
+
+		if want < 0 {
+			if iter.Valid() {
+				t.Errorf("Seek(%d): expected no key, got %s", target, iter.Key())
+			}
+			continue
+		}
+		if !iter.Valid() || string(iter.Key()) != fmt.Sprintf("key_%03d", want) {
+			t.Errorf("Seek(%d): expected key_%03d, got %s (valid=%v)", target, want, iter.Key(), iter.Valid())
+			continue
+		}
+
+		// Iteration carries on from the seek position
+		iter.Next()
+		if next := firstFrom(want + 1); next >= 0 && next < 590 && string(iter.Key()) != fmt.Sprintf("key_%03d", next) {
+			t.Errorf("Next after Seek(%d): expected key_%03d, got %s", target, next, iter.Key())
+		}
+	}
+
+	// Seeking backwards works too
+	iter.Seek([]byte("key_002"))
+	if !iter.Valid() || string(iter.Key()) != "key_002" {
+		t.Errorf("Backward seek: expected key_002, got %s", iter.Key())
+	}
+}
+
+func TestDBVersionConflicts(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("a1"))
+	db.Put([]byte("b"), []byte("same"))
+	db.Put([]byte("c"), []byte("c1"))
+	forceFlush(t, db)
+	older := db.sstables[0].Path()
+
+	db.Put([]byte("a"), []byte("a2"))   // Differing value
+	db.Put([]byte("b"), []byte("same")) // Same value: not a conflict
+	db.Delete([]byte("c"))              // Value vs tombstone
+	db.Put([]byte("d"), []byte("d2"))   // Only one source
+	forceFlush(t, db)
+	newer := db.sstables[0].Path()
+
+	db.Put([]byte("a"), []byte("a3"))
+
+	conflicts, err := db.VersionConflicts(nil, nil)
+	if err != nil {
+		t.Fatalf("VersionConflicts failed: %v", err)
+	}
+	if len(conflicts) != 2 {
+		t.Fatalf("Expected conflicts for a and c, got %+v", conflicts)
+	}
+
+	a := conflicts[0]
+	if string(a.Key) != "a" || len(a.Versions) != 3 {
+		t.Fatalf("Expected 3 versions of a, got %+v", a)
+	}
+	wantA := []SourceVersion{{Source: "memtable", Value: []byte("a3")}, {Source: newer, Value: []byte("a2")}, {Source: older, Value: []byte("a1")}}
+	for i, want := range wantA {
+		got := a.Versions[i]
+		if got.Source != want.Source || string(got.Value) != string(want.Value) || got.Deleted {
+			t.Errorf("a version %d: expected %s=%s, got %s=%s (deleted=%v)", i, want.Source, want.Value, got.Source, got.Value, got.Deleted)
+		}
+	}
+
+	c := conflicts[1]
+	if string(c.Key) != "c" || len(c.Versions) != 2 || !c.Versions[0].Deleted || c.Versions[1].Deleted || string(c.Versions[1].Value) != "c1" {
+		t.Errorf("Expected c's tombstone over c1, got %+v", c)
+	}
+
+	// Bounds apply
+	conflicts, err = db.VersionConflicts([]byte("b"), nil)
+	if err != nil || len(conflicts) != 1 || string(conflicts[0].Key) != "c" {
+		t.Errorf("Expected only c from b onward, got %+v (err=%v)", conflicts, err)
+	}
+
+	// The normal read path still collapses to the newest version
+	if val, _ := db.Get([]byte("a")); string(val) != "a3" {
+		t.Errorf("Expected a=a3, got %s", val)
+	}
+}
+
+func TestDBCountInRange(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 20000; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), value)
+	}
+	forceFlush(t, db)
+	for i := 20000; i < 21000; i++ { // Some keys only in the memtable
+		db.Put([]byte(fmt.Sprintf("key_%06d", i)), value)
+	}
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key_%06d", i)) }
+	ranges := []struct {
+		start, end []byte
+		want       uint64
+	}{
+		{nil, nil, 21000},
+		{key(0), key(100), 100},
+		{key(1234), key(5678), 4444},
+		{key(19500), key(20500), 1000},
+		{key(15000), nil, 6000},
+		{nil, key(3333), 3333},
+		{[]byte("a"), []byte("b"), 0},
+	}
+	for _, r := range ranges {
+		exact, err := db.CountInRange(r.start, r.end)
+		if err != nil {
+			t.Fatalf("CountInRange failed: %v", err)
+		}
+		if exact != r.want {
+			t.Errorf("CountInRange(%s, %s) = %d, want %d", r.start, r.end, exact, r.want)
+		}
+
+		// Each edge block is off by at most half its entries
+		approx, err := db.ApproximateCountInRange(r.start, r.end)
+		if err != nil {
+			t.Fatalf("ApproximateCountInRange failed: %v", err)
+		}
+		tolerance := exact/20 + 50
+		if approx+tolerance < exact || approx > exact+tolerance {
+			t.Errorf("ApproximateCountInRange(%s, %s) = %d, exact %d", r.start, r.end, approx, exact)
+		}
+	}
+
+	// Deleted keys aren't counted exactly
+	for i := 0; i < 10; i++ {
+		db.Delete(key(i))
+	}
+	if n, err := db.CountInRange(key(0), key(100)); err != nil || n != 90 {
+		t.Errorf("Expected 90 live keys after deletes, got %d (err=%v)", n, err)
+	}
+}
+
+func TestDBIteratorDuringBackgroundCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.CompactionTrigger = 3
+	opts.BlockCacheSize = 0 // Every block is read from the file
+
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	// Two tables of many blocks each
+	value := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 300; i++ {
+		db.Put([]byte(fmt.Sprintf("key_%03d", i)), value)
+		if i == 149 || i == 299 {
+			forceFlush(t, db)
+		}
+	}
+
+	it := db.NewIterator(nil, nil)
+	count := 0
+	for ; it.Valid() && count < 10; it.Next() {
+		count++
+	}
+
+	// A third table wakes the worker, which merges all three
+	db.Put([]byte("other"), []byte("v"))
+	forceFlush(t, db)
+	deadline := time.Now().Add(5 * time.Second)
+	for db.Stats().SSTableCount != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a background compaction, got %d SSTables", db.Stats().SSTableCount)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	if err := it.Err(); err != nil || count != 300 {
+		t.Fatalf("Expected 300 keys through the compaction, got %d (err=%v)", count, err)
+	}
+
+	// The merged inputs stay on disk until the iterator is closed
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(files) != 4 {
+		t.Errorf("Expected the 3 inputs kept beside the output, got %v", files)
+	}
+	it.Close()
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.sst")); len(files) != 1 {
+		t.Errorf("Expected the inputs removed after Close, got %v", files)
+	}
+}
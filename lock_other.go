@@ -0,0 +1,10 @@
+//go:build !unix
+
+package lsm
+
+import "os"
+
+// lockFile is a no-op where flock is unavailable
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -15,7 +15,7 @@ type Entry struct {
 	Key       []byte
 	Value     []byte
 	Deleted   bool   // Tombstone flag
-	Timestamp uint64 // for MVCC: version/timestamp (0 for now)
+	Timestamp uint64 // Application-supplied version (0 = unversioned)
 }
 
 func (e *Entry) Size() int64 {
@@ -28,7 +28,7 @@ func NewEntry(key, value []byte) *Entry {
 		Key:       key,
 		Value:     value,
 		Deleted:   false,
-		Timestamp: 0, // Will be used for MVCC later
+		Timestamp: 0, // Unversioned; see DB.PutWithTimestamp
 	}
 }
 
@@ -42,17 +42,95 @@ func NewTombstone(key []byte) *Entry {
 	}
 }
 
+// MemtableBackend is the sorted structure a Memtable keeps its entries in
+// Implementations must be safe for concurrent use; PutEntry replaces any
+// entry with the same key.
+type MemtableBackend interface {
+	PutEntry(entry *Entry)
+	Get(key []byte) ([]byte, bool, bool)
+	GetEntry(key []byte) (Entry, bool)
+	Size() int64
+	MemoryUsage() int64
+	Count() int
+	NewIterator() MemtableIterator
+}
+
+// MemtableIterator walks a MemtableBackend in key order
+// It may hold a lock on the backend until Close.
+type MemtableIterator interface {
+	SeekToFirst()
+	Seek(target []byte)
+	Valid() bool
+	Next()
+	Entry() *Entry
+	Key() []byte
+	Value() []byte
+	IsDeleted() bool
+	Timestamp() uint64
+	Close()
+}
+
+// MemtableType selects the memtable's backend
+type MemtableType int
+
+const (
+	MemtableSkipList MemtableType = iota // Skip list: one node per entry
+	MemtableBTree                        // B-tree: entries stored inline in wide nodes
+)
+
+// skipListBackend adapts SkipList to MemtableBackend
+type skipListBackend struct {
+	*SkipList
+}
+
+func (b skipListBackend) NewIterator() MemtableIterator {
+	return b.SkipList.NewIterator()
+}
+
+// btreeBackend adapts BTree to MemtableBackend
+type btreeBackend struct {
+	*BTree
+}
+
+func (b btreeBackend) NewIterator() MemtableIterator {
+	return b.BTree.NewIterator()
+}
+
+// newMemtableBackend creates an empty backend of the given type
+// maxLevel caps skip list node heights (0 = default)
+func newMemtableBackend(typ MemtableType, maxLevel int) MemtableBackend {
+	if typ == MemtableBTree {
+		return btreeBackend{NewBTree()}
+	}
+	return skipListBackend{NewSkipListWithMaxLevel(DefaultComparator{}, maxLevel)}
+}
+
 type Memtable struct {
-	data    *SkipList // underlying skip list
+	data    MemtableBackend // underlying sorted structure
 	state   int32
 	maxsize int64      // maximum size before flush
 	mu      sync.Mutex // protects state transitions
+
+	// Write sequence numbers of the entries, set by a DB under its lock
+	// (nil = not tracked)
+	seqs *seqRange
 }
 
 // NewMemtable initializes and returns a new Memtable.
 func NewMemtable(maxsize int64) *Memtable {
+	return NewMemtableWithBackend(maxsize, newMemtableBackend(MemtableSkipList, 0))
+}
+
+// NewMemtableWithType returns a new Memtable using the given backend type
+func NewMemtableWithType(maxsize int64, typ MemtableType) *Memtable {
+	return NewMemtableWithBackend(maxsize, newMemtableBackend(typ, 0))
+}
+
+// NewMemtableWithBackend returns a new Memtable keeping its entries in
+// backend, which should be empty
+func NewMemtableWithBackend(maxsize int64, backend MemtableBackend) *Memtable {
 	return &Memtable{
-		data:    NewSkipList(),
+		data:    backend,
 		state:   memtableActive,
 		maxsize: maxsize,
 	}
@@ -66,7 +144,7 @@ func (m *Memtable) Put(key, value []byte) error {
 	if atomic.LoadInt32(&m.state) != memtableActive {
 		return ErrMemtableImmutable
 	}
-	m.data.Put(key, value)
+	m.data.PutEntry(NewEntry(key, value))
 	return nil
 }
 
@@ -78,10 +156,27 @@ func (m *Memtable) Delete(key []byte) error {
 	if atomic.LoadInt32(&m.state) != memtableActive {
 		return ErrMemtableImmutable
 	}
-	m.data.Delete(key)
+	m.data.PutEntry(NewTombstone(key))
+	return nil
+}
+
+// PutEntry inserts an entry as is, keeping its Deleted flag and Timestamp
+func (m *Memtable) PutEntry(entry *Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if atomic.LoadInt32(&m.state) != memtableActive {
+		return ErrMemtableImmutable
+	}
+	m.data.PutEntry(entry)
 	return nil
 }
 
+// GetEntry returns a copy of the entry for key, tombstones included
+func (m *Memtable) GetEntry(key []byte) (Entry, bool) {
+	return m.data.GetEntry(key)
+}
+
 // Get retrieves a value by key
 // Returns: (value, found, deleted)
 func (m *Memtable) Get(key []byte) ([]byte, bool, bool) {
@@ -93,9 +188,16 @@ func (m *Memtable) Size() int64 {
 	return m.data.Size()
 }
 
+// MemoryUsage estimates the memory held, including the backend's overhead
+func (m *Memtable) MemoryUsage() int64 {
+	return m.data.MemoryUsage()
+}
+
 // IsFull returns true if memtable should be flushed
+// It uses MemoryUsage so many small entries can't hold far more memory
+// than the configured size.
 func (m *Memtable) IsFull() bool {
-	return m.data.Size() >= m.maxsize
+	return m.data.MemoryUsage() >= m.maxsize
 }
 
 // SetImmutable freezes the memtable (thread-safe)
@@ -111,10 +213,29 @@ func (m *Memtable) IsImmutable() bool {
 }
 
 // NewIterator creates an iterator
-func (m *Memtable) NewIterator() *SkipListIterator {
+func (m *Memtable) NewIterator() MemtableIterator {
 	return m.data.NewIterator()
 }
 
+// noteSequences widens the memtable's sequence range to cover first..last
+func (m *Memtable) noteSequences(first, last uint64) {
+	if m.seqs == nil {
+		m.seqs = &seqRange{min: first, max: last}
+		return
+	}
+	m.seqs.min = min(m.seqs.min, first)
+	m.seqs.max = max(m.seqs.max, last)
+}
+
+// skipList returns the skip list backing the memtable, or nil for other
+// backends
+func (m *Memtable) skipList() *SkipList {
+	if b, ok := m.data.(skipListBackend); ok {
+		return b.SkipList
+	}
+	return nil
+}
+
 // Count returns number of entries
 func (m *Memtable) Count() int {
 	return m.data.Count()
@@ -3,94 +3,199 @@ package lsm
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 )
 
 func TestMemtablePutGet(t *testing.T) {
-	mem := NewMemtable(1024 * 1024) // 1MB
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(1024*1024, typ) // 1MB
 
-	err := mem.Put([]byte("name"), []byte("Alice"))
-	if err != nil {
-		t.Fatalf("Put failed: %v", err)
-	}
+		err := mem.Put([]byte("name"), []byte("Alice"))
+		if err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
 
-	val, deleted, found := mem.Get([]byte("name")) // (value, deleted, found)
-	if !found {
-		t.Fatal("Key not found")
-	}
-	if deleted {
-		t.Fatal("Key should not be deleted")
-	}
-	if !bytes.Equal(val, []byte("Alice")) {
-		t.Fatalf("Expected 'Alice', got '%s'", val)
-	}
+		val, deleted, found := mem.Get([]byte("name")) // (value, deleted, found)
+		if !found {
+			t.Fatal("Key not found")
+		}
+		if deleted {
+			t.Fatal("Key should not be deleted")
+		}
+		if !bytes.Equal(val, []byte("Alice")) {
+			t.Fatalf("Expected 'Alice', got '%s'", val)
+		}
+	})
 }
 
 func TestMemtableDelete(t *testing.T) {
-	mem := NewMemtable(1024 * 1024)
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(1024*1024, typ)
 
-	mem.Put([]byte("key"), []byte("value"))
-	mem.Delete([]byte("key"))
+		mem.Put([]byte("key"), []byte("value"))
+		mem.Delete([]byte("key"))
 
-	_, deleted, found := mem.Get([]byte("key")) // (value, deleted, found)
-	if !found {
-		t.Fatal("Key should be found (as tombstone)")
-	}
-	if !deleted {
-		t.Fatal("Key should be marked deleted")
-	}
+		_, deleted, found := mem.Get([]byte("key")) // (value, deleted, found)
+		if !found {
+			t.Fatal("Key should be found (as tombstone)")
+		}
+		if !deleted {
+			t.Fatal("Key should be marked deleted")
+		}
+	})
 }
 
 func TestMemtableIsFull(t *testing.T) {
-	mem := NewMemtable(100) // 100 bytes
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(100, typ) // 100 bytes
 
-	for i := 0; i < 10; i++ {
-		key := []byte(fmt.Sprintf("key%d", i))
-		value := []byte(fmt.Sprintf("value%d", i))
-		mem.Put(key, value)
-	}
+		for i := 0; i < 10; i++ {
+			key := []byte(fmt.Sprintf("key%d", i))
+			value := []byte(fmt.Sprintf("value%d", i))
+			mem.Put(key, value)
+		}
 
-	if !mem.IsFull() {
-		t.Fatal("Memtable should be full")
-	}
+		if !mem.IsFull() {
+			t.Fatal("Memtable should be full")
+		}
+	})
 }
 
 func TestMemtableImmutable(t *testing.T) {
-	mem := NewMemtable(1024 * 1024)
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(1024*1024, typ)
 
-	mem.Put([]byte("key1"), []byte("value1"))
-	mem.SetImmutable()
+		mem.Put([]byte("key1"), []byte("value1"))
+		mem.SetImmutable()
 
-	// Write should fail
-	err := mem.Put([]byte("key2"), []byte("value2"))
-	if err != ErrMemtableImmutable {
-		t.Fatalf("Expected ErrMemtableImmutable, got %v", err)
-	}
+		// Write should fail
+		err := mem.Put([]byte("key2"), []byte("value2"))
+		if err != ErrMemtableImmutable {
+			t.Fatalf("Expected ErrMemtableImmutable, got %v", err)
+		}
 
-	// Read should work
-	val, _, found := mem.Get([]byte("key1")) // (value, deleted, found)
-	if !found || !bytes.Equal(val, []byte("value1")) {
-		t.Fatal("Read from immutable failed")
-	}
+		// Read should work
+		val, _, found := mem.Get([]byte("key1")) // (value, deleted, found)
+		if !found || !bytes.Equal(val, []byte("value1")) {
+			t.Fatal("Read from immutable failed")
+		}
+	})
 }
 
 func TestMemtableIterator(t *testing.T) {
-	mem := NewMemtable(1024 * 1024)
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(1024*1024, typ)
+
+		mem.Put([]byte("c"), []byte("3"))
+		mem.Put([]byte("a"), []byte("1"))
+		mem.Put([]byte("b"), []byte("2"))
 
-	mem.Put([]byte("c"), []byte("3"))
-	mem.Put([]byte("a"), []byte("1"))
-	mem.Put([]byte("b"), []byte("2"))
+		it := mem.NewIterator()
+		defer it.Close()
 
-	it := mem.NewIterator()
-	defer it.Close()
+		expected := []string{"a", "b", "c"}
+		i := 0
+
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if string(it.Key()) != expected[i] {
+				t.Errorf("Expected %s, got %s", expected[i], it.Key())
+			}
+			i++
+		}
+	})
+}
 
-	expected := []string{"a", "b", "c"}
-	i := 0
+func TestMemtableMemoryUsage(t *testing.T) {
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(1024*1024, typ)
 
-	for it.SeekToFirst(); it.Valid(); it.Next() {
-		if string(it.Key()) != expected[i] {
-			t.Errorf("Expected %s, got %s", expected[i], it.Key())
+		// Tiny entries: node overhead dwarfs the key and value bytes
+		for i := 0; i < 10000; i++ {
+			mem.Put([]byte(fmt.Sprintf("%04d", i)), []byte("v"))
 		}
-		i++
+
+		size, usage := mem.Size(), mem.MemoryUsage()
+		if usage < 3*size {
+			t.Errorf("Expected memory usage well above raw size %d, got %d", size, usage)
+		}
+
+		// Overwrites reuse the node
+		mem.Put([]byte("0000"), []byte("longer value"))
+		if got := mem.MemoryUsage() - mem.Size(); got != usage-size {
+			t.Errorf("Expected overwrite to keep overhead %d, got %d", usage-size, got)
+		}
+
+		// IsFull goes by the realistic figure
+		small := NewMemtableWithType(size, typ)
+		for i := 0; i < 10000 && !small.IsFull(); i++ {
+			small.Put([]byte(fmt.Sprintf("%04d", i)), []byte("v"))
+		}
+		if !small.IsFull() || small.Size() >= size/2 {
+			t.Errorf("Expected memtable full well before raw size %d, got size %d", size, small.Size())
+		}
+	})
+}
+
+// forEachMemtableType runs fn as a subtest against every memtable backend
+func forEachMemtableType(t *testing.T, fn func(t *testing.T, typ MemtableType)) {
+	types := []struct {
+		name string
+		typ  MemtableType
+	}{
+		{"SkipList", MemtableSkipList},
+		{"BTree", MemtableBTree},
 	}
+	for _, tt := range types {
+		t.Run(tt.name, func(t *testing.T) { fn(t, tt.typ) })
+	}
+}
+
+func TestMemtableManyKeys(t *testing.T) {
+	forEachMemtableType(t, func(t *testing.T, typ MemtableType) {
+		mem := NewMemtableWithType(64*1024*1024, typ)
+
+		// Shuffled inserts split nodes at every level
+		const n = 5000
+		for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+			mem.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("v%d", i)))
+		}
+		for i := 0; i < n; i += 3 {
+			mem.Delete([]byte(fmt.Sprintf("key%05d", i)))
+		}
+		if mem.Count() != n {
+			t.Fatalf("Expected %d entries, got %d", n, mem.Count())
+		}
+
+		it := mem.NewIterator()
+		defer it.Close()
+
+		i := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if want := fmt.Sprintf("key%05d", i); string(it.Key()) != want {
+				t.Fatalf("Expected %s, got %s", want, it.Key())
+			}
+			if it.IsDeleted() != (i%3 == 0) {
+				t.Fatalf("Key %s: expected deleted=%v", it.Key(), i%3 == 0)
+			}
+			i++
+		}
+		if i != n {
+			t.Fatalf("Expected %d keys, iterated %d", n, i)
+		}
+
+		// Seek lands on the target or the next key after it
+		it.Seek([]byte("key01234"))
+		if !it.Valid() || string(it.Key()) != "key01234" {
+			t.Fatalf("Expected key01234, got %s", it.Key())
+		}
+		it.Seek([]byte("key01234x"))
+		if !it.Valid() || string(it.Key()) != "key01235" {
+			t.Fatalf("Expected key01235, got %s", it.Key())
+		}
+		it.Seek([]byte("key99999"))
+		if it.Valid() {
+			t.Fatalf("Expected no key past the end, got %s", it.Key())
+		}
+	})
 }
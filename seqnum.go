@@ -0,0 +1,63 @@
+package lsm
+
+import "fmt"
+
+// SequenceFileName is the file in the DB directory that bounds the write
+// sequence numbers handed out so far (see LastSequence)
+const SequenceFileName = "SEQ"
+
+// Sequence numbers are leased in blocks, so SEQ is rewritten once per
+// block of writes rather than on every write
+const sequenceLease = 1 << 16
+
+// LastSequence returns the sequence number of the latest write
+// Every Put and Delete, each key of a DeleteMulti, and each secondary index
+// update takes the next number.
+// Numbers never go backwards, even across a crash: SEQ records a limit no
+// number has reached, and Open resumes above it. Numbers reserved but not
+// used before a restart are skipped, so the sequence can have gaps.
+func (db *DB) LastSequence() uint64 {
+	return db.seq.Load()
+}
+
+// loadSequence resumes the sequence above the limit in SEQ and leases
+// the next block
+func (db *DB) loadSequence() error {
+	limit, _, err := db.readNumberFile(SequenceFileName)
+	if err != nil {
+		return fmt.Errorf("failed to read sequence file: %w", err)
+	}
+
+	db.seq.Store(limit)
+	return db.leaseSequence(limit + 1 + sequenceLease)
+}
+
+// nextSequence assigns the next n sequence numbers, leasing another block
+// first if they run past the current one
+// Must be called with db.mu held
+func (db *DB) nextSequence(n uint64) error {
+	if n == 0 {
+		return nil
+	}
+	first := db.seq.Load() + 1
+	last := first + n - 1
+	if last >= db.seqLimit {
+		if err := db.leaseSequence(last + sequenceLease); err != nil {
+			return err
+		}
+	}
+	db.seq.Store(last)
+
+	// The numbers go to writes into the active memtable
+	db.memtable.noteSequences(first, last)
+	return nil
+}
+
+// leaseSequence durably raises the limit in SEQ, replacing it atomically
+func (db *DB) leaseSequence(limit uint64) error {
+	if err := db.writeNumberFile(SequenceFileName, limit); err != nil {
+		return fmt.Errorf("failed to write sequence file: %w", err)
+	}
+	db.seqLimit = limit
+	return nil
+}
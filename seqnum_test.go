@@ -0,0 +1,67 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDBSequenceSurvivesCrash(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+
+	start := db.LastSequence()
+	db.Put([]byte("a"), []byte("1"))
+	db.Delete([]byte("a"))
+	db.DeleteMulti([][]byte{[]byte("b"), []byte("c")})
+	if got := db.LastSequence(); got != start+4 {
+		t.Errorf("Expected sequence %d after 4 writes, got %d", start+4, got)
+	}
+
+	// Run past the leased block so SEQ is rewritten mid-run
+	db.mu.Lock()
+	db.seqLimit = db.seq.Load() + 2
+	db.mu.Unlock()
+	for i := 0; i < 5; i++ {
+		if err := db.Put([]byte("d"), []byte("2")); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	last := db.LastSequence()
+
+	// Simulate a crash: drop the lock without Close or any flush
+	db.lock.Close()
+
+	db, err = Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to reopen DB: %v", err)
+	}
+	defer db.Close()
+
+	if got := db.LastSequence(); got <= last {
+		t.Errorf("Expected sequence above %d after reopen, got %d", last, got)
+	}
+	db.Put([]byte("e"), []byte("3"))
+	if got := db.LastSequence(); got <= last {
+		t.Errorf("Expected new write above %d, got %d", last, got)
+	}
+}
+
+func TestDBSequenceFileCorrupted(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Close()
+
+	os.WriteFile(filepath.Join(dir, SequenceFileName), []byte("garbage"), 0644)
+	if _, err := Open(DefaultOptions(dir)); !errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Expected ErrCorruptedData, got %v", err)
+	}
+}
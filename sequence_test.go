@@ -0,0 +1,151 @@
+package lsm
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestSequenceIteratorWriteOrder(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	type record struct {
+		deleted    bool
+		key, value string
+	}
+
+	// Interleaved and out of key order, with overwrites
+	var expected []record
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key_%02d", 19-i)
+		value := fmt.Sprintf("value_%d", i)
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		expected = append(expected, record{key: key, value: value})
+
+		if i%3 == 0 {
+			del := fmt.Sprintf("key_%02d", 19-i/2)
+			if err := db.Delete([]byte(del)); err != nil {
+				t.Fatalf("Failed to delete: %v", err)
+			}
+			expected = append(expected, record{deleted: true, key: del})
+		}
+	}
+	db.Put([]byte("key_05"), []byte("overwritten"))
+	expected = append(expected, record{key: "key_05", value: "overwritten"})
+
+	it, err := db.NewSequenceIterator()
+	if err != nil {
+		t.Fatalf("Failed to create sequence iterator: %v", err)
+	}
+	defer it.Close()
+
+	// Writes after creation are not seen and are not blocked
+	if err := db.Put([]byte("later"), []byte("value")); err != nil {
+		t.Fatalf("Put while iterating failed: %v", err)
+	}
+
+	var got []record
+	for ; it.Valid(); it.Next() {
+		if it.Seq() != uint64(len(got)) {
+			t.Errorf("Expected seq %d, got %d", len(got), it.Seq())
+		}
+		got = append(got, record{deleted: it.IsDeleted(), key: string(it.Key()), value: string(it.Value())})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Iterator error: %v", err)
+	}
+
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d records, got %d: %v", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Record %d: expected %+v, got %+v", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestSequenceIteratorAfterFlush(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("flushed"), []byte("value"))
+	forceFlush(t, db)
+	db.Delete([]byte("flushed"))
+
+	it, err := db.NewSequenceIterator()
+	if err != nil {
+		t.Fatalf("Failed to create sequence iterator: %v", err)
+	}
+	defer it.Close()
+
+	// Only the record written since the flush is left in the WAL
+	if !it.Valid() || !it.IsDeleted() || string(it.Key()) != "flushed" {
+		t.Fatalf("Expected the delete of flushed, got valid=%v key=%s", it.Valid(), it.Key())
+	}
+	it.Next()
+	if it.Valid() {
+		t.Errorf("Expected one record, got another: %s", it.Key())
+	}
+}
+
+func TestSequenceIteratorAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions(dir)
+	opts.KeepRecentWALSegments = 2
+	db, err := Open(opts)
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("flushed"), []byte("value"))
+	forceFlush(t, db)
+	db.Put([]byte("sealed"), []byte("value"))
+	if err := db.RotateMemtable(); err != nil {
+		t.Fatalf("Failed to rotate memtable: %v", err)
+	}
+	db.Delete([]byte("sealed"))
+
+	keys := func(archived bool) []string {
+		t.Helper()
+		it, err := db.NewSequenceIteratorOpt(archived)
+		if err != nil {
+			t.Fatalf("Failed to create sequence iterator: %v", err)
+		}
+		defer it.Close()
+
+		var got []string
+		for ; it.Valid(); it.Next() {
+			if it.Seq() != uint64(len(got)) {
+				t.Errorf("Expected seq %d, got %d", len(got), it.Seq())
+			}
+			got = append(got, fmt.Sprintf("%s:%v", it.Key(), it.IsDeleted()))
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Iterator error: %v", err)
+		}
+		return got
+	}
+
+	// The sealed memtable's WAL comes before the current one
+	if got, want := keys(false), []string{"sealed:false", "sealed:true"}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// Kept segments of flushed WALs come first of all
+	if got, want := keys(true), []string{"flushed:false", "sealed:false", "sealed:true"}; !slices.Equal(got, want) {
+		t.Errorf("Expected %v with archived segments, got %v", want, got)
+	}
+}
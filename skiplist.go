@@ -2,11 +2,23 @@ package lsm
 
 import (
 	"sync"
+	"unsafe"
 )
 
 const (
-	maxLevel    = 12
-	probability = 4
+	defaultMaxLevel = 12
+	probability     = 4
+
+	// MaxSkipListLevel is the highest maxLevel a skip list accepts:
+	// randomLevel draws two bits of a 32-bit value per level
+	MaxSkipListLevel = 16
+)
+
+// Per-node memory beyond the entry's own bytes: the node and Entry structs
+// plus one forward pointer per level (allocator rounding not included)
+const (
+	nodeOverhead = int64(unsafe.Sizeof(skipNode{}) + unsafe.Sizeof(Entry{}))
+	pointerSize  = int64(unsafe.Sizeof(uintptr(0)))
 )
 
 type skipNode struct {
@@ -18,8 +30,10 @@ type skipNode struct {
 type SkipList struct {
 	head       *skipNode
 	comparator Comparator
-	level      int
+	level      int // Tallest node in the list
+	maxLevel   int // Cap on node levels
 	size       int64
+	overhead   int64 // Node bytes not counted in size
 	count      int
 	randSeed   uint32
 	mu         sync.RWMutex // <- ADD THIS for thread safety
@@ -31,12 +45,25 @@ func NewSkipList() *SkipList {
 }
 
 func NewSkipListWithComparator(cmp Comparator) *SkipList {
+	return NewSkipListWithMaxLevel(cmp, defaultMaxLevel)
+}
+
+// NewSkipListWithMaxLevel creates a skip list whose nodes are at most
+// maxLevel tall (<= 0 = the default, 12; capped at MaxSkipListLevel)
+// Each level thins the list by the promotion probability of 1/4, so
+// searches stay logarithmic up to about 4^maxLevel entries.
+func NewSkipListWithMaxLevel(cmp Comparator, maxLevel int) *SkipList {
+	if maxLevel <= 0 {
+		maxLevel = defaultMaxLevel
+	}
+	maxLevel = min(maxLevel, MaxSkipListLevel)
 	return &SkipList{
 		head: &skipNode{
 			forward: make([]*skipNode, maxLevel),
 		},
 		comparator: cmp,
 		level:      1,
+		maxLevel:   maxLevel,
 		randSeed:   0xdeadbeef,
 	}
 }
@@ -45,7 +72,7 @@ func (sl *SkipList) randomLevel() int {
 	level := 1
 	sl.randSeed = sl.randSeed*1664525 + 1013904223
 	r := sl.randSeed
-	for level < maxLevel && r%probability == 0 {
+	for level < sl.maxLevel && r%probability == 0 {
 		level++
 		r /= probability
 	}
@@ -71,7 +98,7 @@ func (sl *SkipList) PutEntry(entry *Entry) {
 	sl.mu.Lock() // <- WRITE LOCK
 	defer sl.mu.Unlock()
 
-	update := make([]*skipNode, maxLevel)
+	update := make([]*skipNode, sl.maxLevel)
 	current := sl.head
 
 	for i := sl.level - 1; i >= 0; i-- {
@@ -114,6 +141,7 @@ func (sl *SkipList) PutEntry(entry *Entry) {
 	}
 
 	sl.size += entry.Size()
+	sl.overhead += nodeOverhead + int64(newLevel)*pointerSize
 	sl.count++
 }
 
@@ -122,31 +150,88 @@ func (sl *SkipList) Get(key []byte) ([]byte, bool, bool) {
 	sl.mu.RLock() // <- READ LOCK (multiple readers allowed)
 	defer sl.mu.RUnlock()
 
+	if node := sl.find(key); node != nil {
+		return node.entry.Value, node.entry.Deleted, true // (value, deleted, found)
+	}
+
+	return nil, false, false // (value, deleted, found)
+}
+
+// GetEntry returns a copy of the entry for key, tombstones included (thread-safe)
+func (sl *SkipList) GetEntry(key []byte) (Entry, bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+
+	if node := sl.find(key); node != nil {
+		return *node.entry, true
+	}
+	return Entry{}, false
+}
+
+// find returns the node holding key, or nil
+// Must be called with sl.mu held
+func (sl *SkipList) find(key []byte) *skipNode {
+	current := sl.seek(key)
+	if current != nil && sl.compare(current.entry.Key, key) == 0 {
+		return current
+	}
+	return nil
+}
+
+// seek returns the first node with a key >= target, or nil
+// Must be called with sl.mu held
+func (sl *SkipList) seek(target []byte) *skipNode {
 	current := sl.head
 
 	for i := sl.level - 1; i >= 0; i-- {
 		for current.forward[i] != nil &&
-			sl.compare(current.forward[i].entry.Key, key) < 0 {
+			sl.compare(current.forward[i].entry.Key, target) < 0 {
 			current = current.forward[i]
 		}
 	}
 
-	current = current.forward[0]
+	return current.forward[0]
+}
 
-	if current != nil && sl.compare(current.entry.Key, key) == 0 {
-		return current.entry.Value, current.entry.Deleted, true // (value, deleted, found)
-	}
+// Range calls fn for each entry with lower <= key < upper, tombstones
+// included, in key order, until fn returns false (thread-safe)
+// A nil lower or upper means unbounded on that side. The read lock is
+// held for the whole walk and released on return, so fn must not write
+// to the list. Entries are the list's own and must not be modified.
+func (sl *SkipList) Range(lower, upper []byte, fn func(entry *Entry) bool) {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
 
-	return nil, false, false // (value, deleted, found)
+	current := sl.head.forward[0]
+	if lower != nil {
+		current = sl.seek(lower)
+	}
+	for ; current != nil; current = current.forward[0] {
+		if upper != nil && sl.compare(current.entry.Key, upper) >= 0 {
+			return
+		}
+		if !fn(current.entry) {
+			return
+		}
+	}
 }
 
-// Size returns approximate memory usage (thread-safe)
+// Size returns the bytes of all entries' keys, values and metadata
+// (thread-safe)
 func (sl *SkipList) Size() int64 {
 	sl.mu.RLock()
 	defer sl.mu.RUnlock()
 	return sl.size
 }
 
+// MemoryUsage estimates the memory held by the list: Size plus the
+// per-node structs and forward pointers (thread-safe)
+func (sl *SkipList) MemoryUsage() int64 {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.size + sl.overhead
+}
+
 // Count returns number of entries (thread-safe)
 func (sl *SkipList) Count() int {
 	sl.mu.RLock()
@@ -154,6 +239,18 @@ func (sl *SkipList) Count() int {
 	return sl.count
 }
 
+// Level returns the height of the tallest node (thread-safe)
+func (sl *SkipList) Level() int {
+	sl.mu.RLock()
+	defer sl.mu.RUnlock()
+	return sl.level
+}
+
+// MaxLevel returns the cap on node heights
+func (sl *SkipList) MaxLevel() int {
+	return sl.maxLevel
+}
+
 // Iterator for traversing the skip list
 // NOTE: Iterator holds a read lock - don't forget to close it!
 type SkipListIterator struct {
@@ -182,14 +279,7 @@ func (it *SkipListIterator) SeekToFirst() {
 
 // Seek moves to first entry >= target
 func (it *SkipListIterator) Seek(target []byte) {
-	current := it.list.head
-	for i := it.list.level - 1; i >= 0; i-- {
-		for current.forward[i] != nil &&
-			it.list.compare(current.forward[i].entry.Key, target) < 0 {
-			current = current.forward[i]
-		}
-	}
-	it.current = current.forward[0]
+	it.current = it.list.seek(target)
 }
 
 // Valid returns true if at a valid entry
@@ -228,6 +318,14 @@ func (it *SkipListIterator) Value() []byte {
 	return nil
 }
 
+// Timestamp returns current entry's timestamp
+func (it *SkipListIterator) Timestamp() uint64 {
+	if it.current != nil {
+		return it.current.entry.Timestamp
+	}
+	return 0
+}
+
 // IsDeleted returns true if current entry is a tombstone
 func (it *SkipListIterator) IsDeleted() bool {
 	if it.current != nil {
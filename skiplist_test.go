@@ -93,6 +93,33 @@ func TestSkipListCount(t *testing.T) {
     }
 }
 
+func TestSkipListMaxLevel(t *testing.T) {
+    if got := NewSkipList().MaxLevel(); got != 12 {
+        t.Fatalf("Expected default max level 12, got %d", got)
+    }
+
+    sl := NewSkipListWithMaxLevel(DefaultComparator{}, 4)
+    if sl.Level() != 1 {
+        t.Fatalf("Empty list should have level 1, got %d", sl.Level())
+    }
+
+    // Far more than 4^4 entries: some node must reach the cap
+    for i := 0; i < 5000; i++ {
+        sl.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("v"))
+    }
+    if sl.Level() != sl.MaxLevel() || sl.MaxLevel() != 4 {
+        t.Fatalf("Expected level to reach max level 4, got %d (max %d)", sl.Level(), sl.MaxLevel())
+    }
+    if v, _, found := sl.Get([]byte("key04999")); !found || string(v) != "v" {
+        t.Fatal("Lookup failed in a saturated list")
+    }
+
+    // Heights are drawn from a 32-bit value, so larger caps are clamped
+    if got := NewSkipListWithMaxLevel(DefaultComparator{}, 40).MaxLevel(); got != MaxSkipListLevel {
+        t.Fatalf("Expected max level clamped to %d, got %d", MaxSkipListLevel, got)
+    }
+}
+
 func TestSkipListIterator(t *testing.T) {
     sl := NewSkipList()
     
@@ -242,4 +269,49 @@ func TestSkipListConcurrentReadsWrites(t *testing.T) {
     if sl.Count() != 600 {
         t.Fatalf("Expected 600, got %d", sl.Count())
     }
-}
\ No newline at end of file
+}
+func TestSkipListRange(t *testing.T) {
+    sl := NewSkipList()
+    for _, k := range []string{"a", "b", "c", "d", "e"} {
+        sl.Put([]byte(k), []byte("v"+k))
+    }
+    sl.Delete([]byte("c"))
+
+    collect := func(lower, upper []byte, limit int) string {
+        var keys []string
+        sl.Range(lower, upper, func(entry *Entry) bool {
+            key := string(entry.Key)
+            if entry.Deleted {
+                key += "(deleted)"
+            }
+            keys = append(keys, key)
+            return len(keys) < limit
+        })
+        return fmt.Sprint(keys)
+    }
+
+    tests := []struct {
+        lower, upper []byte
+        limit        int
+        want         string
+    }{
+        {nil, nil, 10, "[a b c(deleted) d e]"},
+        {[]byte("b"), []byte("d"), 10, "[b c(deleted)]"},
+        {[]byte("bb"), nil, 10, "[c(deleted) d e]"},
+        {nil, []byte("c"), 10, "[a b]"},
+        {[]byte("c"), []byte("c"), 10, "[]"},
+        {[]byte("z"), nil, 10, "[]"},
+        {nil, nil, 2, "[a b]"}, // Early termination
+    }
+    for _, tt := range tests {
+        if got := collect(tt.lower, tt.upper, tt.limit); got != tt.want {
+            t.Errorf("Range(%q, %q) limit %d: expected %s, got %s", tt.lower, tt.upper, tt.limit, tt.want, got)
+        }
+    }
+
+    // The read lock is released, even after stopping early
+    sl.Put([]byte("f"), []byte("vf"))
+    if sl.Count() != 6 {
+        t.Errorf("Expected 6 entries, got %d", sl.Count())
+    }
+}
@@ -0,0 +1,144 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Snapshot is a consistent, read-only view of the DB at a point in time
+//
+// The memtables are copied when the snapshot is taken and the SSTables are
+// pinned: compaction still runs, but files the snapshot can see are only
+// deleted after Release. A snapshot that is never released keeps those
+// files on disk until the DB is closed, so always Release (or Close) it.
+type Snapshot struct {
+	db         *DB
+	memtables  []*sliceIterator // Newest first
+	tables     []*SSTableReader // Newest first
+	comparator Comparator
+	released   atomic.Bool
+}
+
+// Snapshot returns a snapshot of the current DB state
+func (db *DB) Snapshot() (*Snapshot, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	s := &Snapshot{db: db, comparator: DefaultComparator{}}
+	s.memtables = append(s.memtables, copyMemtableRange(db.memtable, s.comparator, nil, nil))
+	if db.immutable != nil {
+		s.memtables = append(s.memtables, copyMemtableRange(db.immutable, s.comparator, nil, nil))
+	}
+
+	s.tables = append(s.tables, db.sstables...)
+	for _, sst := range s.tables {
+		db.pins[sst]++
+	}
+
+	return s, nil
+}
+
+// Get retrieves a value as of the time the snapshot was taken
+// Returns ErrNotFound if the key didn't exist or was deleted. As with
+// DB.Get, the value is a copy the caller owns.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.released.Load() {
+		return nil, ErrSnapshotReleased
+	}
+	if s.db.closed.Load() {
+		return nil, ErrClosed
+	}
+
+	for _, mem := range s.memtables {
+		entries := mem.entries
+		i := sort.Search(len(entries), func(i int) bool {
+			return s.comparator.Compare(entries[i].Key, key) >= 0
+		})
+		if i < len(entries) && s.comparator.Compare(entries[i].Key, key) == 0 {
+			if entries[i].Deleted {
+				return nil, ErrNotFound
+			}
+			return bytes.Clone(entries[i].Value), nil
+		}
+	}
+
+	for _, sst := range s.tables {
+		if !sst.MayContain(key) {
+			continue
+		}
+
+		value, deleted, found, err := sst.Lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if deleted {
+				return nil, ErrNotFound
+			}
+			return value, nil
+		}
+	}
+
+	return nil, ErrNotFound
+}
+
+// Release unpins the snapshot's SSTables so compaction can reclaim them
+// Calling Release more than once is a no-op
+func (s *Snapshot) Release() {
+	if s.released.Swap(true) {
+		return
+	}
+
+	s.db.releaseTables(s.tables)
+	s.tables = nil
+	s.memtables = nil
+}
+
+// releaseTables drops one pin on each of tables, then deletes compacted
+// tables that are no longer pinned
+func (db *DB) releaseTables(tables []*SSTableReader) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed.Load() {
+		return // Close already released every file
+	}
+
+	for _, sst := range tables {
+		if db.pins[sst]--; db.pins[sst] == 0 {
+			delete(db.pins, sst)
+		}
+	}
+	db.deleteObsolete()
+}
+
+// Close releases the snapshot (implements io.Closer)
+func (s *Snapshot) Close() error {
+	s.Release()
+	return nil
+}
+
+// deleteObsolete closes and removes compacted SSTables no snapshot can see
+// Files go strictly in the order they were queued (oldest first) and stop
+// at the first pinned one, preserving compactAll's crash-safety ordering.
+// Must be called with db.mu held
+func (db *DB) deleteObsolete() {
+	for len(db.obsolete) > 0 {
+		sst := db.obsolete[0]
+		if db.pins[sst] > 0 {
+			return
+		}
+
+		sst.Close()
+		if err := db.fs.Remove(sst.Path()); err != nil {
+			fmt.Printf("Warning: failed to remove compacted SSTable %s: %v\n", sst.Path(), err)
+		}
+		db.obsolete = db.obsolete[1:]
+	}
+}
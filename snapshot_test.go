@@ -0,0 +1,100 @@
+package lsm
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotPinsCompactedFiles(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("key"), []byte("v1"))
+	forceFlush(t, db)
+	db.Put([]byte("other"), []byte("o1"))
+	forceFlush(t, db)
+
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+	var _ io.Closer = snap
+
+	// Overwrite after the snapshot, then compact everything away
+	db.Put([]byte("key"), []byte("v2"))
+	db.Delete([]byte("other"))
+	if err := db.Compact(); err != nil {
+		t.Fatalf("Compact failed: %v", err)
+	}
+
+	// The compaction output only holds the newest version
+	if count := db.Stats().SSTableCount; count != 1 {
+		t.Fatalf("Expected 1 live SSTable after compaction, got %d", count)
+	}
+	if val, _ := db.Get([]byte("key")); string(val) != "v2" {
+		t.Errorf("Expected DB to read v2, got %s", val)
+	}
+
+	// The snapshot's files are retained and it still sees the old versions
+	// (the flushed memtable is newer than them, so it waits in line too)
+	files, _ := filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if len(files) != 4 {
+		t.Errorf("Expected 3 retained inputs plus the output on disk, got %v", files)
+	}
+	if val, err := snap.Get([]byte("key")); err != nil || string(val) != "v1" {
+		t.Errorf("Expected snapshot to read v1, got %s (err=%v)", val, err)
+	}
+	if val, err := snap.Get([]byte("other")); err != nil || string(val) != "o1" {
+		t.Errorf("Expected snapshot to read o1, got %s (err=%v)", val, err)
+	}
+
+	// Release reclaims the pinned inputs
+	snap.Release()
+	files, _ = filepath.Glob(filepath.Join(dir, "sst_*.sst"))
+	if len(files) != 1 {
+		t.Errorf("Expected only the compaction output after Release, got %v", files)
+	}
+	if _, err := snap.Get([]byte("key")); err != ErrSnapshotReleased {
+		t.Errorf("Expected ErrSnapshotReleased, got %v", err)
+	}
+
+	// Releasing twice is harmless
+	if err := snap.Close(); err != nil {
+		t.Errorf("Second release failed: %v", err)
+	}
+}
+
+func TestSnapshotSeesMemtable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	defer db.Close()
+
+	db.Put([]byte("a"), []byte("a1"))
+	db.Put([]byte("b"), []byte("b1"))
+	db.Delete([]byte("b"))
+
+	snap, _ := db.Snapshot()
+	defer snap.Release()
+
+	db.Put([]byte("a"), []byte("a2"))
+	db.Put([]byte("b"), []byte("b2"))
+	db.Put([]byte("c"), []byte("c2"))
+
+	if val, err := snap.Get([]byte("a")); err != nil || string(val) != "a1" {
+		t.Errorf("Expected a1, got %s (err=%v)", val, err)
+	}
+	if _, err := snap.Get([]byte("b")); err != ErrNotFound {
+		t.Errorf("Expected b deleted in snapshot, got %v", err)
+	}
+	if _, err := snap.Get([]byte("c")); err != ErrNotFound {
+		t.Errorf("Expected c absent in snapshot, got %v", err)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
-	"os"
+	"io"
 	"sort"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,8 +19,191 @@ const (
 
 	// Magic number for SSTable footer validation
 	SSTableMagic uint64 = 0x53535461626C6521 // "SSTable!" in hex
+
+	// Magic number for SSTables with a two-level (partitioned) index
+	SSTableMagicTwoLevel uint64 = 0x53535461626C6532 // "SSTabl2!" in hex
+
+	// Magic number for SSTables with checksummed index blocks and footer
+	// Files with the older magic numbers above still load without the checks
+	SSTableMagicV3 uint64 = 0x53535461626C6533 // "SSTable3" in hex
+
+	// Magic number for SSTables whose footer records a creation time
+	SSTableMagicV4 uint64 = 0x53535461626C6534 // "SSTable4" in hex
+
+	// Default index entries per partition; tables with more blocks than
+	// this get a two-level index
+	DefaultIndexPartitionEntries = 1024
+)
+
+// V4 footer: [indexOffset:8][indexSize:8][bloomOffset:8][bloomSize:8]
+// [flags:4][bloomCRC:4][createdAt:8][footerCRC:4][magic:8]
+// Bits 8-15 of flags hold the block format code. The V3 footer is the same
+// without createdAt.
+const (
+	sstableFooterSize   = 60
+	sstableFooterV3Size = 52
+	footerCRCOffset     = 48 // Footer CRC covers every byte before it
+
+	// footerFlagTwoLevel marks a two-level (partitioned) index
+	footerFlagTwoLevel uint32 = 1
+
+	// footerFlagPadded marks data blocks laid out as
+	// [entries][padding][paddingLen:4][CRC] (see SetBlockAlignment)
+	footerFlagPadded uint32 = 2
+
+	// footerFlagPrefixBloom marks a bloom filter built over extracted key
+	// prefixes (see SetPrefixExtractor)
+	footerFlagPrefixBloom uint32 = 4
+
+	// footerFlagProperties marks a user properties block between the bloom
+	// filter and the footer: [count:4]([keyLen:4][key][valueLen:4][value])*[CRC:4]
+	footerFlagProperties uint32 = 8
+
+	// footerFlagSummary marks a summary block right after the bloom filter
+	// (before any properties), so the key range and count can be read
+	// without the index: [keyCount:8][len:4][smallest][len:4][largest][CRC:4]
+	footerFlagSummary uint32 = 16
+
+	// footerFlagSeqRange marks a block after the summary bounding the
+	// write sequence numbers of the table's entries (see DB.GetAsOf):
+	// [minSeq:8][maxSeq:8][CRC:4]
+	footerFlagSeqRange uint32 = 32
+
+	// footerFlagBlockCounts marks index entries that end with their
+	// block's entry count (see writeIndexBlock)
+	footerFlagBlockCounts uint32 = 64
+
+	// footerFlagValueDict marks a value dictionary block after the
+	// sequence range (see SetValueDictionary): [len:4][dict][CRC:4]
+	footerFlagValueDict uint32 = 128
+
+	footerBlockFormatShift = 8
 )
 
+// Flags byte of a data block entry
+const (
+	entryFlagDeleted    byte = 1
+	entryFlagTimestamp  byte = 2 // [timestamp:8] follows the flags byte
+	entryFlagCompressed byte = 4 // Value is compressed with the table's dictionary
+)
+
+// BlockFormatDefault is the entry encoding written by SSTableWriter
+// Tables from before block format codes existed use it too.
+const BlockFormatDefault uint8 = 0
+
+// BlockFormatPackedTombstones is the default encoding with the deleted
+// flag in the high bit of keyLen and no valueLen for tombstones:
+// [keyLen|1<<31:4][flags:1][timestamp:8 if flagged][key]
+// (see SetPackedTombstones)
+const BlockFormatPackedTombstones uint8 = 1
+
+// BlockFormatValueDict is the default encoding with values flagged
+// entryFlagCompressed stored compressed against the table's value
+// dictionary (see SetValueDictionary). Readers from before it existed
+// would return the compressed bytes as values, so it has its own code.
+const BlockFormatValueDict uint8 = 2
+
+// BlockFormatPackedValueDict is BlockFormatPackedTombstones with values
+// compressed as in BlockFormatValueDict
+const BlockFormatPackedValueDict uint8 = 3
+
+// packedTombstoneBit marks a tombstone's keyLen in BlockFormatPackedTombstones
+const packedTombstoneBit uint32 = 1 << 31
+
+// BlockDecodeFunc parses the data block entry at off
+// Key and Value may slice into block. It returns the offset of the next
+// entry, or ok=false if the entry is truncated.
+type BlockDecodeFunc func(block []byte, off int) (e Entry, next int, ok bool)
+
+var (
+	blockFormatsMu sync.RWMutex
+	blockFormats   = map[uint8]BlockDecodeFunc{
+		BlockFormatDefault:          decodeEntry,
+		BlockFormatPackedTombstones: decodePackedEntry,
+		BlockFormatValueDict:        decodeEntry, // Wrapped by dictDecoder
+		BlockFormatPackedValueDict:  decodePackedEntry,
+	}
+)
+
+// RegisterBlockFormat makes tables whose footer names code readable
+// Codes are stored with each table, so new formats are additive and
+// readers reject tables in formats they don't know.
+func RegisterBlockFormat(code uint8, decode BlockDecodeFunc) {
+	if decode == nil {
+		panic(fmt.Sprintf("lsm: nil decoder for block format %d", code))
+	}
+
+	blockFormatsMu.Lock()
+	defer blockFormatsMu.Unlock()
+	blockFormats[code] = decode
+}
+
+// lookupBlockFormat returns the decoder registered for code
+func lookupBlockFormat(code uint8) (BlockDecodeFunc, bool) {
+	blockFormatsMu.RLock()
+	defer blockFormatsMu.RUnlock()
+	decode, ok := blockFormats[code]
+	return decode, ok
+}
+
+// decodeEntry parses the data block entry at off
+// Key and Value slice into block (capped, so appends can't clobber the next
+// entry). Returns the offset of the next entry, or ok=false if truncated.
+func decodeEntry(block []byte, off int) (e Entry, next int, ok bool) {
+	if len(block)-off < 9 {
+		return Entry{}, 0, false
+	}
+	keyLen := int(binary.LittleEndian.Uint32(block[off:]))
+	valueLen := int(binary.LittleEndian.Uint32(block[off+4:]))
+	flags := block[off+8]
+	e, next, ok = decodeEntryBody(block, off+9, keyLen, valueLen, flags)
+	e.Deleted = flags&entryFlagDeleted != 0
+	return e, next, ok
+}
+
+// decodePackedEntry parses an entry in BlockFormatPackedTombstones
+func decodePackedEntry(block []byte, off int) (e Entry, next int, ok bool) {
+	if len(block)-off < 5 {
+		return Entry{}, 0, false
+	}
+	keyLen := binary.LittleEndian.Uint32(block[off:])
+	off += 4
+	valueLen := 0
+	deleted := keyLen&packedTombstoneBit != 0
+	if deleted {
+		keyLen &^= packedTombstoneBit
+	} else {
+		if len(block)-off < 5 {
+			return Entry{}, 0, false
+		}
+		valueLen = int(binary.LittleEndian.Uint32(block[off:]))
+		off += 4
+	}
+	e, next, ok = decodeEntryBody(block, off+1, int(keyLen), valueLen, block[off])
+	e.Deleted = deleted
+	return e, next, ok
+}
+
+// decodeEntryBody parses the optional timestamp, key and value that follow
+// an entry's flags byte at off
+func decodeEntryBody(block []byte, off, keyLen, valueLen int, flags byte) (e Entry, next int, ok bool) {
+	if flags&entryFlagTimestamp != 0 {
+		if len(block)-off < 8 {
+			return Entry{}, 0, false
+		}
+		e.Timestamp = binary.LittleEndian.Uint64(block[off:])
+		off += 8
+	}
+
+	if keyLen > len(block)-off || valueLen > len(block)-off-keyLen {
+		return Entry{}, 0, false
+	}
+	e.Key = block[off : off+keyLen : off+keyLen]
+	off += keyLen
+	e.Value = block[off : off+valueLen : off+valueLen]
+	return e, off + valueLen, true
+}
+
 // BlockHandle points to a block in the file
 type BlockHandle struct {
 	Offset uint64 // Where the block starts
@@ -28,27 +214,90 @@ type BlockHandle struct {
 type IndexEntry struct {
 	FirstKey []byte      // First key in the block
 	Handle   BlockHandle // Where to find the block
+	Count    uint32      // Entries in the block, or in a partition's blocks (0 = unknown)
 }
 
 // SSTableWriter writes a new SSTable file
 type SSTableWriter struct {
-	file        *os.File
-	writer      *bufio.Writer
-	offset      uint64       // Current write position
-	blockBuffer bytes.Buffer // Buffer for current data block
-	index       []IndexEntry // Index entries for all blocks
-	firstKey    []byte       // First key of current block
-	entryCount  int          // Entries in current block
-	totalKeys   int          // Total keys added (for bloom filter sizing)
-	bloomFilter *BloomFilter // Bloom filter for fast negative lookups
-	bitsPerKey  int          // Bits per key for bloom filter
-	comparator  Comparator
+	file         File
+	writer       *bufio.Writer
+	offset       uint64       // Current write position
+	blockBuffer  bytes.Buffer // Buffer for current data block
+	index        []IndexEntry // Index entries for all blocks
+	firstKey     []byte       // First key of current block
+	lastKey      []byte       // Last key added (for the summary block)
+	entryCount   int          // Entries in current block
+	totalKeys    int          // Total keys added (for bloom filter sizing)
+	bloomFilter  *BloomFilter // Bloom filter for fast negative lookups
+	bitsPerKey   int          // Bits per key for bloom filter
+	bloomHasher  BloomHasher  // Hash for the bloom filter (nil = FNV)
+	extractor    PrefixExtractor
+	lastPrefix   []byte // Last prefix added to the filter
+	comparator   Comparator
+	preallocated bool              // File was extended by Preallocate
+	createdAt    int64             // Unix nanos for the footer (0 = when Finish runs)
+	properties   map[string]string // User properties (see SetProperties)
+	seqs         *seqRange         // Sequence range block (nil = none)
+	paranoid     bool              // Check the filter against every key in Finish
+	addedKeys    [][]byte          // Copies of the keys added, when paranoid
+	duplicates   DuplicateKeyPolicy
+	lastEntryOff int    // Offset of the last entry in blockBuffer
+	valueDict    []byte // Value dictionary (nil = values stored raw)
+	compressor   *valueCompressor
+	packed       bool // Write BlockFormatPackedTombstones
+
+	blockSize        int // Target data block size
+	partitionEntries int // Index entries per partition (two-level index)
+	blockAlignment   int // Data blocks end on multiples of this (0 = unpadded)
+}
+
+// sstableOptions carries DB-level settings into SSTable writers
+type sstableOptions struct {
+	fs               FileSystem
+	bitsPerKey       int
+	preallocate      bool // Preallocate the file from the memtable size
+	partitionEntries int  // Index entries per partition (0 = default)
+	bloomHasher      BloomHasher
+	blockAlignment   int  // Data block alignment (0 = none)
+	paranoidBloom    bool // Verify the bloom filter in Finish
+	prefixExtractor  PrefixExtractor
+	directIO         bool   // Write with O_DIRECT where supported
+	packedTombstones bool   // Write BlockFormatPackedTombstones
+	valueDictSize    int    // Value dictionary size to train (0 = no dictionary)
+	valueDict        []byte // Trained value dictionary for newWriter
+}
+
+// newWriter creates an SSTable writer with these settings applied
+func (o sstableOptions) newWriter(path string) (*SSTableWriter, error) {
+	fs := o.fs
+	if o.directIO {
+		fs = directFS{fs}
+	}
+	writer, err := newSSTableWriter(fs, path, nil, o.bitsPerKey)
+	if err != nil {
+		return nil, err
+	}
+	if o.partitionEntries > 0 {
+		writer.SetIndexPartitionSize(o.partitionEntries)
+	}
+	writer.SetBloomHasher(o.bloomHasher)
+	writer.SetBlockAlignment(o.blockAlignment)
+	writer.SetParanoidBloom(o.paranoidBloom)
+	writer.SetPrefixExtractor(o.prefixExtractor)
+	writer.SetValueDictionary(o.valueDict)
+	writer.SetPackedTombstones(o.packedTombstones)
+	return writer, nil
 }
 
 // NewSSTableWriter creates a writer for a new SSTable
 // bitsPerKey controls bloom filter size (0 = no bloom filter)
 func NewSSTableWriter(path string, comparator Comparator, bitsPerKey int) (*SSTableWriter, error) {
-	file, err := os.Create(path)
+	return newSSTableWriter(OSFileSystem{}, path, comparator, bitsPerKey)
+}
+
+// newSSTableWriter creates an SSTable writer through the given filesystem
+func newSSTableWriter(fs FileSystem, path string, comparator Comparator, bitsPerKey int) (*SSTableWriter, error) {
+	file, err := fs.Create(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create SSTable: %w", err)
 	}
@@ -64,53 +313,259 @@ func NewSSTableWriter(path string, comparator Comparator, bitsPerKey int) (*SSTa
 		index:       make([]IndexEntry, 0),
 		bloomFilter: nil, // Will be created lazily when we know the size
 		bitsPerKey:  bitsPerKey,
+
+		blockSize:        BlockSize,
+		partitionEntries: DefaultIndexPartitionEntries,
 	}, nil
 }
 
+// SetBlockSize sets the target data block size (must be called before Add)
+func (w *SSTableWriter) SetBlockSize(size int) {
+	if size > 0 {
+		w.blockSize = size
+	}
+}
+
+// SetBlockAlignment pads every data block so it ends, and the next one
+// starts, on a multiple of align bytes, for direct I/O and page-aligned
+// reads (must be called before Add; 0 = no padding)
+func (w *SSTableWriter) SetBlockAlignment(align int) {
+	if align >= 0 {
+		w.blockAlignment = align
+	}
+}
+
+// SetCreatedAt overrides the creation time recorded in the footer
+func (w *SSTableWriter) SetCreatedAt(t time.Time) {
+	w.createdAt = t.UnixNano()
+}
+
+// SetBloomHasher sets the bloom filter hash (must be called before Add)
+func (w *SSTableWriter) SetBloomHasher(h BloomHasher) {
+	w.bloomHasher = h
+}
+
+// SetProperties attaches user metadata to the table (e.g. the job that
+// produced it), readable through SSTableReader.Properties
+func (w *SSTableWriter) SetProperties(props map[string]string) {
+	w.properties = props
+}
+
+// setSequenceRange records the range of write sequence numbers the
+// table's entries were written with
+func (w *SSTableWriter) setSequenceRange(seqs seqRange) {
+	w.seqs = &seqs
+}
+
+// SetPrefixExtractor builds the bloom filter over key prefixes instead of
+// whole keys, so readers can rule out a prefix with MayContainPrefix
+// (must be called before Add; nil = whole keys)
+func (w *SSTableWriter) SetPrefixExtractor(extract PrefixExtractor) {
+	w.extractor = extract
+}
+
+// SetParanoidBloom makes Finish check that the bloom filter, as it will be
+// read back, reports every added key, returning ErrBloomFalseNegative if
+// not (must be called before Add)
+func (w *SSTableWriter) SetParanoidBloom(paranoid bool) {
+	w.paranoid = paranoid
+}
+
+// SetValueDictionary compresses values against dict, such as one from
+// TrainValueDictionary, and stores it in the table (must be called before
+// Add). Each value is compressed on its own and kept raw unless that
+// makes it smaller, so the dictionary pays off for many small, similar
+// values that don't compress alone. The table is written in
+// BlockFormatValueDict, which readers from before it existed reject.
+func (w *SSTableWriter) SetValueDictionary(dict []byte) {
+	if len(dict) > MaxValueDictionarySize {
+		dict = dict[len(dict)-MaxValueDictionarySize:] // DEFLATE uses the tail
+	}
+	if len(dict) == 0 {
+		w.valueDict, w.compressor = nil, nil
+		return
+	}
+	w.valueDict = append([]byte(nil), dict...)
+	w.compressor = newValueCompressor(w.valueDict)
+}
+
+// SetPackedTombstones writes entries in BlockFormatPackedTombstones, which
+// saves 4 bytes per tombstone; tombstone values are dropped. Readers from
+// before the format existed reject the table (must be called before Add).
+func (w *SSTableWriter) SetPackedTombstones(packed bool) {
+	w.packed = packed
+}
+
+// DuplicateKeyPolicy says what SSTableWriter.Add does with a key equal to
+// the previous one. A table can't hold both: lookups would only ever find
+// one of them.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateKeyReject fails the Add with ErrDuplicateKey (the default)
+	DuplicateKeyReject DuplicateKeyPolicy = iota
+
+	// DuplicateKeyKeepLast replaces the previous entry, so the last one
+	// added for a key wins, as in a memtable
+	DuplicateKeyKeepLast
+)
+
+// SetDuplicateKeyPolicy sets how Add handles repeated keys, for input such
+// as external data that isn't known to be unique
+func (w *SSTableWriter) SetDuplicateKeyPolicy(policy DuplicateKeyPolicy) {
+	w.duplicates = policy
+}
+
+// SetIndexPartitionSize sets how many index entries go in one partition
+// Tables with more blocks than this are written with a two-level index
+func (w *SSTableWriter) SetIndexPartitionSize(entries int) {
+	if entries > 0 {
+		w.partitionEntries = entries
+	}
+}
+
+// Preallocate reserves size bytes on disk up front to reduce fragmentation
+// It is best effort: unsupported platforms and filesystems are ignored.
+// Finish truncates the file back to its real size.
+func (w *SSTableWriter) Preallocate(size int64) {
+	if size <= 0 {
+		return
+	}
+	f, ok := w.file.(interface{ Fd() uintptr })
+	if !ok {
+		return
+	}
+	if err := fallocate(f.Fd(), size); err == nil {
+		w.preallocated = true
+	}
+}
+
+// EstimatedSize returns the bytes written so far plus the pending block
+func (w *SSTableWriter) EstimatedSize() uint64 {
+	return w.offset + uint64(w.blockBuffer.Len())
+}
+
 // Add adds a key-value pair (must be called in sorted order!)
+// Keys over MaxKeySize and values over MaxValueSize are rejected, and so
+// are keys less than the previous one, with ErrOutOfOrder. A key equal to
+// the previous one is handled by the DuplicateKeyPolicy.
 func (w *SSTableWriter) Add(key, value []byte, deleted bool) error {
-	// Track total keys for bloom filter
-	w.totalKeys++
+	return w.AddWithTimestamp(key, value, deleted, 0)
+}
+
+// AddWithTimestamp is Add for an entry carrying an application timestamp
+// Entries with timestamp 0 are stored exactly as Add stores them.
+func (w *SSTableWriter) AddWithTimestamp(key, value []byte, deleted bool, ts uint64) error {
+	if err := checkEntrySize(key, value, MaxKeySize, MaxValueSize); err != nil {
+		return err
+	}
 
-	// Add key to bloom filter (lazy initialization, skip if bitsPerKey is 0)
-	if w.bitsPerKey > 0 {
-		if w.bloomFilter == nil {
-			// Estimate: start with 1000 keys
-			w.bloomFilter = NewBloomFilter(1000, w.bitsPerKey)
+	// Lookups binary search the index, so unsorted input can't be read back
+	replace := false
+	if w.totalKeys > 0 {
+		switch cmp := w.comparator.Compare(key, w.lastKey); {
+		case cmp < 0:
+			return fmt.Errorf("%w: %q after %q", ErrOutOfOrder, key, w.lastKey)
+		case cmp == 0 && w.duplicates != DuplicateKeyKeepLast:
+			return fmt.Errorf("%w %q (%w)", ErrDuplicateKey, key, ErrOutOfOrder)
+		case cmp == 0:
+			// Blocks are only cut before a new key, so the previous
+			// entry is still buffered; its key is already in the filter
+			w.blockBuffer.Truncate(w.lastEntryOff)
+			w.entryCount--
+			replace = true
 		}
-		w.bloomFilter.Add(key)
 	}
 
-	// Remember first key of block
-	if w.entryCount == 0 {
-		w.firstKey = make([]byte, len(key))
-		copy(w.firstKey, key)
+	if !replace {
+		// Flush block if it's big enough
+		if w.blockBuffer.Len() >= w.blockSize {
+			if err := w.flushBlock(); err != nil {
+				return err
+			}
+		}
+
+		// Track total keys for bloom filter
+		w.totalKeys++
+
+		// Add key to bloom filter (lazy initialization, skip if bitsPerKey is 0)
+		if w.bitsPerKey > 0 {
+			w.addToBloom(key)
+		}
+
+		w.lastKey = append(w.lastKey[:0], key...)
+
+		// Remember first key of block
+		if w.entryCount == 0 {
+			w.firstKey = make([]byte, len(key))
+			copy(w.firstKey, key)
+		}
 	}
+	w.lastEntryOff = w.blockBuffer.Len()
 
 	// Encode entry into block buffer
-	// Format: [keyLen:4][valueLen:4][deleted:1][key][value]
-	if err := binary.Write(&w.blockBuffer, binary.LittleEndian, uint32(len(key))); err != nil {
-		return err
+	// Format: [keyLen:4][valueLen:4][flags:1][timestamp:8 if flagged][key][value]
+	packedTombstone := w.packed && deleted
+	keyLen := uint32(len(key))
+	if packedTombstone {
+		keyLen |= packedTombstoneBit
+		value = nil
 	}
-	if err := binary.Write(&w.blockBuffer, binary.LittleEndian, uint32(len(value))); err != nil {
+	if err := binary.Write(&w.blockBuffer, binary.LittleEndian, keyLen); err != nil {
 		return err
 	}
-	deletedByte := byte(0)
+	flags := byte(0)
+	if w.compressor != nil && !deleted && len(value) > 0 {
+		if compressed := w.compressor.compress(value); len(compressed) < len(value) {
+			value = compressed
+			flags |= entryFlagCompressed
+		}
+	}
+	if !packedTombstone {
+		if err := binary.Write(&w.blockBuffer, binary.LittleEndian, uint32(len(value))); err != nil {
+			return err
+		}
+	}
 	if deleted {
-		deletedByte = 1
+		flags |= entryFlagDeleted
+	}
+	if ts != 0 {
+		flags |= entryFlagTimestamp
+	}
+	w.blockBuffer.WriteByte(flags)
+	if ts != 0 {
+		binary.Write(&w.blockBuffer, binary.LittleEndian, ts)
 	}
-	w.blockBuffer.WriteByte(deletedByte)
 	w.blockBuffer.Write(key)
 	w.blockBuffer.Write(value)
 
 	w.entryCount++
+	return nil
+}
 
-	// Flush block if it's big enough
-	if w.blockBuffer.Len() >= BlockSize {
-		return w.flushBlock()
+// addToBloom adds key, or its extracted prefix, to the bloom filter
+func (w *SSTableWriter) addToBloom(key []byte) {
+	if w.extractor != nil {
+		prefix := w.extractor(key)
+		if prefix == nil {
+			return
+		}
+		// Keys arrive sorted, so repeats of a prefix are adjacent
+		if w.lastPrefix != nil && bytes.Equal(prefix, w.lastPrefix) {
+			return
+		}
+		w.lastPrefix = append(w.lastPrefix[:0], prefix...)
+		key = prefix
 	}
 
-	return nil
+	if w.bloomFilter == nil {
+		// Estimate: start with 1000 keys
+		w.bloomFilter = NewBloomFilterWithHasher(1000, w.bitsPerKey, w.bloomHasher)
+	}
+	w.bloomFilter.Add(key)
+	if w.paranoid {
+		w.addedKeys = append(w.addedKeys, append([]byte(nil), key...))
+	}
 }
 
 // flushBlock writes the current block to file
@@ -119,6 +574,14 @@ func (w *SSTableWriter) flushBlock() error {
 		return nil // Nothing to flush
 	}
 
+	// Pad between the entries and the CRC, recording the padding length
+	if w.blockAlignment > 0 {
+		align := uint64(w.blockAlignment)
+		pad := (align - (w.offset+uint64(w.blockBuffer.Len())+8)%align) % align
+		w.blockBuffer.Write(make([]byte, pad))
+		binary.Write(&w.blockBuffer, binary.LittleEndian, uint32(pad))
+	}
+
 	blockData := w.blockBuffer.Bytes()
 
 	// Calculate CRC for the block
@@ -131,6 +594,7 @@ func (w *SSTableWriter) flushBlock() error {
 			Offset: w.offset,
 			Size:   uint64(len(blockData) + 4), // +4 for CRC
 		},
+		Count: uint32(w.entryCount),
 	})
 
 	// Write block data
@@ -159,31 +623,29 @@ func (w *SSTableWriter) Finish() error {
 		return err
 	}
 
-	// Write index block
-	indexOffset := w.offset
-
-	// Encode index entries
-	// Format: [numEntries:4] followed by entries
-	if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(w.index))); err != nil {
-		return err
+	// Write index block (flat, or partitions plus a top-level index)
+	format := BlockFormatDefault
+	switch {
+	case w.packed && w.valueDict != nil:
+		format = BlockFormatPackedValueDict
+	case w.packed:
+		format = BlockFormatPackedTombstones
+	case w.valueDict != nil:
+		format = BlockFormatValueDict
 	}
-	w.offset += 4
-
-	for _, entry := range w.index {
-		// [keyLen:4][key][offset:8][size:8]
-		if err := binary.Write(w.writer, binary.LittleEndian, uint32(len(entry.FirstKey))); err != nil {
-			return err
-		}
-		if _, err := w.writer.Write(entry.FirstKey); err != nil {
-			return err
-		}
-		if err := binary.Write(w.writer, binary.LittleEndian, entry.Handle.Offset); err != nil {
-			return err
-		}
-		if err := binary.Write(w.writer, binary.LittleEndian, entry.Handle.Size); err != nil {
+	flags := uint32(format)<<footerBlockFormatShift | footerFlagBlockCounts
+	if w.blockAlignment > 0 {
+		flags |= footerFlagPadded
+	}
+	indexOffset := w.offset
+	if len(w.index) > w.partitionEntries {
+		var err error
+		if indexOffset, err = w.writeTwoLevelIndex(); err != nil {
 			return err
 		}
-		w.offset += uint64(4 + len(entry.FirstKey) + 8 + 8)
+		flags |= footerFlagTwoLevel
+	} else if err := w.writeIndexBlock(nil, w.index); err != nil {
+		return err
 	}
 
 	indexSize := w.offset - indexOffset
@@ -191,37 +653,98 @@ func (w *SSTableWriter) Finish() error {
 	// Write bloom filter block
 	bloomOffset := w.offset
 	var bloomSize uint64 = 0
+	var bloomCRC uint32
 	if w.bloomFilter != nil {
 		bloomData := w.bloomFilter.Encode()
+		if w.paranoid {
+			if err := w.verifyBloom(bloomData); err != nil {
+				return err
+			}
+		}
 		if _, err := w.writer.Write(bloomData); err != nil {
 			return err
 		}
 		bloomSize = uint64(len(bloomData))
+		bloomCRC = crc32.ChecksumIEEE(bloomData)
 		w.offset += bloomSize
+		if w.extractor != nil {
+			flags |= footerFlagPrefixBloom
+		}
 	}
 
-	// Write footer
-	// [indexOffset:8][indexSize:8][bloomOffset:8][bloomSize:8][magic:8]
-	if err := binary.Write(w.writer, binary.LittleEndian, indexOffset); err != nil {
-		return err
+	// Write the summary block
+	summary := tableSummary{keyCount: uint64(w.totalKeys)}
+	if len(w.index) > 0 {
+		summary.smallest, summary.largest = w.index[0].FirstKey, w.lastKey
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, indexSize); err != nil {
+	summaryData := encodeSummary(summary)
+	if _, err := w.writer.Write(summaryData); err != nil {
 		return err
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, bloomOffset); err != nil {
-		return err
+	w.offset += uint64(len(summaryData))
+	flags |= footerFlagSummary
+
+	// Write the sequence range, for tables written by a DB
+	if w.seqs != nil {
+		seqData := encodeSeqRange(*w.seqs)
+		if _, err := w.writer.Write(seqData); err != nil {
+			return err
+		}
+		w.offset += uint64(len(seqData))
+		flags |= footerFlagSeqRange
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, bloomSize); err != nil {
-		return err
+
+	// Write the value dictionary, if values were compressed with one
+	if w.valueDict != nil {
+		dictData := encodeValueDict(w.valueDict)
+		if _, err := w.writer.Write(dictData); err != nil {
+			return err
+		}
+		w.offset += uint64(len(dictData))
+		flags |= footerFlagValueDict
+	}
+
+	// Write user properties, if any
+	if len(w.properties) > 0 {
+		propsData := encodeProperties(w.properties)
+		if _, err := w.writer.Write(propsData); err != nil {
+			return err
+		}
+		w.offset += uint64(len(propsData))
+		flags |= footerFlagProperties
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, SSTableMagic); err != nil {
+
+	createdAt := w.createdAt
+	if createdAt == 0 {
+		createdAt = time.Now().UnixNano()
+	}
+
+	// Write footer, checksumming every field before the CRC
+	footer := make([]byte, sstableFooterSize)
+	binary.LittleEndian.PutUint64(footer[0:8], indexOffset)
+	binary.LittleEndian.PutUint64(footer[8:16], indexSize)
+	binary.LittleEndian.PutUint64(footer[16:24], bloomOffset)
+	binary.LittleEndian.PutUint64(footer[24:32], bloomSize)
+	binary.LittleEndian.PutUint32(footer[32:36], flags)
+	binary.LittleEndian.PutUint32(footer[36:40], bloomCRC)
+	binary.LittleEndian.PutUint64(footer[40:48], uint64(createdAt))
+	binary.LittleEndian.PutUint32(footer[48:52], crc32.ChecksumIEEE(footer[:footerCRCOffset]))
+	binary.LittleEndian.PutUint64(footer[52:60], SSTableMagicV4)
+	if _, err := w.writer.Write(footer); err != nil {
 		return err
 	}
+	w.offset += sstableFooterSize
 
 	// Flush and sync
 	if err := w.writer.Flush(); err != nil {
 		return err
 	}
+	// Drop any preallocated space past the footer (readers find it at EOF)
+	if w.preallocated {
+		if err := w.file.Truncate(int64(w.offset)); err != nil {
+			return err
+		}
+	}
 	if err := w.file.Sync(); err != nil {
 		return err
 	}
@@ -229,24 +752,254 @@ func (w *SSTableWriter) Finish() error {
 	return w.file.Close()
 }
 
+// verifyBloom checks the encoded filter against every added key
+// A filter whose hasher isn't registered can't be decoded, so the
+// in-memory filter is checked instead.
+func (w *SSTableWriter) verifyBloom(bloomData []byte) error {
+	bf, err := DecodeBloomFilter(bloomData)
+	if errors.Is(err, ErrUnknownBloomHasher) {
+		bf = w.bloomFilter
+	} else if err != nil {
+		return fmt.Errorf("failed to decode bloom filter: %w", err)
+	}
+
+	for _, key := range w.addedKeys {
+		if !bf.MayContain(key) {
+			return fmt.Errorf("%w: key %q", ErrBloomFalseNegative, key)
+		}
+	}
+	return nil
+}
+
+// tableSummary is the content of a summary block
+type tableSummary struct {
+	keyCount          uint64 // Entries, including tombstones
+	smallest, largest []byte // Both nil for an empty table
+}
+
+// encodeSummary serializes a summary block with a CRC
+func encodeSummary(s tableSummary) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, s.keyCount)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s.smallest)))
+	buf = append(buf, s.smallest...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s.largest)))
+	buf = append(buf, s.largest...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeSummary parses the summary block at the start of data
+// n is the block's length, where any properties block starts
+func decodeSummary(data []byte) (s tableSummary, n int, ok bool) {
+	if len(data) < 8 {
+		return s, 0, false
+	}
+	s.keyCount = binary.LittleEndian.Uint64(data)
+	n = 8
+	readKey := func() ([]byte, bool) {
+		if len(data)-n < 4 {
+			return nil, false
+		}
+		size := binary.LittleEndian.Uint32(data[n:])
+		if uint64(size) > uint64(len(data)-n-4) {
+			return nil, false
+		}
+		var key []byte
+		if size > 0 {
+			key = append([]byte(nil), data[n+4:n+4+int(size)]...)
+		}
+		n += 4 + int(size)
+		return key, true
+	}
+	if s.smallest, ok = readKey(); !ok {
+		return s, 0, false
+	}
+	if s.largest, ok = readKey(); !ok {
+		return s, 0, false
+	}
+	if len(data)-n < 4 || crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return s, 0, false
+	}
+	return s, n + 4, true
+}
+
+// seqRangeBlockSize is the length of a sequence range block
+const seqRangeBlockSize = 20
+
+// encodeSeqRange serializes a sequence range block with a CRC
+func encodeSeqRange(r seqRange) []byte {
+	buf := binary.LittleEndian.AppendUint64(nil, r.min)
+	buf = binary.LittleEndian.AppendUint64(buf, r.max)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeSeqRange parses the sequence range block at the start of data
+func decodeSeqRange(data []byte) (seqRange, bool) {
+	if len(data) < seqRangeBlockSize || crc32.ChecksumIEEE(data[:16]) != binary.LittleEndian.Uint32(data[16:]) {
+		return seqRange{}, false
+	}
+	r := seqRange{min: binary.LittleEndian.Uint64(data), max: binary.LittleEndian.Uint64(data[8:])}
+	return r, r.min <= r.max
+}
+
+// encodeProperties serializes properties, sorted by key, with a CRC
+func encodeProperties(props map[string]string) []byte {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(keys)))
+	for _, k := range keys {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(k)))
+		buf = append(buf, k...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(props[k])))
+		buf = append(buf, props[k]...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeProperties parses a block written by encodeProperties
+func decodeProperties(data []byte) (map[string]string, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, false
+	}
+
+	count := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	props := make(map[string]string)
+	readString := func() (string, bool) {
+		if len(body) < 4 {
+			return "", false
+		}
+		n := binary.LittleEndian.Uint32(body)
+		if uint64(n) > uint64(len(body)-4) {
+			return "", false
+		}
+		str := string(body[4 : 4+n])
+		body = body[4+n:]
+		return str, true
+	}
+	for i := uint32(0); i < count; i++ {
+		k, ok := readString()
+		if !ok {
+			return nil, false
+		}
+		v, ok := readString()
+		if !ok {
+			return nil, false
+		}
+		props[k] = v
+	}
+	return props, len(body) == 0
+}
+
+// writeIndexBlock writes header and index entries at the current offset
+// Format: [header][numEntries:4] followed by
+// [keyLen:4][key][offset:8][size:8][count:4] per entry, then a CRC32 of
+// everything before it. Tables without footerFlagBlockCounts lack count.
+func (w *SSTableWriter) writeIndexBlock(header []byte, entries []IndexEntry) error {
+	var buf bytes.Buffer
+	buf.Write(header)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(entries)))
+	for _, entry := range entries {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(entry.FirstKey)))
+		buf.Write(entry.FirstKey)
+		binary.Write(&buf, binary.LittleEndian, entry.Handle.Offset)
+		binary.Write(&buf, binary.LittleEndian, entry.Handle.Size)
+		binary.Write(&buf, binary.LittleEndian, entry.Count)
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	if _, err := w.writer.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	w.offset += uint64(buf.Len())
+	return nil
+}
+
+// writeTwoLevelIndex writes the index as fixed-size partitions followed by
+// a top-level index with one entry per partition, and returns the top-level
+// index offset. The top-level index is a regular index block with the header
+// [entriesPerPartition:4][numBlocks:4].
+func (w *SSTableWriter) writeTwoLevelIndex() (uint64, error) {
+	var top []IndexEntry
+	for start := 0; start < len(w.index); start += w.partitionEntries {
+		end := min(start+w.partitionEntries, len(w.index))
+
+		offset := w.offset
+		if err := w.writeIndexBlock(nil, w.index[start:end]); err != nil {
+			return 0, err
+		}
+		var count uint32
+		for _, entry := range w.index[start:end] {
+			count += entry.Count
+		}
+		top = append(top, IndexEntry{
+			FirstKey: w.index[start].FirstKey,
+			Handle:   BlockHandle{Offset: offset, Size: w.offset - offset},
+			Count:    count,
+		})
+	}
+
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(w.partitionEntries))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(w.index)))
+
+	topOffset := w.offset
+	return topOffset, w.writeIndexBlock(header, top)
+}
+
 // Close closes the writer without finishing (for error cases)
 func (w *SSTableWriter) Close() error {
 	return w.file.Close()
 }
 
-// SSTableReader reads from an SSTable file
+// SSTableReader reads from an SSTable file, or any io.ReaderAt
 type SSTableReader struct {
-	file        *os.File
+	reader      io.ReaderAt // The table's bytes; closed by Close if an io.Closer
 	size        int64
-	index       []IndexEntry
+	index       []IndexEntry // Flat index (nil for two-level tables)
+	numBlocks   int
 	bloomFilter *BloomFilter // Bloom filter for fast negative lookups
 	comparator  Comparator
 	path        string
+	checksummed bool              // Index blocks end with a CRC (V3 footer)
+	padded      bool              // Data blocks carry alignment padding
+	blockCounts bool              // Index entries carry entry counts
+	prefixBloom bool              // Bloom filter holds prefixes, not keys
+	extractor   PrefixExtractor   // Prefix extractor for a prefix bloom
+	createdAt   int64             // Unix nanos from the footer (0 = unknown)
+	properties  map[string]string // User properties (empty if none)
+	summary     *tableSummary     // Key range and count (nil for older tables)
+	seqs        *seqRange         // Write sequence range (nil for older tables)
+	valueDict   []byte            // Value dictionary (nil = values stored raw)
+	dictReaders sync.Pool         // flate readers for compressed values
+	decode      BlockDecodeFunc   // Decoder for the table's block format
+	id          uint64            // Identifies the table's blocks in the cache
+	cache       *blockCache       // Shared block cache (nil = none)
+
+	// Two-level index: top-level entries point at index partitions,
+	// which are loaded on first use
+	topIndex         []IndexEntry
+	partitionEntries int
+	indexOffset      uint64
+	partitionMu      sync.Mutex
+	partitions       [][]IndexEntry
 }
 
 // OpenSSTable opens an existing SSTable for reading
 func OpenSSTable(path string, comparator Comparator) (*SSTableReader, error) {
-	file, err := os.Open(path)
+	return openSSTable(OSFileSystem{}, path, comparator)
+}
+
+// openSSTable opens an SSTable through the given filesystem
+func openSSTable(fs FileSystem, path string, comparator Comparator) (*SSTableReader, error) {
+	file, err := fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
@@ -258,69 +1011,236 @@ func OpenSSTable(path string, comparator Comparator) (*SSTableReader, error) {
 		return nil, err
 	}
 
+	r, err := newSSTableReader(file, stat.Size(), path, comparator)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenSSTableFromReaderAt opens an SSTable held in size bytes of r, such as
+// a table in memory, embedded in another file, or fetched from object
+// storage. Close closes r if it is an io.Closer. The reader's Path is
+// empty, including in any CorruptionError.
+func OpenSSTableFromReaderAt(r io.ReaderAt, size int64, comparator Comparator) (*SSTableReader, error) {
+	return newSSTableReader(r, size, "", comparator)
+}
+
+// newSSTableReader reads and validates the table's footer and meta blocks
+func newSSTableReader(reader io.ReaderAt, size int64, path string, comparator Comparator) (*SSTableReader, error) {
 	if comparator == nil {
 		comparator = DefaultComparator{}
 	}
 
 	r := &SSTableReader{
-		file:       file,
-		size:       stat.Size(),
+		reader:     reader,
+		size:       size,
 		comparator: comparator,
 		path:       path,
+		decode:     decodeEntry,
+		id:         nextTableID.Add(1),
 	}
 
 	// Read and validate footer
 	if err := r.readFooter(); err != nil {
-		file.Close()
 		return nil, err
 	}
 
 	return r, nil
 }
 
-// readFooter reads the footer and index
-func (r *SSTableReader) readFooter() error {
-	// Try new footer format first: 40 bytes
-	// [indexOffset:8][indexSize:8][bloomOffset:8][bloomSize:8][magic:8]
-	if r.size >= 40 {
-		footer := make([]byte, 40)
-		if _, err := r.file.ReadAt(footer, r.size-40); err != nil {
-			return err
-		}
-
-		magic := binary.LittleEndian.Uint64(footer[32:40])
-		if magic == SSTableMagic {
-			// New format with bloom filter
-			indexOffset := binary.LittleEndian.Uint64(footer[0:8])
-			indexSize := binary.LittleEndian.Uint64(footer[8:16])
-			bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
-			bloomSize := binary.LittleEndian.Uint64(footer[24:32])
+// SSTableMetadata describes an SSTable, as read by OpenSSTableIndexOnly
+type SSTableMetadata struct {
+	Path        string
+	Size        int64             // File size in bytes
+	KeyCount    uint64            // Entries, including tombstones
+	SmallestKey []byte            // nil if the table is empty
+	LargestKey  []byte            // nil if the table is empty
+	CreatedAt   time.Time         // Zero if unknown
+	BloomBits   uint64            // Bits in the bloom filter (0 = no filter)
+	BloomHashes uint32            // Hash functions per key
+	BloomItems  uint64            // Keys (or prefixes) added to the filter
+	PrefixBloom bool              // The filter holds key prefixes
+	Properties  map[string]string // User properties (empty if none)
+}
 
-			// Read bloom filter if present
-			if bloomSize > 0 {
-				bloomData := make([]byte, bloomSize)
-				if _, err := r.file.ReadAt(bloomData, int64(bloomOffset)); err != nil {
-					return err
-				}
-				bf, err := DecodeBloomFilter(bloomData)
-				if err != nil {
-					return fmt.Errorf("failed to decode bloom filter: %w", err)
-				}
-				r.bloomFilter = bf
-			}
+// OpenSSTableIndexOnly reads an SSTable's metadata from its footer and
+// summary block, without loading the index, bloom filter or any data
+// block, for tools that scan many tables. The file is closed on return.
+// Tables written before summary blocks existed are opened in full, and
+// their keys counted, instead.
+func OpenSSTableIndexOnly(path string) (*SSTableMetadata, error) {
+	return openSSTableIndexOnly(OSFileSystem{}, path)
+}
 
-			return r.readIndex(indexOffset, indexSize)
+// openSSTableIndexOnly is OpenSSTableIndexOnly through the given filesystem
+func openSSTableIndexOnly(fs FileSystem, path string) (*SSTableMetadata, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &SSTableReader{reader: file, size: stat.Size(), path: path}
+
+	if r.size < sstableFooterSize {
+		return openSSTableMetadataFull(fs, path)
+	}
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, r.size-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	flags := binary.LittleEndian.Uint32(footer[32:36])
+	if binary.LittleEndian.Uint64(footer[52:60]) != SSTableMagicV4 || flags&footerFlagSummary == 0 {
+		return openSSTableMetadataFull(fs, path)
+	}
+	if crc32.ChecksumIEEE(footer[:footerCRCOffset]) != binary.LittleEndian.Uint32(footer[48:52]) {
+		return nil, r.corruption(r.size-sstableFooterSize, "footer checksum mismatch")
+	}
+	r.createdAt = int64(binary.LittleEndian.Uint64(footer[40:48]))
+
+	bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
+	bloomSize := binary.LittleEndian.Uint64(footer[24:32])
+	if bloomOffset > uint64(r.size) || bloomSize > uint64(r.size)-bloomOffset {
+		return nil, r.corruption(int64(bloomOffset), "bloom filter out of bounds")
+	}
+	if err := r.readMetaBlocks(bloomOffset+bloomSize, sstableFooterSize, flags); err != nil {
+		return nil, err
+	}
+
+	meta := &SSTableMetadata{
+		Path:        path,
+		Size:        r.size,
+		KeyCount:    r.summary.keyCount,
+		SmallestKey: r.summary.smallest,
+		LargestKey:  r.summary.largest,
+		CreatedAt:   r.CreatedAt(),
+		PrefixBloom: flags&footerFlagPrefixBloom != 0,
+		Properties:  r.Properties(),
+	}
+
+	// The bloom header: [numBits:8][numHash:4][numItems:8]
+	if bloomSize >= 20 {
+		header := make([]byte, 20)
+		if _, err := file.ReadAt(header, int64(bloomOffset)); err != nil {
+			return nil, err
+		}
+		meta.BloomBits = binary.LittleEndian.Uint64(header[0:8])
+		meta.BloomHashes = binary.LittleEndian.Uint32(header[8:12])
+		meta.BloomItems = binary.LittleEndian.Uint64(header[12:20])
+	}
+	return meta, nil
+}
+
+// openSSTableMetadataFull builds SSTableMetadata by opening the table and
+// counting its entries
+func openSSTableMetadataFull(fs FileSystem, path string) (*SSTableMetadata, error) {
+	r, err := openSSTable(fs, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	smallest, largest, err := r.keyRange()
+	if err != nil {
+		return nil, err
+	}
+	meta := &SSTableMetadata{
+		Path:        path,
+		Size:        r.size,
+		SmallestKey: smallest,
+		LargestKey:  largest,
+		CreatedAt:   r.CreatedAt(),
+		PrefixBloom: r.prefixBloom,
+		Properties:  r.Properties(),
+	}
+	if bf := r.bloomFilter; bf != nil {
+		meta.BloomBits, meta.BloomHashes, meta.BloomItems = bf.numBits, bf.numHash, bf.numItems
+	}
+
+	it := r.NewIterator()
+	it.SetFillCache(false)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		meta.KeyCount++
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// readFooter reads the footer and index
+func (r *SSTableReader) readFooter() error {
+	// Current format, with checksums and a creation time
+	if r.size >= sstableFooterSize {
+		footer := make([]byte, sstableFooterSize)
+		if _, err := r.reader.ReadAt(footer, r.size-sstableFooterSize); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(footer[52:60]) == SSTableMagicV4 {
+			if crc32.ChecksumIEEE(footer[:footerCRCOffset]) != binary.LittleEndian.Uint32(footer[48:52]) {
+				return r.corruption(r.size-sstableFooterSize, "footer checksum mismatch")
+			}
+			r.createdAt = int64(binary.LittleEndian.Uint64(footer[40:48]))
+			return r.readChecksummedFooter(footer)
+		}
+	}
+
+	// V3: checksums, no creation time
+	if r.size >= sstableFooterV3Size {
+		footer := make([]byte, sstableFooterV3Size)
+		if _, err := r.reader.ReadAt(footer, r.size-sstableFooterV3Size); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint64(footer[44:52]) == SSTableMagicV3 {
+			if crc32.ChecksumIEEE(footer[:40]) != binary.LittleEndian.Uint32(footer[40:44]) {
+				return r.corruption(r.size-sstableFooterV3Size, "footer checksum mismatch")
+			}
+			return r.readChecksummedFooter(footer)
+		}
+	}
+
+	// Try the unchecksummed footer format: 40 bytes
+	// [indexOffset:8][indexSize:8][bloomOffset:8][bloomSize:8][magic:8]
+	if r.size >= 40 {
+		footer := make([]byte, 40)
+		if _, err := r.reader.ReadAt(footer, r.size-40); err != nil {
+			return err
+		}
+
+		magic := binary.LittleEndian.Uint64(footer[32:40])
+		if magic == SSTableMagic || magic == SSTableMagicTwoLevel {
+			// New format with bloom filter
+			indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+			indexSize := binary.LittleEndian.Uint64(footer[8:16])
+			bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
+			bloomSize := binary.LittleEndian.Uint64(footer[24:32])
+
+			// Read bloom filter if present
+			if err := r.readBloomFilter(bloomOffset, bloomSize, nil); err != nil {
+				return err
+			}
+
+			if magic == SSTableMagicTwoLevel {
+				return r.readTwoLevelIndex(indexOffset, indexSize)
+			}
+			return r.readIndex(indexOffset, indexSize)
 		}
 	}
 
 	// Fall back to old footer format: 24 bytes (for backward compatibility)
 	// [indexOffset:8][indexSize:8][magic:8]
 	if r.size < 24 {
-		return fmt.Errorf("SSTable too small")
+		return r.corruption(0, "file too small for footer")
 	}
 
 	footer := make([]byte, 24)
-	if _, err := r.file.ReadAt(footer, r.size-24); err != nil {
+	if _, err := r.reader.ReadAt(footer, r.size-24); err != nil {
 		return err
 	}
 
@@ -329,52 +1249,317 @@ func (r *SSTableReader) readFooter() error {
 	magic := binary.LittleEndian.Uint64(footer[16:24])
 
 	if magic != SSTableMagic {
-		return fmt.Errorf("invalid SSTable: bad magic number")
+		return r.corruption(r.size-8, "bad footer magic number")
+	}
+
+	return r.readIndex(indexOffset, indexSize)
+}
+
+// readChecksummedFooter reads what a verified V3 or V4 footer points at
+func (r *SSTableReader) readChecksummedFooter(footer []byte) error {
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	indexSize := binary.LittleEndian.Uint64(footer[8:16])
+	bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
+	bloomSize := binary.LittleEndian.Uint64(footer[24:32])
+	flags := binary.LittleEndian.Uint32(footer[32:36])
+	bloomCRC := binary.LittleEndian.Uint32(footer[36:40])
+
+	code := uint8(flags >> footerBlockFormatShift)
+	decode, ok := lookupBlockFormat(code)
+	if !ok {
+		return fmt.Errorf("%w %d in %s", ErrUnknownBlockFormat, code, r.path)
+	}
+	r.decode = decode
+
+	r.checksummed = true
+	r.padded = flags&footerFlagPadded != 0
+	r.blockCounts = flags&footerFlagBlockCounts != 0
+	r.prefixBloom = flags&footerFlagPrefixBloom != 0
+	if err := r.readBloomFilter(bloomOffset, bloomSize, &bloomCRC); err != nil {
+		return err
+	}
+
+	if err := r.readMetaBlocks(bloomOffset+bloomSize, uint64(len(footer)), flags); err != nil {
+		return err
+	}
+	if code == BlockFormatValueDict || code == BlockFormatPackedValueDict {
+		if r.valueDict == nil {
+			return r.corruption(r.size-int64(len(footer)), "value dictionary missing")
+		}
+	}
+	if r.valueDict != nil {
+		r.decode = r.dictDecoder(r.decode)
 	}
 
+	if flags&footerFlagTwoLevel != 0 {
+		return r.readTwoLevelIndex(indexOffset, indexSize)
+	}
 	return r.readIndex(indexOffset, indexSize)
 }
 
-// readIndex reads the index block
+// readMetaBlocks reads the summary, sequence range, value dictionary and
+// properties blocks, which fill the gap between the end of the bloom
+// filter and a footer of footerSize bytes
+func (r *SSTableReader) readMetaBlocks(offset, footerSize uint64, flags uint32) error {
+	if flags&(footerFlagSummary|footerFlagSeqRange|footerFlagValueDict|footerFlagProperties) == 0 {
+		return nil
+	}
+	end := uint64(r.size) - footerSize
+	if offset > end {
+		return r.corruption(int64(offset), "metadata blocks out of bounds")
+	}
+	data := make([]byte, end-offset)
+	if _, err := r.reader.ReadAt(data, int64(offset)); err != nil {
+		return err
+	}
+
+	if flags&footerFlagSummary != 0 {
+		summary, n, ok := decodeSummary(data)
+		if !ok {
+			return r.corruption(int64(offset), "corrupted summary")
+		}
+		r.summary = &summary
+		data, offset = data[n:], offset+uint64(n)
+	}
+
+	if flags&footerFlagSeqRange != 0 {
+		seqs, ok := decodeSeqRange(data)
+		if !ok {
+			return r.corruption(int64(offset), "corrupted sequence range")
+		}
+		r.seqs = &seqs
+		data, offset = data[seqRangeBlockSize:], offset+seqRangeBlockSize
+	}
+
+	if flags&footerFlagValueDict != 0 {
+		dict, n, ok := decodeValueDict(data)
+		if !ok {
+			return r.corruption(int64(offset), "corrupted value dictionary")
+		}
+		r.valueDict = dict
+		data, offset = data[n:], offset+uint64(n)
+	}
+
+	if flags&footerFlagProperties != 0 {
+		props, ok := decodeProperties(data)
+		if !ok {
+			return r.corruption(int64(offset), "corrupted properties")
+		}
+		r.properties = props
+	}
+	return nil
+}
+
+// readBloomFilter loads the bloom filter, if the table has one
+// wantCRC is checked when non-nil (older tables don't record it)
+func (r *SSTableReader) readBloomFilter(bloomOffset, bloomSize uint64, wantCRC *uint32) error {
+	if bloomSize == 0 {
+		return nil
+	}
+	if bloomOffset > uint64(r.size) || bloomSize > uint64(r.size)-bloomOffset {
+		return r.corruption(int64(bloomOffset), "bloom filter out of bounds")
+	}
+
+	bloomData := make([]byte, bloomSize)
+	if _, err := r.reader.ReadAt(bloomData, int64(bloomOffset)); err != nil {
+		return err
+	}
+	if wantCRC != nil && crc32.ChecksumIEEE(bloomData) != *wantCRC {
+		return r.corruption(int64(bloomOffset), "bloom filter checksum mismatch")
+	}
+
+	bf, err := DecodeBloomFilter(bloomData)
+	switch {
+	case errors.Is(err, ErrUnknownBloomHasher):
+		// Still readable, just without negative lookups
+		fmt.Printf("Warning: ignoring bloom filter in %s: %v\n", r.path, err)
+	case err != nil:
+		return r.corruption(int64(bloomOffset), "undecodable bloom filter")
+	default:
+		r.bloomFilter = bf
+	}
+	return nil
+}
+
+// readIndex reads a flat index block
 func (r *SSTableReader) readIndex(indexOffset, indexSize uint64) error {
+	index, err := r.readIndexBlock(indexOffset, indexSize, indexOffset)
+	if err != nil {
+		return err
+	}
+	r.index = index
+	r.numBlocks = len(index)
+	return nil
+}
 
-	// Read index block
-	indexData := make([]byte, indexSize)
-	if _, err := r.file.ReadAt(indexData, int64(indexOffset)); err != nil {
+// readTwoLevelIndex reads the top-level index; partitions load lazily
+func (r *SSTableReader) readTwoLevelIndex(indexOffset, indexSize uint64) error {
+	data, err := r.readIndexData(indexOffset, indexSize)
+	if err != nil {
 		return err
 	}
+	if len(data) < 8 {
+		return r.corruption(int64(indexOffset), fmt.Sprintf("top-level index out of bounds (size %d)", indexSize))
+	}
+
+	partitionEntries := int(binary.LittleEndian.Uint32(data[0:4]))
+	numBlocks := int(binary.LittleEndian.Uint32(data[4:8]))
 
-	// Parse index
-	reader := bytes.NewReader(indexData)
-	var numEntries uint32
-	if err := binary.Read(reader, binary.LittleEndian, &numEntries); err != nil {
+	top, err := r.parseIndexBlock(data[8:], indexOffset+8, indexOffset)
+	if err != nil {
 		return err
 	}
+	if partitionEntries == 0 || len(top) != (numBlocks+partitionEntries-1)/partitionEntries {
+		return r.corruption(int64(indexOffset), fmt.Sprintf("top-level index has %d partitions for %d blocks", len(top), numBlocks))
+	}
+
+	r.topIndex = top
+	r.partitionEntries = partitionEntries
+	r.numBlocks = numBlocks
+	r.indexOffset = indexOffset
+	r.partitions = make([][]IndexEntry, len(top))
+	return nil
+}
+
+// readIndexBlock reads and parses an index block
+// Every handle it contains must point below limit
+func (r *SSTableReader) readIndexBlock(indexOffset, indexSize, limit uint64) ([]IndexEntry, error) {
+	indexData, err := r.readIndexData(indexOffset, indexSize)
+	if err != nil {
+		return nil, err
+	}
+	return r.parseIndexBlock(indexData, indexOffset, limit)
+}
+
+// readIndexData reads an index block, verifying and stripping its CRC
+func (r *SSTableReader) readIndexData(indexOffset, indexSize uint64) ([]byte, error) {
+	minSize := uint64(4)
+	if r.checksummed {
+		minSize += 4
+	}
 
-	r.index = make([]IndexEntry, numEntries)
+	// The index must lie entirely within the file
+	if indexSize < minSize || indexOffset > uint64(r.size) || indexSize > uint64(r.size)-indexOffset {
+		return nil, r.corruption(int64(indexOffset), fmt.Sprintf("index block out of bounds (size %d)", indexSize))
+	}
+
+	indexData := make([]byte, indexSize)
+	if _, err := r.reader.ReadAt(indexData, int64(indexOffset)); err != nil {
+		return nil, err
+	}
+	if !r.checksummed {
+		return indexData, nil
+	}
+
+	dataPart := indexData[:indexSize-4]
+	if crc32.ChecksumIEEE(dataPart) != binary.LittleEndian.Uint32(indexData[indexSize-4:]) {
+		return nil, r.corruption(int64(indexOffset), "index block checksum mismatch")
+	}
+	return dataPart, nil
+}
+
+// parseIndexBlock parses index entries read from indexOffset
+func (r *SSTableReader) parseIndexBlock(indexData []byte, indexOffset, limit uint64) ([]IndexEntry, error) {
+	indexSize := uint64(len(indexData))
+	if indexSize < 4 {
+		return nil, r.corruption(int64(indexOffset), fmt.Sprintf("index block out of bounds (size %d)", indexSize))
+	}
+
+	// Parse index, bounds-checking every field against indexSize
+	// so a truncated index yields ErrCorruptedData instead of a panic
+	numEntries := binary.LittleEndian.Uint32(indexData[0:4])
+	pos := uint64(4)
+
+	// Each entry needs at least [keyLen:4][offset:8][size:8], plus [count:4]
+	fixed := uint64(16)
+	if r.blockCounts {
+		fixed += 4
+	}
+	if uint64(numEntries) > (indexSize-pos)/(4+fixed) {
+		return nil, r.corruption(int64(indexOffset), fmt.Sprintf("index claims %d entries in %d bytes", numEntries, indexSize))
+	}
+
+	index := make([]IndexEntry, numEntries)
 	for i := uint32(0); i < numEntries; i++ {
-		var keyLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-			return err
+		if indexSize-pos < 4 {
+			return nil, r.corruption(int64(indexOffset+pos), fmt.Sprintf("index entry %d truncated", i))
 		}
-		key := make([]byte, keyLen)
-		if _, err := reader.Read(key); err != nil {
-			return err
+		keyLen := uint64(binary.LittleEndian.Uint32(indexData[pos : pos+4]))
+		pos += 4
+
+		if indexSize-pos < keyLen+fixed {
+			return nil, r.corruption(int64(indexOffset+pos), fmt.Sprintf("index entry %d truncated", i))
 		}
-		var offset, size uint64
-		if err := binary.Read(reader, binary.LittleEndian, &offset); err != nil {
-			return err
+		key := make([]byte, keyLen)
+		copy(key, indexData[pos:pos+keyLen])
+		pos += keyLen
+
+		offset := binary.LittleEndian.Uint64(indexData[pos : pos+8])
+		size := binary.LittleEndian.Uint64(indexData[pos+8 : pos+16])
+		var count uint32
+		if r.blockCounts {
+			count = binary.LittleEndian.Uint32(indexData[pos+16 : pos+20])
 		}
-		if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
-			return err
+
+		// Blocks live before the index and always carry a 4-byte CRC
+		if size < 4 || offset > limit || size > limit-offset {
+			return nil, r.corruption(int64(indexOffset+pos), fmt.Sprintf("index entry %d points outside data region", i))
 		}
-		r.index[i] = IndexEntry{
+		pos += fixed
+
+		index[i] = IndexEntry{
 			FirstKey: key,
 			Handle:   BlockHandle{Offset: offset, Size: size},
+			Count:    count,
 		}
 	}
 
-	return nil
+	return index, nil
+}
+
+// partition returns index partition p, loading it on first use
+func (r *SSTableReader) partition(p int) ([]IndexEntry, error) {
+	return r.partitionFill(p, true)
+}
+
+// partitionFill is partition, keeping a partition it loads only if fill is
+// set (see ReadOptions.FillCache)
+func (r *SSTableReader) partitionFill(p int, fill bool) ([]IndexEntry, error) {
+	r.partitionMu.Lock()
+	defer r.partitionMu.Unlock()
+
+	if r.partitions[p] != nil {
+		return r.partitions[p], nil
+	}
+
+	handle := r.topIndex[p].Handle
+	entries, err := r.readIndexBlock(handle.Offset, handle.Size, r.indexOffset)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every partition but the last is full
+	want := min(r.partitionEntries, r.numBlocks-p*r.partitionEntries)
+	if len(entries) != want {
+		return nil, r.corruption(int64(handle.Offset), fmt.Sprintf("index partition %d has %d entries, expected %d", p, len(entries), want))
+	}
+
+	if fill {
+		r.partitions[p] = entries
+	}
+	return entries, nil
+}
+
+// blockEntry returns the index entry for data block i
+func (r *SSTableReader) blockEntry(i int) (IndexEntry, error) {
+	if r.topIndex == nil {
+		return r.index[i], nil
+	}
+	entries, err := r.partition(i / r.partitionEntries)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	return entries[i%r.partitionEntries], nil
 }
 
 // MayContain checks if a key might be in the SSTable using the bloom filter.
@@ -384,104 +1569,464 @@ func (r *SSTableReader) MayContain(key []byte) bool {
 	if r.bloomFilter == nil {
 		return true // No bloom filter, must check SSTable
 	}
+	if r.prefixBloom {
+		if r.extractor == nil {
+			return true // Can't tell which prefix to test
+		}
+		prefix := r.extractor(key)
+		if prefix == nil {
+			return true // Key wasn't added to the filter
+		}
+		key = prefix
+	}
 	return r.bloomFilter.MayContain(key)
 }
 
+// MayContainPrefix reports whether the table might hold keys whose
+// extracted prefix is prefix
+// Always true unless the table was written with a prefix extractor.
+func (r *SSTableReader) MayContainPrefix(prefix []byte) bool {
+	if r.bloomFilter == nil || !r.prefixBloom {
+		return true
+	}
+	return r.bloomFilter.MayContain(prefix)
+}
+
+// SetPrefixExtractor sets the extractor the table was written with, which
+// MayContain needs for tables with a prefix bloom filter
+func (r *SSTableReader) SetPrefixExtractor(extract PrefixExtractor) {
+	r.extractor = extract
+}
+
 // Get looks up a key in the SSTable
 // Returns: (value, deleted, found)
+// Read errors and corrupted blocks are reported as not found; use Lookup
+// to tell them apart.
 func (r *SSTableReader) Get(key []byte) ([]byte, bool, bool) {
+	value, deleted, found, _ := r.Lookup(key)
+	return value, deleted, found
+}
+
+// Lookup looks up a key in the SSTable
+// Returns: (value, deleted, found, error)
+// Returns a *CorruptionError if the block holding the key is corrupted
+func (r *SSTableReader) Lookup(key []byte) ([]byte, bool, bool, error) {
 	// Find which block might contain the key using index
-	blockIdx := r.findBlock(key)
-	if blockIdx < 0 {
-		return nil, false, false
+	blockIdx, err := r.findBlock(key)
+	if err != nil || blockIdx < 0 {
+		return nil, false, false, err
 	}
 
 	// Read and search the block
-	return r.searchBlock(blockIdx, key)
+	entry, found, err := r.searchBlock(blockIdx, key, true)
+	return entry.Value, entry.Deleted, found, err
 }
 
-// findBlock finds which block might contain the key
-// Uses binary search on the index
-func (r *SSTableReader) findBlock(key []byte) int {
-	if len(r.index) == 0 {
-		return -1
+// LookupEntry is Lookup returning the whole entry, including its timestamp
+func (r *SSTableReader) LookupEntry(key []byte) (Entry, bool, error) {
+	return r.lookupEntry(key, true)
+}
+
+// lookupEntry is LookupEntry; fillCache says whether a block read from
+// disk is added to the block cache
+func (r *SSTableReader) lookupEntry(key []byte, fillCache bool) (Entry, bool, error) {
+	blockIdx, err := r.findBlock(key)
+	if err != nil || blockIdx < 0 {
+		return Entry{}, false, err
 	}
+	return r.searchBlock(blockIdx, key, fillCache)
+}
 
-	// Binary search: find the last block where firstKey <= key
-	idx := sort.Search(len(r.index), func(i int) bool {
-		return r.comparator.Compare(r.index[i].FirstKey, key) > 0
-	})
+// findBlock finds which block might contain the key
+// Uses binary search on the index (and on one partition for two-level tables)
+func (r *SSTableReader) findBlock(key []byte) (int, error) {
+	return r.findBlockFill(key, true)
+}
 
-	// idx is the first block where firstKey > key
-	// So we want idx - 1
-	if idx == 0 {
-		// Key is smaller than first key of first block
-		// But it might still be in first block (if there's only one block)
-		// Actually no - if key < firstKey of block 0, it's not in the table
-		return -1
+// findBlockFill is findBlock, keeping the partition it loads only if fill
+// is set
+func (r *SSTableReader) findBlockFill(key []byte, fill bool) (int, error) {
+	if r.topIndex == nil {
+		return searchIndex(r.index, key, r.comparator), nil
 	}
 
+	p := searchIndex(r.topIndex, key, r.comparator)
+	if p < 0 {
+		return -1, nil
+	}
+	entries, err := r.partitionFill(p, fill)
+	if err != nil {
+		return -1, err
+	}
+	return p*r.partitionEntries + searchIndex(entries, key, r.comparator), nil
+}
+
+// searchIndex returns the last entry whose first key is <= key, or -1
+func searchIndex(index []IndexEntry, key []byte, comparator Comparator) int {
+	// Binary search: first entry where firstKey > key
+	idx := sort.Search(len(index), func(i int) bool {
+		return comparator.Compare(index[i].FirstKey, key) > 0
+	})
+
+	// So we want idx - 1; if idx == 0 the key sorts before the table
 	return idx - 1
 }
 
 // searchBlock reads a block and searches for the key
-func (r *SSTableReader) searchBlock(blockIdx int, key []byte) ([]byte, bool, bool) {
-	handle := r.index[blockIdx].Handle
+func (r *SSTableReader) searchBlock(blockIdx int, key []byte, fillCache bool) (Entry, bool, error) {
+	dataPart, shared, err := r.readBlock(blockIdx, nil, fillCache)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	// Search through entries, comparing keys in place
+	for off := 0; off < len(dataPart); {
+		e, next, ok := r.decode(dataPart, off)
+		if !ok {
+			break
+		}
+		off = next
+
+		cmp := r.comparator.Compare(e.Key, key)
+		if cmp == 0 {
+			// Found it! A block read just for us can be aliased, but
+			// callers may modify the value, so copy it out of the cache
+			if shared {
+				e.Value = append([]byte(nil), e.Value...)
+			}
+			return e, true, nil
+		}
+		if cmp > 0 {
+			// Passed where key would be (keys are sorted)
+			break
+		}
+	}
+
+	return Entry{}, false, nil
+}
+
+// keyRange returns the table's smallest and largest keys, from the summary
+// block or else by reading the last data block (both nil for an empty table)
+func (r *SSTableReader) keyRange() (smallest, largest []byte, err error) {
+	if r.summary != nil {
+		return r.summary.smallest, r.summary.largest, nil
+	}
+	if r.numBlocks == 0 {
+		return nil, nil, nil
+	}
+	first, err := r.blockEntry(0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _, err := r.readBlock(r.numBlocks-1, nil, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	for off := 0; off < len(block); {
+		e, next, ok := r.decode(block, off)
+		if !ok {
+			break
+		}
+		largest, off = e.Key, next
+	}
+	if largest == nil {
+		return nil, nil, r.corruption(0, "last data block has no entries")
+	}
+	return first.FirstKey, largest, nil
+}
+
+// readBlock returns the verified entries of data block blockIdx
+// Blocks come from the block cache when possible; shared reports that the
+// result is a cached block, which must not be modified. Otherwise the block
+// is read into buf (if large enough), and added to the cache if fillCache
+// is set, in which case buf is left alone.
+func (r *SSTableReader) readBlock(blockIdx int, buf []byte, fillCache bool) (data []byte, shared bool, err error) {
+	entry, err := r.blockEntry(blockIdx)
+	if err != nil {
+		return nil, false, err
+	}
+	handle := entry.Handle
+
+	key := blockKey{table: r.id, offset: handle.Offset}
+	if r.cache != nil {
+		if data, ok := r.cache.get(key); ok {
+			return data, true, nil
+		}
+	}
+
+	fill := fillCache && r.cache != nil
+	if fill {
+		buf = nil
+	}
 
 	// Read block (excluding CRC)
-	blockData := make([]byte, handle.Size)
-	if _, err := r.file.ReadAt(blockData, int64(handle.Offset)); err != nil {
-		return nil, false, false
+	blockData := growBuffer(buf, int(handle.Size))
+	if _, err := r.reader.ReadAt(blockData, int64(handle.Offset)); err != nil {
+		return nil, false, err
 	}
 
 	// Verify CRC
 	dataPart := blockData[:len(blockData)-4]
 	storedCRC := binary.LittleEndian.Uint32(blockData[len(blockData)-4:])
 	if crc32.ChecksumIEEE(dataPart) != storedCRC {
-		return nil, false, false // Corrupted block
+		return nil, false, r.corruption(int64(handle.Offset), fmt.Sprintf("block %d checksum mismatch", blockIdx))
 	}
 
-	// Search through entries
-	reader := bytes.NewReader(dataPart)
-	for reader.Len() > 0 {
-		var keyLen, valueLen uint32
-		if err := binary.Read(reader, binary.LittleEndian, &keyLen); err != nil {
-			break
+	// Drop alignment padding so decoders only see entries
+	if r.padded {
+		if len(dataPart) < 4 {
+			return nil, false, r.corruption(int64(handle.Offset), fmt.Sprintf("block %d too short for padding length", blockIdx))
 		}
-		if err := binary.Read(reader, binary.LittleEndian, &valueLen); err != nil {
-			break
+		pad := uint64(binary.LittleEndian.Uint32(dataPart[len(dataPart)-4:]))
+		if pad > uint64(len(dataPart)-4) {
+			return nil, false, r.corruption(int64(handle.Offset), fmt.Sprintf("block %d padding out of bounds", blockIdx))
+		}
+		dataPart = dataPart[:len(dataPart)-4-int(pad)]
+	}
+
+	if fill {
+		r.cache.add(key, dataPart)
+		return dataPart, true, nil
+	}
+	return dataPart, false, nil
+}
+
+// sampleBlocks calls fn for every entry of up to n data blocks spread
+// evenly across the table, bypassing the block cache
+func (r *SSTableReader) sampleBlocks(n int, fn func(Entry)) error {
+	if r.numBlocks == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, r.numBlocks)
+	for i := 0; i < n; i++ {
+		blockIdx := i * r.numBlocks / n
+		block, _, err := r.readBlock(blockIdx, nil, false)
+		if err != nil {
+			return err
 		}
-		deletedByte, err := reader.ReadByte()
+		for off := 0; off < len(block); {
+			entry, next, ok := r.decode(block, off)
+			if !ok {
+				handle, _ := r.blockEntry(blockIdx) // Read by readBlock
+				return r.corruption(int64(handle.Handle.Offset), fmt.Sprintf("block %d has an undecodable entry", blockIdx))
+			}
+			fn(entry)
+			off = next
+		}
+	}
+	return nil
+}
+
+// approximateCount estimates the entries with keys in [start, end) (nil =
+// unbounded) from the index's per-block counts: blocks wholly in range
+// count in full and the blocks at either edge count half. Blocks without
+// a count (older tables) are read and counted.
+func (r *SSTableReader) approximateCount(start, end []byte) (float64, error) {
+	first := 0
+	if start != nil {
+		i, err := r.findBlock(start)
 		if err != nil {
-			break
+			return 0, err
 		}
+		first = max(i, 0)
+	}
 
-		entryKey := make([]byte, keyLen)
-		if _, err := reader.Read(entryKey); err != nil {
-			break
+	var total float64
+	for i := first; i < r.numBlocks; i++ {
+		entry, err := r.blockEntry(i)
+		if err != nil {
+			return 0, err
 		}
-		entryValue := make([]byte, valueLen)
-		if _, err := reader.Read(entryValue); err != nil {
+		if end != nil && r.comparator.Compare(entry.FirstKey, end) >= 0 {
 			break
 		}
 
-		cmp := r.comparator.Compare(entryKey, key)
-		if cmp == 0 {
-			// Found it!
-			return entryValue, deletedByte == 1, true
+		count := float64(entry.Count)
+		if entry.Count == 0 {
+			n, err := r.countBlockEntries(i)
+			if err != nil {
+				return 0, err
+			}
+			count = float64(n)
 		}
-		if cmp > 0 {
-			// Passed where key would be (keys are sorted)
-			break
+
+		// A block's keys run up to the next block's first key
+		whole := start == nil || r.comparator.Compare(entry.FirstKey, start) >= 0
+		if whole && end != nil {
+			if i+1 < r.numBlocks {
+				next, err := r.blockEntry(i + 1)
+				if err != nil {
+					return 0, err
+				}
+				whole = r.comparator.Compare(next.FirstKey, end) <= 0
+			} else {
+				_, largest, err := r.keyRange()
+				if err != nil {
+					return 0, err
+				}
+				whole = r.comparator.Compare(largest, end) < 0
+			}
 		}
+		if !whole {
+			count /= 2
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// countBlockEntries reads data block i and counts its entries
+func (r *SSTableReader) countBlockEntries(i int) (int, error) {
+	block, _, err := r.readBlock(i, nil, false)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for off := 0; off < len(block); n++ {
+		_, next, ok := r.decode(block, off)
+		if !ok {
+			handle, _ := r.blockEntry(i) // Read by readBlock
+			return 0, r.corruption(int64(handle.Handle.Offset), fmt.Sprintf("block %d has an undecodable entry", i))
+		}
+		off = next
+	}
+	return n, nil
+}
+
+// VerifyChecksums reads every data block and verifies its CRC
+// Returns an error wrapping ErrCorruptedData on the first mismatch
+func (r *SSTableReader) VerifyChecksums() error {
+	for i := 0; i < r.numBlocks; i++ {
+		entry, err := r.blockEntry(i)
+		if err != nil {
+			return err
+		}
+		handle := entry.Handle
+		blockData := make([]byte, handle.Size)
+		if _, err := r.reader.ReadAt(blockData, int64(handle.Offset)); err != nil {
+			return fmt.Errorf("block %d at offset %d: %w", i, handle.Offset, err)
+		}
+
+		dataPart := blockData[:len(blockData)-4]
+		storedCRC := binary.LittleEndian.Uint32(blockData[len(blockData)-4:])
+		if crc32.ChecksumIEEE(dataPart) != storedCRC {
+			return r.corruption(int64(handle.Offset), fmt.Sprintf("block %d checksum mismatch", i))
+		}
+	}
+	return nil
+}
+
+// NumBlocks returns the number of data blocks in the table
+func (r *SSTableReader) NumBlocks() int {
+	return r.numBlocks
+}
+
+// ReadBlock returns every entry of data block blockIdx (0 to NumBlocks-1),
+// tombstones included, after verifying the block's CRC, for inspection and
+// repair tools. The entries are copies, and a block read from disk isn't
+// added to the block cache.
+func (r *SSTableReader) ReadBlock(blockIdx int) ([]Entry, error) {
+	if blockIdx < 0 || blockIdx >= r.numBlocks {
+		return nil, fmt.Errorf("block %d out of range: %s has %d blocks", blockIdx, r.path, r.numBlocks)
+	}
+	block, _, err := r.readBlock(blockIdx, nil, false)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, false, false
+	var entries []Entry
+	for off := 0; off < len(block); {
+		e, next, ok := r.decode(block, off)
+		if !ok {
+			handle, _ := r.blockEntry(blockIdx) // Read by readBlock
+			return entries, r.corruption(int64(handle.Handle.Offset), fmt.Sprintf("block %d has an undecodable entry", blockIdx))
+		}
+		e.Key = append([]byte(nil), e.Key...)
+		e.Value = append([]byte(nil), e.Value...)
+		entries = append(entries, e)
+		off = next
+	}
+	return entries, nil
 }
 
-// Close closes the SSTable
+// WriteTo streams the table's raw bytes to w, e.g. to ship it to another
+// node without re-encoding its entries (see ReceiveSSTable)
+func (r *SSTableReader) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, io.NewSectionReader(r.reader, 0, r.size))
+}
+
+// ReceiveSSTable writes a table streamed by SSTableReader.WriteTo to
+// destPath, which only appears once the footer, index, bloom filter and
+// every block's CRC have been verified. A truncated or corrupted stream
+// fails, usually with ErrCorruptedData, and leaves nothing behind.
+func ReceiveSSTable(r io.Reader, destPath string) error {
+	return receiveSSTable(OSFileSystem{}, r, destPath)
+}
+
+// receiveSSTable receives a table through the given filesystem
+func receiveSSTable(fs FileSystem, r io.Reader, destPath string) error {
+	tempPath := destPath + ".tmp"
+	out, err := fs.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create SSTable: %w", err)
+	}
+	_, err = io.Copy(out, r)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fs.Remove(tempPath)
+		return fmt.Errorf("failed to receive SSTable: %w", err)
+	}
+
+	// Opening checks the footer and meta blocks, then check the data
+	reader, err := openSSTable(fs, tempPath, nil)
+	if err == nil {
+		err = reader.VerifyChecksums()
+		reader.Close()
+	}
+	if err != nil {
+		fs.Remove(tempPath)
+		return fmt.Errorf("received SSTable is invalid: %w", err)
+	}
+	return fs.Rename(tempPath, destPath)
+}
+
+// corruption builds a CorruptionError for this table
+func (r *SSTableReader) corruption(offset int64, kind string) error {
+	return &CorruptionError{Path: r.path, Offset: offset, Kind: kind}
+}
+
+// Close closes the SSTable's file, or its io.ReaderAt if that is an
+// io.Closer
 func (r *SSTableReader) Close() error {
-	return r.file.Close()
+	if c, ok := r.reader.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Properties returns a copy of the table's user properties (see
+// SSTableWriter.SetProperties); empty for tables without any
+func (r *SSTableReader) Properties() map[string]string {
+	props := make(map[string]string, len(r.properties))
+	for k, v := range r.properties {
+		props[k] = v
+	}
+	return props
+}
+
+// CreatedAt returns when the table was written
+// Tables written before creation times were recorded report the zero Time.
+func (r *SSTableReader) CreatedAt() time.Time {
+	if r.createdAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, r.createdAt)
 }
 
 // Path returns the file path
@@ -492,104 +2037,193 @@ func (r *SSTableReader) Path() string {
 // NewIterator returns an iterator over all entries
 func (r *SSTableReader) NewIterator() *SSTableIterator {
 	return &SSTableIterator{
-		reader:      r,
-		blockIdx:    0,
-		blockData:   nil,
-		blockReader: nil,
+		reader:    r,
+		blockIdx:  0,
+		fillCache: true,
 	}
 }
 
+// NewRangeIterator returns an iterator over entries in [lower, upper)
+// SeekToFirst positions it at the first entry >= lower, found through the
+// index, and blocks entirely outside the range are never read. A nil bound
+// means unbounded on that side; seeks before lower land on lower.
+func (r *SSTableReader) NewRangeIterator(lower, upper []byte) *SSTableIterator {
+	it := r.NewIterator()
+	it.lower = lower
+	it.upper = upper
+	return it
+}
+
 // SSTableIterator iterates over SSTable entries
+//
+// Key and Value slice directly into the current block, so stepping through
+// a block allocates nothing. By default every block is read into a fresh
+// buffer that is never overwritten, so returned slices stay valid for as
+// long as the caller keeps them (each one pins its block in memory).
+// With SetReuseBuffers(true) the block buffer is reused instead, and
+// callers must copy anything they want to retain.
 type SSTableIterator struct {
-	reader      *SSTableReader
-	blockIdx    int
-	blockData   []byte
-	blockReader *bytes.Reader
+	reader    *SSTableReader
+	blockIdx  int
+	blockData []byte // Buffer kept for SetReuseBuffers
+	block     []byte // Verified entries of the current block
+	blockOff  int    // Offset of the next entry in block
+
+	// Reuse the block buffer instead of allocating one per block
+	reuseBuffers bool
+
+	// Add blocks read from disk to the block cache
+	fillCache bool
+
+	// Bounds for NewRangeIterator (nil = unbounded)
+	lower []byte
+	upper []byte
 
 	// Current entry
-	key     []byte
-	value   []byte
-	deleted bool
-	valid   bool
+	key       []byte
+	value     []byte
+	deleted   bool
+	timestamp uint64
+	valid     bool
+
+	err error // Why iteration stopped early, if it did
+}
+
+// SetReuseBuffers makes the iterator read every block into one buffer
+// When enabled, slices returned by Key and Value are only valid until the
+// next call to Next, Seek, SeekToFirst or Reset; copy them to keep them
+func (it *SSTableIterator) SetReuseBuffers(reuse bool) {
+	it.reuseBuffers = reuse
+}
+
+// SetFillCache controls whether blocks the iterator reads from disk are
+// added to the block cache (default true); large scans can turn it off to
+// avoid evicting hot blocks
+func (it *SSTableIterator) SetFillCache(fill bool) {
+	it.fillCache = fill
+}
+
+// Reset repositions the iterator before the first entry, keeping its buffers
+// Call Next to move to the first entry
+func (it *SSTableIterator) Reset() {
+	it.blockIdx = -1 // Next() will increment to 0
+	it.block = nil
+	it.valid = false
+	it.err = nil
 }
 
 // SeekToFirst positions at the first entry
 func (it *SSTableIterator) SeekToFirst() {
-	it.blockIdx = -1 // Start before first block, Next() will increment to 0
-	it.blockData = nil
-	it.blockReader = nil
-	it.valid = false
+	if it.lower != nil {
+		it.Seek(it.lower)
+		return
+	}
+	it.Reset()
 	it.Next()
 }
 
-// loadBlock loads the current block
-func (it *SSTableIterator) loadBlock() bool {
-	if it.blockIdx >= len(it.reader.index) {
+// Seek positions at the first entry with key >= target
+func (it *SSTableIterator) Seek(target []byte) {
+	if it.lower != nil && it.reader.comparator.Compare(target, it.lower) < 0 {
+		target = it.lower
+	}
+	it.err = nil
+	if it.upper != nil && it.reader.comparator.Compare(target, it.upper) >= 0 {
+		it.block = nil
 		it.valid = false
+		return // Nothing in range at or after target
+	}
+	blockIdx, err := it.reader.findBlock(target)
+	if err != nil {
+		it.valid = false
+		it.err = err
+		return
+	}
+	if blockIdx < 0 {
+		blockIdx = 0 // Target is before the first key
+	}
+
+	it.blockIdx = blockIdx - 1 // Next() will increment to blockIdx
+	it.block = nil
+	it.valid = false
+	it.Next()
+
+	for it.valid && it.reader.comparator.Compare(it.key, target) < 0 {
+		it.Next()
+	}
+}
+
+// blockPastUpper reports whether the current block starts at or after the
+// upper bound, so it needn't be read
+func (it *SSTableIterator) blockPastUpper() bool {
+	if it.upper == nil || it.blockIdx >= it.reader.numBlocks {
 		return false
 	}
+	block, err := it.reader.blockEntry(it.blockIdx)
+	if err != nil {
+		return false // loadBlock reports it
+	}
+	return it.reader.comparator.Compare(block.FirstKey, it.upper) >= 0
+}
 
-	handle := it.reader.index[it.blockIdx].Handle
-	it.blockData = make([]byte, handle.Size)
-	if _, err := it.reader.file.ReadAt(it.blockData, int64(handle.Offset)); err != nil {
+// loadBlock loads the current block
+func (it *SSTableIterator) loadBlock() bool {
+	if it.blockIdx >= it.reader.numBlocks {
 		it.valid = false
 		return false
 	}
 
-	// Verify CRC
-	dataPart := it.blockData[:len(it.blockData)-4]
-	storedCRC := binary.LittleEndian.Uint32(it.blockData[len(it.blockData)-4:])
-	if crc32.ChecksumIEEE(dataPart) != storedCRC {
+	// Without reuse every block gets a fresh buffer: earlier entries may
+	// still be held
+	var buf []byte
+	if it.reuseBuffers {
+		buf = it.blockData
+	}
+	dataPart, shared, err := it.reader.readBlock(it.blockIdx, buf, it.fillCache)
+	if err != nil {
 		it.valid = false
+		it.err = err
 		return false
 	}
+	if it.reuseBuffers && !shared {
+		it.blockData = dataPart
+	}
 
-	it.blockReader = bytes.NewReader(dataPart)
+	it.block = dataPart
+	it.blockOff = 0
 	return true
 }
 
 // Next advances to the next entry
 func (it *SSTableIterator) Next() {
-	for {
-		if it.blockReader == nil || it.blockReader.Len() == 0 {
-			// Need next block
-			it.blockIdx++
-			if !it.loadBlock() {
-				it.valid = false
-				return
-			}
-		}
-
-		// Read next entry from block
-		var keyLen, valueLen uint32
-		if err := binary.Read(it.blockReader, binary.LittleEndian, &keyLen); err != nil {
-			it.valid = false
-			return
-		}
-		if err := binary.Read(it.blockReader, binary.LittleEndian, &valueLen); err != nil {
-			it.valid = false
-			return
-		}
-		deletedByte, err := it.blockReader.ReadByte()
-		if err != nil {
+	if it.blockOff >= len(it.block) {
+		// Need next block
+		it.blockIdx++
+		if it.blockPastUpper() || !it.loadBlock() {
 			it.valid = false
 			return
 		}
+	}
 
-		it.key = make([]byte, keyLen)
-		if _, err := it.blockReader.Read(it.key); err != nil {
-			it.valid = false
-			return
-		}
-		it.value = make([]byte, valueLen)
-		if _, err := it.blockReader.Read(it.value); err != nil {
-			it.valid = false
-			return
-		}
-		it.deleted = deletedByte == 1
-		it.valid = true
-		return // Successfully read one entry, stop here
+	// Read next entry from block
+	entry, next, ok := it.reader.decode(it.block, it.blockOff)
+	if !ok {
+		it.valid = false
+		block, _ := it.reader.blockEntry(it.blockIdx) // Loaded by loadBlock
+		it.err = it.reader.corruption(int64(block.Handle.Offset), fmt.Sprintf("block %d has an undecodable entry", it.blockIdx))
+		return
+	}
+	if it.upper != nil && it.reader.comparator.Compare(entry.Key, it.upper) >= 0 {
+		it.valid = false
+		return
 	}
+	it.blockOff = next
+
+	it.key = entry.Key
+	it.value = entry.Value
+	it.deleted = entry.Deleted
+	it.timestamp = entry.Timestamp
+	it.valid = true
 }
 
 // Valid returns true if iterator is positioned at a valid entry
@@ -598,11 +2232,13 @@ func (it *SSTableIterator) Valid() bool {
 }
 
 // Key returns the current key
+// The slice aliases the block; see SSTableIterator for how long it is valid
 func (it *SSTableIterator) Key() []byte {
 	return it.key
 }
 
 // Value returns the current value
+// The slice aliases the block; see SSTableIterator for how long it is valid
 func (it *SSTableIterator) Value() []byte {
 	return it.value
 }
@@ -612,35 +2248,167 @@ func (it *SSTableIterator) IsDeleted() bool {
 	return it.deleted
 }
 
+// Timestamp returns the current entry's timestamp (0 if unversioned)
+func (it *SSTableIterator) Timestamp() uint64 {
+	return it.timestamp
+}
+
+// Err returns the error that ended iteration early, such as a block that
+// failed its CRC, or nil if the iterator simply ran out of entries
+func (it *SSTableIterator) Err() error {
+	return it.err
+}
+
+// growBuffer returns buf resized to n, reallocating only if it is too small
+func growBuffer(buf []byte, n int) []byte {
+	if cap(buf) >= n {
+		return buf[:n]
+	}
+	return make([]byte, n)
+}
+
 // FlushMemtableToSSTable writes a memtable to a new SSTable file
 // Uses atomic rename for crash safety
 // bitsPerKey controls bloom filter size (0 = no bloom filter)
 func FlushMemtableToSSTable(mem *Memtable, path string, bitsPerKey int) error {
-	// Write to temp file first
-	tempPath := path + ".tmp"
+	return flushMemtableToSSTable(mem, path, sstableOptions{fs: OSFileSystem{}, bitsPerKey: bitsPerKey})
+}
 
-	writer, err := NewSSTableWriter(tempPath, nil, bitsPerKey)
+// flushMemtableToSSTable flushes a memtable using the given options
+func flushMemtableToSSTable(mem *Memtable, path string, opts sstableOptions) error {
+	paths, err := flushMemtableToSSTables(mem, 0, func() string { return path }, nil, opts)
 	if err != nil {
 		return err
 	}
+	return publishTables(opts.fs, paths)
+}
 
-	// Iterate through memtable (already sorted!)
-	iter := mem.data.NewIterator()
-	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
-		if err := writer.Add(iter.Key(), iter.Value(), iter.IsDeleted()); err != nil {
+// flushMemtableToSSTables flushes a memtable to SSTables of about
+// targetSize bytes each (0 = a single table), naming each with nextPath
+// Tombstones for which purge returns true are left out (nil = keep all).
+// Returns the paths, in key order, of finished tables that are still under
+// their temp names (path + ".tmp"), for publishTables to move into place.
+// On failure, every temp file is removed again.
+func flushMemtableToSSTables(mem *Memtable, targetSize int64, nextPath func() string, purge func(key []byte) bool, opts sstableOptions) ([]string, error) {
+	fs := opts.fs
+
+	var paths []string
+	var writer *SSTableWriter
+	var path, tempPath string
+
+	fail := func(err error) ([]string, error) {
+		if writer != nil {
 			writer.Close()
-			os.Remove(tempPath) // Clean up temp file
+			fs.Remove(tempPath) // Clean up temp file
+		}
+		for _, p := range paths {
+			fs.Remove(p + ".tmp")
+		}
+		return nil, err
+	}
+
+	// One dictionary serves every table of the flush
+	if opts.valueDictSize > 0 {
+		opts.valueDict = TrainValueDictionary(sampleMemtableValues(mem), opts.valueDictSize)
+	}
+
+	// start opens the next table
+	remaining := mem.Size()
+	start := func() error {
+		// Write to temp file first, clearing any stale one from a crashed flush
+		path = nextPath()
+		tempPath = path + ".tmp"
+		fs.Remove(tempPath)
+
+		var err error
+		if writer, err = opts.newWriter(tempPath); err != nil {
 			return err
 		}
+		if mem.seqs != nil {
+			writer.setSequenceRange(*mem.seqs)
+		}
+
+		// Entry encoding is close to the memtable's size accounting
+		if opts.preallocate {
+			size := remaining
+			if targetSize > 0 && targetSize < size {
+				size = targetSize
+			}
+			writer.Preallocate(size)
+		}
+		return nil
 	}
 
-	if err := writer.Finish(); err != nil {
-		os.Remove(tempPath) // Clean up temp file
-		return err
+	// finish completes the current table, leaving it under its temp name
+	finish := func() error {
+		w := writer
+		writer = nil
+		if err := w.Finish(); err != nil {
+			fs.Remove(tempPath)
+			return err
+		}
+		paths = append(paths, path)
+		return nil
 	}
 
-	// Atomic rename: either succeeds completely or not at all
-	// If crash happens here, temp file exists but final doesn't
-	// On recovery, we can delete orphaned .tmp files
-	return os.Rename(tempPath, path)
+	// Iterate through memtable (already sorted!)
+	iter := mem.NewIterator()
+	defer iter.Close()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		entry := iter.Entry()
+		if entry.Deleted && purge != nil && purge(entry.Key) {
+			remaining -= entry.Size()
+			continue
+		}
+
+		if writer == nil {
+			if err := start(); err != nil {
+				return fail(err)
+			}
+		}
+
+		if err := writer.AddWithTimestamp(entry.Key, entry.Value, entry.Deleted, entry.Timestamp); err != nil {
+			return fail(err)
+		}
+		remaining -= entry.Size()
+
+		if targetSize > 0 && writer.EstimatedSize() >= uint64(targetSize) {
+			if err := finish(); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	// An empty memtable still produces one (empty) table
+	if writer == nil && len(paths) == 0 {
+		if err := start(); err != nil {
+			return fail(err)
+		}
+	}
+	if writer != nil {
+		if err := finish(); err != nil {
+			return fail(err)
+		}
+	}
+	return paths, nil
+}
+
+// publishTables renames tables written by flushMemtableToSSTables from
+// their temp names into place
+// Each rename is atomic: if we crash, a table is either complete under its
+// final name or an orphaned .tmp file that Open deletes. On failure,
+// tables already renamed and the remaining temp files are removed.
+func publishTables(fs FileSystem, paths []string) error {
+	for i, path := range paths {
+		if err := fs.Rename(path+".tmp", path); err != nil {
+			for _, p := range paths[:i] {
+				fs.Remove(p)
+			}
+			for _, p := range paths[i:] {
+				fs.Remove(p + ".tmp")
+			}
+			return err
+		}
+	}
+	return nil
 }
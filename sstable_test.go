@@ -1,10 +1,16 @@
 package lsm
 
 import (
+	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestSSTableWriteRead(t *testing.T) {
@@ -334,3 +340,1783 @@ func TestSSTableEmptyFile(t *testing.T) {
 		t.Error("Iterator should not be valid for empty SSTable")
 	}
 }
+
+func TestSSTableTombstoneAtBlockEnd(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Add([]byte("a"), []byte("1"), false)
+	writer.Add([]byte("b"), nil, true) // Tombstone is the last entry of the block
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	_, deleted, found := reader.Get([]byte("b"))
+	if !found || !deleted {
+		t.Errorf("Expected tombstone for 'b': found=%v, deleted=%v", found, deleted)
+	}
+
+	count := 0
+	iter := reader.NewIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 entries, got %d", count)
+	}
+}
+
+func TestSSTableTruncatedIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	footer := data[len(data)-sstableFooterSize:]
+	indexSize := binary.LittleEndian.Uint64(footer[8:16])
+
+	// Shrink the recorded index size to simulate every possible torn index
+	// (re-checksumming the footer so the index itself is what gets checked)
+	for cut := uint64(1); cut < indexSize; cut++ {
+		torn := make([]byte, len(data))
+		copy(torn, data)
+		tornFooter := torn[len(torn)-sstableFooterSize:]
+		binary.LittleEndian.PutUint64(tornFooter[8:16], indexSize-cut)
+		binary.LittleEndian.PutUint32(tornFooter[48:52], crc32.ChecksumIEEE(tornFooter[:footerCRCOffset]))
+
+		tornPath := filepath.Join(dir, "torn.sst")
+		os.WriteFile(tornPath, torn, 0644)
+
+		reader, err := OpenSSTable(tornPath, nil)
+		if err == nil {
+			reader.Close()
+			t.Fatalf("Expected error for index truncated by %d bytes", cut)
+		}
+		if !errors.Is(err, ErrCorruptedData) {
+			t.Fatalf("Cut %d: expected ErrCorruptedData, got %v", cut, err)
+		}
+	}
+}
+
+func TestSSTableIteratorSeek(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 200; i += 2 {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	tests := []struct {
+		target   string
+		expected string // "" means exhausted
+	}{
+		{"a", "key_00000"},
+		{"key_00050", "key_00050"},
+		{"key_00051", "key_00052"},
+		{"key_00198", "key_00198"},
+		{"key_00199", ""},
+	}
+
+	iter := reader.NewIterator()
+	for _, tc := range tests {
+		iter.Seek([]byte(tc.target))
+		if tc.expected == "" {
+			if iter.Valid() {
+				t.Errorf("Seek(%s): expected exhausted, got %s", tc.target, iter.Key())
+			}
+			continue
+		}
+		if !iter.Valid() || string(iter.Key()) != tc.expected {
+			t.Errorf("Seek(%s): expected %s, got valid=%v key=%s", tc.target, tc.expected, iter.Valid(), iter.Key())
+		}
+	}
+}
+
+func TestSSTablePreallocate(t *testing.T) {
+	dir := t.TempDir()
+
+	mem := NewMemtable(1024 * 1024)
+	for i := 0; i < 500; i++ {
+		mem.Put([]byte(fmt.Sprintf("key_%05d", i)), []byte(fmt.Sprintf("value_%05d", i)))
+	}
+
+	plainPath := filepath.Join(dir, "plain.sst")
+	if err := flushMemtableToSSTable(mem, plainPath, sstableOptions{fs: OSFileSystem{}, bitsPerKey: 10}); err != nil {
+		t.Fatalf("Plain flush failed: %v", err)
+	}
+
+	preallocPath := filepath.Join(dir, "prealloc.sst")
+	opts := sstableOptions{fs: OSFileSystem{}, bitsPerKey: 10, preallocate: true}
+	if err := flushMemtableToSSTable(mem, preallocPath, opts); err != nil {
+		t.Fatalf("Preallocated flush failed: %v", err)
+	}
+
+	// Final size must match regardless of pre-allocation
+	plainInfo, _ := os.Stat(plainPath)
+	preallocInfo, _ := os.Stat(preallocPath)
+	if plainInfo.Size() != preallocInfo.Size() {
+		t.Errorf("Size mismatch: plain=%d, preallocated=%d", plainInfo.Size(), preallocInfo.Size())
+	}
+
+	// Over-estimating must also be trimmed back
+	bigPath := filepath.Join(dir, "big.sst")
+	writer, err := NewSSTableWriter(bigPath, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Preallocate(1 << 20)
+	writer.Add([]byte("a"), []byte("1"), false)
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	if info, _ := os.Stat(bigPath); info.Size() >= 1<<20 {
+		t.Errorf("Expected file trimmed to real size, got %d bytes", info.Size())
+	}
+
+	for _, path := range []string{preallocPath, bigPath} {
+		reader, err := OpenSSTable(path, nil)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", path, err)
+		}
+		iter := reader.NewIterator()
+		iter.SeekToFirst()
+		if !iter.Valid() {
+			t.Errorf("%s: expected entries", path)
+		}
+		reader.Close()
+	}
+}
+
+func TestSSTableDirectIO(t *testing.T) {
+	dir := t.TempDir()
+
+	probe, err := openDirect(filepath.Join(dir, "probe"))
+	if err != nil {
+		t.Skipf("O_DIRECT not supported here: %v", err)
+	}
+	probe.Close()
+
+	// Large enough to fill the staging buffer several times
+	mem := NewMemtable(16 * 1024 * 1024)
+	for i := 0; i < 5000; i++ {
+		mem.Put([]byte(fmt.Sprintf("key_%05d", i)), bytes.Repeat([]byte{byte(i)}, i%300))
+	}
+
+	plainPath := filepath.Join(dir, "plain.sst")
+	if err := flushMemtableToSSTable(mem, plainPath, sstableOptions{fs: OSFileSystem{}, bitsPerKey: 10}); err != nil {
+		t.Fatalf("Plain flush failed: %v", err)
+	}
+
+	for _, preallocate := range []bool{false, true} {
+		directPath := filepath.Join(dir, fmt.Sprintf("direct_%v.sst", preallocate))
+		opts := sstableOptions{fs: OSFileSystem{}, bitsPerKey: 10, directIO: true, preallocate: preallocate}
+		writer, err := opts.newWriter(directPath + ".check")
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if _, ok := writer.file.(*directFile); !ok {
+			t.Errorf("Expected an O_DIRECT file, got %T", writer.file)
+		}
+		writer.Close()
+
+		if err := flushMemtableToSSTable(mem, directPath, opts); err != nil {
+			t.Fatalf("Direct flush failed: %v", err)
+		}
+
+		// Same size as a buffered write: the unaligned tail isn't padded
+		plainInfo, _ := os.Stat(plainPath)
+		directInfo, _ := os.Stat(directPath)
+		if plainInfo.Size() != directInfo.Size() {
+			t.Errorf("Size mismatch: plain=%d, direct=%d", plainInfo.Size(), directInfo.Size())
+		}
+
+		reader, err := OpenSSTable(directPath, nil)
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		for i := 0; i < 5000; i++ {
+			value, _, found := reader.Get([]byte(fmt.Sprintf("key_%05d", i)))
+			if !found || !bytes.Equal(value, bytes.Repeat([]byte{byte(i)}, i%300)) {
+				t.Fatalf("key_%05d: wrong value read back (found=%v)", i, found)
+			}
+		}
+		reader.Close()
+	}
+}
+
+func TestSSTableRangeIterator(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	writer.Finish()
+
+	fs := &readCountFS{reads: make(map[string]int)}
+	reader, err := openSSTable(fs, path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+	if len(reader.index) < 10 {
+		t.Fatalf("Expected many blocks, got %d", len(reader.index))
+	}
+
+	cases := []struct{ lower, upper int }{
+		{400, 450}, {0, 10}, {990, -1}, {-1, 25}, {500, 500},
+	}
+	for _, c := range cases {
+		var lower, upper []byte
+		if c.lower >= 0 {
+			lower = []byte(fmt.Sprintf("key_%05d", c.lower))
+		}
+		if c.upper >= 0 {
+			upper = []byte(fmt.Sprintf("key_%05d", c.upper))
+		}
+
+		// Blocks holding at least one key in the range
+		overlapping := 0
+		for i, entry := range reader.index {
+			startsBefore := upper == nil || bytes.Compare(entry.FirstKey, upper) < 0
+			endsAfter := lower == nil || i == len(reader.index)-1 || bytes.Compare(reader.index[i+1].FirstKey, lower) > 0
+			if startsBefore && endsAfter && !bytes.Equal(lower, upper) {
+				overlapping++
+			}
+		}
+
+		fs.reset()
+		iter := reader.NewRangeIterator(lower, upper)
+		want := max(c.lower, 0)
+		end := c.upper
+		if end < 0 {
+			end = 1000
+		}
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			if got := string(iter.Key()); got != fmt.Sprintf("key_%05d", want) {
+				t.Fatalf("[%d, %d): expected key_%05d, got %s", c.lower, c.upper, want, got)
+			}
+			want++
+		}
+		if want != end {
+			t.Errorf("[%d, %d): stopped at %d, expected %d", c.lower, c.upper, want, end)
+		}
+		if iter.Err() != nil {
+			t.Errorf("[%d, %d): unexpected error %v", c.lower, c.upper, iter.Err())
+		}
+
+		if reads := fs.reset()["test.sst"]; reads != overlapping {
+			t.Errorf("[%d, %d): read %d blocks, expected the %d overlapping ones", c.lower, c.upper, reads, overlapping)
+		}
+	}
+
+	// Seeks stay inside the range
+	iter := reader.NewRangeIterator([]byte("key_00100"), []byte("key_00200"))
+	iter.Seek([]byte("key_00000"))
+	if !iter.Valid() || string(iter.Key()) != "key_00100" {
+		t.Errorf("Seek before lower: expected key_00100, got %s", iter.Key())
+	}
+	iter.Seek([]byte("key_00150"))
+	if !iter.Valid() || string(iter.Key()) != "key_00150" {
+		t.Errorf("Seek inside range: expected key_00150, got %s", iter.Key())
+	}
+}
+
+func TestSSTableCorruptionError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if len(reader.index) < 2 {
+		t.Fatalf("Expected multiple blocks, got %d", len(reader.index))
+	}
+	second := reader.index[1]
+	reader.Close()
+
+	// Corrupt a byte inside the second block
+	data, _ := os.ReadFile(path)
+	data[second.Handle.Offset+5] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+
+	reader, err = OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	_, _, found, err := reader.Lookup(second.FirstKey)
+	if found {
+		t.Fatal("Key in corrupted block should not be found")
+	}
+
+	var corruptErr *CorruptionError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected *CorruptionError, got %v", err)
+	}
+	if corruptErr.Path != path {
+		t.Errorf("Expected path %s, got %s", path, corruptErr.Path)
+	}
+	if corruptErr.Offset == 0 || corruptErr.Offset != int64(second.Handle.Offset) {
+		t.Errorf("Expected offset %d, got %d", second.Handle.Offset, corruptErr.Offset)
+	}
+	if !errors.Is(err, ErrCorruptedData) {
+		t.Error("CorruptionError should wrap ErrCorruptedData")
+	}
+
+	// Lookups in intact blocks still work
+	if _, _, found, err := reader.Lookup([]byte("key_00000")); !found || err != nil {
+		t.Errorf("Expected key_00000 in intact block: found=%v err=%v", found, err)
+	}
+}
+
+func TestSSTableIteratorErr(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if len(reader.index) < 3 {
+		t.Fatalf("Expected at least 3 blocks, got %d", len(reader.index))
+	}
+	middle := reader.index[len(reader.index)/2]
+	reader.Close()
+
+	// A clean scan ends without an error
+	reader, err = OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	iter := reader.NewIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+	}
+	if err := iter.Err(); err != nil {
+		t.Errorf("Expected no error from a clean scan, got %v", err)
+	}
+	reader.Close()
+
+	// Corrupt a byte inside a middle block
+	data, _ := os.ReadFile(path)
+	data[middle.Handle.Offset+5] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+
+	reader, err = OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	iter = reader.NewIterator()
+	var last []byte
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		last = append(last[:0], iter.Key()...)
+	}
+	if bytes.Compare(last, middle.FirstKey) >= 0 {
+		t.Errorf("Expected the scan to stop before %s, last key %s", middle.FirstKey, last)
+	}
+
+	var corruptErr *CorruptionError
+	if !errors.As(iter.Err(), &corruptErr) {
+		t.Fatalf("Expected *CorruptionError from Err, got %v", iter.Err())
+	}
+	if corruptErr.Offset != int64(middle.Handle.Offset) {
+		t.Errorf("Expected offset %d, got %d", middle.Handle.Offset, corruptErr.Offset)
+	}
+
+	// Seeking past the bad block clears the error
+	iter.Seek([]byte("key_00099"))
+	if !iter.Valid() || iter.Err() != nil {
+		t.Errorf("Expected a clean seek past the corruption: valid=%v err=%v", iter.Valid(), iter.Err())
+	}
+}
+
+func TestSSTableBadMagicCorruptionError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "invalid.sst")
+	os.WriteFile(path, make([]byte, 64), 0644)
+
+	_, err := OpenSSTable(path, nil)
+	var corruptErr *CorruptionError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("Expected *CorruptionError, got %v", err)
+	}
+	if corruptErr.Path != path {
+		t.Errorf("Expected path %s, got %s", path, corruptErr.Path)
+	}
+}
+
+func TestSSTableIteratorReset(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, _ := NewSSTableWriter(path, nil, 10)
+	for i := 0; i < 500; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%04d", i)), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	iter := reader.NewIterator()
+	iter.SetReuseBuffers(true)
+
+	// Two full passes over the same iterator must see identical data
+	for pass := 0; pass < 2; pass++ {
+		iter.Reset()
+		if iter.Valid() {
+			t.Fatal("Iterator should not be valid right after Reset")
+		}
+
+		count := 0
+		for iter.Next(); iter.Valid(); iter.Next() {
+			wantKey := fmt.Sprintf("key_%04d", count)
+			wantValue := fmt.Sprintf("value_%04d", count)
+			if string(iter.Key()) != wantKey || string(iter.Value()) != wantValue {
+				t.Fatalf("Pass %d: expected %s=%s, got %s=%s", pass, wantKey, wantValue, iter.Key(), iter.Value())
+			}
+			count++
+		}
+		if count != 500 {
+			t.Errorf("Pass %d: expected 500 entries, got %d", pass, count)
+		}
+	}
+}
+
+func BenchmarkSSTableIteratorScan(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "bench.sst")
+
+	writer, _ := NewSSTableWriter(path, nil, 10)
+	for i := 0; i < 10000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%06d", i)), []byte(fmt.Sprintf("value_%06d", i)), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		b.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	// Copying every entry, as Next did before slicing into the block
+	b.Run("CopyEntries", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter := reader.NewIterator()
+			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+				_ = append([]byte(nil), iter.Key()...)
+				_ = append([]byte(nil), iter.Value()...)
+			}
+		}
+	})
+
+	// A fresh iterator per scan allocates one buffer per block
+	b.Run("NewIterator", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter := reader.NewIterator()
+			for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			}
+		}
+	})
+
+	// Reset with reused buffers allocates only when a buffer has to grow
+	b.Run("Reset", func(b *testing.B) {
+		iter := reader.NewIterator()
+		iter.SetReuseBuffers(true)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			iter.Reset()
+			for iter.Next(); iter.Valid(); iter.Next() {
+			}
+		}
+	})
+}
+
+func TestSSTableTwoLevelIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	// Tiny blocks and partitions so a small table needs many of both
+	writer.SetBlockSize(64)
+	writer.SetIndexPartitionSize(8)
+
+	numKeys := 2000
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key_%05d", i))
+		value := []byte(fmt.Sprintf("value_%05d", i))
+		if err := writer.Add(key, value, i%10 == 0); err != nil {
+			t.Fatalf("Failed to add: %v", err)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	if reader.topIndex == nil || reader.index != nil {
+		t.Fatal("Expected a two-level index")
+	}
+	if reader.numBlocks <= 8*8 {
+		t.Fatalf("Expected many blocks across many partitions, got %d", reader.numBlocks)
+	}
+
+	// Partitions are only loaded on demand
+	for p, part := range reader.partitions {
+		if part != nil {
+			t.Fatalf("Partition %d loaded before any lookup", p)
+		}
+	}
+
+	for i := 0; i < numKeys; i++ {
+		key := []byte(fmt.Sprintf("key_%05d", i))
+		value, deleted, found, err := reader.Lookup(key)
+		if err != nil || !found {
+			t.Fatalf("Key %s not found (err=%v)", key, err)
+		}
+		if deleted != (i%10 == 0) {
+			t.Errorf("Key %s: expected deleted=%v", key, i%10 == 0)
+		}
+		if !deleted && string(value) != fmt.Sprintf("value_%05d", i) {
+			t.Errorf("Key %s: wrong value %s", key, value)
+		}
+	}
+
+	// Missing keys before, between and after the table's range
+	for _, key := range []string{"a", "key_00010x", "zzz"} {
+		if _, _, found, err := reader.Lookup([]byte(key)); found || err != nil {
+			t.Errorf("Key %s: expected not found, got found=%v err=%v", key, found, err)
+		}
+	}
+
+	// Iteration and seeks walk across partition boundaries
+	iter := reader.NewIterator()
+	count := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+	if count != numKeys {
+		t.Errorf("Expected %d entries, got %d", numKeys, count)
+	}
+
+	iter.Seek([]byte("key_01500"))
+	if !iter.Valid() || string(iter.Key()) != "key_01500" {
+		t.Errorf("Seek landed on %s", iter.Key())
+	}
+
+	if err := reader.VerifyChecksums(); err != nil {
+		t.Errorf("VerifyChecksums failed: %v", err)
+	}
+}
+
+func TestSSTableSmallTableKeepsFlatIndex(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, _ := NewSSTableWriter(path, nil, 10)
+	writer.SetBlockSize(64)
+	writer.SetIndexPartitionSize(1000)
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	if reader.topIndex != nil || len(reader.index) != reader.numBlocks {
+		t.Errorf("Expected a flat index with %d entries", reader.numBlocks)
+	}
+}
+
+func TestSSTableEntrySizeLimits(t *testing.T) {
+	dir := t.TempDir()
+	writer, _ := NewSSTableWriter(filepath.Join(dir, "test.sst"), nil, 10)
+	defer writer.Close()
+
+	if err := writer.Add(make([]byte, MaxKeySize), nil, false); err != nil {
+		t.Fatalf("Add at MaxKeySize failed: %v", err)
+	}
+	if err := writer.Add(make([]byte, MaxKeySize+1), nil, false); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := writer.Add([]byte("z"), make([]byte, MaxValueSize+1), false); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+}
+
+func TestSSTableOutOfOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+	writer, _ := NewSSTableWriter(path, nil, 10)
+
+	for _, key := range []string{"b", "d"} {
+		if err := writer.Add([]byte(key), []byte("v"), false); err != nil {
+			t.Fatalf("Add %s failed: %v", key, err)
+		}
+	}
+	for _, key := range []string{"c", "a", "d"} { // Earlier, first, duplicate
+		if err := writer.Add([]byte(key), []byte("v"), false); !errors.Is(err, ErrOutOfOrder) {
+			t.Errorf("Add %s: expected ErrOutOfOrder, got %v", key, err)
+		}
+	}
+
+	// Rejected keys leave the table readable
+	if err := writer.Add([]byte("e"), []byte("v"), false); err != nil {
+		t.Fatalf("Add e failed: %v", err)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+	for _, key := range []string{"b", "d", "e"} {
+		if _, _, found, err := reader.Lookup([]byte(key)); !found || err != nil {
+			t.Errorf("Expected %s to be found (err=%v)", key, err)
+		}
+	}
+	if _, _, found, _ := reader.Lookup([]byte("c")); found {
+		t.Error("Rejected key c should not be in the table")
+	}
+}
+
+func TestSSTableDuplicateKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	writer, _ := NewSSTableWriter(filepath.Join(dir, "reject.sst"), nil, 10)
+	writer.Add([]byte("a"), []byte("v1"), false)
+	err := writer.Add([]byte("a"), []byte("v2"), false)
+	if !errors.Is(err, ErrDuplicateKey) || !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("Expected ErrDuplicateKey, also matching ErrOutOfOrder, got %v", err)
+	}
+	writer.Close()
+
+	// Tiny blocks put every duplicate right after a block fills
+	path := filepath.Join(dir, "keep.sst")
+	writer, _ = NewSSTableWriter(path, nil, 10)
+	writer.SetBlockSize(32)
+	writer.SetDuplicateKeyPolicy(DuplicateKeyKeepLast)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key_%03d", i))
+		for v := 0; v < 3; v++ {
+			if err := writer.Add(key, []byte(fmt.Sprintf("value_%03d_%d", i, v)), false); err != nil {
+				t.Fatalf("Add %s failed: %v", key, err)
+			}
+		}
+	}
+	writer.Add([]byte("key_100"), []byte("value"), false)
+	writer.Add([]byte("key_100"), nil, true) // A newer tombstone wins too
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+	if reader.summary.keyCount != 101 {
+		t.Errorf("Expected 101 keys in the summary, got %d", reader.summary.keyCount)
+	}
+	count := 0
+	it := reader.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		count++
+	}
+	if count != 101 {
+		t.Errorf("Expected 101 entries, got %d", count)
+	}
+	for i := 0; i < 100; i++ {
+		want := fmt.Sprintf("value_%03d_2", i)
+		if value, _, found := reader.Get([]byte(fmt.Sprintf("key_%03d", i))); !found || string(value) != want {
+			t.Errorf("Key %d: expected %s, got %s (found=%v)", i, want, value, found)
+		}
+	}
+	if _, deleted, found := reader.Get([]byte("key_100")); !found || !deleted {
+		t.Errorf("Expected key_100 deleted, got found=%v, deleted=%v", found, deleted)
+	}
+}
+
+func TestSSTableWriteToReceive(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.sst")
+	writer, err := NewSSTableWriter(src, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%04d", i)), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	reader, err := OpenSSTable(src, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer reader.Close()
+
+	// Stream through a pipe, as over a network connection
+	dest := filepath.Join(dir, "received.sst")
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := reader.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	if err := ReceiveSSTable(pr, dest); err != nil {
+		t.Fatalf("ReceiveSSTable failed: %v", err)
+	}
+
+	received, err := OpenSSTable(dest, nil)
+	if err != nil {
+		t.Fatalf("Failed to open received SSTable: %v", err)
+	}
+	defer received.Close()
+	for _, i := range []int{0, 777, 1999} {
+		want := fmt.Sprintf("value_%04d", i)
+		if value, _, found := received.Get([]byte(fmt.Sprintf("key_%04d", i))); !found || string(value) != want {
+			t.Errorf("Key %d: expected %s, got %s (found=%v)", i, want, value, found)
+		}
+	}
+
+	// A corrupted or truncated stream is rejected and leaves no file
+	data, _ := os.ReadFile(src)
+	flipped := bytes.Clone(data)
+	flipped[100] ^= 0xFF
+	for name, stream := range map[string][]byte{"corrupted": flipped, "truncated": data[:len(data)/2]} {
+		bad := filepath.Join(dir, name+".sst")
+		if err := ReceiveSSTable(bytes.NewReader(stream), bad); !errors.Is(err, ErrCorruptedData) {
+			t.Errorf("%s stream: expected ErrCorruptedData, got %v", name, err)
+		}
+		if matches, _ := filepath.Glob(bad + "*"); len(matches) != 0 {
+			t.Errorf("%s stream: expected no files left, got %v", name, matches)
+		}
+	}
+}
+
+func TestSSTableReadBlock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.sst")
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetBlockSize(256)
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key_%03d", i))
+		if i%3 == 0 {
+			writer.Add(key, nil, true)
+		} else {
+			writer.Add(key, []byte(fmt.Sprintf("value_%03d", i)), false)
+		}
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer reader.Close()
+	if reader.NumBlocks() < 3 {
+		t.Fatalf("Expected several blocks, got %d", reader.NumBlocks())
+	}
+
+	// Blocks hold consecutive keys, so a middle block starts where the
+	// ones before it end
+	mid := reader.NumBlocks() / 2
+	first := 0
+	for i := 0; i < mid; i++ {
+		entries, err := reader.ReadBlock(i)
+		if err != nil {
+			t.Fatalf("ReadBlock(%d) failed: %v", i, err)
+		}
+		first += len(entries)
+	}
+	entries, err := reader.ReadBlock(mid)
+	if err != nil {
+		t.Fatalf("ReadBlock(%d) failed: %v", mid, err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("Expected entries in block %d", mid)
+	}
+	for j, e := range entries {
+		i := first + j
+		wantDeleted := i%3 == 0
+		if string(e.Key) != fmt.Sprintf("key_%03d", i) || e.Deleted != wantDeleted {
+			t.Errorf("Entry %d: expected key_%03d (deleted=%v), got %s (deleted=%v)", j, i, wantDeleted, e.Key, e.Deleted)
+		}
+		if !wantDeleted && string(e.Value) != fmt.Sprintf("value_%03d", i) {
+			t.Errorf("Entry %d: expected value_%03d, got %s", j, i, e.Value)
+		}
+	}
+
+	for _, idx := range []int{-1, reader.NumBlocks()} {
+		if _, err := reader.ReadBlock(idx); err == nil {
+			t.Errorf("Expected an error for block %d of %d", idx, reader.NumBlocks())
+		}
+	}
+}
+
+func BenchmarkSSTableGetLargeBlock(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "bench.sst")
+
+	// One large block so each lookup walks many entries
+	writer, _ := NewSSTableWriter(path, nil, 0)
+	writer.SetBlockSize(256 * 1024)
+	for i := 0; i < 4096; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%06d", i)), []byte(fmt.Sprintf("value_%06d", i)), false)
+	}
+	writer.Finish()
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		b.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	key := make([]byte, 0, 16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key = fmt.Appendf(key[:0], "key_%06d", i%4096)
+		if _, _, found, err := reader.Lookup(key); err != nil || !found {
+			b.Fatalf("Lookup %s failed: found=%v err=%v", key, found, err)
+		}
+	}
+}
+
+func TestSSTableIndexChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), make([]byte, 100), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	footer := data[len(data)-sstableFooterSize:]
+	indexOffset := binary.LittleEndian.Uint64(footer[0:8])
+	bloomOffset := binary.LittleEndian.Uint64(footer[16:24])
+
+	corrupt := map[string]int{
+		"index count":  int(indexOffset),
+		"index key":    int(indexOffset) + 8 + 2, // Inside the first key
+		"index offset": int(indexOffset) + 4 + 4 + 9 + 1,
+		"bloom filter": int(bloomOffset) + 25,
+		"footer":       len(data) - sstableFooterSize + 3,
+	}
+	for name, pos := range corrupt {
+		bad := make([]byte, len(data))
+		copy(bad, data)
+		bad[pos] ^= 0x01
+
+		badPath := filepath.Join(dir, "bad.sst")
+		os.WriteFile(badPath, bad, 0644)
+
+		reader, err := OpenSSTable(badPath, nil)
+		if err == nil {
+			reader.Close()
+			t.Errorf("%s: expected flipped bit to be detected", name)
+			continue
+		}
+		if !errors.Is(err, ErrCorruptedData) {
+			t.Errorf("%s: expected ErrCorruptedData, got %v", name, err)
+		}
+	}
+}
+
+func TestSSTableIndexPartitionChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 0)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetBlockSize(64)
+	writer.SetIndexPartitionSize(4)
+	for i := 0; i < 200; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	firstPartition := reader.topIndex[0].Handle
+	reader.Close()
+
+	// Flip a bit in the first partition's first index key; partitions load
+	// lazily, so Open succeeds and the lookup has to catch it
+	data, _ := os.ReadFile(path)
+	data[firstPartition.Offset+8+2] ^= 0x01
+	os.WriteFile(path, data, 0644)
+
+	reader, err = OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	defer reader.Close()
+
+	if _, _, found, err := reader.Lookup([]byte("key_00001")); !errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Expected ErrCorruptedData from corrupted partition, got found=%v err=%v", found, err)
+	}
+
+	// Other partitions are unaffected
+	if val, _, found, err := reader.Lookup([]byte("key_00199")); err != nil || !found || string(val) != "value" {
+		t.Errorf("Expected key_00199 from intact partition: found=%v err=%v", found, err)
+	}
+}
+
+func TestSSTableLegacyFooter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "legacy.sst")
+
+	// Hand-built table in the unchecksummed format: one data block, a flat
+	// index without a CRC and a 40-byte footer
+	var block bytes.Buffer
+	for _, key := range []string{"a", "b"} {
+		binary.Write(&block, binary.LittleEndian, uint32(len(key)))
+		binary.Write(&block, binary.LittleEndian, uint32(len("value_"+key)))
+		block.WriteByte(0)
+		block.WriteString(key)
+		block.WriteString("value_" + key)
+	}
+	binary.Write(&block, binary.LittleEndian, crc32.ChecksumIEEE(block.Bytes()))
+
+	var file bytes.Buffer
+	file.Write(block.Bytes())
+	indexOffset := uint64(file.Len())
+	binary.Write(&file, binary.LittleEndian, uint32(1))
+	binary.Write(&file, binary.LittleEndian, uint32(1))
+	file.WriteString("a")
+	binary.Write(&file, binary.LittleEndian, uint64(0))
+	binary.Write(&file, binary.LittleEndian, uint64(block.Len()))
+	indexSize := uint64(file.Len()) - indexOffset
+
+	for _, v := range []uint64{indexOffset, indexSize, uint64(file.Len()), 0, SSTableMagic} {
+		binary.Write(&file, binary.LittleEndian, v)
+	}
+	os.WriteFile(path, file.Bytes(), 0644)
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open legacy table: %v", err)
+	}
+	defer reader.Close()
+
+	for _, key := range []string{"a", "b"} {
+		val, _, found, err := reader.Lookup([]byte(key))
+		if err != nil || !found || string(val) != "value_"+key {
+			t.Errorf("Lookup %s: expected value_%s, got %s (found=%v err=%v)", key, key, val, found, err)
+		}
+	}
+}
+
+func TestSSTableCreatedAt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	before := time.Now()
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%02d", i)), []byte("value"), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	created := reader.CreatedAt()
+	reader.Close()
+	if created.Before(before) || created.After(time.Now()) {
+		t.Errorf("Expected creation time between %v and now, got %v", before, created)
+	}
+
+	// An explicit creation time survives the round trip
+	want := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	writer, err = NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetCreatedAt(want)
+	writer.Add([]byte("key"), []byte("value"), false)
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	reader, err = OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer reader.Close()
+	if !reader.CreatedAt().Equal(want) {
+		t.Errorf("Expected creation time %v, got %v", want, reader.CreatedAt())
+	}
+}
+
+func TestSSTableV3FooterCreatedAt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.Add([]byte("key"), []byte("value"), false)
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	// Rewrite the footer in the V3 layout, which has no creation time
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	footer := data[len(data)-sstableFooterSize:]
+	v3 := make([]byte, sstableFooterV3Size)
+	copy(v3, footer[:40])
+	binary.LittleEndian.PutUint32(v3[40:44], crc32.ChecksumIEEE(v3[:40]))
+	binary.LittleEndian.PutUint64(v3[44:52], SSTableMagicV3)
+	data = append(data[:len(data)-sstableFooterSize], v3...)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open V3 table: %v", err)
+	}
+	defer reader.Close()
+
+	if !reader.CreatedAt().IsZero() {
+		t.Errorf("Expected zero creation time, got %v", reader.CreatedAt())
+	}
+	val, _, found, err := reader.Lookup([]byte("key"))
+	if err != nil || !found || string(val) != "value" {
+		t.Errorf("Expected value, got %s (found=%v err=%v)", val, found, err)
+	}
+}
+
+func TestSSTableProperties(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(name string, props map[string]string, bitsPerKey int) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		writer, err := NewSSTableWriter(path, nil, bitsPerKey)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		writer.SetProperties(props)
+		for i := 0; i < 100; i++ {
+			writer.Add([]byte(fmt.Sprintf("key_%03d", i)), []byte("value"), false)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Failed to finish: %v", err)
+		}
+		return path
+	}
+
+	props := map[string]string{"job": "compaction-42", "shard": "eu-1", "empty": ""}
+	for _, bitsPerKey := range []int{10, 0} {
+		path := write(fmt.Sprintf("props_%d.sst", bitsPerKey), props, bitsPerKey)
+		reader, err := OpenSSTable(path, nil)
+		if err != nil {
+			t.Fatalf("Failed to open: %v", err)
+		}
+		got := reader.Properties()
+		if len(got) != len(props) {
+			t.Errorf("Expected %v, got %v", props, got)
+		}
+		for k, v := range props {
+			if got[k] != v {
+				t.Errorf("Property %s: expected %q, got %q", k, v, got[k])
+			}
+		}
+
+		// The table itself is unaffected
+		if val, _, found, err := reader.Lookup([]byte("key_050")); err != nil || !found || string(val) != "value" {
+			t.Errorf("Expected key_050, got %s (found=%v err=%v)", val, found, err)
+		}
+
+		// The returned map is a copy
+		got["job"] = "changed"
+		if reader.Properties()["job"] != "compaction-42" {
+			t.Error("Modifying Properties() changed the table's properties")
+		}
+		reader.Close()
+	}
+
+	// Tables without properties, including legacy ones, report none
+	path := write("plain.sst", nil, 10)
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	if got := reader.Properties(); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty map, got %#v", got)
+	}
+	reader.Close()
+
+	legacyPath := filepath.Join(dir, "legacy.sst")
+	mem := NewMemtable(1024)
+	mem.Put([]byte("key"), []byte("value"))
+	if err := FlushMemtableToSSTable(mem, legacyPath, 10); err != nil {
+		t.Fatalf("Failed to flush: %v", err)
+	}
+	data, _ := os.ReadFile(legacyPath)
+	footer := data[len(data)-sstableFooterSize:]
+	v3 := make([]byte, sstableFooterV3Size)
+	copy(v3, footer[:40])
+	binary.LittleEndian.PutUint32(v3[40:44], crc32.ChecksumIEEE(v3[:40]))
+	binary.LittleEndian.PutUint64(v3[44:52], SSTableMagicV3)
+	os.WriteFile(legacyPath, append(data[:len(data)-sstableFooterSize], v3...), 0644)
+
+	reader, err = OpenSSTable(legacyPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open legacy table: %v", err)
+	}
+	defer reader.Close()
+	if got := reader.Properties(); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty map from a legacy table, got %#v", got)
+	}
+
+	// A damaged properties block is reported as corruption
+	path = write("damaged.sst", props, 10)
+	data, _ = os.ReadFile(path)
+	data[len(data)-sstableFooterSize-6] ^= 0xFF
+	os.WriteFile(path, data, 0644)
+	if _, err := OpenSSTable(path, nil); !errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Expected ErrCorruptedData for damaged properties, got %v", err)
+	}
+}
+
+// setBlockFormat rewrites a table's footer to name a different block format
+func setBlockFormat(t *testing.T, path string, code uint8) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	footer := data[len(data)-sstableFooterSize:]
+	flags := binary.LittleEndian.Uint32(footer[32:36])
+	flags = flags&^(0xFF<<footerBlockFormatShift) | uint32(code)<<footerBlockFormatShift
+	binary.LittleEndian.PutUint32(footer[32:36], flags)
+	binary.LittleEndian.PutUint32(footer[48:52], crc32.ChecksumIEEE(footer[:footerCRCOffset]))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write SSTable: %v", err)
+	}
+}
+
+func TestSSTableBlockFormatRegistry(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("value_%03d", i)), false)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	// A dummy format that decodes like the default one but counts calls
+	const dummyFormat uint8 = 200
+	decoded := 0
+	RegisterBlockFormat(dummyFormat, func(block []byte, off int) (Entry, int, bool) {
+		decoded++
+		return decodeEntry(block, off)
+	})
+	setBlockFormat(t, path, dummyFormat)
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open table in registered format: %v", err)
+	}
+	count := 0
+	iter := reader.NewIterator()
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		count++
+	}
+	if val, _, found, err := reader.Lookup([]byte("key_050")); err != nil || !found || string(val) != "value_050" {
+		t.Errorf("Lookup through dummy format: found=%v val=%s err=%v", found, val, err)
+	}
+	reader.Close()
+
+	if count != 100 || decoded == 0 {
+		t.Errorf("Expected 100 entries decoded by the dummy format, got %d (%d calls)", count, decoded)
+	}
+
+	// An unregistered code is rejected with a clear error, not as corruption
+	setBlockFormat(t, path, 201)
+	_, err = OpenSSTable(path, nil)
+	if !errors.Is(err, ErrUnknownBlockFormat) {
+		t.Fatalf("Expected ErrUnknownBlockFormat, got %v", err)
+	}
+	if errors.Is(err, ErrCorruptedData) {
+		t.Errorf("Unknown format should not be reported as corruption: %v", err)
+	}
+}
+
+func TestSSTableBlockAlignment(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "aligned.sst")
+	const align = 512
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetBlockAlignment(align)
+	for i := 0; i < 500; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%d", i)), i%7 == 0)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer reader.Close()
+
+	if reader.numBlocks < 2 {
+		t.Fatalf("Expected several blocks, got %d", reader.numBlocks)
+	}
+	for i := 0; i < reader.numBlocks; i++ {
+		entry, err := reader.blockEntry(i)
+		if err != nil {
+			t.Fatalf("Failed to read index entry %d: %v", i, err)
+		}
+		if entry.Handle.Offset%align != 0 || entry.Handle.Size%align != 0 {
+			t.Errorf("Block %d not aligned: offset %d size %d", i, entry.Handle.Offset, entry.Handle.Size)
+		}
+	}
+	if err := reader.VerifyChecksums(); err != nil {
+		t.Errorf("Checksum verification failed: %v", err)
+	}
+
+	// Padding is invisible to lookups and iteration
+	for i := 0; i < 500; i++ {
+		val, deleted, found, err := reader.Lookup([]byte(fmt.Sprintf("key_%04d", i)))
+		if err != nil || !found || deleted != (i%7 == 0) {
+			t.Fatalf("Lookup key_%04d: found=%v deleted=%v err=%v", i, found, deleted, err)
+		}
+		if !deleted && string(val) != fmt.Sprintf("value_%d", i) {
+			t.Errorf("Lookup key_%04d: expected value_%d, got %s", i, i, val)
+		}
+	}
+	count := 0
+	it := reader.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if want := fmt.Sprintf("key_%04d", count); string(it.Key()) != want {
+			t.Fatalf("Expected %s, got %s", want, it.Key())
+		}
+		count++
+	}
+	if count != 500 {
+		t.Errorf("Expected 500 entries, got %d", count)
+	}
+}
+
+func TestSSTableIndexOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "meta.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetIndexPartitionSize(4) // Force a two-level index
+	writer.SetProperties(map[string]string{"job": "analytics"})
+	for i := 0; i < 2000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"), i%10 == 0)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+
+	check := func(meta *SSTableMetadata) {
+		t.Helper()
+		if meta.KeyCount != 2000 {
+			t.Errorf("Expected 2000 keys, got %d", meta.KeyCount)
+		}
+		if string(meta.SmallestKey) != "key_00000" || string(meta.LargestKey) != "key_01999" {
+			t.Errorf("Expected key_00000..key_01999, got %s..%s", meta.SmallestKey, meta.LargestKey)
+		}
+		if meta.BloomItems != 2000 || meta.BloomBits == 0 || meta.BloomHashes == 0 {
+			t.Errorf("Unexpected bloom stats: %+v", meta)
+		}
+		if meta.CreatedAt.IsZero() {
+			t.Error("Expected a creation time")
+		}
+	}
+
+	// Only the footer, metadata blocks and bloom header are read
+	fs := &readCountFS{reads: make(map[string]int)}
+	meta, err := openSSTableIndexOnly(fs, path)
+	if err != nil {
+		t.Fatalf("OpenSSTableIndexOnly failed: %v", err)
+	}
+	check(meta)
+	if meta.Properties["job"] != "analytics" {
+		t.Errorf("Expected job=analytics, got %v", meta.Properties)
+	}
+	if reads := fs.reset()["meta.sst"]; reads != 3 {
+		t.Errorf("Expected 3 reads, got %d", reads)
+	}
+
+	// A full open reads the index and bloom filter as well
+	reader, err := openSSTable(fs, path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open: %v", err)
+	}
+	reader.Close()
+	if reads := fs.reset()["meta.sst"]; reads <= 3 {
+		t.Errorf("Expected a full open to read more than the metadata, got %d reads", reads)
+	}
+
+	// Tables without a summary block are opened in full instead
+	legacyPath := filepath.Join(dir, "legacy.sst")
+	writer, _ = NewSSTableWriter(legacyPath, nil, 10)
+	for i := 0; i < 2000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"), i%10 == 0)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	data, _ := os.ReadFile(legacyPath)
+	footer := data[len(data)-sstableFooterSize:]
+	flags := binary.LittleEndian.Uint32(footer[32:36]) &^ footerFlagSummary
+	binary.LittleEndian.PutUint32(footer[32:36], flags)
+	binary.LittleEndian.PutUint32(footer[48:52], crc32.ChecksumIEEE(footer[:footerCRCOffset]))
+	os.WriteFile(legacyPath, data, 0644)
+
+	meta, err = OpenSSTableIndexOnly(legacyPath)
+	if err != nil {
+		t.Fatalf("OpenSSTableIndexOnly failed on legacy table: %v", err)
+	}
+	check(meta)
+}
+
+func TestSSTableFromReaderAt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mem.sst")
+
+	writer, err := NewSSTableWriter(path, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte(fmt.Sprintf("value_%05d", i)), i%7 == 0)
+	}
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read SSTable: %v", err)
+	}
+	os.Remove(path)
+
+	check := func(reader *SSTableReader) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("key_%05d", i)
+			value, deleted, found := reader.Get([]byte(key))
+			if !found || deleted != (i%7 == 0) {
+				t.Fatalf("Key %s: found=%v deleted=%v", key, found, deleted)
+			}
+			if !deleted && string(value) != fmt.Sprintf("value_%05d", i) {
+				t.Fatalf("Key %s: got value %s", key, value)
+			}
+		}
+		if _, _, found := reader.Get([]byte("missing")); found {
+			t.Error("Expected missing key to not be found")
+		}
+
+		it := reader.NewIterator()
+		count := 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			count++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Iterator failed: %v", err)
+		}
+		if count != 1000 {
+			t.Errorf("Expected 1000 entries, got %d", count)
+		}
+	}
+
+	// A table held in memory
+	reader, err := OpenSSTableFromReaderAt(bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable from memory: %v", err)
+	}
+	check(reader)
+	if reader.Path() != "" {
+		t.Errorf("Expected no path, got %q", reader.Path())
+	}
+	if err := reader.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+
+	// A table embedded in a larger blob
+	blob := append(append([]byte("header"), data...), "trailer"...)
+	section := io.NewSectionReader(bytes.NewReader(blob), 6, int64(len(data)))
+	reader, err = OpenSSTableFromReaderAt(section, section.Size(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open embedded SSTable: %v", err)
+	}
+	check(reader)
+	reader.Close()
+
+	// Corruption is still reported, without a path
+	_, err = OpenSSTableFromReaderAt(bytes.NewReader(data[:len(data)-1]), int64(len(data)-1), nil)
+	var corrupt *CorruptionError
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected CorruptionError for a truncated table, got %v", err)
+	}
+}
+
+func TestSSTableBlockCounts(t *testing.T) {
+	dir := t.TempDir()
+	for _, partition := range []int{0, 8} { // Flat and two-level index
+		path := filepath.Join(dir, fmt.Sprintf("counts_%d.sst", partition))
+		writer, err := NewSSTableWriter(path, nil, 10)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		if partition > 0 {
+			writer.SetIndexPartitionSize(partition)
+		}
+		for i := 0; i < 5000; i++ {
+			writer.Add([]byte(fmt.Sprintf("key_%05d", i)), []byte(fmt.Sprintf("value_%05d", i)), false)
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Failed to finish: %v", err)
+		}
+
+		reader, err := OpenSSTable(path, nil)
+		if err != nil {
+			t.Fatalf("Failed to open SSTable: %v", err)
+		}
+		if (reader.topIndex != nil) != (partition > 0) {
+			t.Fatalf("Partition size %d: unexpected index layout", partition)
+		}
+		total := 0
+		for i := 0; i < reader.numBlocks; i++ {
+			entry, err := reader.blockEntry(i)
+			if err != nil {
+				t.Fatalf("Failed to read index entry %d: %v", i, err)
+			}
+			n, err := reader.countBlockEntries(i)
+			if err != nil {
+				t.Fatalf("Failed to count block %d: %v", i, err)
+			}
+			if int(entry.Count) != n {
+				t.Errorf("Block %d: index count %d, block holds %d", i, entry.Count, n)
+			}
+			total += n
+		}
+		if total != 5000 {
+			t.Errorf("Expected 5000 entries over all blocks, got %d", total)
+		}
+		if n, err := reader.approximateCount(nil, nil); err != nil || n != 5000 {
+			t.Errorf("Expected an approximate count of 5000 for the whole table, got %v (err=%v)", n, err)
+		}
+		reader.Close()
+	}
+}
+
+func TestSSTableValueDictionary(t *testing.T) {
+	dir := t.TempDir()
+	jsonValue := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"type":"order","status":"shipped","currency":"EUR","customer":{"region":"eu-west","tier":"gold"},"total":%d}`, i, i*7%1000))
+	}
+
+	var samples [][]byte
+	for i := 0; i < 5000; i += 50 {
+		samples = append(samples, jsonValue(i))
+	}
+	dict := TrainValueDictionary(samples, 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Fatalf("Expected a dictionary of up to 4096 bytes, got %d", len(dict))
+	}
+
+	write := func(name string, dict []byte) (string, int64) {
+		path := filepath.Join(dir, name)
+		writer, err := NewSSTableWriter(path, nil, 10)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		writer.SetValueDictionary(dict)
+		for i := 0; i < 5000; i++ {
+			writer.Add([]byte(fmt.Sprintf("key_%05d", i)), jsonValue(i), false)
+		}
+		writer.Add([]byte("key_99999"), nil, true)
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Failed to finish: %v", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat SSTable: %v", err)
+		}
+		return path, info.Size()
+	}
+	_, rawSize := write("raw.sst", nil)
+	path, dictSize := write("dict.sst", dict)
+	if dictSize*2 > rawSize {
+		t.Errorf("Expected the dictionary to at least halve the table: %d bytes, %d without", dictSize, rawSize)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer reader.Close()
+	if !bytes.Equal(reader.valueDict, dict) {
+		t.Errorf("Expected the stored dictionary to match the trained one")
+	}
+	for _, i := range []int{0, 1234, 4999} {
+		value, deleted, found := reader.Get([]byte(fmt.Sprintf("key_%05d", i)))
+		if !found || deleted || !bytes.Equal(value, jsonValue(i)) {
+			t.Errorf("Key %d: expected %s, got %s (found=%v, deleted=%v)", i, jsonValue(i), value, found, deleted)
+		}
+	}
+	if _, deleted, found := reader.Get([]byte("key_99999")); !found || !deleted {
+		t.Errorf("Expected the tombstone to survive, got found=%v, deleted=%v", found, deleted)
+	}
+
+	it := reader.NewIterator()
+	count := 0
+	for it.SeekToFirst(); it.Valid() && !it.IsDeleted(); it.Next() {
+		if !bytes.Equal(it.Value(), jsonValue(count)) {
+			t.Fatalf("Entry %d: expected %s, got %s", count, jsonValue(count), it.Value())
+		}
+		count++
+	}
+	if count != 5000 {
+		t.Errorf("Expected to iterate 5000 values, got %d", count)
+	}
+
+	// Packed tombstones combine with the dictionary
+	packedPath := filepath.Join(dir, "packed.sst")
+	writer, err := NewSSTableWriter(packedPath, nil, 10)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	writer.SetValueDictionary(dict)
+	writer.SetPackedTombstones(true)
+	writer.Add([]byte("key_00001"), jsonValue(1), false)
+	writer.Add([]byte("key_00002"), nil, true)
+	if err := writer.Finish(); err != nil {
+		t.Fatalf("Failed to finish: %v", err)
+	}
+	packed, err := OpenSSTable(packedPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	defer packed.Close()
+	if value, _, found := packed.Get([]byte("key_00001")); !found || !bytes.Equal(value, jsonValue(1)) {
+		t.Errorf("Expected %s from the packed table, got %s", jsonValue(1), value)
+	}
+	if _, deleted, found := packed.Get([]byte("key_00002")); !found || !deleted {
+		t.Errorf("Expected a tombstone in the packed table, got found=%v, deleted=%v", found, deleted)
+	}
+
+	// A reader that predates the dictionary rejects the table rather than
+	// return compressed values
+	blockFormatsMu.Lock()
+	delete(blockFormats, BlockFormatValueDict)
+	blockFormatsMu.Unlock()
+	_, err = OpenSSTable(path, nil)
+	RegisterBlockFormat(BlockFormatValueDict, decodeEntry)
+	if !errors.Is(err, ErrUnknownBlockFormat) {
+		t.Errorf("Expected ErrUnknownBlockFormat without the decoder, got %v", err)
+	}
+}
+
+func TestSSTablePackedTombstones(t *testing.T) {
+	dir := t.TempDir()
+
+	// Nine tombstones for every value, some with timestamps
+	write := func(name string, packed bool) (string, int64) {
+		path := filepath.Join(dir, name)
+		writer, err := NewSSTableWriter(path, nil, 10)
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		writer.SetPackedTombstones(packed)
+		for i := 0; i < 10000; i++ {
+			key := []byte(fmt.Sprintf("key_%05d", i))
+			if i%10 == 0 {
+				err = writer.AddWithTimestamp(key, []byte(fmt.Sprintf("value_%05d", i)), false, uint64(i))
+			} else {
+				err = writer.AddWithTimestamp(key, nil, true, uint64(i%3))
+			}
+			if err != nil {
+				t.Fatalf("Failed to add key %d: %v", i, err)
+			}
+		}
+		if err := writer.Finish(); err != nil {
+			t.Fatalf("Failed to finish: %v", err)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat SSTable: %v", err)
+		}
+		return path, info.Size()
+	}
+	_, defaultSize := write("default.sst", false)
+	path, packedSize := write("packed.sst", true)
+	if saved := defaultSize - packedSize; saved < 9000*4*9/10 {
+		t.Errorf("Expected about 4 bytes saved per tombstone, saved %d (%d bytes, %d unpacked)", saved, packedSize, defaultSize)
+	}
+
+	reader, err := OpenSSTable(path, nil)
+	if err != nil {
+		t.Fatalf("Failed to open SSTable: %v", err)
+	}
+	it := reader.NewIterator()
+	count := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		wantKey := fmt.Sprintf("key_%05d", count)
+		wantDeleted, wantTS := count%10 != 0, uint64(count)
+		wantValue := ""
+		if !wantDeleted {
+			wantValue = fmt.Sprintf("value_%05d", count)
+		} else {
+			wantTS = uint64(count % 3)
+		}
+		if string(it.Key()) != wantKey || string(it.Value()) != wantValue || it.IsDeleted() != wantDeleted || it.Timestamp() != wantTS {
+			t.Fatalf("Entry %d: got %q=%q (deleted=%v, ts=%d)", count, it.Key(), it.Value(), it.IsDeleted(), it.Timestamp())
+		}
+		count++
+	}
+	if count != 10000 {
+		t.Errorf("Expected 10000 entries, got %d", count)
+	}
+	if _, deleted, found := reader.Get([]byte("key_00001")); !found || !deleted {
+		t.Errorf("Expected a tombstone, got found=%v, deleted=%v", found, deleted)
+	}
+	if value, deleted, found := reader.Get([]byte("key_05000")); !found || deleted || string(value) != "value_05000" {
+		t.Errorf("Expected value_05000, got %q (found=%v, deleted=%v)", value, found, deleted)
+	}
+	reader.Close()
+
+	// A reader that predates the format rejects the table
+	blockFormatsMu.Lock()
+	delete(blockFormats, BlockFormatPackedTombstones)
+	blockFormatsMu.Unlock()
+	_, err = OpenSSTable(path, nil)
+	RegisterBlockFormat(BlockFormatPackedTombstones, decodePackedEntry)
+	if !errors.Is(err, ErrUnknownBlockFormat) {
+		t.Errorf("Expected ErrUnknownBlockFormat without the decoder, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package lsm
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// MaxValueDictionarySize is the largest useful value dictionary, since
+// DEFLATE only looks back 32KB
+const MaxValueDictionarySize = 32 * 1024
+
+// Values sampled to train the dictionary for each flush or compaction
+const valueDictSamples = 1024
+
+// TrainValueDictionary builds a dictionary of up to size bytes (at most
+// MaxValueDictionarySize) from sample values, for
+// SSTableWriter.SetValueDictionary. DEFLATE can match any substring of
+// the dictionary, so it is simply the distinct samples, in order, until
+// it is full; samples should be spread over the data. Returns nil if no
+// sample fits.
+func TrainValueDictionary(samples [][]byte, size int) []byte {
+	size = min(size, MaxValueDictionarySize)
+	seen := make(map[string]bool)
+	var dict []byte
+	for _, v := range samples {
+		if len(v) == 0 || len(v) > size-len(dict) || seen[string(v)] {
+			continue
+		}
+		seen[string(v)] = true
+		dict = append(dict, v...)
+	}
+	return dict
+}
+
+// sampleMemtableValues returns up to valueDictSamples values spread evenly
+// over mem, skipping tombstones
+func sampleMemtableValues(mem *Memtable) [][]byte {
+	step := max(mem.Count()/valueDictSamples, 1)
+	var samples [][]byte
+	it := mem.NewIterator()
+	defer it.Close()
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if i++; i%step == 0 && !it.IsDeleted() {
+			samples = append(samples, it.Value())
+		}
+	}
+	return samples
+}
+
+// sampleTableValues returns values from a few data blocks of each table
+func sampleTableValues(tables []*SSTableReader) ([][]byte, error) {
+	var samples [][]byte
+	for _, sst := range tables {
+		err := sst.sampleBlocks(histogramBlocksPerTable, func(e Entry) {
+			if !e.Deleted && len(samples) < valueDictSamples {
+				samples = append(samples, append([]byte(nil), e.Value...))
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return samples, nil
+}
+
+// valueCompressor DEFLATE-compresses values one at a time against a
+// preset dictionary, so each can be decompressed on its own
+type valueCompressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+func newValueCompressor(dict []byte) *valueCompressor {
+	c := &valueCompressor{}
+	// Lower levels skip matching on inputs this small, dictionary or not;
+	// values are small enough that the slowest level is still cheap
+	c.w, _ = flate.NewWriterDict(&c.buf, flate.BestCompression, dict)
+	return c
+}
+
+// compress returns value compressed; the result is valid until the next call
+func (c *valueCompressor) compress(value []byte) []byte {
+	c.buf.Reset()
+	c.w.Reset(&c.buf) // Reloads the dictionary
+	c.w.Write(value)
+	c.w.Close()
+	return c.buf.Bytes()
+}
+
+// encodeValueDict encodes a value dictionary block: [len:4][dict][CRC:4]
+func encodeValueDict(dict []byte) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(dict)))
+	buf = append(buf, dict...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeValueDict parses a value dictionary block, returning its length
+func decodeValueDict(data []byte) (dict []byte, n int, ok bool) {
+	if len(data) < 4 {
+		return nil, 0, false
+	}
+	size := binary.LittleEndian.Uint32(data)
+	if uint64(size) > MaxValueDictionarySize || uint64(size) > uint64(len(data)-4) {
+		return nil, 0, false
+	}
+	n = 4 + int(size)
+	if len(data)-n < 4 || crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return nil, 0, false
+	}
+	return append([]byte(nil), data[4:n]...), n + 4, true
+}
+
+// dictDecoder wraps a block decoder to decompress values stored with
+// entryFlagCompressed, using the table's dictionary
+func (r *SSTableReader) dictDecoder(decode BlockDecodeFunc) BlockDecodeFunc {
+	return func(block []byte, off int) (Entry, int, bool) {
+		// Tombstones are never compressed, and in packed tables have
+		// their flags byte at off+4
+		e, next, ok := decode(block, off)
+		if !ok || e.Deleted || block[off+8]&entryFlagCompressed == 0 {
+			return e, next, ok
+		}
+		if e.Value, ok = r.decompressValue(e.Value); !ok {
+			return Entry{}, 0, false
+		}
+		return e, next, true
+	}
+}
+
+// decompressValue inflates a value compressed by valueCompressor
+func (r *SSTableReader) decompressValue(compressed []byte) ([]byte, bool) {
+	src := bytes.NewReader(compressed)
+	fr, _ := r.dictReaders.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReaderDict(src, r.valueDict)
+	} else if err := fr.(flate.Resetter).Reset(src, r.valueDict); err != nil {
+		return nil, false
+	}
+	defer r.dictReaders.Put(fr)
+
+	// A corrupted stream mustn't inflate past the value size limit
+	value, err := io.ReadAll(io.LimitReader(fr, MaxValueSize+1))
+	if err != nil || len(value) > MaxValueSize {
+		return nil, false
+	}
+	return value, true
+}
@@ -0,0 +1,75 @@
+package lsm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FormatVersion is the on-disk format this package writes
+// Open records it in the VERSION file and refuses directories written in a
+// newer format. Version 0 is a directory from before VERSION existed;
+// version 2 added SSTable sequence range blocks, version 3 entry counts
+// in SSTable index entries, version 4 compressed values, version 5
+// packed tombstones, and version 6 block format codes for compressed
+// values.
+const FormatVersion = 6
+
+// VersionFileName is the file in the DB directory holding its format version
+const VersionFileName = "VERSION"
+
+// checkFormatVersion rejects a directory in a newer format than this
+// package supports, and records FormatVersion in VERSION otherwise
+// Every older version is readable as is, so upgrading only rewrites VERSION.
+func (db *DB) checkFormatVersion() error {
+	version, _, err := db.readNumberFile(VersionFileName)
+	if err != nil {
+		return fmt.Errorf("failed to read version file: %w", err)
+	}
+	if version > FormatVersion {
+		return fmt.Errorf("%w: %s has format version %d, this build supports up to %d",
+			ErrIncompatibleVersion, db.opts.Dir, version, FormatVersion)
+	}
+	if version == FormatVersion {
+		return nil
+	}
+	if err := db.writeNumberFile(VersionFileName, FormatVersion); err != nil {
+		return fmt.Errorf("failed to write version file: %w", err)
+	}
+	return nil
+}
+
+// readNumberFile reads a file in the DB directory holding one decimal
+// number; found is false (with n = 0) if the file doesn't exist
+func (db *DB) readNumberFile(name string) (n uint64, found bool, err error) {
+	file, err := db.fs.Open(filepath.Join(db.opts.Dir, name))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, false, err
+	}
+	if n, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+		return 0, false, fmt.Errorf("%w: bad %s file %q", ErrCorruptedData, name, data)
+	}
+	return n, true, nil
+}
+
+// writeNumberFile atomically replaces a file in the DB directory with one
+// holding n
+func (db *DB) writeNumberFile(name string, n uint64) error {
+	path := filepath.Join(db.opts.Dir, name)
+	if err := db.writeFile(path+".tmp", []byte(strconv.FormatUint(n, 10)+"\n")); err != nil {
+		return err
+	}
+	return db.fs.Rename(path+".tmp", path)
+}
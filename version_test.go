@@ -0,0 +1,59 @@
+package lsm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDBFormatVersion(t *testing.T) {
+	dir := t.TempDir()
+	versionPath := filepath.Join(dir, VersionFileName)
+
+	readVersion := func() string {
+		t.Helper()
+		data, err := os.ReadFile(versionPath)
+		if err != nil {
+			t.Fatalf("Failed to read VERSION: %v", err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+
+	db, err := Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open DB: %v", err)
+	}
+	db.Put([]byte("key"), []byte("value"))
+	db.Close()
+	if got := readVersion(); got != strconv.Itoa(FormatVersion) {
+		t.Errorf("Expected VERSION %d, got %s", FormatVersion, got)
+	}
+
+	// A directory from a newer build is refused and left untouched
+	os.WriteFile(versionPath, []byte(strconv.Itoa(FormatVersion+1)), 0644)
+	orphan := filepath.Join(dir, "sst_999999.sst.tmp")
+	os.WriteFile(orphan, []byte("partial"), 0644)
+	if _, err := Open(DefaultOptions(dir)); !errors.Is(err, ErrIncompatibleVersion) {
+		t.Fatalf("Expected ErrIncompatibleVersion, got %v", err)
+	}
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("Expected a refused Open to leave files alone: %v", err)
+	}
+
+	// A directory from before VERSION existed is upgraded
+	os.Remove(versionPath)
+	db, err = Open(DefaultOptions(dir))
+	if err != nil {
+		t.Fatalf("Failed to open unversioned DB: %v", err)
+	}
+	defer db.Close()
+	if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+		t.Errorf("Expected key=value, got %s (err=%v)", val, err)
+	}
+	if got := readVersion(); got != strconv.Itoa(FormatVersion) {
+		t.Errorf("Expected VERSION upgraded to %d, got %s", FormatVersion, got)
+	}
+}
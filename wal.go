@@ -2,37 +2,66 @@ package lsm
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"sync"
+	"time"
 )
 
 // WAL record types
 const (
 	RecordTypePut    byte = 1
 	RecordTypeDelete byte = 2
+
+	// Put and Delete with an application timestamp: the record's value
+	// is prefixed with [timestamp:8]
+	RecordTypePutTimestamp    byte = 3
+	RecordTypeDeleteTimestamp byte = 4
 )
 
 // Magic bytes to identify record start (helps recover from corruption)
 var walMagic = []byte{0xDE, 0xAD, 0xBE, 0xEF}
 
+// walRecordLimit is the largest record length a reader accepts for
+// values up to maxValueSize (0 = MaxValueSize): room for a MaxKeySize key,
+// a timestamp, and the type, length and CRC fields
+func walRecordLimit(maxValueSize int) uint32 {
+	if maxValueSize <= 0 {
+		maxValueSize = MaxValueSize
+	}
+	// type(1) + keyLen(4) + valueLen(4) + key + timestamp(8) + value + crc(4)
+	return uint32(min(1+4+4+MaxKeySize+8+maxValueSize+4, math.MaxUint32))
+}
+
 // WAL is a write-ahead log for durability
 type WAL struct {
-	file     *os.File
+	file     File
 	writer   *bufio.Writer
 	path     string
 	mu       sync.Mutex
 	syncMode bool // if true, sync to disk on every write
+
+	syncBytes int64 // Sync once this many bytes are unsynced (0 = off)
+	unsynced  int64 // Bytes written since the last sync
+
+	firstWrite time.Time // When the oldest record was written (zero = none)
 }
 
 // OpenWAL opens or creates a WAL file
 // If sync is true, every write is synced to disk (slower but durable)
 // If sync is false, writes are buffered (faster but may lose data on crash)
 func OpenWAL(path string, sync bool) (*WAL, error) {
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	return openWAL(OSFileSystem{}, path, sync)
+}
+
+// openWAL opens a WAL through the given filesystem
+func openWAL(fs FileSystem, path string, sync bool) (*WAL, error) {
+	file, err := fs.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open WAL: %w", err)
 	}
@@ -47,10 +76,137 @@ func OpenWAL(path string, sync bool) (*WAL, error) {
 
 // Write writes a record to the WAL
 // Format: [magic:4][recordLen:4][type:1][keyLen:4][valueLen:4][key][value][crc:4]
+// Keys over MaxKeySize and values over MaxValueSize are rejected
 func (w *WAL) Write(recordType byte, key, value []byte) error {
+	return w.write(recordType, key, value, 0, false)
+}
+
+// WriteTimestamp writes a Put or Delete record carrying timestamp ts
+func (w *WAL) WriteTimestamp(recordType byte, key, value []byte, ts uint64) error {
+	return w.write(recordType, key, value, ts, false)
+}
+
+// write writes a record, syncing if forceSync is set even outside sync mode
+// A non-zero ts turns it into a timestamped record
+func (w *WAL) write(recordType byte, key, value []byte, ts uint64, forceSync bool) error {
+	if err := checkEntrySize(key, value, MaxKeySize, MaxValueSize); err != nil {
+		return err
+	}
+	if ts != 0 {
+		recordType, value = timestampRecord(recordType, value, ts)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := encodeRecord(w.writer, recordType, key, value); err != nil {
+		return err
+	}
+	w.noteWrite()
+	return w.flush(int64(walRecordSize(key, value)), forceSync)
+}
+
+// WriteDeleteBatch writes Delete records for all keys with a single
+// write and flush (and a single sync in sync mode)
+func (w *WAL) WriteDeleteBatch(keys [][]byte) error {
+	var batch bytes.Buffer
+	for _, key := range keys {
+		if err := checkEntrySize(key, nil, MaxKeySize, MaxValueSize); err != nil {
+			return err
+		}
+		if err := encodeRecord(&batch, RecordTypeDelete, key, nil); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.writer.Write(batch.Bytes()); err != nil {
+		return err
+	}
+	w.noteWrite()
+	return w.flush(int64(batch.Len()), false)
+}
+
+// noteWrite records the time of the first record
+// Must be called with w.mu held
+func (w *WAL) noteWrite() {
+	if w.firstWrite.IsZero() {
+		w.firstWrite = time.Now()
+	}
+}
+
+// oldestRecordTime returns when the oldest record in the WAL was written,
+// or the zero time if it is empty
+func (w *WAL) oldestRecordTime() time.Time {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.firstWrite
+}
+
+// SetSyncBytes makes the WAL sync whenever at least n bytes have been
+// written since the last sync, bounding loss by bytes (0 disables)
+func (w *WAL) SetSyncBytes(n int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncBytes = n
+}
+
+// flush pushes n newly buffered bytes to the OS and syncs if sync mode,
+// forceSync or the byte threshold asks for it
+// Must be called with w.mu held
+func (w *WAL) flush(n int64, forceSync bool) error {
+	// Flush to OS buffer
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	w.unsynced += n
+
+	// If sync mode, also sync to disk for durability
+	if w.syncMode || forceSync || (w.syncBytes > 0 && w.unsynced >= w.syncBytes) {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+		w.unsynced = 0
+	}
 
+	return nil
+}
+
+// timestampRecord converts a Put or Delete into its timestamped form
+func timestampRecord(recordType byte, value []byte, ts uint64) (byte, []byte) {
+	prefixed := make([]byte, 8+len(value))
+	binary.LittleEndian.PutUint64(prefixed, ts)
+	copy(prefixed[8:], value)
+	if recordType == RecordTypeDelete {
+		return RecordTypeDeleteTimestamp, prefixed
+	}
+	return RecordTypePutTimestamp, prefixed
+}
+
+// splitTimestampRecord undoes timestampRecord, returning the plain record
+// type, the value and the timestamp (0 for records without one)
+func splitTimestampRecord(recordType byte, value []byte) (byte, []byte, uint64, bool) {
+	switch recordType {
+	case RecordTypePutTimestamp, RecordTypeDeleteTimestamp:
+		if len(value) < 8 {
+			return 0, nil, 0, false
+		}
+		return recordType - 2, value[8:], binary.LittleEndian.Uint64(value), true
+	default:
+		return recordType, value, 0, true
+	}
+}
+
+// walRecordSize is the encoded size of a record including its framing
+func walRecordSize(key, value []byte) int {
+	// magic(4) + recordLen(4) + type(1) + keyLen(4) + valueLen(4) + key + value + crc(4)
+	return 4 + 4 + 1 + 4 + 4 + len(key) + len(value) + 4
+}
+
+// encodeRecord writes one framed record to dst
+func encodeRecord(dst io.Writer, recordType byte, key, value []byte) error {
 	// Build record
 	keyLen := uint32(len(key))
 	valueLen := uint32(len(value))
@@ -69,44 +225,30 @@ func (w *WAL) Write(recordType byte, key, value []byte) error {
 	checksum := crc.Sum32()
 
 	// Write magic bytes first (allows scanning for next record if corrupted)
-	if _, err := w.writer.Write(walMagic); err != nil {
+	if _, err := dst.Write(walMagic); err != nil {
 		return err
 	}
 	// Write record length (allows skipping corrupted records)
-	if err := binary.Write(w.writer, binary.LittleEndian, recordLen); err != nil {
+	if err := binary.Write(dst, binary.LittleEndian, recordLen); err != nil {
 		return err
 	}
 	// Write record
-	if err := w.writer.WriteByte(recordType); err != nil {
-		return err
-	}
-	if err := binary.Write(w.writer, binary.LittleEndian, keyLen); err != nil {
+	if _, err := dst.Write([]byte{recordType}); err != nil {
 		return err
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, valueLen); err != nil {
+	if err := binary.Write(dst, binary.LittleEndian, keyLen); err != nil {
 		return err
 	}
-	if _, err := w.writer.Write(key); err != nil {
+	if err := binary.Write(dst, binary.LittleEndian, valueLen); err != nil {
 		return err
 	}
-	if _, err := w.writer.Write(value); err != nil {
+	if _, err := dst.Write(key); err != nil {
 		return err
 	}
-	if err := binary.Write(w.writer, binary.LittleEndian, checksum); err != nil {
+	if _, err := dst.Write(value); err != nil {
 		return err
 	}
-
-	// Flush to OS buffer
-	if err := w.writer.Flush(); err != nil {
-		return err
-	}
-
-	// If sync mode, also sync to disk for durability
-	if w.syncMode {
-		return w.file.Sync()
-	}
-
-	return nil
+	return binary.Write(dst, binary.LittleEndian, checksum)
 }
 
 // WritePut writes a Put record
@@ -127,7 +269,11 @@ func (w *WAL) Sync() error {
 	if err := w.writer.Flush(); err != nil {
 		return err
 	}
-	return w.file.Sync()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.unsynced = 0
+	return nil
 }
 
 // Close closes the WAL
@@ -148,27 +294,65 @@ func (w *WAL) Path() string {
 
 // WALReader reads records from a WAL file
 type WALReader struct {
-	reader *bufio.Reader
-	file   *os.File
+	reader       *bufio.Reader
+	file         File
+	path         string
+	offset       int64  // File position of the next unread record
+	maxRecordLen uint32 // Longer records are reported as corrupted
 }
 
 // NewWALReader creates a reader for WAL recovery
-func NewWALReader(path string) (*WALReader, error) {
-	file, err := os.Open(path)
+// maxValueSize is the largest value the log may hold (0 = MaxValueSize);
+// records too long for it are reported as corrupted.
+func NewWALReader(path string, maxValueSize int) (*WALReader, error) {
+	return newWALReader(OSFileSystem{}, path, maxValueSize)
+}
+
+// NewWALReaderAt creates a reader positioned at offset
+// offset must be a value previously returned by Offset()
+func NewWALReaderAt(path string, offset int64, maxValueSize int) (*WALReader, error) {
+	return newWALReaderAt(OSFileSystem{}, path, offset, maxValueSize)
+}
+
+// newWALReader opens a WAL for reading through the given filesystem
+func newWALReader(fs FileSystem, path string, maxValueSize int) (*WALReader, error) {
+	return newWALReaderAt(fs, path, 0, maxValueSize)
+}
+
+// newWALReaderAt opens a WAL through the given filesystem at offset
+func newWALReaderAt(fs FileSystem, path string, offset int64, maxValueSize int) (*WALReader, error) {
+	file, err := fs.Open(path)
 	if err != nil {
 		return nil, err
 	}
 
+	if offset != 0 {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seek WAL to %d: %w", offset, err)
+		}
+	}
+
 	return &WALReader{
-		reader: bufio.NewReader(file),
-		file:   file,
+		reader:       bufio.NewReader(file),
+		file:         file,
+		path:         path,
+		offset:       offset,
+		maxRecordLen: walRecordLimit(maxValueSize),
 	}, nil
 }
 
+// Offset returns the byte position just past the last record returned
+// by a successful ReadRecord, for resuming with NewWALReaderAt
+func (r *WALReader) Offset() int64 {
+	return r.offset
+}
+
 // ReadRecord reads the next record from WAL
 // Returns: (recordType, key, value, error)
-// Returns io.EOF when no more records
-// Returns ErrCorrupted if record is corrupted (caller can try to skip)
+// Returns io.EOF when no more records (clean end at a record boundary)
+// Returns io.ErrUnexpectedEOF if the final record is truncated (torn write)
+// Returns a *CorruptionError if record is corrupted (caller can try to skip)
 func (r *WALReader) ReadRecord() (byte, []byte, []byte, error) {
 	// Read and verify magic bytes
 	magic := make([]byte, 4)
@@ -179,39 +363,40 @@ func (r *WALReader) ReadRecord() (byte, []byte, []byte, error) {
 	// Check magic - if it doesn't match, record start is corrupted
 	if magic[0] != walMagic[0] || magic[1] != walMagic[1] ||
 		magic[2] != walMagic[2] || magic[3] != walMagic[3] {
-		return 0, nil, nil, fmt.Errorf("invalid magic bytes: corrupted record start")
+		return 0, nil, nil, r.corruption("invalid magic bytes at record start")
 	}
 
 	// Read record length
+	// From here on, EOF means the record was cut short by a crash
 	var recordLen uint32
 	if err := binary.Read(r.reader, binary.LittleEndian, &recordLen); err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, tornRecordErr(err)
 	}
 
-	// Sanity check: record shouldn't be too large (max 100MB)
-	if recordLen > 100*1024*1024 {
-		return 0, nil, nil, fmt.Errorf("record too large: %d bytes (likely corrupted)", recordLen)
+	// Sanity check: record shouldn't be longer than the largest entry
+	if recordLen > r.maxRecordLen {
+		return 0, nil, nil, r.corruption(fmt.Sprintf("record too large: %d bytes", recordLen))
 	}
 
 	// Read the entire record
 	recordData := make([]byte, recordLen)
 	if _, err := io.ReadFull(r.reader, recordData); err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, tornRecordErr(err)
 	}
 
 	// Parse record from buffer
 	if len(recordData) < 1+4+4+4 { // type + keyLen + valueLen + crc minimum
-		return 0, nil, nil, fmt.Errorf("record too short")
+		return 0, nil, nil, r.corruption("record too short")
 	}
 
 	recordType := recordData[0]
 	keyLen := binary.LittleEndian.Uint32(recordData[1:5])
 	valueLen := binary.LittleEndian.Uint32(recordData[5:9])
 
-	// Validate lengths
-	expectedLen := uint32(1 + 4 + 4 + keyLen + valueLen + 4)
-	if recordLen != expectedLen {
-		return 0, nil, nil, fmt.Errorf("record length mismatch")
+	// Validate lengths (in 64 bits, so corrupted ones can't wrap around)
+	expectedLen := uint64(1+4+4+4) + uint64(keyLen) + uint64(valueLen)
+	if uint64(recordLen) != expectedLen {
+		return 0, nil, nil, r.corruption("record length mismatch")
 	}
 
 	// Extract key and value
@@ -233,21 +418,47 @@ func (r *WALReader) ReadRecord() (byte, []byte, []byte, error) {
 	crc.Write(value)
 
 	if crc.Sum32() != storedCRC {
-		return 0, nil, nil, fmt.Errorf("CRC mismatch: corrupted record")
+		return 0, nil, nil, r.corruption("CRC mismatch")
 	}
 
+	// magic(4) + recordLen(4) + record
+	r.offset += int64(4 + 4 + recordLen)
+
 	return recordType, key, value, nil
 }
 
+// corruption builds a CorruptionError for the record starting at r.offset
+func (r *WALReader) corruption(kind string) error {
+	return &CorruptionError{Path: r.path, Offset: r.offset, Kind: kind}
+}
+
+// tornRecordErr maps EOF inside a record to io.ErrUnexpectedEOF
+func tornRecordErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
 // Close closes the reader
 func (r *WALReader) Close() error {
 	return r.file.Close()
 }
 
 // ScanToNextRecord scans forward looking for the next magic bytes
-// Used to recover from corruption by finding the next valid record
+// Used to recover from corruption by finding the next valid record. The
+// scan starts one byte past the start of the record ReadRecord failed on,
+// not where it stopped reading: a corrupted length may have consumed the
+// records after it, and garbage before a record may have consumed part of
+// its magic.
 // Returns true if found, false if EOF reached
 func (r *WALReader) ScanToNextRecord() bool {
+	pos := r.offset + 1
+	if _, err := r.file.Seek(pos, io.SeekStart); err != nil {
+		return false
+	}
+	r.reader.Reset(r.file)
+
 	// We look for the magic sequence byte by byte
 	matchCount := 0
 
@@ -256,24 +467,20 @@ func (r *WALReader) ScanToNextRecord() bool {
 		if err != nil {
 			return false // EOF or error
 		}
+		pos++
 
 		switch b {
 		case walMagic[matchCount]:
 			matchCount++
 			if matchCount == 4 {
-				// Found complete magic sequence!
-				// Unread the last byte so we can unread all 4
-				r.reader.UnreadByte()
-
-				// Now we're positioned right after the first 3 magic bytes
-				// We need to "unread" the magic so ReadRecord can find it
-				// Discard buffered data and seek back in file
-				buffered := r.reader.Buffered()
-				currentPos, _ := r.file.Seek(0, io.SeekCurrent)
-				// Position = file position - buffered - 3 (for the 3 magic bytes we consumed)
-				newPos := currentPos - int64(buffered) - 3
-				r.file.Seek(newPos, io.SeekStart)
+				// Found complete magic sequence! Seek back to its start
+				// so ReadRecord can find it
+				start := pos - 4
+				if _, err := r.file.Seek(start, io.SeekStart); err != nil {
+					return false
+				}
 				r.reader.Reset(r.file)
+				r.offset = start
 				return true
 			}
 		case walMagic[0]:
@@ -285,22 +492,40 @@ func (r *WALReader) ScanToNextRecord() bool {
 	}
 }
 
-// RecoverMemtable rebuilds a memtable from WAL
-// Skips corrupted records by scanning for next magic bytes
-func RecoverMemtable(walPath string, maxSize int64) (*Memtable, error) {
-	reader, err := NewWALReader(walPath)
+// ReplayWAL calls fn for every valid record in a WAL, in write order,
+// without building a memtable or touching any file
+// It reads the log the way recovery does: corrupted records are skipped by
+// scanning for the next record, and a torn final record is dropped.
+// recordType is RecordTypePut or RecordTypeDelete; timestamps of versioned
+// records are not passed on. An error from fn stops the replay and is
+// returned.
+func ReplayWAL(path string, fn func(recordType byte, key, value []byte) error) error {
+	_, err := replayWAL(OSFileSystem{}, path, func(recordType byte, key, value []byte, ts uint64) error {
+		return fn(recordType, key, value)
+	})
+	return err
+}
+
+// walReplayStats describes what replayWAL found
+type walReplayStats struct {
+	records   int  // Records passed to fn
+	corrupted int  // Corrupted records skipped
+	torn      bool // Log ended in a partially written record
+}
+
+// replayWAL reads a WAL through the given filesystem, calling fn per valid
+// record with timestamped record types mapped to Put and Delete
+func replayWAL(fs FileSystem, path string, fn func(recordType byte, key, value []byte, ts uint64) error) (walReplayStats, error) {
+	var stats walReplayStats
+
+	// The package limit, not DBOptions.MaxValueSize: the log may predate
+	// a lowered limit
+	reader, err := newWALReader(fs, path, 0)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return NewMemtable(maxSize), nil // No WAL, fresh start
-		}
-		return nil, err
+		return stats, err
 	}
 	defer reader.Close()
 
-	mem := NewMemtable(maxSize)
-	recovered := 0
-	corrupted := 0
-
 	for {
 		recordType, key, value, err := reader.ReadRecord()
 
@@ -308,28 +533,79 @@ func RecoverMemtable(walPath string, maxSize int64) (*Memtable, error) {
 			break // Normal end of file
 		}
 
+		if err == io.ErrUnexpectedEOF {
+			// Torn write: the last record was only partially written
+			// before a crash. It was never acknowledged, so drop it.
+			// Unless records follow: then a corrupted length ran past
+			// the end of the log.
+			if !reader.ScanToNextRecord() {
+				stats.torn = true
+				break
+			}
+			stats.corrupted++
+			continue
+		}
+
 		if err != nil {
 			// Corrupted record - scan forward to find next valid record
-			corrupted++
+			stats.corrupted++
 			if !reader.ScanToNextRecord() {
 				break // No more valid records found
 			}
 			continue // Try reading the record we found
 		}
 
+		recordType, value, ts, ok := splitTimestampRecord(recordType, value)
+		if !ok {
+			stats.corrupted++
+			continue
+		}
+
+		if err := fn(recordType, key, value, ts); err != nil {
+			return stats, err
+		}
+		stats.records++
+	}
+
+	return stats, nil
+}
+
+// RecoverMemtable rebuilds a memtable from WAL
+// Skips corrupted records by scanning for next magic bytes
+func RecoverMemtable(walPath string, maxSize int64) (*Memtable, error) {
+	return recoverMemtable(OSFileSystem{}, walPath, func() *Memtable { return NewMemtable(maxSize) })
+}
+
+// recoverMemtable rebuilds a memtable, made by newMem, from a WAL read
+// through the given filesystem
+func recoverMemtable(fs FileSystem, walPath string, newMem func() *Memtable) (*Memtable, error) {
+	mem := newMem()
+	recovered := 0
+
+	stats, err := replayWAL(fs, walPath, func(recordType byte, key, value []byte, ts uint64) error {
 		switch recordType {
 		case RecordTypePut:
-			mem.data.Put(key, value)
+			mem.data.PutEntry(&Entry{Key: key, Value: value, Timestamp: ts})
 			recovered++
 		case RecordTypeDelete:
-			mem.data.Delete(key)
+			mem.data.PutEntry(&Entry{Key: key, Deleted: true, Timestamp: ts})
 			recovered++
 		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newMem(), nil // No WAL, fresh start
+		}
+		return nil, err
 	}
 
-	if corrupted > 0 {
+	if stats.torn {
+		fmt.Printf("WAL Recovery: discarded truncated record at end of log\n")
+	}
+	if stats.corrupted > 0 {
 		fmt.Printf("WAL Recovery: %d records recovered, %d corrupted records skipped\n",
-			recovered, corrupted)
+			recovered, stats.corrupted)
 	}
 
 	return mem, nil
@@ -2,6 +2,9 @@ package lsm
 
 import (
     "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
     "io"
     "os"
     "path/filepath"
@@ -24,7 +27,7 @@ func TestWALWriteRead(t *testing.T) {
     wal.Close()
 
     // Read records back
-    reader, err := NewWALReader(walPath)
+    reader, err := NewWALReader(walPath, 0)
     if err != nil {
         t.Fatalf("Failed to open WAL reader: %v", err)
     }
@@ -147,4 +150,460 @@ func TestWALSync(t *testing.T) {
     if info.Size() == 0 {
         t.Fatal("WAL file should have data after sync")
     }
-}
\ No newline at end of file
+}
+func TestWALTornWrite(t *testing.T) {
+    dir := t.TempDir()
+
+    // Encode a full record in a scratch WAL to get its raw bytes
+    scratchPath := filepath.Join(dir, "scratch.wal")
+    scratch, _ := OpenWAL(scratchPath, false)
+    scratch.WritePut([]byte("partial"), []byte("never_acknowledged"))
+    scratch.Close()
+    partial, _ := os.ReadFile(scratchPath)
+
+    // Cut the record after magic, inside the length, and inside the payload
+    for _, cut := range []int{2, 4, 6, 12, len(partial) - 1} {
+        walPath := filepath.Join(dir, "test.wal")
+        os.Remove(walPath)
+
+        wal, _ := OpenWAL(walPath, false)
+        wal.WritePut([]byte("good"), []byte("value"))
+        wal.Close()
+
+        f, _ := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+        f.Write(partial[:cut])
+        f.Close()
+
+        // ReadRecord reports the torn tail distinctly from a clean EOF
+        reader, _ := NewWALReader(walPath, 0)
+        if _, _, _, err := reader.ReadRecord(); err != nil {
+            t.Fatalf("Cut %d: failed to read good record: %v", cut, err)
+        }
+        if _, _, _, err := reader.ReadRecord(); err != io.ErrUnexpectedEOF {
+            t.Errorf("Cut %d: expected io.ErrUnexpectedEOF, got %v", cut, err)
+        }
+        reader.Close()
+
+        // Recovery keeps the good record and drops the partial one
+        mem, err := RecoverMemtable(walPath, 1024*1024)
+        if err != nil {
+            t.Fatalf("Cut %d: recovery failed: %v", cut, err)
+        }
+        if val, _, found := mem.Get([]byte("good")); !found || !bytes.Equal(val, []byte("value")) {
+            t.Errorf("Cut %d: good record not recovered", cut)
+        }
+        if _, _, found := mem.Get([]byte("partial")); found {
+            t.Errorf("Cut %d: partial record should be discarded", cut)
+        }
+        if mem.Count() != 1 {
+            t.Errorf("Cut %d: expected 1 entry, got %d", cut, mem.Count())
+        }
+    }
+}
+
+func TestWALReaderOffset(t *testing.T) {
+    dir := t.TempDir()
+    walPath := filepath.Join(dir, "test.wal")
+
+    wal, _ := OpenWAL(walPath, false)
+    wal.WritePut([]byte("key1"), []byte("value1"))
+    wal.WritePut([]byte("key2"), []byte("value2"))
+    wal.WriteDelete([]byte("key1"))
+    wal.WritePut([]byte("key3"), []byte("value3"))
+    wal.Close()
+
+    // Read the first two records and checkpoint
+    reader, err := NewWALReader(walPath, 0)
+    if err != nil {
+        t.Fatalf("Failed to open WAL reader: %v", err)
+    }
+    if reader.Offset() != 0 {
+        t.Fatalf("Expected initial offset 0, got %d", reader.Offset())
+    }
+    reader.ReadRecord()
+    reader.ReadRecord()
+    checkpoint := reader.Offset()
+    reader.Close()
+
+    if checkpoint == 0 {
+        t.Fatal("Offset should advance after reading records")
+    }
+
+    // Resume from the checkpoint
+    reader, err = NewWALReaderAt(walPath, checkpoint, 0)
+    if err != nil {
+        t.Fatalf("Failed to reopen WAL at offset: %v", err)
+    }
+    defer reader.Close()
+
+    recType, key, _, err := reader.ReadRecord()
+    if err != nil || recType != RecordTypeDelete || !bytes.Equal(key, []byte("key1")) {
+        t.Fatalf("Expected Delete key1 after resume, got type=%d key=%s err=%v", recType, key, err)
+    }
+
+    recType, key, value, err := reader.ReadRecord()
+    if err != nil || recType != RecordTypePut || !bytes.Equal(key, []byte("key3")) || !bytes.Equal(value, []byte("value3")) {
+        t.Fatalf("Expected Put key3 after resume, got type=%d key=%s err=%v", recType, key, err)
+    }
+
+    if _, _, _, err := reader.ReadRecord(); err != io.EOF {
+        t.Fatalf("Expected EOF, got %v", err)
+    }
+
+    info, _ := os.Stat(walPath)
+    if reader.Offset() != info.Size() {
+        t.Errorf("Expected final offset %d, got %d", info.Size(), reader.Offset())
+    }
+}
+
+func TestWALCorruptionError(t *testing.T) {
+    dir := t.TempDir()
+    walPath := filepath.Join(dir, "test.wal")
+
+    wal, _ := OpenWAL(walPath, false)
+    wal.WritePut([]byte("key1"), []byte("value1"))
+    wal.WritePut([]byte("key2"), []byte("value2"))
+    wal.Close()
+
+    // Flip a byte in the second record's value so its CRC fails
+    data, _ := os.ReadFile(walPath)
+    data[len(data)-6] ^= 0xFF
+    os.WriteFile(walPath, data, 0644)
+
+    reader, _ := NewWALReader(walPath, 0)
+    defer reader.Close()
+
+    if _, _, _, err := reader.ReadRecord(); err != nil {
+        t.Fatalf("First record should be intact: %v", err)
+    }
+    secondOffset := reader.Offset()
+
+    _, _, _, err := reader.ReadRecord()
+    var corruptErr *CorruptionError
+    if !errors.As(err, &corruptErr) {
+        t.Fatalf("Expected *CorruptionError, got %v", err)
+    }
+    if corruptErr.Path != walPath || corruptErr.Offset != secondOffset {
+        t.Errorf("Expected %s@%d, got %s@%d", walPath, secondOffset, corruptErr.Path, corruptErr.Offset)
+    }
+}
+
+func TestWALEntrySizeLimits(t *testing.T) {
+    dir := t.TempDir()
+    walPath := filepath.Join(dir, "test.wal")
+
+    wal, _ := OpenWAL(walPath, false)
+    defer wal.Close()
+
+    if err := wal.WritePut(make([]byte, MaxKeySize), []byte("v")); err != nil {
+        t.Fatalf("Write at MaxKeySize failed: %v", err)
+    }
+    if err := wal.WritePut(make([]byte, MaxKeySize+1), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+        t.Errorf("Expected ErrKeyTooLarge, got %v", err)
+    }
+    if err := wal.WritePut([]byte("k"), make([]byte, MaxValueSize+1)); !errors.Is(err, ErrValueTooLarge) {
+        t.Errorf("Expected ErrValueTooLarge, got %v", err)
+    }
+
+    // Rejected writes leave nothing behind
+    wal.Sync()
+    reader, _ := NewWALReader(walPath, 0)
+    defer reader.Close()
+    reader.ReadRecord()
+    if _, _, _, err := reader.ReadRecord(); err != io.EOF {
+        t.Errorf("Expected only one record, got %v", err)
+    }
+}
+
+func TestReplayWAL(t *testing.T) {
+    dir := t.TempDir()
+    walPath := filepath.Join(dir, "test.wal")
+
+    wal, _ := OpenWAL(walPath, false)
+    wal.WritePut([]byte("key1"), []byte("value1"))
+    wal.WriteDelete([]byte("key2"))
+    wal.WritePut([]byte("key3"), []byte("value3"))
+    wal.WriteTimestamp(RecordTypePut, []byte("key4"), []byte("value4"), 7)
+    wal.Close()
+
+    // Find the third record and flip a byte in its value
+    reader, _ := NewWALReader(walPath, 0)
+    reader.ReadRecord()
+    reader.ReadRecord()
+    thirdOffset := reader.Offset()
+    reader.Close()
+
+    data, _ := os.ReadFile(walPath)
+    data[int(thirdOffset)+4+4+1+4+4+len("key3")] ^= 0xFF
+    os.WriteFile(walPath, data, 0644)
+
+    type record struct {
+        recordType byte
+        key, value string
+    }
+    var got []record
+    err := ReplayWAL(walPath, func(recordType byte, key, value []byte) error {
+        got = append(got, record{recordType, string(key), string(value)})
+        return nil
+    })
+    if err != nil {
+        t.Fatalf("Replay failed: %v", err)
+    }
+
+    expected := []record{
+        {RecordTypePut, "key1", "value1"},
+        {RecordTypeDelete, "key2", ""},
+        {RecordTypePut, "key4", "value4"},
+    }
+    if len(got) != len(expected) {
+        t.Fatalf("Expected %v, got %v", expected, got)
+    }
+    for i := range expected {
+        if got[i] != expected[i] {
+            t.Errorf("Record %d: expected %v, got %v", i, expected[i], got[i])
+        }
+    }
+
+    // Nothing was written next to the WAL, and it is unchanged
+    if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+        t.Errorf("Expected only the WAL in %s, got %d entries", dir, len(entries))
+    }
+    if after, _ := os.ReadFile(walPath); !bytes.Equal(after, data) {
+        t.Error("Replay modified the WAL")
+    }
+
+    // An error from fn stops the replay
+    stop := errors.New("stop")
+    calls := 0
+    err = ReplayWAL(walPath, func(recordType byte, key, value []byte) error {
+        calls++
+        return stop
+    })
+    if err != stop || calls != 1 {
+        t.Errorf("Expected replay to stop after one call with fn's error, got %d calls, %v", calls, err)
+    }
+}
+
+// walFuzzRecord is one record of the WAL the fuzz target corrupts
+type walFuzzRecord struct {
+    key, value []byte
+    deleted    bool
+    start, end int // Byte span in the uncorrupted log
+}
+
+// walFuzzLog encodes a fixed sequence of puts and deletes
+// Keys and values are ASCII, so the magic only appears at record starts.
+func walFuzzLog() ([]walFuzzRecord, []byte) {
+    var buf bytes.Buffer
+    var records []walFuzzRecord
+    for i := 0; i < 12; i++ {
+        rec := walFuzzRecord{key: []byte(fmt.Sprintf("key%02d", i)), start: buf.Len()}
+        if i%4 == 3 {
+            rec.deleted = true
+            encodeRecord(&buf, RecordTypeDelete, rec.key, nil)
+        } else {
+            rec.value = bytes.Repeat([]byte{byte('a' + i)}, i*3)
+            encodeRecord(&buf, RecordTypePut, rec.key, rec.value)
+        }
+        rec.end = buf.Len()
+        records = append(records, rec)
+    }
+    return records, buf.Bytes()
+}
+
+// corruptWAL applies mutations to log, four bytes each:
+// [op][offset:2][byte]. op%3 is 0 = flip, 1 = insert before, 2 = delete.
+// Offsets refer to the uncorrupted log, so damage maps back to records.
+// Returns the corrupted log and which records were damaged.
+func corruptWAL(records []walFuzzRecord, log, mutations []byte) ([]byte, map[int]bool) {
+    flips := make(map[int]byte)
+    inserts := make(map[int][]byte)
+    deletes := make(map[int]bool)
+    for ; len(mutations) >= 4; mutations = mutations[4:] {
+        off := int(binary.LittleEndian.Uint16(mutations[1:3])) % (len(log) + 1)
+        switch mutations[0] % 3 {
+        case 0:
+            if off < len(log) && mutations[3] != 0 {
+                flips[off] ^= mutations[3]
+            }
+        case 1:
+            inserts[off] = append(inserts[off], mutations[3])
+        case 2:
+            if off < len(log) {
+                deletes[off] = true
+            }
+        }
+    }
+
+    var out []byte
+    for i := 0; i <= len(log); i++ {
+        out = append(out, inserts[i]...)
+        if i == len(log) {
+            break
+        }
+        if !deletes[i] {
+            out = append(out, log[i]^flips[i])
+        }
+    }
+
+    damaged := make(map[int]bool)
+    for n, rec := range records {
+        for i := rec.start; i < rec.end; i++ {
+            // Bytes inserted before a record's first byte leave it intact
+            if flips[i] != 0 || deletes[i] || (i > rec.start && len(inserts[i]) > 0) {
+                damaged[n] = true
+                break
+            }
+        }
+    }
+    return out, damaged
+}
+
+// checkWALRecovery recovers a corrupted log and checks that every
+// undamaged record comes back and nothing else does
+func checkWALRecovery(t *testing.T, mutations []byte) {
+    records, log := walFuzzLog()
+    corrupted, damaged := corruptWAL(records, log, mutations)
+
+    walPath := filepath.Join(t.TempDir(), "test.wal")
+    if err := os.WriteFile(walPath, corrupted, 0644); err != nil {
+        t.Fatalf("Failed to write WAL: %v", err)
+    }
+    mem, err := RecoverMemtable(walPath, 1024*1024)
+    if err != nil {
+        t.Fatalf("Recovery failed: %v", err)
+    }
+
+    want := make(map[string]walFuzzRecord)
+    for _, rec := range records {
+        want[string(rec.key)] = rec
+    }
+    recovered := make(map[string]bool)
+    it := mem.NewIterator()
+    defer it.Close()
+    for it.SeekToFirst(); it.Valid(); it.Next() {
+        rec, ok := want[string(it.Key())]
+        if !ok || rec.deleted != it.IsDeleted() || (!rec.deleted && !bytes.Equal(rec.value, it.Value())) {
+            t.Fatalf("Phantom entry %q (deleted=%v) = %q", it.Key(), it.IsDeleted(), it.Value())
+        }
+        recovered[string(it.Key())] = true
+    }
+    for n, rec := range records {
+        if !damaged[n] && !recovered[string(rec.key)] {
+            t.Errorf("Undamaged record %d (%s) not recovered", n, rec.key)
+        }
+    }
+}
+
+// Minimized cases the fuzzer found in the original ScanToNextRecord
+func TestWALRecoveryRescansFromRecordStart(t *testing.T) {
+    records, _ := walFuzzLog()
+    mutation := func(op byte, off int, b byte) []byte {
+        return []byte{op, byte(off), byte(off >> 8), b}
+    }
+
+    // Garbage before a record: the bad magic read consumed the first
+    // three bytes of the real one, so the scan skipped the record
+    checkWALRecovery(t, mutation(1, records[2].start, 'x'))
+
+    // A length grown past the end of the log was reported as a torn
+    // write, dropping every record after it
+    checkWALRecovery(t, mutation(0, records[1].start+7, 0x01))
+
+    // A length grown into the next record: the scan resumed after the
+    // bytes read for it, skipping that record
+    checkWALRecovery(t, mutation(0, records[1].start+4, 0x20))
+}
+
+func TestWALRecordLengthOverflow(t *testing.T) {
+    walPath := filepath.Join(t.TempDir(), "test.wal")
+
+    // keyLen+valueLen wraps to 0 in 32 bits, so the record length check
+    // passed and slicing the key panicked
+    var buf bytes.Buffer
+    buf.Write(walMagic)
+    binary.Write(&buf, binary.LittleEndian, uint32(13))
+    buf.WriteByte(RecordTypePut)
+    binary.Write(&buf, binary.LittleEndian, uint32(0xFFFFFFFF))
+    binary.Write(&buf, binary.LittleEndian, uint32(1))
+    binary.Write(&buf, binary.LittleEndian, uint32(0))
+    os.WriteFile(walPath, buf.Bytes(), 0644)
+
+    reader, _ := NewWALReader(walPath, 0)
+    defer reader.Close()
+    if _, _, _, err := reader.ReadRecord(); !errors.Is(err, ErrCorruptedData) {
+        t.Errorf("Expected ErrCorruptedData, got %v", err)
+    }
+}
+
+func FuzzWALRecovery(f *testing.F) {
+    f.Add([]byte{})
+    f.Add([]byte{0, 30, 0, 0xFF})                 // Flip a byte inside a record
+    f.Add([]byte{1, 0, 0, 'x'})                   // Garbage before the first record
+    f.Add([]byte{2, 5, 0, 0})                     // Delete a length byte
+    f.Add([]byte{0, 4, 0, 0x01, 1, 60, 0, 0xDE}) // Two mutations
+    f.Fuzz(func(t *testing.T, mutations []byte) {
+        checkWALRecovery(t, mutations)
+    })
+}
+
+func TestWALReaderMaxValueSize(t *testing.T) {
+    if testing.Short() {
+        t.Skip("writes a 100MB+ record")
+    }
+    dir := t.TempDir()
+    walPath := filepath.Join(dir, "large.wal")
+
+    // WAL.Write caps values at MaxValueSize, so frame the record directly,
+    // as a writer with a raised limit would
+    value := bytes.Repeat([]byte("v"), 110*1024*1024)
+    var buf bytes.Buffer
+    if err := encodeRecord(&buf, RecordTypePut, []byte("big"), value); err != nil {
+        t.Fatalf("Failed to encode record: %v", err)
+    }
+    wal, _ := OpenWAL(walPath, false)
+    wal.WritePut([]byte("small"), []byte("value"))
+    wal.Close()
+    f, _ := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+    f.Write(buf.Bytes())
+    f.Close()
+    buf = bytes.Buffer{}
+
+    // The default cap is derived from MaxValueSize and rejects it
+    reader, _ := NewWALReader(walPath, 0)
+    if _, _, _, err := reader.ReadRecord(); err != nil {
+        t.Fatalf("Failed to read small record: %v", err)
+    }
+    _, _, _, err := reader.ReadRecord()
+    var corrupt *CorruptionError
+    if !errors.As(err, &corrupt) {
+        t.Errorf("Expected a record too large for the default cap, got %v", err)
+    }
+    reader.Close()
+
+    // A raised limit reads it back intact
+    reader, _ = NewWALReader(walPath, 128*1024*1024)
+    defer reader.Close()
+    reader.ReadRecord()
+    recType, key, got, err := reader.ReadRecord()
+    if err != nil {
+        t.Fatalf("Failed to read large record: %v", err)
+    }
+    if recType != RecordTypePut || string(key) != "big" || !bytes.Equal(got, value) {
+        t.Errorf("Large record mismatch: type %d, key %q, %d value bytes", recType, key, len(got))
+    }
+    if _, _, _, err := reader.ReadRecord(); err != io.EOF {
+        t.Errorf("Expected EOF, got %v", err)
+    }
+
+    // A lowered limit rejects records over it
+    small := filepath.Join(dir, "small.wal")
+    wal, _ = OpenWAL(small, false)
+    wal.WritePut([]byte("key"), bytes.Repeat([]byte("v"), 200*1024))
+    wal.Close()
+    reader, _ = NewWALReader(small, 64*1024)
+    if _, _, _, err := reader.ReadRecord(); !errors.As(err, &corrupt) {
+        t.Errorf("Expected a record too large for a 64KB limit, got %v", err)
+    }
+    reader.Close()
+}